@@ -9,8 +9,10 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/zubans/metrics/internal/config"
 	"github.com/zubans/metrics/internal/controllers"
+	"github.com/zubans/metrics/internal/identity"
 	"github.com/zubans/metrics/internal/services"
 	"github.com/zubans/metrics/internal/version"
 )
@@ -20,11 +22,20 @@ func main() {
 
 	var cfg = config.NewAgentConfig()
 
+	if cfg.AgentID == "" {
+		id, err := identity.LoadOrCreateAgentID(cfg.AgentIDFile)
+		if err != nil {
+			log.Printf("failed to persist agent id, using a temporary one: %v", err)
+			id = identity.NewAgentID(uuid.New())
+		}
+		cfg.AgentID = id
+	}
+
 	metricsService := services.NewMetricsService(cfg)
 
 	defer log.Println("stopped")
 
-	log.Printf("Agent send to server address %s", cfg.AddressServer)
+	log.Printf("Agent %s send to server address %s", cfg.AgentID, cfg.AddressServer)
 	log.Printf("Send interval: %v, Poll interval: %v", cfg.SendInterval, cfg.PollInterval)
 
 	metricsController := controllers.NewMetricsController(metricsService)
@@ -42,6 +42,11 @@ func PrintBuildInfo() {
 	fmt.Printf("Build date: %s\n", BuildDate)
 	fmt.Printf("Build commit: %s\n", BuildCommit)
 }
+
+// Version returns the build version reported to the server.
+func Version() string {
+	return BuildVersion
+}
 `)
 
 	generated := []byte(sb.String())
@@ -3,22 +3,33 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"regexp"
 	"syscall"
 	"time"
 
+	"github.com/zubans/metrics/internal/aggregate"
+	"github.com/zubans/metrics/internal/alerts"
+	"github.com/zubans/metrics/internal/auth"
 	"github.com/zubans/metrics/internal/config"
 	"github.com/zubans/metrics/internal/cryptoutil"
+	"github.com/zubans/metrics/internal/guard"
 	"github.com/zubans/metrics/internal/handler"
 	"github.com/zubans/metrics/internal/logger"
 	"github.com/zubans/metrics/internal/middlewares"
+	"github.com/zubans/metrics/internal/models"
+	"github.com/zubans/metrics/internal/pubsub"
+	"github.com/zubans/metrics/internal/query"
+	"github.com/zubans/metrics/internal/registry"
 	"github.com/zubans/metrics/internal/router"
 	"github.com/zubans/metrics/internal/services"
 	"github.com/zubans/metrics/internal/storage"
 	"github.com/zubans/metrics/internal/version"
+	"github.com/zubans/metrics/internal/webhook"
 	"go.uber.org/zap"
 )
 
@@ -31,6 +42,19 @@ func main() {
 		log.Printf("logger error: %v", err)
 	}
 
+	// Tokens are loaded before anything needs cleaning up, as exiting skips
+	// deferred calls.
+	var tokens *auth.Tokens
+	if cfg.AuthTokens != "" {
+		loaded, err := auth.Load(cfg.AuthTokens)
+		if err != nil {
+			// Serving without the configured authentication would let anyone
+			// overwrite metrics, so refuse to start instead.
+			log.Fatalf("error load auth tokens: %v", err)
+		}
+		tokens = loaded
+	}
+
 	defer func() {
 		if r := recover(); r != nil {
 			logger.Log.Info("CRITICAL panic occurred", zap.Any("error", r))
@@ -43,13 +67,30 @@ func main() {
 	var dump = storage.New(memStorage, *cfg)
 
 	var actualStorage services.MetricStorage
+	var cache *storage.CachedStorage
 
 	if cfg.DBCfg != "" {
-		err := storage.InitDB(cfg.DBCfg, "./migrations")
+		dbStorage, err := openDBStorage(cfg.DBCfg)
 		if err != nil {
-			logger.Log.Info("error init DB", zap.Any("error", err))
+			// Every request would fail without the configured storage.
+			log.Fatalf("error init storage: %v", err)
+		}
+		defer func() {
+			if err := dbStorage.Close(); err != nil {
+				logger.Log.Info("error close DB", zap.Any("error", err))
+			}
+		}()
+		actualStorage = dbStorage
+
+		if cfg.CacheFlushInterval > 0 {
+			cached, err := storage.NewCachedStorage(context.Background(), dbStorage, cfg.CacheFlushInterval)
+			if err != nil {
+				logger.Log.Info("error init cache, using DB directly", zap.Any("error", err))
+			} else {
+				cache = cached
+				actualStorage = cached
+			}
 		}
-		actualStorage = storage.NewDB(storage.DB)
 	} else {
 		if cfg.StoreInterval == 0 {
 			actualStorage = storage.NewAutoDump(memStorage, dump)
@@ -77,10 +118,59 @@ func main() {
 		}
 	}
 
-	var serv = services.NewMetricService(actualStorage)
-	var memHandler = handler.NewHandler(serv)
+	hub := pubsub.NewHub()
+	serviceOpts := []services.Option{
+		services.WithRegistry(registry.New()),
+		services.WithHub(hub),
+	}
+	if g, err := newGuard(cfg, actualStorage); err != nil {
+		logger.Log.Info("error init metric guard, metric policy disabled", zap.Any("error", err))
+	} else {
+		serviceOpts = append(serviceOpts, services.WithGuard(g))
+	}
+	if cfg.AggregationWindow > 0 {
+		serviceOpts = append(serviceOpts, services.WithAggregator(aggregate.New(cfg.AggregationWindow)))
+	}
+	if cfg.HistoryRetention > 0 {
+		serviceOpts = append(serviceOpts, services.WithHistory(query.NewHistory(cfg.HistoryRetention, historySamples)))
+	}
+
+	var hooks *webhook.Dispatcher
+	if len(cfg.Webhooks) > 0 {
+		deadLetter, err := os.OpenFile(cfg.WebhookDeadLetter, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			logger.Log.Info("error open webhook dead-letter log", zap.Any("error", err))
+		} else {
+			defer deadLetter.Close()
+			hooks, err = webhook.New(cfg.Webhooks, webhook.WithDeadLetter(deadLetter))
+			if err != nil {
+				logger.Log.Info("error init webhooks, webhooks disabled", zap.Any("error", err))
+			} else {
+				serviceOpts = append(serviceOpts, services.WithWebhooks(hooks))
+			}
+		}
+	}
+
+	alertCtx, stopAlerts := context.WithCancel(context.Background())
+	defer stopAlerts()
+	if cfg.AlertRules != "" {
+		if engine, err := newAlertEngine(cfg.AlertRules, actualStorage); err != nil {
+			logger.Log.Info("error load alert rules, alerting disabled", zap.Any("error", err))
+		} else {
+			serviceOpts = append(serviceOpts, services.WithAlerts(engine))
+			go engine.Run(alertCtx, cfg.AlertInterval)
+		}
+	}
+
+	var serv = services.NewMetricService(actualStorage, serviceOpts...)
+	var memHandler = handler.NewHandler(serv, handler.WithMaxBatchSize(cfg.MaxBatchSize))
 
-	var baseRouter = router.GetRouter(memHandler)
+	var baseRouter = router.GetRouter(memHandler,
+		router.WithMaxDecompressedSize(cfg.MaxDecompressedSize),
+		router.WithIngestRateLimit(cfg.IngestRateLimit, cfg.IngestRateBurst),
+		router.WithReadRateLimit(cfg.ReadRateLimit, cfg.ReadRateBurst),
+		router.WithAuth(tokens, cfg.AnonymousRead),
+	)
 	var r = baseRouter
 	if cfg.CryptoKey != "" {
 		priv, err := cryptoutil.LoadPrivateKey(cfg.CryptoKey)
@@ -94,7 +184,12 @@ func main() {
 		}
 	}
 
-	srv := &http.Server{Addr: cfg.RunAddr, Handler: middlewares.RequestLogger(r)}
+	// Bodies are limited before the request logger and handlers read them.
+	r = middlewares.LimitBody(cfg.MaxBodySize)(middlewares.RequestLogger(r))
+
+	srv := &http.Server{Addr: cfg.RunAddr, Handler: middlewares.RequestID(r)}
+	// Streams never become idle, so end them for Shutdown to complete.
+	srv.RegisterOnShutdown(hub.Close)
 
 	go func() {
 		logger.Log.Info("Starting server on ", zap.String("address", cfg.RunAddr))
@@ -107,12 +202,28 @@ func main() {
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 	<-stop
 
+	stopAlerts()
+
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	if err := srv.Shutdown(shutdownCtx); err != nil {
 		log.Printf("Server shutdown error: %v", err)
 	}
 
+	if cache != nil {
+		logger.Log.Info("Flushing cached metrics before shutdown...")
+		if err := cache.Close(shutdownCtx); err != nil {
+			logger.Log.Info("failed to flush cached metrics", zap.Any("error", err))
+		}
+	}
+
+	if hooks != nil {
+		logger.Log.Info("Delivering pending webhooks before shutdown...")
+		if err := hooks.Close(shutdownCtx); err != nil {
+			logger.Log.Info("failed to deliver pending webhooks", zap.Any("error", err))
+		}
+	}
+
 	logger.Log.Info("Saving metrics before shutdown...")
 	if err := dump.SaveMetricToFile(context.Background()); err != nil {
 		logger.Log.Info("failed to save metrics: ", zap.Any("error", err))
@@ -120,3 +231,86 @@ func main() {
 		logger.Log.Info("Metrics saved.")
 	}
 }
+
+// historySamples bounds the history kept per metric regardless of retention.
+const historySamples = 1000
+
+func newAlertEngine(path string, source alerts.Source) (*alerts.Engine, error) {
+	rules, err := alerts.Load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	notifiers, err := alerts.Notifiers(rules.Notifiers)
+	if err != nil {
+		return nil, err
+	}
+	if len(notifiers) == 0 {
+		notifiers = append(notifiers, alerts.LogNotifier{})
+	}
+
+	return alerts.New(rules.Rules, source, alerts.WithNotifiers(notifiers...)), nil
+}
+
+// newGuard enforces the metric policy of cfg. The stored metrics are known
+// series from the start. Only an invalid name pattern is an error.
+func newGuard(cfg *config.Config, storage services.MetricStorage) (*guard.Guard, error) {
+	policy := guard.Policy{
+		MaxNameLength:         cfg.MaxMetricNameLength,
+		MaxSeries:             cfg.MaxSeries,
+		MaxNewSeriesPerMinute: cfg.MaxNewSeriesPerMinute,
+	}
+	if cfg.MetricNamePattern != "" {
+		pattern, err := regexp.Compile(cfg.MetricNamePattern)
+		if err != nil {
+			return nil, err
+		}
+		policy.NamePattern = pattern
+	}
+
+	g := guard.New(policy)
+	snap, err := storage.Snapshot(context.Background())
+	if err != nil {
+		logger.Log.Info("error read stored metrics, series limit counts new metrics only", zap.Any("error", err))
+		return g, nil
+	}
+	for name := range snap.Gauges {
+		g.Seed(guard.Series{Type: string(models.Gauge), Name: name})
+	}
+	for name := range snap.Counters {
+		g.Seed(guard.Series{Type: string(models.Counter), Name: name})
+	}
+	return g, nil
+}
+
+type dbStorage interface {
+	services.MetricStorage
+	Close() error
+}
+
+// openDBStorage picks the backend by DSN scheme: sqlite:// selects SQLite,
+// redis:// and rediss:// select Redis, anything else is treated as a
+// Postgres DSN.
+func openDBStorage(dsn string) (dbStorage, error) {
+	if storage.IsRedisDSN(dsn) {
+		client, err := storage.InitRedis(dsn)
+		if err != nil {
+			return nil, fmt.Errorf("init Redis: %w", err)
+		}
+		return storage.NewRedis(client), nil
+	}
+
+	if storage.IsSQLiteDSN(dsn) {
+		db, err := storage.InitSQLite(dsn, "./migrations/sqlite")
+		if err != nil {
+			return nil, fmt.Errorf("init SQLite: %w", err)
+		}
+		return storage.NewSQLite(db), nil
+	}
+
+	db, err := storage.InitDB(dsn, "./migrations")
+	if err != nil {
+		return nil, fmt.Errorf("init DB: %w", err)
+	}
+	return storage.NewDB(db), nil
+}
@@ -0,0 +1,185 @@
+// Package aggregate derives cross-agent aggregates of gauges.
+//
+// Every agent reports the same gauge names, so the stored value of a gauge is
+// whatever the last agent sent. The Aggregator keeps the latest value per
+// agent and computes min/max/avg/sum/count over the agents that reported
+// within a time window. Aggregates are addressed as virtual metrics named
+// "<gauge>:<func>", e.g. "Alloc:avg".
+//
+// Samples older than the window are dropped as gauges are written, and the
+// number of agents tracked per gauge is capped, so clients inventing agent
+// IDs can't grow the Aggregator without bound.
+package aggregate
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Func is an aggregate function over the per-agent values of a gauge.
+type Func string
+
+const (
+	Min   Func = "min"
+	Max   Func = "max"
+	Avg   Func = "avg"
+	Sum   Func = "sum"
+	Count Func = "count"
+)
+
+// Separator splits a virtual metric name into gauge name and function.
+const Separator = ":"
+
+// ParseVirtual splits a virtual metric name like "Alloc:avg". It returns
+// false if name has no known function suffix.
+func ParseVirtual(name string) (string, Func, bool) {
+	i := strings.LastIndex(name, Separator)
+	if i <= 0 {
+		return "", "", false
+	}
+
+	fn := Func(name[i+1:])
+	switch fn {
+	case Min, Max, Avg, Sum, Count:
+		return name[:i], fn, true
+	default:
+		return "", "", false
+	}
+}
+
+// DefaultMaxAgents is the default cap on agents tracked per gauge.
+const DefaultMaxAgents = 1000
+
+type sample struct {
+	value float64
+	at    time.Time
+}
+
+// Aggregator keeps the latest gauge value reported by each agent.
+type Aggregator struct {
+	window    time.Duration
+	maxAgents int
+	now       func() time.Time
+
+	mu        sync.RWMutex
+	samples   map[string]map[string]sample // gauge name -> agent ID -> sample
+	lastPrune time.Time
+}
+
+// Option configures an Aggregator.
+type Option func(*Aggregator)
+
+// WithMaxAgents caps the agents tracked per gauge. Samples of further agents
+// are ignored until others leave the window.
+func WithMaxAgents(n int) Option {
+	return func(a *Aggregator) {
+		a.maxAgents = n
+	}
+}
+
+// New creates an Aggregator taking into account agents that reported a gauge
+// within window.
+func New(window time.Duration, opts ...Option) *Aggregator {
+	a := &Aggregator{
+		window:    window,
+		maxAgents: DefaultMaxAgents,
+		now:       time.Now,
+		samples:   make(map[string]map[string]sample),
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// Observe records value of gauge name as reported by agentID.
+func (a *Aggregator) Observe(agentID, name string, value float64) {
+	now := a.now()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.prune(now)
+
+	byAgent, ok := a.samples[name]
+	if !ok {
+		byAgent = make(map[string]sample)
+		a.samples[name] = byAgent
+	}
+	if _, ok := byAgent[agentID]; !ok && len(byAgent) >= a.maxAgents {
+		a.dropStale(byAgent, now)
+		if len(byAgent) >= a.maxAgents {
+			return
+		}
+	}
+	byAgent[agentID] = sample{value: value, at: now}
+}
+
+// Aggregate computes fn over the values of gauge name reported within the
+// window. It returns false if no agent reported the gauge in that time.
+func (a *Aggregator) Aggregate(name string, fn Func) (float64, bool) {
+	cutoff := a.now().Add(-a.window)
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	var (
+		n        int
+		sum      float64
+		min, max = math.Inf(1), math.Inf(-1)
+	)
+	for _, s := range a.samples[name] {
+		if s.at.Before(cutoff) {
+			continue
+		}
+		n++
+		sum += s.value
+		min = math.Min(min, s.value)
+		max = math.Max(max, s.value)
+	}
+
+	if n == 0 {
+		return 0, false
+	}
+
+	switch fn {
+	case Min:
+		return min, true
+	case Max:
+		return max, true
+	case Avg:
+		return sum / float64(n), true
+	case Sum:
+		return sum, true
+	case Count:
+		return float64(n), true
+	default:
+		return 0, false
+	}
+}
+
+// prune drops, at most once per window, the samples that left it and the
+// gauges no agent reports any more.
+func (a *Aggregator) prune(now time.Time) {
+	if now.Sub(a.lastPrune) < a.window {
+		return
+	}
+	a.lastPrune = now
+
+	for name, byAgent := range a.samples {
+		a.dropStale(byAgent, now)
+		if len(byAgent) == 0 {
+			delete(a.samples, name)
+		}
+	}
+}
+
+func (a *Aggregator) dropStale(byAgent map[string]sample, now time.Time) {
+	for id, s := range byAgent {
+		if now.Sub(s.at) > a.window {
+			delete(byAgent, id)
+		}
+	}
+}
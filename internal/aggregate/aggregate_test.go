@@ -0,0 +1,112 @@
+package aggregate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseVirtual(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		wantBase string
+		wantFn   Func
+		wantOK   bool
+	}{
+		{name: "avg", input: "Alloc:avg", wantBase: "Alloc", wantFn: Avg, wantOK: true},
+		{name: "count", input: "HeapAlloc:count", wantBase: "HeapAlloc", wantFn: Count, wantOK: true},
+		{name: "last separator wins", input: "a:b:max", wantBase: "a:b", wantFn: Max, wantOK: true},
+		{name: "plain name", input: "Alloc", wantOK: false},
+		{name: "unknown function", input: "Alloc:median", wantOK: false},
+		{name: "empty base", input: ":avg", wantOK: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base, fn, ok := ParseVirtual(tt.input)
+			assert.Equal(t, tt.wantOK, ok)
+			assert.Equal(t, tt.wantBase, base)
+			assert.Equal(t, tt.wantFn, fn)
+		})
+	}
+}
+
+func TestAggregator_Aggregate(t *testing.T) {
+	a := New(time.Minute)
+	a.Observe("agent-1", "Alloc", 10)
+	a.Observe("agent-2", "Alloc", 30)
+	a.Observe("agent-3", "Alloc", 20)
+	a.Observe("agent-1", "Alloc", 40) // replaces agent-1's previous value
+
+	tests := []struct {
+		fn   Func
+		want float64
+	}{
+		{Min, 20},
+		{Max, 40},
+		{Avg, 30},
+		{Sum, 90},
+		{Count, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.fn), func(t *testing.T) {
+			got, ok := a.Aggregate("Alloc", tt.fn)
+			assert.True(t, ok)
+			assert.InDelta(t, tt.want, got, 1e-9)
+		})
+	}
+
+	_, ok := a.Aggregate("Unknown", Avg)
+	assert.False(t, ok)
+}
+
+func TestAggregator_Window(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := New(time.Minute)
+	a.now = func() time.Time { return now }
+
+	a.Observe("old", "Alloc", 100)
+	now = now.Add(45 * time.Second)
+	a.Observe("new", "Alloc", 10)
+
+	got, ok := a.Aggregate("Alloc", Count)
+	assert.True(t, ok)
+	assert.InDelta(t, 2, got, 0)
+
+	now = now.Add(30 * time.Second)
+	got, ok = a.Aggregate("Alloc", Avg)
+	assert.True(t, ok)
+	assert.InDelta(t, 10, got, 0, "samples older than the window must be ignored")
+
+	now = now.Add(time.Minute)
+	_, ok = a.Aggregate("Alloc", Avg)
+	assert.False(t, ok)
+}
+
+func TestAggregator_Limits(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := New(time.Minute, WithMaxAgents(2))
+	a.now = func() time.Time { return now }
+
+	a.Observe("agent-1", "Alloc", 10)
+	a.Observe("agent-2", "Alloc", 20)
+	a.Observe("agent-3", "Alloc", 30)
+	a.Observe("agent-1", "Alloc", 40)
+
+	got, _ := a.Aggregate("Alloc", Sum)
+	assert.InDelta(t, 60, got, 0, "agents beyond the cap must be ignored")
+
+	now = now.Add(2 * time.Minute)
+	a.Observe("agent-3", "Alloc", 30)
+	got, _ = a.Aggregate("Alloc", Sum)
+	assert.InDelta(t, 30, got, 0, "agents that left the window free their slot")
+	assert.Len(t, a.samples["Alloc"], 1, "stale samples must be dropped on write")
+
+	a.Observe("agent-3", "HeapSys", 1)
+	now = now.Add(2 * time.Minute)
+	a.Observe("agent-3", "HeapSys", 1)
+	assert.NotContains(t, a.samples, "Alloc", "gauges no agent reports must be dropped")
+}
@@ -0,0 +1,238 @@
+// Package alerts evaluates threshold and absence rules against stored
+// metrics and notifies about alerts that fire or resolve.
+//
+// An alert whose condition holds becomes pending and turns firing once the
+// condition has held for the rule's For duration. A firing alert whose
+// condition no longer holds becomes resolved; a pending one is dropped.
+package alerts
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zubans/metrics/internal/logger"
+	"github.com/zubans/metrics/internal/models"
+	"go.uber.org/zap"
+)
+
+// State of an alert.
+type State string
+
+const (
+	Pending  State = "pending"
+	Firing   State = "firing"
+	Resolved State = "resolved"
+)
+
+// Alert is the current state of a rule.
+type Alert struct {
+	Rule        string     `json:"rule"`
+	Metric      string     `json:"metric"`
+	State       State      `json:"state"`
+	Value       *float64   `json:"value,omitempty"`
+	Message     string     `json:"message"`
+	ActiveSince time.Time  `json:"active_since"`
+	FiredAt     *time.Time `json:"fired_at,omitempty"`
+	ResolvedAt  *time.Time `json:"resolved_at,omitempty"`
+}
+
+// Source is the read side of a metric storage. Every evaluation reads one
+// snapshot, so all rules see the same state.
+type Source interface {
+	Snapshot(ctx context.Context) (models.Snapshot, error)
+}
+
+type ruleState struct {
+	rule  Rule
+	alert *Alert
+
+	// Absence rules remember when the value last changed.
+	seen       bool
+	last       float64
+	lastFound  bool
+	lastChange time.Time
+}
+
+// Engine evaluates rules against a Source.
+type Engine struct {
+	source    Source
+	notifiers []Notifier
+	now       func() time.Time
+
+	mu    sync.RWMutex
+	rules []*ruleState
+}
+
+// Option configures an Engine.
+type Option func(*Engine)
+
+// WithNotifiers sets the notifiers alert transitions are sent to.
+func WithNotifiers(n ...Notifier) Option {
+	return func(e *Engine) {
+		e.notifiers = append(e.notifiers, n...)
+	}
+}
+
+// New creates an Engine for rules, which must have passed Load validation.
+func New(rules []Rule, source Source, opts ...Option) *Engine {
+	e := &Engine{source: source, now: time.Now}
+	for _, r := range rules {
+		e.rules = append(e.rules, &ruleState{rule: r})
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e
+}
+
+// Run evaluates the rules every interval until ctx ends.
+func (e *Engine) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.Evaluate(ctx)
+		}
+	}
+}
+
+// Evaluate checks every rule once and sends notifications for alerts that
+// started firing or got resolved. If the metrics can't be read, the
+// evaluation is skipped and every alert keeps its state.
+func (e *Engine) Evaluate(ctx context.Context) {
+	snap, err := e.source.Snapshot(ctx)
+	if err != nil {
+		logger.Log.Info("failed to read metrics, skipping alert evaluation", zap.Error(err))
+		return
+	}
+
+	now := e.now()
+	var changed []Alert
+
+	e.mu.Lock()
+	for _, rs := range e.rules {
+		value, found := read(snap, rs.rule)
+		if a, ok := rs.step(now, value, found); ok {
+			changed = append(changed, a)
+		}
+	}
+	e.mu.Unlock()
+
+	for _, a := range changed {
+		for _, n := range e.notifiers {
+			if err := n.Notify(ctx, a); err != nil {
+				logger.Log.Info("failed to send alert notification",
+					zap.String("rule", a.Rule), zap.Error(err))
+			}
+		}
+	}
+}
+
+// Alerts returns the pending, firing and resolved alerts sorted by rule.
+func (e *Engine) Alerts() []Alert {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	alerts := make([]Alert, 0, len(e.rules))
+	for _, rs := range e.rules {
+		if rs.alert != nil {
+			alerts = append(alerts, *rs.alert)
+		}
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].Rule < alerts[j].Rule })
+
+	return alerts
+}
+
+func read(snap models.Snapshot, r Rule) (float64, bool) {
+	if r.Type == string(models.Counter) {
+		v, ok := snap.Counters[r.Metric]
+		return float64(v), ok
+	}
+	v, ok := snap.Gauges[r.Metric]
+	return v, ok
+}
+
+// step advances the rule state machine and returns the alert if it started
+// firing or got resolved.
+func (rs *ruleState) step(now time.Time, value float64, found bool) (Alert, bool) {
+	active, msg := rs.check(now, value, found)
+
+	a := rs.alert
+	if !active {
+		switch {
+		case a == nil || a.State == Resolved:
+			return Alert{}, false
+		case a.State == Pending:
+			rs.alert = nil
+			return Alert{}, false
+		default:
+			a.State = Resolved
+			a.Message = msg
+			a.ResolvedAt = &now
+			a.Value = valuePtr(value, found)
+			return *a, true
+		}
+	}
+
+	if a == nil || a.State == Resolved {
+		a = &Alert{Rule: rs.rule.Name, Metric: rs.rule.Metric, State: Pending, ActiveSince: now}
+		rs.alert = a
+	}
+	a.Message = msg
+	a.Value = valuePtr(value, found)
+
+	if a.State == Pending && now.Sub(a.ActiveSince) >= time.Duration(rs.rule.For) {
+		a.State = Firing
+		a.FiredAt = &now
+		return *a, true
+	}
+	return Alert{}, false
+}
+
+// check reports whether the rule condition holds and describes why.
+func (rs *ruleState) check(now time.Time, value float64, found bool) (bool, string) {
+	r := rs.rule
+
+	if r.Absent <= 0 {
+		if !found {
+			return false, fmt.Sprintf("%s is not reported", r.Metric)
+		}
+		formatted := strconv.FormatFloat(value, 'f', -1, 64)
+		threshold := strconv.FormatFloat(r.Threshold, 'f', -1, 64)
+		return r.compare(value), fmt.Sprintf("%s = %s (%s %s)", r.Metric, formatted, r.Comparator, threshold)
+	}
+
+	switch {
+	case !rs.seen:
+		// The clock starts at the first evaluation.
+		rs.seen = true
+		rs.lastChange = now
+	case found && (!rs.lastFound || value != rs.last):
+		rs.lastChange = now
+	}
+	if found {
+		rs.last, rs.lastFound = value, true
+	}
+
+	stale := now.Sub(rs.lastChange)
+	if stale >= time.Duration(r.Absent) {
+		return true, fmt.Sprintf("%s has not changed for %s", r.Metric, stale.Truncate(time.Second))
+	}
+	return false, fmt.Sprintf("%s changed %s ago", r.Metric, stale.Truncate(time.Second))
+}
+
+func valuePtr(v float64, found bool) *float64 {
+	if !found {
+		return nil
+	}
+	return &v
+}
@@ -0,0 +1,180 @@
+package alerts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zubans/metrics/internal/models"
+	"github.com/zubans/metrics/internal/webhook"
+)
+
+type fakeSource struct {
+	gauges   map[string]float64
+	counters map[string]int64
+	err      error
+}
+
+func (f *fakeSource) Snapshot(context.Context) (models.Snapshot, error) {
+	if f.err != nil {
+		return models.Snapshot{}, f.err
+	}
+	return models.Snapshot{Gauges: f.gauges, Counters: f.counters}, nil
+}
+
+type recordingNotifier struct {
+	mu     sync.Mutex
+	alerts []Alert
+}
+
+func (n *recordingNotifier) Notify(_ context.Context, a Alert) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.alerts = append(n.alerts, a)
+	return nil
+}
+
+type testEngine struct {
+	*Engine
+	clock    time.Time
+	notifier *recordingNotifier
+}
+
+func newTestEngine(rules []Rule, src *fakeSource) *testEngine {
+	te := &testEngine{clock: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), notifier: &recordingNotifier{}}
+	te.Engine = New(rules, src, WithNotifiers(te.notifier))
+	te.now = func() time.Time { return te.clock }
+	return te
+}
+
+func (te *testEngine) tick(d time.Duration) {
+	te.clock = te.clock.Add(d)
+	te.Evaluate(context.Background())
+}
+
+func (te *testEngine) state(t *testing.T) State {
+	t.Helper()
+	alerts := te.Alerts()
+	if len(alerts) == 0 {
+		return ""
+	}
+	require.Len(t, alerts, 1)
+	return alerts[0].State
+}
+
+func TestEngine_ThresholdLifecycle(t *testing.T) {
+	src := &fakeSource{gauges: map[string]float64{"HeapAlloc": 10}}
+	rule := Rule{Name: "heap", Metric: "HeapAlloc", Type: "gauge", Comparator: Greater, Threshold: 100, For: Duration(time.Minute)}
+	te := newTestEngine([]Rule{rule}, src)
+
+	te.tick(0)
+	assert.Equal(t, State(""), te.state(t))
+
+	src.gauges["HeapAlloc"] = 200
+	te.tick(10 * time.Second)
+	assert.Equal(t, Pending, te.state(t))
+
+	src.gauges["HeapAlloc"] = 50
+	te.tick(10 * time.Second)
+	assert.Equal(t, State(""), te.state(t), "pending alerts are dropped when the condition clears")
+
+	src.gauges["HeapAlloc"] = 200
+	te.tick(10 * time.Second)
+	te.tick(30 * time.Second)
+	assert.Equal(t, Pending, te.state(t))
+	te.tick(30 * time.Second)
+	assert.Equal(t, Firing, te.state(t))
+	te.tick(10 * time.Second)
+	assert.Equal(t, Firing, te.state(t))
+
+	src.gauges["HeapAlloc"] = 50
+	te.tick(10 * time.Second)
+	assert.Equal(t, Resolved, te.state(t))
+
+	require.Len(t, te.notifier.alerts, 2, "only firing and resolved transitions are notified")
+	assert.Equal(t, Firing, te.notifier.alerts[0].State)
+	assert.Equal(t, 200.0, *te.notifier.alerts[0].Value)
+	assert.Equal(t, Resolved, te.notifier.alerts[1].State)
+	assert.NotNil(t, te.notifier.alerts[1].ResolvedAt)
+}
+
+func TestEngine_AbsentCounter(t *testing.T) {
+	src := &fakeSource{counters: map[string]int64{"PollCount": 1}}
+	rule := Rule{Name: "poll-stalled", Metric: "PollCount", Type: "counter", Absent: Duration(30 * time.Second)}
+	te := newTestEngine([]Rule{rule}, src)
+
+	te.tick(0)
+	for i := 0; i < 5; i++ {
+		src.counters["PollCount"]++
+		te.tick(20 * time.Second)
+		assert.Equal(t, State(""), te.state(t), "an increasing counter must not alert")
+	}
+
+	te.tick(20 * time.Second)
+	assert.Equal(t, State(""), te.state(t))
+	te.tick(20 * time.Second)
+	assert.Equal(t, Firing, te.state(t))
+
+	src.counters["PollCount"]++
+	te.tick(time.Second)
+	assert.Equal(t, Resolved, te.state(t))
+}
+
+func TestEngine_AbsentMissingMetric(t *testing.T) {
+	src := &fakeSource{gauges: map[string]float64{}}
+	te := newTestEngine([]Rule{{Name: "alloc-missing", Metric: "Alloc", Type: "gauge", Absent: Duration(time.Minute)}}, src)
+
+	te.tick(0)
+	te.tick(59 * time.Second)
+	assert.Equal(t, State(""), te.state(t))
+	te.tick(time.Second)
+	assert.Equal(t, Firing, te.state(t))
+	assert.Nil(t, te.Alerts()[0].Value)
+}
+
+func TestEngine_SkipsFailedRead(t *testing.T) {
+	src := &fakeSource{gauges: map[string]float64{"HeapAlloc": 200}}
+	te := newTestEngine([]Rule{{Name: "heap", Metric: "HeapAlloc", Type: "gauge", Comparator: Greater, Threshold: 100}}, src)
+
+	te.tick(0)
+	assert.Equal(t, Firing, te.state(t))
+
+	src.err = errors.New("storage is down")
+	te.tick(10 * time.Second)
+	assert.Equal(t, Firing, te.state(t), "a failed read must not resolve the alert")
+	assert.Len(t, te.notifier.alerts, 1)
+
+	src.err = nil
+	src.gauges["HeapAlloc"] = 50
+	te.tick(10 * time.Second)
+	assert.Equal(t, Resolved, te.state(t))
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var got Alert
+	var signature string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signature = r.Header.Get(webhook.SignatureHeader)
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+	}))
+	defer srv.Close()
+
+	n := WebhookNotifier{URL: srv.URL, Secret: "s3cret"}
+	require.NoError(t, n.Notify(context.Background(), Alert{Rule: "heap", Metric: "HeapAlloc", State: Firing}))
+	assert.Equal(t, "heap", got.Rule)
+	assert.Equal(t, Firing, got.State)
+	assert.NotEmpty(t, signature)
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+	assert.Error(t, WebhookNotifier{URL: failing.URL}.Notify(context.Background(), Alert{}))
+}
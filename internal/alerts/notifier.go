@@ -0,0 +1,89 @@
+package alerts
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/zubans/metrics/internal/logger"
+	"github.com/zubans/metrics/internal/webhook"
+	"go.uber.org/zap"
+)
+
+// Notifier is told about alerts that start firing or get resolved.
+type Notifier interface {
+	Notify(ctx context.Context, a Alert) error
+}
+
+// LogNotifier writes alert transitions to the server log.
+type LogNotifier struct{}
+
+func (LogNotifier) Notify(_ context.Context, a Alert) error {
+	logger.Log.Info("alert "+string(a.State),
+		zap.String("rule", a.Rule),
+		zap.String("metric", a.Metric),
+		zap.String("message", a.Message),
+	)
+	return nil
+}
+
+// WebhookNotifier POSTs the alert as JSON to URL, signed like metric
+// webhooks when Secret is set.
+type WebhookNotifier struct {
+	URL    string
+	Secret string
+	Client *http.Client
+}
+
+func (n WebhookNotifier) Notify(ctx context.Context, a Alert) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.Secret != "" {
+		req.Header.Set(webhook.SignatureHeader, webhook.Sign(n.Secret, body))
+	}
+
+	client := n.Client
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("alert webhook %s: unexpected status %d", n.URL, resp.StatusCode)
+	}
+	return nil
+}
+
+// Notifiers builds notifiers from their configuration.
+func Notifiers(cfgs []NotifierConfig) ([]Notifier, error) {
+	notifiers := make([]Notifier, 0, len(cfgs))
+	for _, c := range cfgs {
+		switch c.Type {
+		case "log":
+			notifiers = append(notifiers, LogNotifier{})
+		case "webhook":
+			if c.URL == "" {
+				return nil, fmt.Errorf("webhook notifier: url is required")
+			}
+			notifiers = append(notifiers, WebhookNotifier{URL: c.URL, Secret: c.Secret})
+		default:
+			return nil, fmt.Errorf("unknown notifier type %q", c.Type)
+		}
+	}
+	return notifiers, nil
+}
@@ -0,0 +1,161 @@
+package alerts
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/zubans/metrics/internal/models"
+	"gopkg.in/yaml.v3"
+)
+
+// Duration is a time.Duration written as "30s" in rule files.
+type Duration time.Duration
+
+func (d *Duration) set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	return d.set(s)
+}
+
+func (d *Duration) UnmarshalYAML(n *yaml.Node) error {
+	return d.set(n.Value)
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Comparators supported by threshold rules.
+const (
+	Greater        = ">"
+	GreaterOrEqual = ">="
+	Less           = "<"
+	LessOrEqual    = "<="
+	Equal          = "=="
+	NotEqual       = "!="
+)
+
+// Rule is an alert condition on a single metric. A threshold rule fires when
+// "value Comparator Threshold" holds for the For duration. An absence rule
+// (Absent > 0) fires when the metric is missing or its value has not changed
+// for Absent, e.g. a counter that stopped increasing.
+type Rule struct {
+	Name       string   `json:"name" yaml:"name"`
+	Metric     string   `json:"metric" yaml:"metric"`
+	Type       string   `json:"type" yaml:"type"`
+	Comparator string   `json:"comparator,omitempty" yaml:"comparator"`
+	Threshold  float64  `json:"threshold,omitempty" yaml:"threshold"`
+	For        Duration `json:"for,omitempty" yaml:"for"`
+	Absent     Duration `json:"absent,omitempty" yaml:"absent"`
+}
+
+// NotifierConfig selects a notifier: "log", or "webhook" with URL and an
+// optional HMAC Secret.
+type NotifierConfig struct {
+	Type   string `json:"type" yaml:"type"`
+	URL    string `json:"url" yaml:"url"`
+	Secret string `json:"secret" yaml:"secret"`
+}
+
+// File is the content of an alert rules file.
+type File struct {
+	Rules     []Rule           `json:"rules" yaml:"rules"`
+	Notifiers []NotifierConfig `json:"notifiers" yaml:"notifiers"`
+}
+
+// Load reads a rules file. Files ending in .yaml or .yml are parsed as YAML,
+// anything else as JSON.
+func Load(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f File
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &f)
+	default:
+		err = json.Unmarshal(data, &f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	for i := range f.Rules {
+		if err := f.Rules[i].validate(); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+	}
+
+	return &f, nil
+}
+
+func (r *Rule) validate() error {
+	if r.Metric == "" {
+		return errors.New("metric is required")
+	}
+	if r.Name == "" {
+		r.Name = r.Metric
+	}
+	if r.Type == "" {
+		r.Type = string(models.Gauge)
+	}
+	if r.Type != string(models.Gauge) && r.Type != string(models.Counter) {
+		return fmt.Errorf("%s: invalid metric type %q", r.Name, r.Type)
+	}
+	if r.For < 0 || r.Absent < 0 {
+		return fmt.Errorf("%s: durations must not be negative", r.Name)
+	}
+
+	if r.Absent > 0 {
+		if r.Comparator != "" {
+			return fmt.Errorf("%s: absent and comparator are mutually exclusive", r.Name)
+		}
+		return nil
+	}
+
+	switch r.Comparator {
+	case Greater, GreaterOrEqual, Less, LessOrEqual, Equal, NotEqual:
+		return nil
+	case "":
+		return fmt.Errorf("%s: comparator or absent is required", r.Name)
+	default:
+		return fmt.Errorf("%s: invalid comparator %q", r.Name, r.Comparator)
+	}
+}
+
+func (r *Rule) compare(v float64) bool {
+	switch r.Comparator {
+	case Greater:
+		return v > r.Threshold
+	case GreaterOrEqual:
+		return v >= r.Threshold
+	case Less:
+		return v < r.Threshold
+	case LessOrEqual:
+		return v <= r.Threshold
+	case Equal:
+		return v == r.Threshold
+	case NotEqual:
+		return v != r.Threshold
+	default:
+		return false
+	}
+}
@@ -0,0 +1,76 @@
+package alerts
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeRules(t *testing.T, name, content string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(p, []byte(content), 0o600))
+	return p
+}
+
+func TestLoad_YAML(t *testing.T) {
+	p := writeRules(t, "alerts.yaml", `
+rules:
+  - name: heap-high
+    metric: HeapAlloc
+    comparator: ">"
+    threshold: 1e9
+    for: 1m
+  - metric: PollCount
+    type: counter
+    absent: 30s
+notifiers:
+  - type: log
+  - type: webhook
+    url: http://hooks.local/alerts
+`)
+
+	f, err := Load(p)
+	require.NoError(t, err)
+	require.Len(t, f.Rules, 2)
+
+	assert.Equal(t, Rule{Name: "heap-high", Metric: "HeapAlloc", Type: "gauge", Comparator: ">", Threshold: 1e9, For: Duration(time.Minute)}, f.Rules[0])
+	assert.Equal(t, Rule{Name: "PollCount", Metric: "PollCount", Type: "counter", Absent: Duration(30 * time.Second)}, f.Rules[1])
+
+	notifiers, err := Notifiers(f.Notifiers)
+	require.NoError(t, err)
+	assert.Equal(t, []Notifier{LogNotifier{}, WebhookNotifier{URL: "http://hooks.local/alerts"}}, notifiers)
+}
+
+func TestLoad_JSON(t *testing.T) {
+	p := writeRules(t, "alerts.json", `{"rules":[{"metric":"Alloc","comparator":"<=","threshold":5,"for":"10s"}]}`)
+
+	f, err := Load(p)
+	require.NoError(t, err)
+	require.Len(t, f.Rules, 1)
+	assert.Equal(t, Duration(10*time.Second), f.Rules[0].For)
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	tests := map[string]string{
+		"missing metric":     `{"rules":[{"comparator":">","threshold":1}]}`,
+		"missing condition":  `{"rules":[{"metric":"Alloc"}]}`,
+		"unknown comparator": `{"rules":[{"metric":"Alloc","comparator":"~"}]}`,
+		"both conditions":    `{"rules":[{"metric":"Alloc","comparator":">","absent":"1s"}]}`,
+		"invalid type":       `{"rules":[{"metric":"Alloc","type":"histogram","comparator":">"}]}`,
+		"invalid duration":   `{"rules":[{"metric":"Alloc","comparator":">","for":"soon"}]}`,
+	}
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := Load(writeRules(t, "alerts.json", content))
+			assert.Error(t, err)
+		})
+	}
+
+	_, err := Notifiers([]NotifierConfig{{Type: "pager"}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,145 @@
+// Package auth authenticates API clients by bearer token.
+//
+// Tokens are loaded from a file and grant roles: ingest to update metrics,
+// read to read them and admin to delete metrics and inspect the server.
+// Admin implies the other roles.
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Role is a set of permissions granted to a token.
+type Role string
+
+const (
+	Ingest Role = "ingest"
+	Read   Role = "read"
+	Admin  Role = "admin"
+)
+
+// MinTokenLength is the shortest accepted token. Tokens are meant to be
+// random strings, e.g. from "openssl rand -hex 32".
+const MinTokenLength = 16
+
+// Token grants Roles to clients presenting Token. Name identifies the token
+// in logs and defaults to its position in the file.
+type Token struct {
+	Name  string `json:"name" yaml:"name"`
+	Token string `json:"token" yaml:"token"`
+	Roles []Role `json:"roles" yaml:"roles"`
+}
+
+// Has reports whether t grants role.
+func (t *Token) Has(role Role) bool {
+	for _, r := range t.Roles {
+		if r == role || r == Admin {
+			return true
+		}
+	}
+	return false
+}
+
+// File is the content of a tokens file.
+type File struct {
+	Tokens []Token `json:"tokens" yaml:"tokens"`
+}
+
+// Tokens looks up clients by token. Tokens are kept and compared as SHA-256
+// digests, so lookups take the same time for every wrong token.
+type Tokens struct {
+	byDigest map[[sha256.Size]byte]*Token
+}
+
+// Load reads a tokens file. Files ending in .yaml or .yml are parsed as
+// YAML, anything else as JSON.
+func Load(path string) (*Tokens, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f File
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &f)
+	default:
+		err = json.Unmarshal(data, &f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	return New(f.Tokens...)
+}
+
+// New validates tokens and indexes them for lookup.
+func New(tokens ...Token) (*Tokens, error) {
+	if len(tokens) == 0 {
+		return nil, errors.New("no tokens defined")
+	}
+
+	t := &Tokens{byDigest: make(map[[sha256.Size]byte]*Token, len(tokens))}
+	for i := range tokens {
+		tok := tokens[i]
+		if tok.Name == "" {
+			tok.Name = fmt.Sprintf("token %d", i+1)
+		}
+		if err := tok.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %w", tok.Name, err)
+		}
+
+		digest := sha256.Sum256([]byte(tok.Token))
+		if _, ok := t.byDigest[digest]; ok {
+			return nil, fmt.Errorf("%s: duplicate token", tok.Name)
+		}
+		t.byDigest[digest] = &tok
+	}
+
+	return t, nil
+}
+
+// Lookup returns the token matching secret.
+func (t *Tokens) Lookup(secret string) (*Token, bool) {
+	tok, ok := t.byDigest[sha256.Sum256([]byte(secret))]
+	return tok, ok
+}
+
+func (t *Token) validate() error {
+	if len(t.Token) < MinTokenLength {
+		return fmt.Errorf("token must be at least %d characters long", MinTokenLength)
+	}
+	if len(t.Roles) == 0 {
+		return errors.New("at least one role is required")
+	}
+	for _, r := range t.Roles {
+		switch r {
+		case Ingest, Read, Admin:
+		default:
+			return fmt.Errorf("unknown role %q", r)
+		}
+	}
+	return nil
+}
+
+type tokenKey struct{}
+
+// NewContext returns a copy of ctx carrying the authenticated token.
+func NewContext(ctx context.Context, t *Token) context.Context {
+	return context.WithValue(ctx, tokenKey{}, t)
+}
+
+// FromContext returns the authenticated token stored in ctx.
+func FromContext(ctx context.Context) (*Token, bool) {
+	t, ok := ctx.Value(tokenKey{}).(*Token)
+	return t, ok
+}
@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	agentToken = "0123456789abcdef-agent"
+	adminToken = "0123456789abcdef-admin"
+)
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"tokens.yaml": `
+tokens:
+  - name: agents
+    token: ` + agentToken + `
+    roles: [ingest]
+  - token: ` + adminToken + `
+    roles: [admin]
+`,
+		"tokens.json": `{"tokens":[{"name":"agents","token":"` + agentToken + `","roles":["ingest"]},{"token":"` + adminToken + `","roles":["admin"]}]}`,
+	}
+
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+			tokens, err := Load(path)
+			require.NoError(t, err)
+
+			tok, ok := tokens.Lookup(agentToken)
+			require.True(t, ok)
+			assert.Equal(t, "agents", tok.Name)
+			assert.True(t, tok.Has(Ingest))
+			assert.False(t, tok.Has(Read))
+			assert.False(t, tok.Has(Admin))
+
+			tok, ok = tokens.Lookup(adminToken)
+			require.True(t, ok)
+			assert.Equal(t, "token 2", tok.Name)
+			assert.True(t, tok.Has(Ingest), "admin implies every role")
+			assert.True(t, tok.Has(Read))
+
+			_, ok = tokens.Lookup("0123456789abcdef-other")
+			assert.False(t, ok)
+			_, ok = tokens.Lookup("")
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestNew_Invalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		tokens []Token
+		err    string
+	}{
+		{name: "no tokens", err: "no tokens defined"},
+		{name: "short token", tokens: []Token{{Token: "secret", Roles: []Role{Read}}}, err: "token 1: token must be at least 16 characters long"},
+		{name: "no roles", tokens: []Token{{Name: "reader", Token: agentToken}}, err: "reader: at least one role is required"},
+		{name: "unknown role", tokens: []Token{{Token: agentToken, Roles: []Role{"write"}}}, err: `token 1: unknown role "write"`},
+		{
+			name:   "duplicate",
+			tokens: []Token{{Token: agentToken, Roles: []Role{Read}}, {Token: agentToken, Roles: []Role{Ingest}}},
+			err:    "token 2: duplicate token",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.tokens...)
+			assert.EqualError(t, err, tt.err)
+		})
+	}
+}
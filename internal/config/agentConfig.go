@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"flag"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/caarlos0/env/v6"
@@ -14,6 +15,14 @@ type AgentConfig struct {
 	SendInterval  time.Duration `env:"REPORT_INTERVAL"`
 	PollInterval  time.Duration `env:"POLL_INTERVAL"`
 	CryptoKey     string        `env:"CRYPTO_KEY"`
+	// AgentID identifies the agent to the server. Empty builds one from the
+	// host name and the UUID stored in AgentIDFile.
+	AgentID string `env:"AGENT_ID"`
+	// AgentIDFile stores the generated UUID, by default under the user
+	// config directory so the ID doesn't depend on the working directory.
+	AgentIDFile string `env:"AGENT_ID_FILE"`
+	// AuthToken is sent as a bearer token when the server requires one.
+	AuthToken string `env:"AUTH_TOKEN"`
 }
 
 type agentFileConfig struct {
@@ -21,6 +30,19 @@ type agentFileConfig struct {
 	ReportInterval *string `json:"report_interval"`
 	PollInterval   *string `json:"poll_interval"`
 	CryptoKey      *string `json:"crypto_key"`
+	AgentID        *string `json:"agent_id"`
+	AgentIDFile    *string `json:"agent_id_file"`
+	AuthToken      *string `json:"auth_token"`
+}
+
+// defaultAgentIDFile returns metrics-agent/agent_id in the user config
+// directory, or in the working directory when there is none.
+func defaultAgentIDFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "agent_id"
+	}
+	return filepath.Join(dir, "metrics-agent", "agent_id")
 }
 
 func NewAgentConfig() *AgentConfig {
@@ -29,6 +51,7 @@ func NewAgentConfig() *AgentConfig {
 		SendInterval:  10 * time.Second,
 		PollInterval:  2 * time.Second,
 		CryptoKey:     "",
+		AgentIDFile:   defaultAgentIDFile(),
 	}
 
 	configEnvPath := os.Getenv("CONFIG")
@@ -38,6 +61,9 @@ func NewAgentConfig() *AgentConfig {
 		repIntFlag    int
 		pollIntFlag   int
 		cryptoFlag    string
+		idFlag        string
+		idFileFlag    string
+		tokenFlag     string
 		configFlag    string
 		configFlagAlt string
 	)
@@ -45,6 +71,9 @@ func NewAgentConfig() *AgentConfig {
 	flag.IntVar(&repIntFlag, "r", int(cfg.SendInterval/time.Second), "report send interval")
 	flag.IntVar(&pollIntFlag, "p", int(cfg.PollInterval/time.Second), "poll interval")
 	flag.StringVar(&cryptoFlag, "crypto-key", cfg.CryptoKey, "path to RSA public key (PEM)")
+	flag.StringVar(&idFlag, "id", cfg.AgentID, "agent ID sent to the server (default: hostname and a persisted UUID)")
+	flag.StringVar(&idFileFlag, "id-file", cfg.AgentIDFile, "file storing the generated agent UUID")
+	flag.StringVar(&tokenFlag, "token", cfg.AuthToken, "bearer token sent to the server")
 	flag.StringVar(&configFlag, "config", "", "path to JSON config file")
 	flag.StringVar(&configFlagAlt, "c", "", "path to JSON config file (short)")
 	flag.Parse()
@@ -77,6 +106,15 @@ func NewAgentConfig() *AgentConfig {
 				if fc.CryptoKey != nil {
 					cfg.CryptoKey = *fc.CryptoKey
 				}
+				if fc.AgentID != nil {
+					cfg.AgentID = *fc.AgentID
+				}
+				if fc.AgentIDFile != nil {
+					cfg.AgentIDFile = *fc.AgentIDFile
+				}
+				if fc.AuthToken != nil {
+					cfg.AuthToken = *fc.AuthToken
+				}
 			}
 		}
 	}
@@ -86,12 +124,12 @@ func NewAgentConfig() *AgentConfig {
 		return nil
 	}
 
-	applyAgentFlagOverrides(&cfg, addrFlag, repIntFlag, pollIntFlag, cryptoFlag)
+	applyAgentFlagOverrides(&cfg, addrFlag, repIntFlag, pollIntFlag, cryptoFlag, idFlag, idFileFlag, tokenFlag)
 
 	return &cfg
 }
 
-func applyAgentFlagOverrides(cfg *AgentConfig, addrFlag string, repIntFlag int, pollIntFlag int, cryptoFlag string) {
+func applyAgentFlagOverrides(cfg *AgentConfig, addrFlag string, repIntFlag int, pollIntFlag int, cryptoFlag string, idFlag string, idFileFlag string, tokenFlag string) {
 	setFlags := map[string]bool{}
 	flag.Visit(func(f *flag.Flag) {
 		setFlags[f.Name] = true
@@ -108,4 +146,13 @@ func applyAgentFlagOverrides(cfg *AgentConfig, addrFlag string, repIntFlag int,
 	if setFlags["crypto-key"] {
 		cfg.CryptoKey = cryptoFlag
 	}
+	if setFlags["id"] {
+		cfg.AgentID = idFlag
+	}
+	if setFlags["id-file"] {
+		cfg.AgentIDFile = idFileFlag
+	}
+	if setFlags["token"] {
+		cfg.AuthToken = tokenFlag
+	}
 }
@@ -35,6 +35,9 @@ func clearAgentEnv(tb testing.TB) {
 	_ = os.Unsetenv("REPORT_INTERVAL")
 	_ = os.Unsetenv("POLL_INTERVAL")
 	_ = os.Unsetenv("CRYPTO_KEY")
+	_ = os.Unsetenv("AGENT_ID")
+	_ = os.Unsetenv("AGENT_ID_FILE")
+	_ = os.Unsetenv("AUTH_TOKEN")
 }
 
 func TestAgentConfig_FileOnly(t *testing.T) {
@@ -139,3 +142,68 @@ func TestAgentConfig_FlagsOverrideEnvAndFile(t *testing.T) {
 		t.Fatalf("crypto=%q", cfg.CryptoKey)
 	}
 }
+
+func TestAgentConfig_AgentID(t *testing.T) {
+	t.Cleanup(func() { clearAgentEnv(t) })
+	clearAgentEnv(t)
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	resetFlagsAndArgs(t, []string{"agent"})
+
+	cfg := NewAgentConfig()
+	if want := filepath.Join(dir, "metrics-agent", "agent_id"); cfg.AgentIDFile != want {
+		t.Fatalf("default idFile=%q, want %q", cfg.AgentIDFile, want)
+	}
+
+	p := writeAgentJSON(t, dir, map[string]any{
+		"agent_id":      "file-agent",
+		"agent_id_file": "/file/agent_id",
+	})
+	_ = os.Setenv("CONFIG", p)
+	resetFlagsAndArgs(t, []string{"agent"})
+
+	cfg = NewAgentConfig()
+	if cfg.AgentID != "file-agent" || cfg.AgentIDFile != "/file/agent_id" {
+		t.Fatalf("file id=%q idFile=%q", cfg.AgentID, cfg.AgentIDFile)
+	}
+
+	_ = os.Setenv("AGENT_ID", "env-agent")
+	resetFlagsAndArgs(t, []string{"agent"})
+	cfg = NewAgentConfig()
+	if cfg.AgentID != "env-agent" {
+		t.Fatalf("env id=%q", cfg.AgentID)
+	}
+
+	resetFlagsAndArgs(t, []string{"agent", "-id", "flag-agent", "-id-file", "flag_id"})
+	cfg = NewAgentConfig()
+	if cfg.AgentID != "flag-agent" || cfg.AgentIDFile != "flag_id" {
+		t.Fatalf("flag id=%q idFile=%q", cfg.AgentID, cfg.AgentIDFile)
+	}
+}
+
+func TestAgentConfig_AuthToken(t *testing.T) {
+	t.Cleanup(func() { clearAgentEnv(t) })
+	clearAgentEnv(t)
+	dir := t.TempDir()
+	p := writeAgentJSON(t, dir, map[string]any{"auth_token": "file-token"})
+	_ = os.Setenv("CONFIG", p)
+	resetFlagsAndArgs(t, []string{"agent"})
+
+	cfg := NewAgentConfig()
+	if cfg.AuthToken != "file-token" {
+		t.Fatalf("file token=%q", cfg.AuthToken)
+	}
+
+	_ = os.Setenv("AUTH_TOKEN", "env-token")
+	resetFlagsAndArgs(t, []string{"agent"})
+	cfg = NewAgentConfig()
+	if cfg.AuthToken != "env-token" {
+		t.Fatalf("env token=%q", cfg.AuthToken)
+	}
+
+	resetFlagsAndArgs(t, []string{"agent", "-token", "flag-token"})
+	cfg = NewAgentConfig()
+	if cfg.AuthToken != "flag-token" {
+		t.Fatalf("flag token=%q", cfg.AuthToken)
+	}
+}
@@ -21,26 +21,120 @@ type Config struct {
 	Restore         bool          `env:"RESTORE"`
 	DBCfg           string        `env:"DATABASE_DSN"`
 	CryptoKey       string        `env:"CRYPTO_KEY"`
+	// CacheFlushInterval enables an in-memory cache in front of the database
+	// storage and sets how often queued writes are flushed. Zero disables it.
+	CacheFlushInterval time.Duration `env:"CACHE_FLUSH_INTERVAL"`
+	// AggregationWindow is how long a gauge value reported by an agent takes
+	// part in cross-agent aggregates such as "Alloc:avg". Zero disables them.
+	AggregationWindow time.Duration `env:"AGGREGATION_WINDOW"`
+	// Webhooks are notified about metric changes. They can only be set in
+	// the JSON config file.
+	Webhooks []WebhookConfig
+	// WebhookDeadLetter is the file undeliverable webhook batches are
+	// appended to as JSON lines.
+	WebhookDeadLetter string `env:"WEBHOOK_DEAD_LETTER"`
+	// AlertRules is the YAML or JSON file with alert rules and notifiers.
+	// Alerting is disabled when it is empty.
+	AlertRules string `env:"ALERT_RULES"`
+	// AlertInterval is how often alert rules are evaluated. Non-positive
+	// values fall back to the default of 10 seconds.
+	AlertInterval time.Duration `env:"ALERT_INTERVAL"`
+	// HistoryRetention is how long recent metric values are kept for range
+	// functions such as rate() in /query. Zero disables the history.
+	HistoryRetention time.Duration `env:"HISTORY_RETENTION"`
+	// MaxBodySize limits request bodies as sent, in bytes.
+	MaxBodySize int64 `env:"MAX_BODY_SIZE"`
+	// MaxDecompressedSize limits gzip request bodies after decompression,
+	// in bytes.
+	MaxDecompressedSize int64 `env:"MAX_DECOMPRESSED_SIZE"`
+	// MaxBatchSize limits the number of metrics in a batch update.
+	MaxBatchSize int `env:"MAX_BATCH_SIZE"`
+	// IngestRateLimit is how many update requests per second a client may
+	// send, with bursts of IngestRateBurst. Zero disables the limit.
+	IngestRateLimit float64 `env:"INGEST_RATE_LIMIT"`
+	IngestRateBurst int     `env:"INGEST_RATE_BURST"`
+	// ReadRateLimit and ReadRateBurst limit reads, queries and streams the
+	// same way.
+	ReadRateLimit float64 `env:"READ_RATE_LIMIT"`
+	ReadRateBurst int     `env:"READ_RATE_BURST"`
+	// MetricNamePattern is a regular expression new metric names must
+	// match. Empty allows any name.
+	MetricNamePattern string `env:"METRIC_NAME_PATTERN"`
+	// MaxMetricNameLength limits the length of new metric names in bytes.
+	MaxMetricNameLength int `env:"MAX_METRIC_NAME_LENGTH"`
+	// MaxSeries limits the number of stored metrics. Zero disables the
+	// limit.
+	MaxSeries int `env:"MAX_SERIES"`
+	// MaxNewSeriesPerMinute limits how many metrics one client, told apart
+	// by token or remote address, may create per minute. Zero disables the
+	// limit.
+	MaxNewSeriesPerMinute int `env:"MAX_NEW_SERIES_PER_MINUTE"`
+	// AuthTokens is a YAML or JSON file of bearer tokens and their roles.
+	// Empty disables authentication.
+	AuthTokens string `env:"AUTH_TOKENS_FILE"`
+	// AnonymousRead lets clients without a token read metrics when
+	// authentication is enabled.
+	AnonymousRead bool `env:"ANONYMOUS_READ"`
+}
+
+// WebhookConfig describes a webhook endpoint. Pattern selects metric names
+// using path.Match syntax, empty matches all. When Secret is set, requests
+// carry an HMAC-SHA256 signature of the body.
+type WebhookConfig struct {
+	URL     string `json:"url"`
+	Pattern string `json:"pattern"`
+	Secret  string `json:"secret"`
 }
 
 type serverFileConfig struct {
-	Address       *string `json:"address"`
-	Restore       *bool   `json:"restore"`
-	StoreInterval *string `json:"store_interval"`
-	StoreFile     *string `json:"store_file"`
-	DatabaseDSN   *string `json:"database_dsn"`
-	CryptoKey     *string `json:"crypto_key"`
+	Address       *string         `json:"address"`
+	Restore       *bool           `json:"restore"`
+	StoreInterval *string         `json:"store_interval"`
+	StoreFile     *string         `json:"store_file"`
+	DatabaseDSN   *string         `json:"database_dsn"`
+	CryptoKey     *string         `json:"crypto_key"`
+	CacheFlush    *string         `json:"cache_flush_interval"`
+	AggWindow     *string         `json:"aggregation_window"`
+	Webhooks      []WebhookConfig `json:"webhooks"`
+	DeadLetter    *string         `json:"webhook_dead_letter"`
+	AlertRules    *string         `json:"alert_rules"`
+	AlertInterval *string         `json:"alert_interval"`
+	History       *string         `json:"history_retention"`
+	MaxBody       *int64          `json:"max_body_size"`
+	MaxInflated   *int64          `json:"max_decompressed_size"`
+	MaxBatch      *int            `json:"max_batch_size"`
+	IngestRate    *float64        `json:"ingest_rate_limit"`
+	IngestBurst   *int            `json:"ingest_rate_burst"`
+	ReadRate      *float64        `json:"read_rate_limit"`
+	ReadBurst     *int            `json:"read_rate_burst"`
+	NamePattern   *string         `json:"metric_name_pattern"`
+	MaxNameLength *int            `json:"max_metric_name_length"`
+	MaxSeries     *int            `json:"max_series"`
+	MaxNewSeries  *int            `json:"max_new_series_per_minute"`
+	AuthTokens    *string         `json:"auth_tokens_file"`
+	AnonymousRead *bool           `json:"anonymous_read"`
 }
 
+// defaultAlertInterval is used when no positive alert interval is set.
+const defaultAlertInterval = 10 * time.Second
+
 func NewServerConfig() *Config {
 	cfg := Config{
-		RunAddr:         "localhost:8080",
-		FlagLogLevel:    "info",
-		StoreInterval:   300 * time.Second,
-		FileStoragePath: "metric_storage.json",
-		Restore:         true,
-		DBCfg:           "",
-		CryptoKey:       "",
+		RunAddr:             "localhost:8080",
+		FlagLogLevel:        "info",
+		StoreInterval:       300 * time.Second,
+		FileStoragePath:     "metric_storage.json",
+		Restore:             true,
+		DBCfg:               "",
+		CryptoKey:           "",
+		AggregationWindow:   time.Minute,
+		WebhookDeadLetter:   "webhook_dead_letter.log",
+		AlertInterval:       defaultAlertInterval,
+		HistoryRetention:    15 * time.Minute,
+		MaxBodySize:         1 << 20,
+		MaxDecompressedSize: 8 << 20,
+		MaxBatchSize:        10000,
+		MaxMetricNameLength: 255,
 	}
 
 	configEnvPath := os.Getenv("CONFIG")
@@ -53,6 +147,25 @@ func NewServerConfig() *Config {
 		db            string
 		isRestore     bool
 		cryptoFlag    string
+		cacheInterval int
+		aggWindow     int
+		deadLetter    string
+		alertRules    string
+		alertInterval int
+		history       int
+		maxBody       int64
+		maxInflated   int64
+		maxBatch      int
+		ingestRate    float64
+		ingestBurst   int
+		readRate      float64
+		readBurst     int
+		namePattern   string
+		maxNameLength int
+		maxSeries     int
+		maxNewSeries  int
+		authTokens    string
+		anonymousRead bool
 		configFlag    string
 		configFlagAlt string
 	)
@@ -60,9 +173,28 @@ func NewServerConfig() *Config {
 	flag.StringVar(&flagLogLevel, "l", cfg.FlagLogLevel, "log level")
 	flag.IntVar(&storeInterval, "i", int(cfg.StoreInterval/time.Second), "store to file interval")
 	flag.StringVar(&storagePath, "f", cfg.FileStoragePath, "file storage path")
-	flag.StringVar(&db, "d", cfg.DBCfg, "db credential")
+	flag.StringVar(&db, "d", cfg.DBCfg, "storage DSN: postgres DSN, sqlite:///path/to/file.db or redis://host:port/db")
 	flag.BoolVar(&isRestore, "r", cfg.Restore, "bool value. Ability to restore metrics from file")
 	flag.StringVar(&cryptoFlag, "crypto-key", cfg.CryptoKey, "path to RSA private key (PEM)")
+	flag.IntVar(&cacheInterval, "cache-interval", int(cfg.CacheFlushInterval/time.Second), "database write cache flush interval in seconds, 0 disables the cache")
+	flag.IntVar(&aggWindow, "aggregate-window", int(cfg.AggregationWindow/time.Second), "cross-agent gauge aggregation window in seconds, 0 disables aggregates")
+	flag.StringVar(&deadLetter, "webhook-dead-letter", cfg.WebhookDeadLetter, "file for undeliverable webhook batches")
+	flag.StringVar(&alertRules, "alert-rules", cfg.AlertRules, "YAML or JSON file with alert rules, empty disables alerting")
+	flag.IntVar(&alertInterval, "alert-interval", int(cfg.AlertInterval/time.Second), "alert rules evaluation interval in seconds")
+	flag.IntVar(&history, "history-retention", int(cfg.HistoryRetention/time.Second), "metric history retention for /query range functions in seconds, 0 disables the history")
+	flag.Int64Var(&maxBody, "max-body-size", cfg.MaxBodySize, "maximum request body size in bytes, 0 disables the limit")
+	flag.Int64Var(&maxInflated, "max-decompressed-size", cfg.MaxDecompressedSize, "maximum decompressed gzip request body size in bytes, 0 disables the limit")
+	flag.IntVar(&maxBatch, "max-batch-size", cfg.MaxBatchSize, "maximum number of metrics in a batch update, 0 disables the limit")
+	flag.Float64Var(&ingestRate, "ingest-rate-limit", cfg.IngestRateLimit, "update requests per second allowed per client, 0 disables the limit")
+	flag.IntVar(&ingestBurst, "ingest-rate-burst", cfg.IngestRateBurst, "update request burst allowed per client, 0 defaults to the rate")
+	flag.Float64Var(&readRate, "read-rate-limit", cfg.ReadRateLimit, "read requests per second allowed per client, 0 disables the limit")
+	flag.IntVar(&readBurst, "read-rate-burst", cfg.ReadRateBurst, "read request burst allowed per client, 0 defaults to the rate")
+	flag.StringVar(&namePattern, "metric-name-pattern", cfg.MetricNamePattern, "regular expression new metric names must match, empty allows any name")
+	flag.IntVar(&maxNameLength, "max-metric-name-length", cfg.MaxMetricNameLength, "maximum length of new metric names in bytes, 0 disables the limit")
+	flag.IntVar(&maxSeries, "max-series", cfg.MaxSeries, "maximum number of stored metrics, 0 disables the limit")
+	flag.IntVar(&maxNewSeries, "max-new-series-per-minute", cfg.MaxNewSeriesPerMinute, "new metrics allowed per client per minute, 0 disables the limit")
+	flag.StringVar(&authTokens, "auth-tokens", cfg.AuthTokens, "YAML or JSON file with bearer tokens and their roles, empty disables authentication")
+	flag.BoolVar(&anonymousRead, "anonymous-read", cfg.AnonymousRead, "allow reading metrics without a token when authentication is enabled")
 	flag.StringVar(&configFlag, "config", "", "path to JSON config file")
 	flag.StringVar(&configFlagAlt, "c", "", "path to JSON config file (short)")
 
@@ -100,6 +232,74 @@ func NewServerConfig() *Config {
 				if fc.CryptoKey != nil {
 					cfg.CryptoKey = *fc.CryptoKey
 				}
+				if fc.CacheFlush != nil {
+					if d, err := time.ParseDuration(*fc.CacheFlush); err == nil {
+						cfg.CacheFlushInterval = d
+					}
+				}
+				if fc.AggWindow != nil {
+					if d, err := time.ParseDuration(*fc.AggWindow); err == nil {
+						cfg.AggregationWindow = d
+					}
+				}
+				if fc.Webhooks != nil {
+					cfg.Webhooks = fc.Webhooks
+				}
+				if fc.DeadLetter != nil {
+					cfg.WebhookDeadLetter = *fc.DeadLetter
+				}
+				if fc.AlertRules != nil {
+					cfg.AlertRules = *fc.AlertRules
+				}
+				if fc.AlertInterval != nil {
+					if d, err := time.ParseDuration(*fc.AlertInterval); err == nil {
+						cfg.AlertInterval = d
+					}
+				}
+				if fc.History != nil {
+					if d, err := time.ParseDuration(*fc.History); err == nil {
+						cfg.HistoryRetention = d
+					}
+				}
+				if fc.MaxBody != nil {
+					cfg.MaxBodySize = *fc.MaxBody
+				}
+				if fc.MaxInflated != nil {
+					cfg.MaxDecompressedSize = *fc.MaxInflated
+				}
+				if fc.MaxBatch != nil {
+					cfg.MaxBatchSize = *fc.MaxBatch
+				}
+				if fc.IngestRate != nil {
+					cfg.IngestRateLimit = *fc.IngestRate
+				}
+				if fc.IngestBurst != nil {
+					cfg.IngestRateBurst = *fc.IngestBurst
+				}
+				if fc.ReadRate != nil {
+					cfg.ReadRateLimit = *fc.ReadRate
+				}
+				if fc.ReadBurst != nil {
+					cfg.ReadRateBurst = *fc.ReadBurst
+				}
+				if fc.NamePattern != nil {
+					cfg.MetricNamePattern = *fc.NamePattern
+				}
+				if fc.MaxNameLength != nil {
+					cfg.MaxMetricNameLength = *fc.MaxNameLength
+				}
+				if fc.MaxSeries != nil {
+					cfg.MaxSeries = *fc.MaxSeries
+				}
+				if fc.MaxNewSeries != nil {
+					cfg.MaxNewSeriesPerMinute = *fc.MaxNewSeries
+				}
+				if fc.AuthTokens != nil {
+					cfg.AuthTokens = *fc.AuthTokens
+				}
+				if fc.AnonymousRead != nil {
+					cfg.AnonymousRead = *fc.AnonymousRead
+				}
 			}
 		}
 	}
@@ -148,6 +348,67 @@ func NewServerConfig() *Config {
 	if setFlags["crypto-key"] {
 		cfg.CryptoKey = cryptoFlag
 	}
+	if setFlags["cache-interval"] {
+		cfg.CacheFlushInterval = time.Duration(cacheInterval) * time.Second
+	}
+	if setFlags["aggregate-window"] {
+		cfg.AggregationWindow = time.Duration(aggWindow) * time.Second
+	}
+	if setFlags["webhook-dead-letter"] {
+		cfg.WebhookDeadLetter = deadLetter
+	}
+	if setFlags["alert-rules"] {
+		cfg.AlertRules = alertRules
+	}
+	if setFlags["alert-interval"] {
+		cfg.AlertInterval = time.Duration(alertInterval) * time.Second
+	}
+	if setFlags["history-retention"] {
+		cfg.HistoryRetention = time.Duration(history) * time.Second
+	}
+	if setFlags["max-body-size"] {
+		cfg.MaxBodySize = maxBody
+	}
+	if setFlags["max-decompressed-size"] {
+		cfg.MaxDecompressedSize = maxInflated
+	}
+	if setFlags["max-batch-size"] {
+		cfg.MaxBatchSize = maxBatch
+	}
+	if setFlags["ingest-rate-limit"] {
+		cfg.IngestRateLimit = ingestRate
+	}
+	if setFlags["ingest-rate-burst"] {
+		cfg.IngestRateBurst = ingestBurst
+	}
+	if setFlags["read-rate-limit"] {
+		cfg.ReadRateLimit = readRate
+	}
+	if setFlags["read-rate-burst"] {
+		cfg.ReadRateBurst = readBurst
+	}
+	if setFlags["metric-name-pattern"] {
+		cfg.MetricNamePattern = namePattern
+	}
+	if setFlags["max-metric-name-length"] {
+		cfg.MaxMetricNameLength = maxNameLength
+	}
+	if setFlags["max-series"] {
+		cfg.MaxSeries = maxSeries
+	}
+	if setFlags["max-new-series-per-minute"] {
+		cfg.MaxNewSeriesPerMinute = maxNewSeries
+	}
+	if setFlags["auth-tokens"] {
+		cfg.AuthTokens = authTokens
+	}
+	if setFlags["anonymous-read"] {
+		cfg.AnonymousRead = anonymousRead
+	}
+
+	if cfg.AlertInterval <= 0 {
+		cfg.AlertInterval = defaultAlertInterval
+	}
 
 	return &cfg
 }
@@ -5,6 +5,7 @@ import (
 	"flag"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -38,6 +39,25 @@ func clearServerEnv(tb testing.TB) {
 	_ = os.Unsetenv("RESTORE")
 	_ = os.Unsetenv("DATABASE_DSN")
 	_ = os.Unsetenv("CRYPTO_KEY")
+	_ = os.Unsetenv("CACHE_FLUSH_INTERVAL")
+	_ = os.Unsetenv("AGGREGATION_WINDOW")
+	_ = os.Unsetenv("WEBHOOK_DEAD_LETTER")
+	_ = os.Unsetenv("ALERT_RULES")
+	_ = os.Unsetenv("ALERT_INTERVAL")
+	_ = os.Unsetenv("HISTORY_RETENTION")
+	_ = os.Unsetenv("MAX_BODY_SIZE")
+	_ = os.Unsetenv("MAX_DECOMPRESSED_SIZE")
+	_ = os.Unsetenv("MAX_BATCH_SIZE")
+	_ = os.Unsetenv("INGEST_RATE_LIMIT")
+	_ = os.Unsetenv("INGEST_RATE_BURST")
+	_ = os.Unsetenv("READ_RATE_LIMIT")
+	_ = os.Unsetenv("READ_RATE_BURST")
+	_ = os.Unsetenv("METRIC_NAME_PATTERN")
+	_ = os.Unsetenv("MAX_METRIC_NAME_LENGTH")
+	_ = os.Unsetenv("MAX_SERIES")
+	_ = os.Unsetenv("MAX_NEW_SERIES_PER_MINUTE")
+	_ = os.Unsetenv("AUTH_TOKENS_FILE")
+	_ = os.Unsetenv("ANONYMOUS_READ")
 }
 
 func TestServerConfig_FileOnly(t *testing.T) {
@@ -171,3 +191,336 @@ func TestServerConfig_FlagsOverrideEnvAndFile(t *testing.T) {
 		t.Fatalf("crypto=%q", cfg.CryptoKey)
 	}
 }
+
+func TestServerConfig_CacheFlushInterval(t *testing.T) {
+	t.Cleanup(func() { clearServerEnv(t) })
+	clearServerEnv(t)
+	dir := t.TempDir()
+	p := writeServerJSON(t, dir, map[string]any{
+		"cache_flush_interval": "3s",
+	})
+	_ = os.Setenv("CONFIG", p)
+	resetServerFlagsArgs(t, []string{"server"})
+
+	cfg := NewServerConfig()
+	if cfg.CacheFlushInterval != 3*time.Second {
+		t.Fatalf("file cache=%v", cfg.CacheFlushInterval)
+	}
+
+	_ = os.Setenv("CACHE_FLUSH_INTERVAL", "500ms")
+	resetServerFlagsArgs(t, []string{"server"})
+	cfg = NewServerConfig()
+	if cfg.CacheFlushInterval != 500*time.Millisecond {
+		t.Fatalf("env cache=%v", cfg.CacheFlushInterval)
+	}
+
+	resetServerFlagsArgs(t, []string{"server", "-cache-interval", "7"})
+	cfg = NewServerConfig()
+	if cfg.CacheFlushInterval != 7*time.Second {
+		t.Fatalf("flag cache=%v", cfg.CacheFlushInterval)
+	}
+}
+
+func TestServerConfig_AggregationWindow(t *testing.T) {
+	t.Cleanup(func() { clearServerEnv(t) })
+	clearServerEnv(t)
+	resetServerFlagsArgs(t, []string{"server"})
+
+	cfg := NewServerConfig()
+	if cfg.AggregationWindow != time.Minute {
+		t.Fatalf("default window=%v", cfg.AggregationWindow)
+	}
+
+	_ = os.Setenv("AGGREGATION_WINDOW", "30s")
+	resetServerFlagsArgs(t, []string{"server"})
+	cfg = NewServerConfig()
+	if cfg.AggregationWindow != 30*time.Second {
+		t.Fatalf("env window=%v", cfg.AggregationWindow)
+	}
+
+	resetServerFlagsArgs(t, []string{"server", "-aggregate-window", "0"})
+	cfg = NewServerConfig()
+	if cfg.AggregationWindow != 0 {
+		t.Fatalf("flag window=%v", cfg.AggregationWindow)
+	}
+}
+
+func TestServerConfig_Webhooks(t *testing.T) {
+	t.Cleanup(func() { clearServerEnv(t) })
+	clearServerEnv(t)
+	dir := t.TempDir()
+	p := writeServerJSON(t, dir, map[string]any{
+		"webhooks": []map[string]any{
+			{"url": "http://hooks.local/a", "pattern": "Heap*", "secret": "s3cret"},
+			{"url": "http://hooks.local/b"},
+		},
+		"webhook_dead_letter": "file.log",
+	})
+	_ = os.Setenv("CONFIG", p)
+	resetServerFlagsArgs(t, []string{"server"})
+
+	cfg := NewServerConfig()
+	want := []WebhookConfig{
+		{URL: "http://hooks.local/a", Pattern: "Heap*", Secret: "s3cret"},
+		{URL: "http://hooks.local/b"},
+	}
+	if !reflect.DeepEqual(cfg.Webhooks, want) {
+		t.Fatalf("webhooks=%+v", cfg.Webhooks)
+	}
+	if cfg.WebhookDeadLetter != "file.log" {
+		t.Fatalf("file dead letter=%q", cfg.WebhookDeadLetter)
+	}
+
+	_ = os.Setenv("WEBHOOK_DEAD_LETTER", "env.log")
+	resetServerFlagsArgs(t, []string{"server", "-webhook-dead-letter", "flag.log"})
+	cfg = NewServerConfig()
+	if cfg.WebhookDeadLetter != "flag.log" {
+		t.Fatalf("flag dead letter=%q", cfg.WebhookDeadLetter)
+	}
+}
+
+func TestServerConfig_Alerts(t *testing.T) {
+	t.Cleanup(func() { clearServerEnv(t) })
+	clearServerEnv(t)
+	dir := t.TempDir()
+	p := writeServerJSON(t, dir, map[string]any{
+		"alert_rules":    "file.yaml",
+		"alert_interval": "5s",
+	})
+	_ = os.Setenv("CONFIG", p)
+	resetServerFlagsArgs(t, []string{"server"})
+
+	cfg := NewServerConfig()
+	if cfg.AlertRules != "file.yaml" || cfg.AlertInterval != 5*time.Second {
+		t.Fatalf("file rules=%q interval=%v", cfg.AlertRules, cfg.AlertInterval)
+	}
+
+	_ = os.Setenv("ALERT_RULES", "env.yaml")
+	_ = os.Setenv("ALERT_INTERVAL", "1m")
+	resetServerFlagsArgs(t, []string{"server"})
+	cfg = NewServerConfig()
+	if cfg.AlertRules != "env.yaml" || cfg.AlertInterval != time.Minute {
+		t.Fatalf("env rules=%q interval=%v", cfg.AlertRules, cfg.AlertInterval)
+	}
+
+	resetServerFlagsArgs(t, []string{"server", "-alert-rules", "flag.json", "-alert-interval", "3"})
+	cfg = NewServerConfig()
+	if cfg.AlertRules != "flag.json" || cfg.AlertInterval != 3*time.Second {
+		t.Fatalf("flag rules=%q interval=%v", cfg.AlertRules, cfg.AlertInterval)
+	}
+}
+
+func TestServerConfig_AlertIntervalZero(t *testing.T) {
+	t.Cleanup(func() { clearServerEnv(t) })
+	clearServerEnv(t)
+	dir := t.TempDir()
+	p := writeServerJSON(t, dir, map[string]any{"alert_interval": "0s"})
+	_ = os.Setenv("CONFIG", p)
+	resetServerFlagsArgs(t, []string{"server"})
+
+	if cfg := NewServerConfig(); cfg.AlertInterval != 10*time.Second {
+		t.Fatalf("file: expected the default interval, got %v", cfg.AlertInterval)
+	}
+
+	_ = os.Setenv("ALERT_INTERVAL", "0")
+	resetServerFlagsArgs(t, []string{"server"})
+	if cfg := NewServerConfig(); cfg.AlertInterval != 10*time.Second {
+		t.Fatalf("env: expected the default interval, got %v", cfg.AlertInterval)
+	}
+
+	_ = os.Unsetenv("ALERT_INTERVAL")
+	resetServerFlagsArgs(t, []string{"server", "-alert-interval", "-5"})
+	if cfg := NewServerConfig(); cfg.AlertInterval != 10*time.Second {
+		t.Fatalf("flag: expected the default interval, got %v", cfg.AlertInterval)
+	}
+}
+
+func TestServerConfig_HistoryRetention(t *testing.T) {
+	t.Cleanup(func() { clearServerEnv(t) })
+	clearServerEnv(t)
+	resetServerFlagsArgs(t, []string{"server"})
+
+	cfg := NewServerConfig()
+	if cfg.HistoryRetention != 15*time.Minute {
+		t.Fatalf("default retention=%v", cfg.HistoryRetention)
+	}
+
+	dir := t.TempDir()
+	p := writeServerJSON(t, dir, map[string]any{
+		"history_retention": "1h",
+	})
+	_ = os.Setenv("CONFIG", p)
+	resetServerFlagsArgs(t, []string{"server"})
+	cfg = NewServerConfig()
+	if cfg.HistoryRetention != time.Hour {
+		t.Fatalf("file retention=%v", cfg.HistoryRetention)
+	}
+
+	_ = os.Setenv("HISTORY_RETENTION", "5m")
+	resetServerFlagsArgs(t, []string{"server"})
+	cfg = NewServerConfig()
+	if cfg.HistoryRetention != 5*time.Minute {
+		t.Fatalf("env retention=%v", cfg.HistoryRetention)
+	}
+
+	resetServerFlagsArgs(t, []string{"server", "-history-retention", "0"})
+	cfg = NewServerConfig()
+	if cfg.HistoryRetention != 0 {
+		t.Fatalf("flag retention=%v", cfg.HistoryRetention)
+	}
+}
+
+func TestServerConfig_BodyLimits(t *testing.T) {
+	t.Cleanup(func() { clearServerEnv(t) })
+	clearServerEnv(t)
+	resetServerFlagsArgs(t, []string{"server"})
+
+	cfg := NewServerConfig()
+	if cfg.MaxBodySize != 1<<20 || cfg.MaxDecompressedSize != 8<<20 || cfg.MaxBatchSize != 10000 {
+		t.Fatalf("default limits body=%d decompressed=%d batch=%d", cfg.MaxBodySize, cfg.MaxDecompressedSize, cfg.MaxBatchSize)
+	}
+
+	dir := t.TempDir()
+	p := writeServerJSON(t, dir, map[string]any{
+		"max_body_size":         1000,
+		"max_decompressed_size": 2000,
+		"max_batch_size":        10,
+	})
+	_ = os.Setenv("CONFIG", p)
+	resetServerFlagsArgs(t, []string{"server"})
+	cfg = NewServerConfig()
+	if cfg.MaxBodySize != 1000 || cfg.MaxDecompressedSize != 2000 || cfg.MaxBatchSize != 10 {
+		t.Fatalf("file limits body=%d decompressed=%d batch=%d", cfg.MaxBodySize, cfg.MaxDecompressedSize, cfg.MaxBatchSize)
+	}
+
+	_ = os.Setenv("MAX_BODY_SIZE", "3000")
+	_ = os.Setenv("MAX_BATCH_SIZE", "20")
+	resetServerFlagsArgs(t, []string{"server"})
+	cfg = NewServerConfig()
+	if cfg.MaxBodySize != 3000 || cfg.MaxBatchSize != 20 {
+		t.Fatalf("env limits body=%d batch=%d", cfg.MaxBodySize, cfg.MaxBatchSize)
+	}
+
+	resetServerFlagsArgs(t, []string{"server", "-max-body-size", "0", "-max-decompressed-size", "0", "-max-batch-size", "0"})
+	cfg = NewServerConfig()
+	if cfg.MaxBodySize != 0 || cfg.MaxDecompressedSize != 0 || cfg.MaxBatchSize != 0 {
+		t.Fatalf("flag limits body=%d decompressed=%d batch=%d", cfg.MaxBodySize, cfg.MaxDecompressedSize, cfg.MaxBatchSize)
+	}
+}
+
+func TestServerConfig_RateLimits(t *testing.T) {
+	t.Cleanup(func() { clearServerEnv(t) })
+	clearServerEnv(t)
+	resetServerFlagsArgs(t, []string{"server"})
+
+	cfg := NewServerConfig()
+	if cfg.IngestRateLimit != 0 || cfg.ReadRateLimit != 0 {
+		t.Fatalf("rate limits must be disabled by default, got ingest=%v read=%v", cfg.IngestRateLimit, cfg.ReadRateLimit)
+	}
+
+	dir := t.TempDir()
+	p := writeServerJSON(t, dir, map[string]any{
+		"ingest_rate_limit": 2.5,
+		"ingest_rate_burst": 5,
+		"read_rate_limit":   10,
+		"read_rate_burst":   20,
+	})
+	_ = os.Setenv("CONFIG", p)
+	resetServerFlagsArgs(t, []string{"server"})
+	cfg = NewServerConfig()
+	if cfg.IngestRateLimit != 2.5 || cfg.IngestRateBurst != 5 || cfg.ReadRateLimit != 10 || cfg.ReadRateBurst != 20 {
+		t.Fatalf("file limits ingest=%v/%d read=%v/%d", cfg.IngestRateLimit, cfg.IngestRateBurst, cfg.ReadRateLimit, cfg.ReadRateBurst)
+	}
+
+	_ = os.Setenv("INGEST_RATE_LIMIT", "1")
+	_ = os.Setenv("READ_RATE_BURST", "3")
+	resetServerFlagsArgs(t, []string{"server"})
+	cfg = NewServerConfig()
+	if cfg.IngestRateLimit != 1 || cfg.ReadRateBurst != 3 {
+		t.Fatalf("env limits ingest=%v read burst=%d", cfg.IngestRateLimit, cfg.ReadRateBurst)
+	}
+
+	resetServerFlagsArgs(t, []string{"server", "-ingest-rate-limit", "0.5", "-ingest-rate-burst", "1", "-read-rate-limit", "0"})
+	cfg = NewServerConfig()
+	if cfg.IngestRateLimit != 0.5 || cfg.IngestRateBurst != 1 || cfg.ReadRateLimit != 0 {
+		t.Fatalf("flag limits ingest=%v/%d read=%v", cfg.IngestRateLimit, cfg.IngestRateBurst, cfg.ReadRateLimit)
+	}
+}
+
+func TestServerConfig_SeriesLimits(t *testing.T) {
+	t.Cleanup(func() { clearServerEnv(t) })
+	clearServerEnv(t)
+	resetServerFlagsArgs(t, []string{"server"})
+
+	cfg := NewServerConfig()
+	if cfg.MetricNamePattern != "" || cfg.MaxMetricNameLength != 255 || cfg.MaxSeries != 0 || cfg.MaxNewSeriesPerMinute != 0 {
+		t.Fatalf("default policy pattern=%q length=%d series=%d new=%d",
+			cfg.MetricNamePattern, cfg.MaxMetricNameLength, cfg.MaxSeries, cfg.MaxNewSeriesPerMinute)
+	}
+
+	dir := t.TempDir()
+	p := writeServerJSON(t, dir, map[string]any{
+		"metric_name_pattern":       "^[a-z]+$",
+		"max_metric_name_length":    64,
+		"max_series":                1000,
+		"max_new_series_per_minute": 50,
+	})
+	_ = os.Setenv("CONFIG", p)
+	resetServerFlagsArgs(t, []string{"server"})
+	cfg = NewServerConfig()
+	if cfg.MetricNamePattern != "^[a-z]+$" || cfg.MaxMetricNameLength != 64 || cfg.MaxSeries != 1000 || cfg.MaxNewSeriesPerMinute != 50 {
+		t.Fatalf("file policy pattern=%q length=%d series=%d new=%d",
+			cfg.MetricNamePattern, cfg.MaxMetricNameLength, cfg.MaxSeries, cfg.MaxNewSeriesPerMinute)
+	}
+
+	_ = os.Setenv("MAX_SERIES", "2000")
+	_ = os.Setenv("METRIC_NAME_PATTERN", "^[A-Z]+$")
+	resetServerFlagsArgs(t, []string{"server"})
+	cfg = NewServerConfig()
+	if cfg.MaxSeries != 2000 || cfg.MetricNamePattern != "^[A-Z]+$" {
+		t.Fatalf("env policy series=%d pattern=%q", cfg.MaxSeries, cfg.MetricNamePattern)
+	}
+
+	resetServerFlagsArgs(t, []string{"server", "-max-series", "0", "-max-new-series-per-minute", "5", "-max-metric-name-length", "32"})
+	cfg = NewServerConfig()
+	if cfg.MaxSeries != 0 || cfg.MaxNewSeriesPerMinute != 5 || cfg.MaxMetricNameLength != 32 {
+		t.Fatalf("flag policy series=%d new=%d length=%d", cfg.MaxSeries, cfg.MaxNewSeriesPerMinute, cfg.MaxMetricNameLength)
+	}
+}
+
+func TestServerConfig_Auth(t *testing.T) {
+	t.Cleanup(func() { clearServerEnv(t) })
+	clearServerEnv(t)
+	resetServerFlagsArgs(t, []string{"server"})
+
+	cfg := NewServerConfig()
+	if cfg.AuthTokens != "" || cfg.AnonymousRead {
+		t.Fatalf("authentication must be disabled by default, got tokens=%q anonymous=%v", cfg.AuthTokens, cfg.AnonymousRead)
+	}
+
+	dir := t.TempDir()
+	p := writeServerJSON(t, dir, map[string]any{
+		"auth_tokens_file": "/file/tokens.yaml",
+		"anonymous_read":   true,
+	})
+	_ = os.Setenv("CONFIG", p)
+	resetServerFlagsArgs(t, []string{"server"})
+	cfg = NewServerConfig()
+	if cfg.AuthTokens != "/file/tokens.yaml" || !cfg.AnonymousRead {
+		t.Fatalf("file tokens=%q anonymous=%v", cfg.AuthTokens, cfg.AnonymousRead)
+	}
+
+	_ = os.Setenv("AUTH_TOKENS_FILE", "/env/tokens.json")
+	_ = os.Setenv("ANONYMOUS_READ", "false")
+	resetServerFlagsArgs(t, []string{"server"})
+	cfg = NewServerConfig()
+	if cfg.AuthTokens != "/env/tokens.json" || cfg.AnonymousRead {
+		t.Fatalf("env tokens=%q anonymous=%v", cfg.AuthTokens, cfg.AnonymousRead)
+	}
+
+	resetServerFlagsArgs(t, []string{"server", "-auth-tokens", "/flag/tokens.yaml", "-anonymous-read"})
+	cfg = NewServerConfig()
+	if cfg.AuthTokens != "/flag/tokens.yaml" || !cfg.AnonymousRead {
+		t.Fatalf("flag tokens=%q anonymous=%v", cfg.AuthTokens, cfg.AnonymousRead)
+	}
+}
@@ -8,10 +8,14 @@ import (
 	"fmt"
 	"github.com/go-resty/resty/v2"
 	"github.com/zubans/metrics/internal/cryptoutil"
+	"github.com/zubans/metrics/internal/identity"
 	"github.com/zubans/metrics/internal/models"
 	"github.com/zubans/metrics/internal/services"
+	"github.com/zubans/metrics/internal/version"
 	"io"
 	"log"
+	"net/http"
+	"strconv"
 	"time"
 )
 
@@ -92,6 +96,12 @@ func (mc *MetricsController) JSONSendMetrics() {
 		SetRetryWaitTime(1*time.Second).
 		SetRetryMaxWaitTime(5*time.Second).
 		SetRetryAfter(func(c *resty.Client, r *resty.Response) (time.Duration, error) {
+			if wait, ok := retryAfter(r); ok {
+				if wait > c.RetryMaxWaitTime {
+					return 0, fmt.Errorf("server asked to retry after %s", wait)
+				}
+				return wait, nil
+			}
 			attempt := r.Request.Attempt - 1
 			if attempt >= len(retryDelays) {
 				attempt = len(retryDelays) - 1
@@ -99,7 +109,9 @@ func (mc *MetricsController) JSONSendMetrics() {
 			return retryDelays[attempt], nil
 		}).
 		R().
+		AddRetryCondition(retryThrottled).
 		SetHeader("Content-Type", "application/json")
+	request = mc.setIdentity(request)
 
 	if mc.publicKey == nil {
 		request = request.SetHeader("Content-Encoding", "gzip")
@@ -124,6 +136,45 @@ func (mc *MetricsController) JSONSendMetrics() {
 	}
 }
 
+// retryThrottled retries requests the server turned away because of load,
+// besides the transport errors resty retries by default.
+func retryThrottled(r *resty.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return r.StatusCode() == http.StatusTooManyRequests || r.StatusCode() == http.StatusServiceUnavailable
+}
+
+// retryAfter returns the delay requested by the Retry-After header, given
+// in seconds or as an HTTP date.
+func retryAfter(r *resty.Response) (time.Duration, bool) {
+	header := r.Header().Get("Retry-After")
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(header); err == nil {
+		return max(time.Until(at), 0), true
+	}
+	return 0, false
+}
+
+// setIdentity adds the agent ID and build version headers so the server can
+// tell agents apart, and the bearer token when one is configured.
+func (mc *MetricsController) setIdentity(r *resty.Request) *resty.Request {
+	if cfg := mc.metricsService.Cfg; cfg != nil {
+		if cfg.AgentID != "" {
+			r = r.SetHeader(identity.AgentIDHeader, cfg.AgentID)
+		}
+		if cfg.AuthToken != "" {
+			r = r.SetAuthToken(cfg.AuthToken)
+		}
+	}
+	return r.SetHeader(identity.AgentVersionHeader, version.Version())
+}
+
 func (mc *MetricsController) prepareRequestBody(data []byte) (interface{}, map[string]string, error) {
 	extraHeaders := map[string]string{}
 	if mc.publicKey != nil {
@@ -180,8 +231,8 @@ func (mc *MetricsController) OldJSONSendMetrics() {
 			reqBody = buf.Bytes()
 		}
 
-		restyReq := mc.httpClient.R().
-			SetHeader("Content-Type", "application/json")
+		restyReq := mc.setIdentity(mc.httpClient.R().
+			SetHeader("Content-Type", "application/json"))
 		if mc.publicKey == nil {
 			restyReq = restyReq.SetHeader("Content-Encoding", "gzip")
 		}
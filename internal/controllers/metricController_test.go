@@ -12,12 +12,15 @@ import (
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/zubans/metrics/internal/config"
+	"github.com/zubans/metrics/internal/identity"
 	"github.com/zubans/metrics/internal/models"
 	"github.com/zubans/metrics/internal/services"
+	"github.com/zubans/metrics/internal/version"
 )
 
 type roundTripFunc func(*http.Request) (*http.Response, error)
@@ -31,11 +34,16 @@ func TestMetricsController_JSONSendMetrics(t *testing.T) {
 		AddressServer: "localhost:8080",
 		PollInterval:  2,
 		SendInterval:  10,
+		AgentID:       "host-1",
+		AuthToken:     "agent-secret-token",
 	}
 
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
 		assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+		assert.Equal(t, "host-1", r.Header.Get(identity.AgentIDHeader))
+		assert.Equal(t, "Bearer agent-secret-token", r.Header.Get("Authorization"))
+		assert.Equal(t, version.Version(), r.Header.Get(identity.AgentVersionHeader))
 
 		gz, err := gzip.NewReader(r.Body)
 		require.NoError(t, err)
@@ -133,3 +141,51 @@ func TestErrorScenarios(t *testing.T) {
 		assert.Contains(t, logBuffer.String(), "Error sending metric")
 	})
 }
+
+func TestMetricsController_HonorsRetryAfter(t *testing.T) {
+	tests := []struct {
+		name       string
+		retryAfter string
+		attempts   int
+		logged     string
+	}{
+		{name: "retries after the requested delay", retryAfter: "1", attempts: 2, logged: "Successfully sent metric"},
+		{name: "gives up on a long delay", retryAfter: "60", attempts: 1, logged: "server asked to retry after 1m0s"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				attempts int
+				times    []time.Time
+			)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempts++
+				times = append(times, time.Now())
+				if attempts == 1 {
+					w.Header().Set("Retry-After", tt.retryAfter)
+					w.WriteHeader(http.StatusTooManyRequests)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer server.Close()
+
+			service := services.NewMetricsService(&config.AgentConfig{AddressServer: server.URL[7:]})
+			controller := &MetricsController{metricsService: service, httpClient: resty.New()}
+			controller.UpdateMetrics()
+
+			logBuffer := bytes.NewBuffer(nil)
+			log.SetOutput(logBuffer)
+			defer log.SetOutput(os.Stderr)
+
+			controller.JSONSendMetrics()
+
+			require.Equal(t, tt.attempts, attempts)
+			assert.Contains(t, logBuffer.String(), tt.logged)
+			if len(times) == 2 {
+				assert.GreaterOrEqual(t, times[1].Sub(times[0]), time.Second, "retry must wait for Retry-After")
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+// Package errdefs defines the errors the server reports to clients and
+// renders them as RFC 7807 problem details.
+package errdefs
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+// Code is a stable, machine-readable error code. Clients may rely on codes;
+// messages are meant for humans and may change.
+type Code string
+
+const (
+	CodeInvalidRequest     Code = "invalid_request"
+	CodeValidationFailed   Code = "validation_failed"
+	CodeInvalidMetricType  Code = "invalid_metric_type"
+	CodeMetricNameRequired Code = "metric_name_required"
+	CodeMetricNotFound     Code = "metric_not_found"
+	CodeInvalidQuery       Code = "invalid_query"
+	CodeNotFound           Code = "not_found"
+	CodeMethodNotAllowed   Code = "method_not_allowed"
+	CodeNotAcceptable      Code = "not_acceptable"
+	CodeUnauthorized       Code = "unauthorized"
+	CodeForbidden          Code = "forbidden"
+	CodeBodyTooLarge       Code = "body_too_large"
+	CodeBatchTooLarge      Code = "batch_too_large"
+	CodeRateLimited        Code = "rate_limited"
+	CodeSeriesLimit        Code = "series_limit_exceeded"
+	CodeSeriesRateLimited  Code = "series_rate_limited"
+	CodeFeatureDisabled    Code = "feature_disabled"
+	CodeStorageFailure     Code = "storage_failure"
+	CodeInternal           Code = "internal_error"
+)
+
+// FieldError describes an invalid field of a request. Field is a path into
+// the request body such as "value" or "[2].type".
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Error is an error reported to the client with an HTTP status and a code.
+// Err is the underlying cause; it is logged but never sent to the client.
+type Error struct {
+	Status  int
+	Code    Code
+	Message string
+	Fields  []FieldError
+	Err     error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func New(status int, code Code, message string) *Error {
+	return &Error{Status: status, Code: code, Message: message}
+}
+
+func NewBadRequestError(code Code, message string) *Error {
+	return New(http.StatusBadRequest, code, message)
+}
+
+func NewNotFoundError(code Code, message string) *Error {
+	return New(http.StatusNotFound, code, message)
+}
+
+// NewValidationError reports the invalid fields of a request.
+func NewValidationError(message string, fields ...FieldError) *Error {
+	e := New(http.StatusBadRequest, CodeValidationFailed, message)
+	e.Fields = fields
+	return e
+}
+
+// NewTooLargeError reports a request over a size limit.
+func NewTooLargeError(code Code, message string) *Error {
+	return New(http.StatusRequestEntityTooLarge, code, message)
+}
+
+// NewInternalError hides err from the client behind a generic message.
+func NewInternalError(code Code, message string, err error) *Error {
+	e := New(http.StatusInternalServerError, code, message)
+	e.Err = err
+	return e
+}
+
+// As returns err as an *Error. A body read past http.MaxBytesReader becomes
+// a 413, errors of other types become internal errors.
+func As(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return TooLarge(tooLarge)
+	}
+	return NewInternalError(CodeInternal, "internal error", err)
+}
+
+// TooLarge reports a request body over the limit of err.
+func TooLarge(err *http.MaxBytesError) *Error {
+	e := NewTooLargeError(CodeBodyTooLarge, fmt.Sprintf("request body exceeds %d bytes", err.Limit))
+	e.Err = err
+	return e
+}
+
+func IsConnectionRefused(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return errors.Is(opErr.Err, syscall.ECONNREFUSED)
+	}
+	return false
+}
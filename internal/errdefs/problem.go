@@ -0,0 +1,61 @@
+package errdefs
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/zubans/metrics/internal/logger"
+	"go.uber.org/zap"
+)
+
+// ProblemContentType is the media type of problem details responses.
+const ProblemContentType = "application/problem+json"
+
+// Problem is an RFC 7807 problem details object extended with the error
+// code, invalid fields and the request ID.
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	Code      Code         `json:"code"`
+	Errors    []FieldError `json:"errors,omitempty"`
+	RequestID string       `json:"request_id,omitempty"`
+}
+
+// NewProblem describes err for the client. Errors other than *Error are
+// reported as internal errors without details.
+func NewProblem(r *http.Request, err error) Problem {
+	e := As(err)
+	return Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(e.Status),
+		Status:    e.Status,
+		Detail:    e.Message,
+		Instance:  r.URL.Path,
+		Code:      e.Code,
+		Errors:    e.Fields,
+		RequestID: middleware.GetReqID(r.Context()),
+	}
+}
+
+// WriteProblem writes err as problem details and logs it.
+func WriteProblem(w http.ResponseWriter, r *http.Request, err error) {
+	p := NewProblem(r, err)
+
+	logger.Log.Info("request failed",
+		zap.String("code", string(p.Code)),
+		zap.Int("status_code", p.Status),
+		zap.String("request_id", p.RequestID),
+		zap.Error(err),
+	)
+
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		logger.Log.Info("failed to encode problem details", zap.Error(err))
+	}
+}
@@ -0,0 +1,237 @@
+// Package guard enforces metric name and cardinality policies.
+//
+// Every metric a client writes is a series identified by its type and name.
+// The Guard tracks the known series and decides whether a write may create
+// new ones: their names must be valid, the total number of series is capped
+// and every client may only create so many series per minute. Updates of
+// known series are always admitted, so tightening the policy never locks
+// out metrics that are already stored.
+package guard
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Policy limits the series clients may create. Zero values disable a limit.
+type Policy struct {
+	// NamePattern must match the names of new series.
+	NamePattern *regexp.Regexp
+	// MaxNameLength limits the names of new series, in bytes.
+	MaxNameLength int
+	// MaxSeries limits the number of known series.
+	MaxSeries int
+	// MaxNewSeriesPerMinute limits the series one client creates per
+	// minute.
+	MaxNewSeriesPerMinute int
+}
+
+// Reason tells which part of the policy a write broke.
+type Reason string
+
+const (
+	InvalidName Reason = "invalid_name"
+	SeriesLimit Reason = "series_limit"
+	SeriesRate  Reason = "series_rate"
+)
+
+// Reasons lists every Reason in a stable order.
+var Reasons = []Reason{InvalidName, SeriesLimit, SeriesRate}
+
+// Series identifies a metric.
+type Series struct {
+	Type string
+	Name string
+}
+
+// Violation points at a series of a rejected write by its index.
+type Violation struct {
+	Index   int
+	Message string
+}
+
+// Rejection is the error returned for a write that breaks the policy.
+type Rejection struct {
+	Reason     Reason
+	Message    string
+	Violations []Violation
+}
+
+func (r *Rejection) Error() string {
+	return r.Message
+}
+
+// Stats is a snapshot of the guard's counters.
+type Stats struct {
+	// Series is the number of known series.
+	Series int
+	// Rejected counts the series updates in rejected writes by reason.
+	Rejected map[Reason]int64
+}
+
+type window struct {
+	start   time.Time
+	created int
+}
+
+// Guard admits writes according to a Policy. It is safe for concurrent use.
+//
+// The series count covers series seeded at startup and those written
+// through this Guard since; series created by other servers sharing the
+// storage are not seen.
+type Guard struct {
+	policy Policy
+	now    func() time.Time
+
+	mu        sync.Mutex
+	series    map[Series]struct{}
+	clients   map[string]*window
+	lastPrune time.Time
+	rejected  map[Reason]int64
+}
+
+// New creates a Guard enforcing p with no known series.
+func New(p Policy) *Guard {
+	return &Guard{
+		policy:   p,
+		now:      time.Now,
+		series:   make(map[Series]struct{}),
+		clients:  make(map[string]*window),
+		rejected: make(map[Reason]int64),
+	}
+}
+
+// Seed records series that are already stored. They count towards
+// MaxSeries but not towards any client's rate.
+func (g *Guard) Seed(series ...Series) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, s := range series {
+		g.series[s] = struct{}{}
+	}
+}
+
+// Forget drops a deleted series, freeing its slot.
+func (g *Guard) Forget(s Series) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.series, s)
+}
+
+// Admit checks a write of series by the client with the given key, see
+// package identity. Either the whole write is
+// admitted and its new series become known, or a *Rejection is returned
+// and nothing changes. A slot stays taken if the write then fails in the
+// storage.
+func (g *Guard) Admit(client string, series []Series) error {
+	now := g.now()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var (
+		fresh   []int
+		seen    = make(map[Series]struct{})
+		invalid []Violation
+	)
+	for i, s := range series {
+		if _, ok := g.series[s]; ok {
+			continue
+		}
+		if _, ok := seen[s]; ok {
+			continue
+		}
+		seen[s] = struct{}{}
+		fresh = append(fresh, i)
+
+		if msg := g.checkName(s.Name); msg != "" {
+			invalid = append(invalid, Violation{Index: i, Message: msg})
+		}
+	}
+
+	if len(fresh) == 0 {
+		return nil
+	}
+	if len(invalid) > 0 {
+		return g.reject(InvalidName, "invalid metric name", len(series), invalid)
+	}
+
+	if limit := g.policy.MaxSeries; limit > 0 && len(g.series)+len(fresh) > limit {
+		return g.reject(SeriesLimit, fmt.Sprintf("series limit of %d reached", limit),
+			len(series), violations(fresh, "would create a new series"))
+	}
+
+	if limit := g.policy.MaxNewSeriesPerMinute; limit > 0 {
+		g.prune(now)
+
+		w, ok := g.clients[client]
+		if !ok || now.Sub(w.start) >= time.Minute {
+			w = &window{start: now}
+			g.clients[client] = w
+		}
+		if w.created+len(fresh) > limit {
+			return g.reject(SeriesRate, fmt.Sprintf("client may create at most %d new series per minute", limit),
+				len(series), violations(fresh, "would create a new series"))
+		}
+		w.created += len(fresh)
+	}
+
+	for _, i := range fresh {
+		g.series[series[i]] = struct{}{}
+	}
+	return nil
+}
+
+// Stats returns the number of known series and the rejection counters.
+func (g *Guard) Stats() Stats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	rejected := make(map[Reason]int64, len(Reasons))
+	for _, r := range Reasons {
+		rejected[r] = g.rejected[r]
+	}
+	return Stats{Series: len(g.series), Rejected: rejected}
+}
+
+func (g *Guard) checkName(name string) string {
+	if limit := g.policy.MaxNameLength; limit > 0 && len(name) > limit {
+		return fmt.Sprintf("must be at most %d bytes long", limit)
+	}
+	if p := g.policy.NamePattern; p != nil && !p.MatchString(name) {
+		return "must match " + p.String()
+	}
+	return ""
+}
+
+func (g *Guard) reject(reason Reason, msg string, writes int, v []Violation) *Rejection {
+	g.rejected[reason] += int64(writes)
+	return &Rejection{Reason: reason, Message: msg, Violations: v}
+}
+
+// prune drops, at most once a minute, clients whose window has ended, so
+// the map only holds clients active in the last minute.
+func (g *Guard) prune(now time.Time) {
+	if now.Sub(g.lastPrune) < time.Minute {
+		return
+	}
+	g.lastPrune = now
+
+	for key, w := range g.clients {
+		if now.Sub(w.start) >= time.Minute {
+			delete(g.clients, key)
+		}
+	}
+}
+
+func violations(indexes []int, msg string) []Violation {
+	v := make([]Violation, len(indexes))
+	for i, idx := range indexes {
+		v[i] = Violation{Index: idx, Message: msg}
+	}
+	return v
+}
@@ -0,0 +1,80 @@
+package guard
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gauges(names ...string) []Series {
+	s := make([]Series, len(names))
+	for i, n := range names {
+		s[i] = Series{Type: "gauge", Name: n}
+	}
+	return s
+}
+
+func reason(t *testing.T, err error) Reason {
+	t.Helper()
+	var rej *Rejection
+	require.ErrorAs(t, err, &rej)
+	return rej.Reason
+}
+
+func TestGuard_Names(t *testing.T) {
+	g := New(Policy{NamePattern: regexp.MustCompile(`^[A-Za-z_]+$`), MaxNameLength: 8})
+	g.Seed(Series{Type: "gauge", Name: "legacy-name"})
+
+	require.NoError(t, g.Admit("a", gauges("Alloc", "Heap_Sys")))
+	require.NoError(t, g.Admit("a", gauges("legacy-name")), "known series are always admitted")
+
+	err := g.Admit("a", gauges("Alloc", "bad name", "TooLongName"))
+	assert.Equal(t, InvalidName, reason(t, err))
+	var rej *Rejection
+	require.ErrorAs(t, err, &rej)
+	assert.Equal(t, []Violation{
+		{Index: 1, Message: "must match ^[A-Za-z_]+$"},
+		{Index: 2, Message: "must be at most 8 bytes long"},
+	}, rej.Violations)
+
+	stats := g.Stats()
+	assert.Equal(t, 3, stats.Series)
+	assert.Equal(t, int64(3), stats.Rejected[InvalidName])
+	assert.Equal(t, int64(0), stats.Rejected[SeriesLimit])
+}
+
+func TestGuard_SeriesLimit(t *testing.T) {
+	g := New(Policy{MaxSeries: 3})
+	g.Seed(Series{Type: "counter", Name: "PollCount"})
+
+	require.NoError(t, g.Admit("a", gauges("Alloc", "Alloc")), "duplicates count once")
+	assert.Equal(t, SeriesLimit, reason(t, g.Admit("a", gauges("HeapSys", "HeapIdle"))))
+	assert.Equal(t, 2, g.Stats().Series, "a rejected write creates nothing")
+
+	require.NoError(t, g.Admit("a", gauges("HeapSys")))
+	assert.Equal(t, SeriesLimit, reason(t, g.Admit("b", gauges("HeapIdle"))))
+	require.NoError(t, g.Admit("b", gauges("Alloc", "HeapSys")))
+
+	g.Forget(Series{Type: "gauge", Name: "Alloc"})
+	require.NoError(t, g.Admit("b", gauges("HeapIdle")))
+	assert.Equal(t, int64(3), g.Stats().Rejected[SeriesLimit])
+}
+
+func TestGuard_SeriesRate(t *testing.T) {
+	now := time.Unix(0, 0)
+	g := New(Policy{MaxNewSeriesPerMinute: 2})
+	g.now = func() time.Time { return now }
+
+	require.NoError(t, g.Admit("a", gauges("A", "B")))
+	assert.Equal(t, SeriesRate, reason(t, g.Admit("a", gauges("C"))))
+	require.NoError(t, g.Admit("a", gauges("A", "B")), "updates do not use the budget")
+	require.NoError(t, g.Admit("b", gauges("C", "D")), "clients have separate budgets")
+	assert.Equal(t, SeriesRate, reason(t, g.Admit("", gauges("E", "F", "G"))))
+
+	now = now.Add(time.Minute)
+	require.NoError(t, g.Admit("a", gauges("E", "F")))
+	assert.Equal(t, int64(4), g.Stats().Rejected[SeriesRate])
+}
@@ -0,0 +1,144 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/zubans/metrics/internal/errdefs"
+	"github.com/zubans/metrics/internal/logger"
+	"github.com/zubans/metrics/internal/models"
+	"github.com/zubans/metrics/internal/services"
+	"go.uber.org/zap"
+)
+
+// The /api/v1/metrics resource API. Metrics are addressed as
+// /api/v1/metrics/{type}/{name}; the legacy routes are kept as adapters over
+// the same service.
+
+// v1Offers are the representations of metrics in the v1 API, JSON first.
+var v1Offers = []string{mediaJSON, mediaCSV, mediaText, mediaPrometheus}
+
+// ListMetricsV1 serves GET /api/v1/metrics. The name and type query
+// parameters filter the list as on the dashboard.
+func (h *Handler) ListMetricsV1(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "Accept")
+	mediaType, ok := negotiate(r, v1Offers...)
+	if !ok {
+		notAcceptable(w, r, v1Offers...)
+		return
+	}
+
+	metrics, err := h.service.ListMetrics(r.Context())
+	if err != nil {
+		errdefs.WriteProblem(w, r, err)
+		return
+	}
+
+	selected := parseDashboardQuery(r.URL.Query()).apply(metrics)
+	if err := writeMetrics(w, mediaType, selected, false); err != nil {
+		logger.Log.Info("failed to write metrics", zap.Error(err))
+	}
+}
+
+// SelfMetricsV1 serves GET /api/v1/self/metrics, the metrics about the
+// server itself, in the same formats as the metrics list.
+func (h *Handler) SelfMetricsV1(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "Accept")
+	mediaType, ok := negotiate(r, v1Offers...)
+	if !ok {
+		notAcceptable(w, r, v1Offers...)
+		return
+	}
+
+	if err := writeMetrics(w, mediaType, h.service.SelfMetrics(r.Context()), false); err != nil {
+		logger.Log.Info("failed to write self-metrics", zap.Error(err))
+	}
+}
+
+// GetMetricV1 serves GET /api/v1/metrics/{type}/{name}.
+func (h *Handler) GetMetricV1(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "Accept")
+	mediaType, ok := negotiate(r, v1Offers...)
+	if !ok {
+		notAcceptable(w, r, v1Offers...)
+		return
+	}
+
+	mData, err := services.NewMetricData(chi.URLParam(r, "type"), chi.URLParam(r, "name"))
+	if err != nil {
+		errdefs.WriteProblem(w, r, err)
+		return
+	}
+
+	m, err := h.service.Metric(r.Context(), mData)
+	if err != nil {
+		errdefs.WriteProblem(w, r, err)
+		return
+	}
+
+	if err := writeMetrics(w, mediaType, []models.MetricsDTO{*m}, true); err != nil {
+		logger.Log.Info("failed to write metric", zap.Error(err))
+	}
+}
+
+// PutMetricV1 serves PUT /api/v1/metrics/{type}/{name}. The body carries the
+// value of a gauge or the delta of a counter; id and type may be omitted but
+// must match the URL when present. Like every update, a counter delta is
+// added to the stored value.
+func (h *Handler) PutMetricV1(w http.ResponseWriter, r *http.Request) {
+	var m models.MetricsDTO
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		errdefs.WriteProblem(w, r, invalidJSON(err))
+		return
+	}
+
+	mType, name := chi.URLParam(r, "type"), chi.URLParam(r, "name")
+
+	var fields []errdefs.FieldError
+	if m.ID != "" && m.ID != name {
+		fields = append(fields, errdefs.FieldError{Field: "id", Message: "must match the metric name in the URL"})
+	}
+	if m.MType != "" && m.MType != mType {
+		fields = append(fields, errdefs.FieldError{Field: "type", Message: "must match the metric type in the URL"})
+	}
+	if len(fields) > 0 {
+		errdefs.WriteProblem(w, r, errdefs.NewValidationError("invalid metric", fields...))
+		return
+	}
+
+	m.ID, m.MType = name, mType
+	h.updateMetricDTO(w, r, m)
+}
+
+// UpdateMetricsV1 serves POST /api/v1/metrics, a batch update.
+func (h *Handler) UpdateMetricsV1(w http.ResponseWriter, r *http.Request) {
+	m, err := h.decodeBatch(r.Body)
+	if err != nil {
+		errdefs.WriteProblem(w, r, err)
+		return
+	}
+
+	if err := h.service.UpdateMetrics(r.Context(), m); err != nil {
+		errdefs.WriteProblem(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteMetricV1 serves DELETE /api/v1/metrics/{type}/{name}.
+func (h *Handler) DeleteMetricV1(w http.ResponseWriter, r *http.Request) {
+	mData, err := services.NewMetricData(chi.URLParam(r, "type"), chi.URLParam(r, "name"))
+	if err != nil {
+		errdefs.WriteProblem(w, r, err)
+		return
+	}
+
+	if err := h.service.DeleteMetric(r.Context(), mData); err != nil {
+		errdefs.WriteProblem(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
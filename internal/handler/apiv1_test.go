@@ -0,0 +1,182 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zubans/metrics/internal/guard"
+	"github.com/zubans/metrics/internal/services"
+	"github.com/zubans/metrics/internal/storage"
+)
+
+func TestHandler_MetricsV1(t *testing.T) {
+	h := NewHandler(services.NewMetricService(storage.NewMemStorage()))
+
+	r := chi.NewRouter()
+	r.Get("/api/v1/metrics", h.ListMetricsV1)
+	r.Post("/api/v1/metrics", h.UpdateMetricsV1)
+	r.Get("/api/v1/metrics/{type}/{name}", h.GetMetricV1)
+	r.Put("/api/v1/metrics/{type}/{name}", h.PutMetricV1)
+	r.Delete("/api/v1/metrics/{type}/{name}", h.DeleteMetricV1)
+
+	// Steps run in order against the same storage.
+	steps := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		code   int
+		want   string
+	}{
+		{
+			name:   "batch update",
+			method: http.MethodPost,
+			target: "/api/v1/metrics",
+			body:   `[{"id":"Alloc","type":"gauge","value":1.5},{"id":"PollCount","type":"counter","delta":2}]`,
+			code:   http.StatusNoContent,
+		},
+		{
+			name:   "put adds counter delta",
+			method: http.MethodPut,
+			target: "/api/v1/metrics/counter/PollCount",
+			body:   `{"delta":3}`,
+			code:   http.StatusOK,
+			want:   `{"id":"PollCount","type":"counter","delta":5}` + "\n",
+		},
+		{
+			name:   "put with mismatching id",
+			method: http.MethodPut,
+			target: "/api/v1/metrics/gauge/Alloc",
+			body:   `{"id":"Other","value":1}`,
+			code:   http.StatusBadRequest,
+		},
+		{
+			name:   "put without value",
+			method: http.MethodPut,
+			target: "/api/v1/metrics/gauge/Alloc",
+			body:   `{"delta":1}`,
+			code:   http.StatusBadRequest,
+		},
+		{
+			name:   "get one",
+			method: http.MethodGet,
+			target: "/api/v1/metrics/gauge/Alloc",
+			code:   http.StatusOK,
+			want:   `{"id":"Alloc","type":"gauge","value":1.5}` + "\n",
+		},
+		{
+			name:   "list filtered",
+			method: http.MethodGet,
+			target: "/api/v1/metrics?type=counter",
+			code:   http.StatusOK,
+			want:   `[{"id":"PollCount","type":"counter","delta":5}]` + "\n",
+		},
+		{
+			name:   "delete",
+			method: http.MethodDelete,
+			target: "/api/v1/metrics/gauge/Alloc",
+			code:   http.StatusNoContent,
+		},
+		{
+			name:   "get deleted",
+			method: http.MethodGet,
+			target: "/api/v1/metrics/gauge/Alloc",
+			code:   http.StatusNotFound,
+		},
+		{
+			name:   "delete missing",
+			method: http.MethodDelete,
+			target: "/api/v1/metrics/gauge/Alloc",
+			code:   http.StatusNotFound,
+		},
+		{
+			name:   "delete unknown type",
+			method: http.MethodDelete,
+			target: "/api/v1/metrics/histogram/Alloc",
+			code:   http.StatusBadRequest,
+		},
+		{
+			name:   "list after delete",
+			method: http.MethodGet,
+			target: "/api/v1/metrics",
+			code:   http.StatusOK,
+			want:   `[{"id":"PollCount","type":"counter","delta":5}]` + "\n",
+		},
+	}
+
+	for _, tt := range steps {
+		req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+
+		require.Equal(t, tt.code, rr.Code, "%s: %s", tt.name, rr.Body.String())
+		if tt.want != "" {
+			assert.Equal(t, tt.want, rr.Body.String(), tt.name)
+		}
+	}
+}
+
+func TestHandler_MaxBatchSize(t *testing.T) {
+	h := NewHandler(services.NewMetricService(storage.NewMemStorage()), WithMaxBatchSize(2))
+
+	r := chi.NewRouter()
+	r.Post("/updates/", h.UpdateMetrics)
+	r.Post("/api/v1/metrics", h.UpdateMetricsV1)
+
+	tests := []struct {
+		target string
+		body   string
+		code   int
+	}{
+		{target: "/updates/", body: `[{"id":"a","type":"gauge","value":1},{"id":"b","type":"gauge","value":2}]`, code: http.StatusOK},
+		{target: "/updates/", body: `[{"id":"a","type":"gauge","value":1},{"id":"b","type":"gauge","value":2},{"id":"c","type":"gauge","value":3}]`, code: http.StatusRequestEntityTooLarge},
+		// The cap is hit before the broken tail is read.
+		{target: "/api/v1/metrics", body: `[{"id":"a","type":"gauge","value":1},{"id":"b","type":"gauge","value":2},{"id":`, code: http.StatusRequestEntityTooLarge},
+		{target: "/api/v1/metrics", body: `{"id":"a","type":"gauge","value":1}`, code: http.StatusBadRequest},
+		{target: "/api/v1/metrics", body: `[]`, code: http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader(tt.body)))
+
+		require.Equal(t, tt.code, rr.Code, "%s %s: %s", tt.target, tt.body, rr.Body.String())
+		if tt.code == http.StatusRequestEntityTooLarge {
+			assert.Contains(t, rr.Body.String(), `"code":"batch_too_large"`)
+		}
+	}
+}
+
+func TestHandler_SelfMetricsV1(t *testing.T) {
+	g := guard.New(guard.Policy{MaxSeries: 1})
+	h := NewHandler(services.NewMetricService(storage.NewMemStorage(), services.WithGuard(g)))
+
+	r := chi.NewRouter()
+	r.Post("/api/v1/metrics", h.UpdateMetricsV1)
+	r.Get("/api/v1/self/metrics", h.SelfMetricsV1)
+
+	send := func(method, target, body, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Accept", accept)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := send(http.MethodPost, "/api/v1/metrics", `[{"id":"Alloc","type":"gauge","value":1},{"id":"HeapSys","type":"gauge","value":2}]`, "")
+	require.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"code":"series_limit_exceeded"`)
+
+	rr = send(http.MethodGet, "/api/v1/self/metrics", "", "text/plain")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "gauge server_series 0\n"+
+		"counter server_rejected_writes_total 2\n"+
+		"counter server_rejected_writes_invalid_name_total 0\n"+
+		"counter server_rejected_writes_series_limit_total 2\n"+
+		"counter server_rejected_writes_series_rate_total 0\n", rr.Body.String())
+}
@@ -0,0 +1,232 @@
+package handler
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/zubans/metrics/internal/errdefs"
+	"github.com/zubans/metrics/internal/logger"
+	"github.com/zubans/metrics/internal/models"
+	"go.uber.org/zap"
+)
+
+// defaultDashboardRefresh is how often the dashboard reloads itself, in
+// seconds, unless the refresh query parameter says otherwise.
+const defaultDashboardRefresh = 10
+
+var (
+	//go:embed templates static
+	dashboardFS embed.FS
+
+	dashboardTemplate = template.Must(template.ParseFS(dashboardFS, "templates/dashboard.html"))
+	staticFS, _       = fs.Sub(dashboardFS, "static")
+)
+
+type dashboardRow struct {
+	Name  string
+	Type  string
+	Value string
+}
+
+// dashboardColumn is a sortable table header.
+type dashboardColumn struct {
+	Title string
+	URL   string
+	// Order is the arrow shown next to the column the table is sorted by.
+	Order string
+}
+
+type dashboardPage struct {
+	Rows    []dashboardRow
+	Columns []dashboardColumn
+	Name    string
+	Type    string
+	Sort    string
+	Order   string
+	Refresh int
+	Total   int
+}
+
+type dashboardQuery struct {
+	name    string
+	mType   string
+	sort    string
+	desc    bool
+	refresh int
+}
+
+func parseDashboardQuery(q url.Values) dashboardQuery {
+	dq := dashboardQuery{
+		name:    strings.TrimSpace(q.Get("name")),
+		mType:   q.Get("type"),
+		sort:    q.Get("sort"),
+		desc:    q.Get("order") == "desc",
+		refresh: defaultDashboardRefresh,
+	}
+	if dq.mType != string(models.Gauge) && dq.mType != string(models.Counter) {
+		dq.mType = ""
+	}
+	switch dq.sort {
+	case "name", "type", "value":
+	default:
+		dq.sort = "name"
+	}
+	if v, err := strconv.Atoi(q.Get("refresh")); err == nil && v >= 0 {
+		dq.refresh = v
+	}
+	return dq
+}
+
+// url links to the dashboard sorted by column, flipping the order when the
+// table is already sorted by it.
+func (dq dashboardQuery) url(column string) string {
+	q := url.Values{}
+	if dq.name != "" {
+		q.Set("name", dq.name)
+	}
+	if dq.mType != "" {
+		q.Set("type", dq.mType)
+	}
+	if dq.refresh != defaultDashboardRefresh {
+		q.Set("refresh", strconv.Itoa(dq.refresh))
+	}
+	q.Set("sort", column)
+	if column == dq.sort && !dq.desc {
+		q.Set("order", "desc")
+	}
+	return "/?" + q.Encode()
+}
+
+// apply filters metrics by name and type and sorts them.
+func (dq dashboardQuery) apply(metrics []models.MetricsDTO) []models.MetricsDTO {
+	res := make([]models.MetricsDTO, 0, len(metrics))
+	needle := strings.ToLower(dq.name)
+	for _, m := range metrics {
+		if dq.mType != "" && m.MType != dq.mType {
+			continue
+		}
+		if needle != "" && !strings.Contains(strings.ToLower(m.ID), needle) {
+			continue
+		}
+		res = append(res, m)
+	}
+
+	less := map[string]func(a, b models.MetricsDTO) bool{
+		"name":  func(a, b models.MetricsDTO) bool { return a.ID < b.ID },
+		"type":  func(a, b models.MetricsDTO) bool { return a.MType < b.MType },
+		"value": func(a, b models.MetricsDTO) bool { return metricNumber(a) < metricNumber(b) },
+	}[dq.sort]
+	sort.SliceStable(res, func(i, j int) bool {
+		if dq.desc {
+			return less(res[j], res[i])
+		}
+		return less(res[i], res[j])
+	})
+
+	return res
+}
+
+func metricNumber(m models.MetricsDTO) float64 {
+	switch {
+	case m.Value != nil:
+		return *m.Value
+	case m.Delta != nil:
+		return float64(*m.Delta)
+	}
+	return 0
+}
+
+// page builds the dashboard for metrics already passed through apply; total
+// is the number of metrics before filtering.
+func (dq dashboardQuery) page(metrics []models.MetricsDTO, total int) dashboardPage {
+	rows := make([]dashboardRow, 0, len(metrics))
+	for _, m := range metrics {
+		rows = append(rows, dashboardRow{Name: m.ID, Type: m.MType, Value: formatMetricValue(m)})
+	}
+
+	columns := make([]dashboardColumn, 0, 3)
+	for _, c := range []string{"name", "type", "value"} {
+		col := dashboardColumn{Title: strings.ToUpper(c[:1]) + c[1:], URL: dq.url(c)}
+		if c == dq.sort {
+			col.Order = "▲"
+			if dq.desc {
+				col.Order = "▼"
+			}
+		}
+		columns = append(columns, col)
+	}
+
+	order := "asc"
+	if dq.desc {
+		order = "desc"
+	}
+
+	return dashboardPage{
+		Rows:    rows,
+		Columns: columns,
+		Name:    dq.name,
+		Type:    dq.mType,
+		Sort:    dq.sort,
+		Order:   order,
+		Refresh: dq.refresh,
+		Total:   total,
+	}
+}
+
+// ShowMetrics serves GET / as the HTML dashboard, or as JSON (a list of
+// MetricsDTO), CSV, Prometheus or plain text when the Accept header asks for
+// it.
+//
+// Query parameters, honored by every representation:
+//   - name: show metrics whose name contains it, case-insensitive;
+//   - type: "gauge" or "counter";
+//   - sort: "name" (default), "type" or "value"; order: "asc" or "desc";
+//   - refresh: reload interval in seconds, 0 disables it.
+func (h *Handler) ShowMetrics(w http.ResponseWriter, r *http.Request) {
+	offers := []string{mediaHTML, mediaJSON, mediaCSV, mediaText, mediaPrometheus}
+	w.Header().Add("Vary", "Accept")
+	mediaType, ok := negotiate(r, offers...)
+	if !ok {
+		notAcceptable(w, r, offers...)
+		return
+	}
+
+	metrics, err := h.service.ListMetrics(r.Context())
+	if err != nil {
+		errdefs.WriteProblem(w, r, err)
+		return
+	}
+
+	dq := parseDashboardQuery(r.URL.Query())
+	selected := dq.apply(metrics)
+	if mediaType != mediaHTML {
+		if err := writeMetrics(w, mediaType, selected, false); err != nil {
+			logger.Log.Info("failed to write metrics", zap.Error(err))
+		}
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := dashboardTemplate.Execute(&buf, dq.page(selected, len(metrics))); err != nil {
+		errdefs.WriteProblem(w, r, errdefs.NewInternalError(errdefs.CodeInternal, "can't render metrics", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if _, err := buf.WriteTo(w); err != nil {
+		return
+	}
+}
+
+// StaticAssets serves the embedded dashboard assets under /static/.
+func (h *Handler) StaticAssets(w http.ResponseWriter, r *http.Request) {
+	http.StripPrefix("/static/", http.FileServerFS(staticFS)).ServeHTTP(w, r)
+}
@@ -0,0 +1,126 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zubans/metrics/internal/services"
+	"github.com/zubans/metrics/internal/storage"
+)
+
+var dashboardCell = regexp.MustCompile(`<tr>\s*<td>([^<]*)</td>\s*<td[^>]*>([^<]*)</td>\s*<td[^>]*>([^<]*)</td>`)
+
+// dashboardRows returns the name, type and value of every table row.
+func dashboardRows(body string) [][3]string {
+	var rows [][3]string
+	for _, m := range dashboardCell.FindAllStringSubmatch(body, -1) {
+		rows = append(rows, [3]string{m[1], m[2], m[3]})
+	}
+	return rows
+}
+
+func TestHandler_ShowMetrics(t *testing.T) {
+	memStorage := storage.NewMemStorage()
+	ctx := context.Background()
+	memStorage.UpdateGauge(ctx, "Alloc", 2.5)
+	memStorage.UpdateGauge(ctx, "HeapSys", 120)
+	memStorage.UpdateCounter(ctx, "PollCount", 7)
+	memStorage.UpdateCounter(ctx, "Alarms", 300)
+	h := NewHandler(services.NewMetricService(memStorage))
+
+	tests := []struct {
+		name  string
+		query string
+		want  [][3]string
+	}{
+		{
+			name: "sorted by name",
+			want: [][3]string{
+				{"Alarms", "counter", "300"},
+				{"Alloc", "gauge", "2.5"},
+				{"HeapSys", "gauge", "120"},
+				{"PollCount", "counter", "7"},
+			},
+		},
+		{
+			name:  "sorted by value descending",
+			query: "?sort=value&order=desc",
+			want: [][3]string{
+				{"Alarms", "counter", "300"},
+				{"HeapSys", "gauge", "120"},
+				{"PollCount", "counter", "7"},
+				{"Alloc", "gauge", "2.5"},
+			},
+		},
+		{
+			name:  "filtered by type",
+			query: "?type=counter",
+			want: [][3]string{
+				{"Alarms", "counter", "300"},
+				{"PollCount", "counter", "7"},
+			},
+		},
+		{
+			name:  "filtered by name",
+			query: "?name=al",
+			want: [][3]string{
+				{"Alarms", "counter", "300"},
+				{"Alloc", "gauge", "2.5"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			h.ShowMetrics(rr, httptest.NewRequest(http.MethodGet, "/"+tt.query, nil))
+
+			require.Equal(t, http.StatusOK, rr.Code)
+			assert.Equal(t, "text/html; charset=utf-8", rr.Header().Get("Content-Type"))
+			assert.Equal(t, tt.want, dashboardRows(rr.Body.String()))
+		})
+	}
+}
+
+func TestHandler_ShowMetricsEscapesNames(t *testing.T) {
+	memStorage := storage.NewMemStorage()
+	memStorage.UpdateGauge(context.Background(), "<script>alert(1)</script>", 1)
+	h := NewHandler(services.NewMetricService(memStorage))
+
+	rr := httptest.NewRecorder()
+	h.ShowMetrics(rr, httptest.NewRequest(http.MethodGet, `/?name=<script>`, nil))
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	body := rr.Body.String()
+	assert.NotContains(t, body, "<script>")
+	assert.Contains(t, body, "&lt;script&gt;alert(1)&lt;/script&gt;")
+}
+
+func TestHandler_ShowMetricsRefresh(t *testing.T) {
+	h := NewHandler(services.NewMetricService(storage.NewMemStorage()))
+
+	rr := httptest.NewRecorder()
+	h.ShowMetrics(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Contains(t, rr.Body.String(), `<meta http-equiv="refresh" content="10">`)
+	assert.Contains(t, rr.Body.String(), "No metrics")
+
+	rr = httptest.NewRecorder()
+	h.ShowMetrics(rr, httptest.NewRequest(http.MethodGet, "/?refresh=0", nil))
+	assert.NotContains(t, rr.Body.String(), `http-equiv="refresh"`)
+}
+
+func TestHandler_StaticAssets(t *testing.T) {
+	h := NewHandler(services.NewMetricService(storage.NewMemStorage()))
+
+	rr := httptest.NewRecorder()
+	h.StaticAssets(rr, httptest.NewRequest(http.MethodGet, "/static/dashboard.css", nil))
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.True(t, strings.HasPrefix(rr.Header().Get("Content-Type"), "text/css"))
+}
@@ -4,10 +4,15 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/go-chi/chi/v5"
+	"github.com/zubans/metrics/internal/alerts"
 	"github.com/zubans/metrics/internal/errdefs"
 	"github.com/zubans/metrics/internal/logger"
 	"github.com/zubans/metrics/internal/models"
+	"github.com/zubans/metrics/internal/pubsub"
+	"github.com/zubans/metrics/internal/query"
+	"github.com/zubans/metrics/internal/registry"
 	"github.com/zubans/metrics/internal/services"
 	"go.uber.org/zap"
 	"io"
@@ -16,73 +21,121 @@ import (
 )
 
 type ServerMetricService interface {
-	UpdateMetric(ctx context.Context, mData *services.MetricData) (*models.MetricsDTO, *errdefs.CustomError, error)
-	UpdateMetrics(ctx context.Context, m []models.MetricsDTO) (bool, *errdefs.CustomError, error)
-	GetMetric(ctx context.Context, mData *services.MetricData) (string, *errdefs.CustomError)
-	GetJSONMetric(ctx context.Context, jsonData *models.MetricsDTO) ([]byte, *errdefs.CustomError)
-	ShowMetrics(ctx context.Context) (string, error)
+	UpdateMetric(ctx context.Context, mData *services.MetricData) (*models.MetricsDTO, error)
+	UpdateMetrics(ctx context.Context, m []models.MetricsDTO) error
+	DeleteMetric(ctx context.Context, mData *services.MetricData) error
+	Metric(ctx context.Context, mData *services.MetricData) (*models.MetricsDTO, error)
+	GetJSONMetric(ctx context.Context, jsonData *models.MetricsDTO) ([]byte, error)
+	ListMetrics(ctx context.Context) ([]models.MetricsDTO, error)
+	SelfMetrics(ctx context.Context) []models.MetricsDTO
 	Ping(ctx context.Context) error
+	Agents(ctx context.Context) []registry.Agent
+	Alerts(ctx context.Context) []alerts.Alert
+	Query(ctx context.Context, expr string) (*query.Result, error)
+	Subscribe(ctx context.Context, f pubsub.Filter) *pubsub.Subscription
+	SubscribeQueue(ctx context.Context, size int, match func(models.MetricsDTO) bool) *pubsub.Queue
 }
 
+// Handler serves the metrics HTTP API. Every error response is written as
+// RFC 7807 problem details by errdefs.WriteProblem.
 type Handler struct {
-	service ServerMetricService
+	service  ServerMetricService
+	maxBatch int
 }
 
-func NewHandler(service ServerMetricService) *Handler {
-	return &Handler{service: service}
+// Option configures optional limits of the handler.
+type Option func(*Handler)
+
+// WithMaxBatchSize rejects batch updates of more than n metrics with 413.
+// Zero means no limit.
+func WithMaxBatchSize(n int) Option {
+	return func(h *Handler) {
+		h.maxBatch = n
+	}
+}
+
+func NewHandler(service ServerMetricService, opts ...Option) *Handler {
+	h := &Handler{service: service}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+func invalidJSON(err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return errdefs.TooLarge(tooLarge)
+	}
+	return errdefs.NewBadRequestError(errdefs.CodeInvalidRequest, "invalid JSON body: "+err.Error())
+}
+
+// decodeBatch reads a JSON array of metrics one element at a time, so a
+// batch over the limit is rejected without reading the rest of it.
+func (h *Handler) decodeBatch(body io.Reader) ([]models.MetricsDTO, error) {
+	dec := json.NewDecoder(body)
+
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, invalidJSON(err)
+	}
+	if tok == nil {
+		return nil, nil
+	}
+	if tok != json.Delim('[') {
+		return nil, invalidJSON(errors.New("expected an array of metrics"))
+	}
+
+	m := make([]models.MetricsDTO, 0)
+	for dec.More() {
+		if h.maxBatch > 0 && len(m) == h.maxBatch {
+			return nil, errdefs.NewTooLargeError(errdefs.CodeBatchTooLarge,
+				fmt.Sprintf("batch exceeds %d metrics", h.maxBatch))
+		}
+
+		var v models.MetricsDTO
+		if err := dec.Decode(&v); err != nil {
+			return nil, invalidJSON(err)
+		}
+		m = append(m, v)
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return nil, invalidJSON(err)
+	}
+	return m, nil
 }
 
 func (h *Handler) UpdateMetric(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	v := chi.URLParam(r, "value")
 	mData, err := services.NewMetricData(
 		chi.URLParam(r, "type"),
 		chi.URLParam(r, "name"),
-		v,
+		chi.URLParam(r, "value"),
 	)
-
 	if err != nil {
-		http.Error(w, "invalid input: "+err.Error(), http.StatusBadRequest)
+		errdefs.WriteProblem(w, r, err)
 		return
 	}
 
-	_, details, err := h.service.UpdateMetric(ctx, mData)
-
-	if err != nil {
-		var CustomErr *errdefs.CustomError
-		if errors.As(details, &CustomErr) {
-			http.Error(w, CustomErr.Message, CustomErr.Code)
-			logger.Log.Info("custom error",
-				zap.String("message", CustomErr.Message),
-				zap.Int("status_code", CustomErr.Code),
-			)
-			return
-		}
+	if _, err := h.service.UpdateMetric(r.Context(), mData); err != nil {
+		errdefs.WriteProblem(w, r, err)
+		return
 	}
+
 	w.Header().Set("Content-Type", "text/plain")
 	w.WriteHeader(http.StatusOK)
 }
 
 func (h *Handler) UpdateMetrics(w http.ResponseWriter, r *http.Request) {
-	var m []models.MetricsDTO
-	ctx := r.Context()
-
-	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
-		writeJSONError(w, "invalid input: "+err.Error(), http.StatusBadRequest)
+	m, err := h.decodeBatch(r.Body)
+	if err != nil {
+		errdefs.WriteProblem(w, r, err)
 		return
 	}
 
-	_, details, err := h.service.UpdateMetrics(ctx, m)
-
-	if err != nil {
-		var CustomErr *errdefs.CustomError
-		if errors.As(details, &CustomErr) {
-			logger.Log.Info("custom error",
-				zap.String("message", CustomErr.Message),
-				zap.Int("status_code", CustomErr.Code),
-			)
-			return
-		}
+	if err := h.service.UpdateMetrics(r.Context(), m); err != nil {
+		errdefs.WriteProblem(w, r, err)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -91,10 +144,19 @@ func (h *Handler) UpdateMetrics(w http.ResponseWriter, r *http.Request) {
 
 func (h *Handler) UpdateMetricJSON(w http.ResponseWriter, r *http.Request) {
 	var m models.MetricsDTO
-	ctx := r.Context()
-
 	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
-		writeJSONError(w, "invalid input: "+err.Error(), http.StatusBadRequest)
+		errdefs.WriteProblem(w, r, invalidJSON(err))
+		return
+	}
+
+	h.updateMetricDTO(w, r, m)
+}
+
+// updateMetricDTO validates and stores m and responds with the stored
+// metric.
+func (h *Handler) updateMetricDTO(w http.ResponseWriter, r *http.Request, m models.MetricsDTO) {
+	if fields := services.ValidateMetric(m, ""); len(fields) > 0 {
+		errdefs.WriteProblem(w, r, errdefs.NewValidationError("invalid metric", fields...))
 		return
 	}
 
@@ -102,48 +164,18 @@ func (h *Handler) UpdateMetricJSON(w http.ResponseWriter, r *http.Request) {
 		Type: m.MType,
 		Name: m.ID,
 	}
-
-	switch m.MType {
-	case string(models.Gauge):
-		if m.Value == nil {
-			writeJSONError(w, "missing gauge value", http.StatusBadRequest)
-			return
-		}
-		if m.Delta != nil {
-			writeJSONError(w, "gauge metric should not contain delta", http.StatusBadRequest)
-			return
-		}
-
-		val := strconv.FormatFloat(*m.Value, 'f', -1, 64)
-		mData.Value = &val
-	case string(models.Counter):
-		if m.Delta == nil {
-			writeJSONError(w, "missing counter delta", http.StatusBadRequest)
-			return
-		}
-		if m.Value != nil {
-			writeJSONError(w, "counter metric should not contain value", http.StatusBadRequest)
-			return
-		}
-
-		val := strconv.FormatInt(int64(*m.Delta), 10)
-		mData.Value = &val
-	default:
-		writeJSONError(w, "invalid input", http.StatusBadRequest)
-		return
+	var val string
+	if m.MType == string(models.Gauge) {
+		val = strconv.FormatFloat(*m.Value, 'f', -1, 64)
+	} else {
+		val = strconv.FormatInt(*m.Delta, 10)
 	}
+	mData.Value = &val
 
-	res, details, err := h.service.UpdateMetric(ctx, mData)
-
+	res, err := h.service.UpdateMetric(r.Context(), mData)
 	if err != nil {
-		var CustomErr *errdefs.CustomError
-		if errors.As(details, &CustomErr) {
-			logger.Log.Info("custom error",
-				zap.String("message", CustomErr.Message),
-				zap.Int("status_code", CustomErr.Code),
-			)
-			return
-		}
+		errdefs.WriteProblem(w, r, err)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -154,126 +186,104 @@ func (h *Handler) UpdateMetricJSON(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// GetMetric serves GET /value/{type}/{name} as plain text, JSON (a
+// MetricsDTO), CSV or Prometheus text, as requested by the Accept header.
 func (h *Handler) GetMetric(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
+	offers := []string{mediaText, mediaJSON, mediaCSV, mediaPrometheus}
+	w.Header().Add("Vary", "Accept")
+	mediaType, ok := negotiate(r, offers...)
+	if !ok {
+		notAcceptable(w, r, offers...)
+		return
+	}
 
 	mData, err := services.NewMetricData(
 		chi.URLParam(r, "type"),
 		chi.URLParam(r, "name"),
 	)
-
 	if err != nil {
-		http.Error(w, "invalid input: "+err.Error(), http.StatusBadRequest)
+		errdefs.WriteProblem(w, r, err)
 		return
 	}
 
-	var res string
-	res, err = h.service.GetMetric(ctx, mData)
-
-	var CustomErr *errdefs.CustomError
-
-	if err.(*errdefs.CustomError) != nil {
-		if errors.As(err, &CustomErr) {
-			http.Error(w, CustomErr.Message, CustomErr.Code)
-			logger.Log.Info("custom error", zap.String("message", CustomErr.Error()))
-			return
-		}
-	}
-
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "text/plain")
-
-	_, err = io.WriteString(w, res)
+	m, err := h.service.Metric(r.Context(), mData)
 	if err != nil {
+		errdefs.WriteProblem(w, r, err)
 		return
 	}
+
+	if err := writeMetrics(w, mediaType, []models.MetricsDTO{*m}, true); err != nil {
+		logger.Log.Info("failed to write metric", zap.Error(err))
+	}
 }
 
 func (h *Handler) GetMetricJSON(w http.ResponseWriter, r *http.Request) {
-	var m *models.MetricsDTO
-	ctx := r.Context()
-
+	var m models.MetricsDTO
 	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
-		http.Error(w, "invalid input: "+err.Error(), http.StatusBadRequest)
+		errdefs.WriteProblem(w, r, invalidJSON(err))
 		return
 	}
 
-	var res []byte
-	var err error
-
-	res, err = h.service.GetJSONMetric(ctx, m)
-
-	var CustomErr *errdefs.CustomError
-
-	if err.(*errdefs.CustomError) != nil {
-		if errors.As(err, &CustomErr) {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(CustomErr.Code)
-
-			jsonResp := map[string]interface{}{
-				"error":   CustomErr.Message,
-				"code":    CustomErr.Code,
-				"details": m,
-			}
-			if err := json.NewEncoder(w).Encode(jsonResp); err != nil {
-				logger.Log.Info("failed to encode JSON error response", zap.Error(err))
-			}
-
-			logger.Log.Info("custom error",
-				zap.String("message", CustomErr.Message),
-				zap.Int("status_code", CustomErr.Code),
-				zap.Any("body", m),
-				zap.Any("raw", err),
-				zap.Any("request", r),
-			)
-			return
-		}
+	res, err := h.service.GetJSONMetric(r.Context(), &m)
+	if err != nil {
+		errdefs.WriteProblem(w, r, err)
+		return
 	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 
-	_, err = w.Write(res)
-	if err != nil {
+	if _, err := w.Write(res); err != nil {
 		return
 	}
 }
 
-func (h *Handler) ShowMetrics(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	value, err := h.service.ShowMetrics(ctx)
-	if err != nil {
-		logger.Log.Info("failed to get metrics", zap.Error(err))
-	}
-
-	_, err = io.WriteString(w, value)
-	if err != nil {
+func (h *Handler) PingServer(w http.ResponseWriter, r *http.Request) {
+	if err := h.service.Ping(r.Context()); err != nil {
+		errdefs.WriteProblem(w, r, errdefs.NewInternalError(errdefs.CodeStorageFailure, "storage is unavailable", err))
 		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
 }
 
-func writeJSONError(w http.ResponseWriter, message string, statusCode int) {
+func (h *Handler) ListAgents(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
+	w.WriteHeader(http.StatusOK)
 
-	resp := map[string]string{
-		"error": message,
+	if err := json.NewEncoder(w).Encode(h.service.Agents(r.Context())); err != nil {
+		logger.Log.Info("failed to encode agents", zap.Error(err))
 	}
+}
 
-	_ = json.NewEncoder(w).Encode(resp)
+func (h *Handler) ListAlerts(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(h.service.Alerts(r.Context())); err != nil {
+		logger.Log.Info("failed to encode alerts", zap.Error(err))
+	}
 }
 
-func (h *Handler) PingServer(w http.ResponseWriter, r *http.Request) {
-	err := h.service.Ping(r.Context())
+func (h *Handler) Query(w http.ResponseWriter, r *http.Request) {
+	expr := r.URL.Query().Get("expr")
+	if expr == "" {
+		errdefs.WriteProblem(w, r, errdefs.NewValidationError("missing query expression",
+			errdefs.FieldError{Field: "expr", Message: "is required"}))
+		return
+	}
+
+	res, err := h.service.Query(r.Context(), expr)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		errdefs.WriteProblem(w, r, err)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 
-	_, err = io.WriteString(w, "")
-	if err != nil {
-		return
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		logger.Log.Info("failed to encode query result", zap.Error(err))
 	}
 }
@@ -3,13 +3,26 @@ package handler
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"github.com/go-chi/chi/v5"
+	chimiddleware "github.com/go-chi/chi/v5/middleware"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zubans/metrics/internal/alerts"
+	"github.com/zubans/metrics/internal/errdefs"
+	"github.com/zubans/metrics/internal/identity"
+	"github.com/zubans/metrics/internal/middlewares"
+	"github.com/zubans/metrics/internal/models"
+	"github.com/zubans/metrics/internal/query"
+	"github.com/zubans/metrics/internal/registry"
 	"github.com/zubans/metrics/internal/services"
 	"github.com/zubans/metrics/internal/storage"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
+	"time"
 )
 
 func TestHandler_UpdateMetricJSON(t *testing.T) {
@@ -38,13 +51,19 @@ func TestHandler_UpdateMetricJSON(t *testing.T) {
 			name:                "Invalid Gauge Metric - bad value type",
 			requestData:         `{  "id": "Alloc",  "type": "gauge",  "value": "1""}`,
 			expectedStatusCode:  http.StatusBadRequest,
-			expectedContentType: "application/json",
+			expectedContentType: "application/problem+json",
 		},
 		{
 			name:                "Invalid Gauge Metric - unsupported type",
 			requestData:         `{  "id": "Alloc",  "type": "unsupported",  "value": 1"}`,
 			expectedStatusCode:  http.StatusBadRequest,
-			expectedContentType: "application/json",
+			expectedContentType: "application/problem+json",
+		},
+		{
+			name:                "Invalid Gauge Metric - missing value",
+			requestData:         `{  "id": "Alloc",  "type": "gauge",  "delta": 1}`,
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedContentType: "application/problem+json",
 		},
 	}
 
@@ -159,3 +178,255 @@ func TestHandler_UpdateMetric(t *testing.T) {
 		})
 	}
 }
+
+func TestHandler_PingServer_IndependentInstances(t *testing.T) {
+	firstStorage := storage.NewMemStorage()
+	secondStorage := storage.NewMemStorage()
+	first := NewHandler(services.NewMetricService(firstStorage))
+	second := NewHandler(services.NewMetricService(secondStorage))
+
+	for _, h := range []*Handler{first, second} {
+		r := chi.NewRouter()
+		r.Get("/ping", h.PingServer)
+
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/ping", nil)
+		r.ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+	}
+
+	r := chi.NewRouter()
+	r.Post("/update/{type}/{name}/{value}", first.UpdateMetric)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/update/counter/PollCount/5", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	_, exists := firstStorage.GetCounter(context.Background(), "PollCount")
+	assert.True(t, exists)
+	_, exists = secondStorage.GetCounter(context.Background(), "PollCount")
+	assert.False(t, exists, "instances must not share storage")
+}
+
+func TestHandler_ListAgents(t *testing.T) {
+	h := NewHandler(services.NewMetricService(storage.NewMemStorage(), services.WithRegistry(registry.New())))
+
+	r := chi.NewRouter()
+	r.Use(middlewares.AgentIdentity)
+	r.Post("/update/{type}/{name}/{value}", h.UpdateMetric)
+	r.Get("/agents", h.ListAgents)
+
+	for _, path := range []string{"/update/gauge/Alloc/1", "/update/counter/PollCount/1", "/update/gauge/Alloc/2"} {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.Header.Set(identity.AgentIDHeader, "host-1")
+		req.Header.Set(identity.AgentVersionHeader, "v1.2.3")
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code)
+	}
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/update/gauge/Anonymous/1", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/agents", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+
+	var agents []registry.Agent
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &agents))
+	require.Len(t, agents, 1)
+	assert.Equal(t, "host-1", agents[0].ID)
+	assert.Equal(t, "v1.2.3", agents[0].Version)
+	assert.Equal(t, 2, agents[0].MetricCount)
+	assert.False(t, agents[0].FirstSeen.After(agents[0].LastSeen))
+}
+
+func TestHandler_ListAlerts(t *testing.T) {
+	memStorage := storage.NewMemStorage()
+	memStorage.UpdateGauge(context.Background(), "HeapAlloc", 500)
+
+	engine := alerts.New([]alerts.Rule{
+		{Name: "heap-high", Metric: "HeapAlloc", Type: "gauge", Comparator: alerts.Greater, Threshold: 100},
+		{Name: "heap-low", Metric: "HeapAlloc", Type: "gauge", Comparator: alerts.Less, Threshold: 100},
+	}, memStorage)
+	engine.Evaluate(context.Background())
+
+	h := NewHandler(services.NewMetricService(memStorage, services.WithAlerts(engine)))
+	rr := httptest.NewRecorder()
+	h.ListAlerts(rr, httptest.NewRequest(http.MethodGet, "/alerts", nil))
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	var got []alerts.Alert
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &got))
+	require.Len(t, got, 1)
+	assert.Equal(t, "heap-high", got[0].Rule)
+	assert.Equal(t, alerts.Firing, got[0].State)
+
+	rr = httptest.NewRecorder()
+	NewHandler(services.NewMetricService(memStorage)).ListAlerts(rr, httptest.NewRequest(http.MethodGet, "/alerts", nil))
+	assert.JSONEq(t, "[]", rr.Body.String())
+}
+
+func TestHandler_Query(t *testing.T) {
+	memStorage := storage.NewMemStorage()
+	memStorage.UpdateGauge(context.Background(), "HeapInuse", 30)
+	memStorage.UpdateGauge(context.Background(), "HeapSys", 120)
+	memStorage.UpdateCounter(context.Background(), "PollCount", 5)
+
+	tests := []struct {
+		name     string
+		expr     string
+		history  bool
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "arithmetic",
+			expr:     "HeapInuse / HeapSys",
+			wantCode: http.StatusOK,
+			wantBody: `{"type":"vector","result":[{"name":"","type":"gauge","value":0.25}]}`,
+		},
+		{
+			name:     "glob with matcher",
+			expr:     `Heap*{name!="HeapSys"}`,
+			wantCode: http.StatusOK,
+			wantBody: `{"type":"vector","result":[{"name":"HeapInuse","type":"gauge","value":30}]}`,
+		},
+		{
+			name:     "scalar",
+			expr:     "2 * 3",
+			wantCode: http.StatusOK,
+			wantBody: `{"type":"scalar","value":6}`,
+		},
+		{
+			name:     "rate with history",
+			expr:     "rate(PollCount[5m])",
+			history:  true,
+			wantCode: http.StatusOK,
+			wantBody: `{"type":"vector","result":[]}`,
+		},
+		{
+			name:     "rate without history",
+			expr:     "rate(PollCount[5m])",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "syntax error",
+			expr:     "HeapInuse +",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "missing expr",
+			wantCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts []services.Option
+			if tt.history {
+				opts = append(opts, services.WithHistory(query.NewHistory(time.Hour, 100)))
+			}
+			h := NewHandler(services.NewMetricService(memStorage, opts...))
+
+			req := httptest.NewRequest(http.MethodGet, "/query?expr="+url.QueryEscape(tt.expr), nil)
+			rr := httptest.NewRecorder()
+			h.Query(rr, req)
+
+			require.Equal(t, tt.wantCode, rr.Code, rr.Body.String())
+			if tt.wantCode == http.StatusOK {
+				assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+			} else {
+				assert.Equal(t, errdefs.ProblemContentType, rr.Header().Get("Content-Type"))
+			}
+			if tt.wantBody != "" {
+				assert.JSONEq(t, tt.wantBody, rr.Body.String())
+			}
+		})
+	}
+}
+
+type brokenStorage struct {
+	*storage.MemStorage
+}
+
+func (brokenStorage) UpdateMetrics(context.Context, []models.MetricsDTO) ([]models.MetricsDTO, error) {
+	return nil, errors.New("disk full")
+}
+
+func TestHandler_ProblemDetails(t *testing.T) {
+	h := NewHandler(services.NewMetricService(brokenStorage{storage.NewMemStorage()}))
+
+	r := chi.NewRouter()
+	r.Post("/updates/", h.UpdateMetrics)
+	r.Post("/update/", h.UpdateMetricJSON)
+	srv := middlewares.RequestID(r)
+
+	tests := []struct {
+		name string
+		path string
+		body string
+		want errdefs.Problem
+	}{
+		{
+			name: "storage failure",
+			path: "/updates/",
+			body: `[{"id":"Alloc","type":"gauge","value":1}]`,
+			want: errdefs.Problem{
+				Type:     "about:blank",
+				Title:    "Internal Server Error",
+				Status:   http.StatusInternalServerError,
+				Detail:   "can't update metrics",
+				Instance: "/updates/",
+				Code:     errdefs.CodeStorageFailure,
+			},
+		},
+		{
+			name: "validation failure",
+			path: "/update/",
+			body: `{"id":"Alloc","type":"gauge"}`,
+			want: errdefs.Problem{
+				Type:     "about:blank",
+				Title:    "Bad Request",
+				Status:   http.StatusBadRequest,
+				Detail:   "invalid metric",
+				Instance: "/update/",
+				Code:     errdefs.CodeValidationFailed,
+				Errors:   []errdefs.FieldError{{Field: "value", Message: "is required for gauge"}},
+			},
+		},
+		{
+			name: "malformed body",
+			path: "/updates/",
+			body: `{`,
+			want: errdefs.Problem{
+				Type:     "about:blank",
+				Title:    "Bad Request",
+				Status:   http.StatusBadRequest,
+				Detail:   "invalid JSON body: expected an array of metrics",
+				Instance: "/updates/",
+				Code:     errdefs.CodeInvalidRequest,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.path, bytes.NewBufferString(tt.body))
+			req.Header.Set(chimiddleware.RequestIDHeader, "req-42")
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+
+			require.Equal(t, tt.want.Status, rr.Code)
+			assert.Equal(t, errdefs.ProblemContentType, rr.Header().Get("Content-Type"))
+			assert.Equal(t, "req-42", rr.Header().Get(chimiddleware.RequestIDHeader))
+
+			var got errdefs.Problem
+			require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &got))
+			tt.want.RequestID = "req-42"
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package handler
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/zubans/metrics/internal/errdefs"
+	"github.com/zubans/metrics/internal/models"
+)
+
+// Media types the read endpoints can produce. Prometheus shares text/plain
+// with the plain format and is told apart by the version parameter.
+const (
+	mediaText       = "text/plain"
+	mediaHTML       = "text/html"
+	mediaJSON       = "application/json"
+	mediaCSV        = "text/csv"
+	mediaPrometheus = "text/plain; version=0.0.4"
+)
+
+type mediaRange struct {
+	mType, subType string
+	params         map[string]string
+	q              float64
+}
+
+func parseAccept(header string) []mediaRange {
+	var ranges []mediaRange
+	for _, part := range strings.Split(header, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		mType, subType, ok := strings.Cut(mt, "/")
+		if !ok {
+			continue
+		}
+
+		q := 1.0
+		if v, found := params["q"]; found {
+			if q, err = strconv.ParseFloat(v, 64); err != nil || q < 0 || q > 1 {
+				continue
+			}
+			delete(params, "q")
+		}
+		ranges = append(ranges, mediaRange{mType: mType, subType: subType, params: params, q: q})
+	}
+	return ranges
+}
+
+// quality returns the weight the most specific range matching offer gives
+// it, or -1 when no range matches.
+func quality(ranges []mediaRange, offer string) float64 {
+	mt, offerParams, _ := mime.ParseMediaType(offer)
+	mType, subType, _ := strings.Cut(mt, "/")
+
+	q, best := -1.0, -1
+	for _, r := range ranges {
+		specificity := len(r.params)
+		switch {
+		case r.mType == "*" && r.subType == "*":
+		case r.mType == mType && r.subType == "*":
+			specificity += 10
+		case r.mType == mType && r.subType == subType:
+			specificity += 20
+		default:
+			continue
+		}
+
+		matches := true
+		for k, v := range r.params {
+			if offerParams[k] != v {
+				matches = false
+				break
+			}
+		}
+		if matches && specificity > best {
+			q, best = r.q, specificity
+		}
+	}
+	return q
+}
+
+// negotiate picks the offer the Accept header of r prefers. Ties go to the
+// earlier offer and a missing header selects the first one. ok is false when
+// none of the offers is acceptable.
+func negotiate(r *http.Request, offers ...string) (offer string, ok bool) {
+	header := r.Header.Get("Accept")
+	if header == "" {
+		return offers[0], true
+	}
+
+	ranges := parseAccept(header)
+	bestQ := 0.0
+	for _, o := range offers {
+		if q := quality(ranges, o); q > bestQ {
+			offer, bestQ = o, q
+		}
+	}
+	return offer, bestQ > 0
+}
+
+func notAcceptable(w http.ResponseWriter, r *http.Request, offers ...string) {
+	errdefs.WriteProblem(w, r, errdefs.New(http.StatusNotAcceptable, errdefs.CodeNotAcceptable,
+		"supported media types: "+strings.Join(offers, ", ")))
+}
+
+func formatMetricValue(m models.MetricsDTO) string {
+	switch {
+	case m.Value != nil:
+		return strconv.FormatFloat(*m.Value, 'f', -1, 64)
+	case m.Delta != nil:
+		return strconv.FormatInt(*m.Delta, 10)
+	}
+	return ""
+}
+
+// writeMetricsText writes one "type name value" line per metric.
+func writeMetricsText(w io.Writer, metrics []models.MetricsDTO) error {
+	for _, m := range metrics {
+		if _, err := fmt.Fprintf(w, "%s %s %s\n", m.MType, m.ID, formatMetricValue(m)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeMetricsCSV(w io.Writer, metrics []models.MetricsDTO) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"name", "type", "value"}); err != nil {
+		return err
+	}
+	for _, m := range metrics {
+		if err := cw.Write([]string{m.ID, m.MType, formatMetricValue(m)}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeMetricsPrometheus writes metrics in the Prometheus text exposition
+// format. Characters not allowed in Prometheus names are replaced by "_";
+// when two metrics end up with the same name only the first is written.
+func writeMetricsPrometheus(w io.Writer, metrics []models.MetricsDTO) error {
+	seen := make(map[string]struct{}, len(metrics))
+	for _, m := range metrics {
+		name := prometheusName(m.ID)
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+
+		if _, err := fmt.Fprintf(w, "# TYPE %s %s\n%s %s\n", name, m.MType, name, formatMetricValue(m)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func prometheusName(name string) string {
+	var sb strings.Builder
+	for i, c := range name {
+		switch {
+		case c == '_' || c == ':' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			sb.WriteRune(c)
+		case c >= '0' && c <= '9':
+			if i == 0 {
+				sb.WriteByte('_')
+			}
+			sb.WriteRune(c)
+		default:
+			sb.WriteByte('_')
+		}
+	}
+	if sb.Len() == 0 {
+		return "_"
+	}
+	return sb.String()
+}
+
+// writeMetrics writes metrics as mediaType, which is one of the non-HTML
+// media types. A single metric is written as a JSON object rather than an
+// array when single is set.
+func writeMetrics(w http.ResponseWriter, mediaType string, metrics []models.MetricsDTO, single bool) error {
+	switch mediaType {
+	case mediaJSON:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if single && len(metrics) == 1 {
+			return json.NewEncoder(w).Encode(metrics[0])
+		}
+		return json.NewEncoder(w).Encode(metrics)
+	case mediaCSV:
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		return writeMetricsCSV(w, metrics)
+	case mediaPrometheus:
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		return writeMetricsPrometheus(w, metrics)
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if single && len(metrics) == 1 {
+			_, err := io.WriteString(w, formatMetricValue(metrics[0]))
+			return err
+		}
+		return writeMetricsText(w, metrics)
+	}
+}
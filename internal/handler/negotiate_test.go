@@ -0,0 +1,162 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zubans/metrics/internal/services"
+	"github.com/zubans/metrics/internal/storage"
+)
+
+func TestNegotiate(t *testing.T) {
+	offers := []string{mediaText, mediaJSON, mediaCSV, mediaPrometheus}
+
+	tests := []struct {
+		accept string
+		want   string
+		ok     bool
+	}{
+		{accept: "", want: mediaText, ok: true},
+		{accept: "*/*", want: mediaText, ok: true},
+		{accept: "text/plain", want: mediaText, ok: true},
+		{accept: "application/json", want: mediaJSON, ok: true},
+		{accept: "text/*;q=0.5, application/json", want: mediaJSON, ok: true},
+		{accept: "text/csv;q=0.9, application/json;q=0.8", want: mediaCSV, ok: true},
+		{accept: "text/plain;version=0.0.4", want: mediaPrometheus, ok: true},
+		{
+			accept: "application/openmetrics-text;version=1.0.0,application/openmetrics-text;version=0.0.1;q=0.75,text/plain;version=0.0.4;q=0.5,*/*;q=0.1",
+			want:   mediaPrometheus,
+			ok:     true,
+		},
+		{accept: "application/json;q=0, */*", want: mediaText, ok: true},
+		{accept: "image/png", ok: false},
+		{accept: "text/plain;q=0", ok: false},
+		{accept: "not a media type", ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			got, ok := negotiate(r, offers...)
+			require.Equal(t, tt.ok, ok)
+			if tt.ok {
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func TestHandler_GetMetricFormats(t *testing.T) {
+	memStorage := storage.NewMemStorage()
+	memStorage.UpdateGauge(context.Background(), "Heap.Alloc", 2.5)
+	h := NewHandler(services.NewMetricService(memStorage))
+
+	r := chi.NewRouter()
+	r.Get("/value/{type}/{name}", h.GetMetric)
+
+	tests := []struct {
+		accept      string
+		code        int
+		contentType string
+		body        string
+	}{
+		{accept: "", code: http.StatusOK, contentType: "text/plain; charset=utf-8", body: "2.5"},
+		{accept: "application/json", code: http.StatusOK, contentType: "application/json", body: `{"id":"Heap.Alloc","type":"gauge","value":2.5}` + "\n"},
+		{accept: "text/csv", code: http.StatusOK, contentType: "text/csv; charset=utf-8", body: "name,type,value\nHeap.Alloc,gauge,2.5\n"},
+		{accept: "text/plain; version=0.0.4", code: http.StatusOK, contentType: "text/plain; version=0.0.4; charset=utf-8", body: "# TYPE Heap_Alloc gauge\nHeap_Alloc 2.5\n"},
+		{accept: "application/xml", code: http.StatusNotAcceptable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/value/gauge/Heap.Alloc", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+
+			require.Equal(t, tt.code, rr.Code)
+			assert.Equal(t, "Accept", rr.Header().Get("Vary"))
+			if tt.code == http.StatusOK {
+				assert.Equal(t, tt.contentType, rr.Header().Get("Content-Type"))
+				assert.Equal(t, tt.body, rr.Body.String())
+			}
+		})
+	}
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/value/gauge/Unknown", nil)
+	req.Header.Set("Accept", "application/json")
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestHandler_ShowMetricsFormats(t *testing.T) {
+	memStorage := storage.NewMemStorage()
+	memStorage.UpdateGauge(context.Background(), "Alloc", 2.5)
+	memStorage.UpdateCounter(context.Background(), "PollCount", 7)
+	h := NewHandler(services.NewMetricService(memStorage))
+
+	tests := []struct {
+		accept      string
+		query       string
+		code        int
+		contentType string
+		body        string
+	}{
+		{
+			accept:      "application/json",
+			code:        http.StatusOK,
+			contentType: "application/json",
+			body:        `[{"id":"Alloc","type":"gauge","value":2.5},{"id":"PollCount","type":"counter","delta":7}]` + "\n",
+		},
+		{
+			accept:      "text/csv",
+			query:       "?type=counter",
+			code:        http.StatusOK,
+			contentType: "text/csv; charset=utf-8",
+			body:        "name,type,value\nPollCount,counter,7\n",
+		},
+		{
+			accept:      "text/plain;version=0.0.4",
+			code:        http.StatusOK,
+			contentType: "text/plain; version=0.0.4; charset=utf-8",
+			body:        "# TYPE Alloc gauge\nAlloc 2.5\n# TYPE PollCount counter\nPollCount 7\n",
+		},
+		{
+			accept:      "text/plain",
+			query:       "?sort=value&order=desc",
+			code:        http.StatusOK,
+			contentType: "text/plain; charset=utf-8",
+			body:        "counter PollCount 7\ngauge Alloc 2.5\n",
+		},
+		{
+			accept: "application/pdf",
+			code:   http.StatusNotAcceptable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/"+tt.query, nil)
+			req.Header.Set("Accept", tt.accept)
+			rr := httptest.NewRecorder()
+			h.ShowMetrics(rr, req)
+
+			require.Equal(t, tt.code, rr.Code)
+			if tt.code == http.StatusOK {
+				assert.Equal(t, tt.contentType, rr.Header().Get("Content-Type"))
+				assert.Equal(t, tt.body, rr.Body.String())
+			}
+		})
+	}
+}
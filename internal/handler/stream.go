@@ -0,0 +1,148 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/zubans/metrics/internal/errdefs"
+	"github.com/zubans/metrics/internal/logger"
+	"github.com/zubans/metrics/internal/models"
+	"github.com/zubans/metrics/internal/pubsub"
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultStreamCoalesce is the minimum delay between two writes to a
+	// stream; updates arriving in between are merged per metric.
+	defaultStreamCoalesce = 200 * time.Millisecond
+	maxStreamCoalesce     = time.Minute
+	streamKeepAlive       = 15 * time.Second
+)
+
+// StreamMetrics serves GET /stream as Server-Sent Events. Every changed
+// metric is sent as a "metric" event carrying a MetricsDTO.
+//
+// Query parameters:
+//   - name: metric names to include, repeated or comma-separated;
+//   - type: "gauge" or "counter";
+//   - coalesce: minimum delay between writes, e.g. "1s".
+func (h *Handler) StreamMetrics(w http.ResponseWriter, r *http.Request) {
+	filter, coalesce, err := parseStreamQuery(r)
+	if err != nil {
+		errdefs.WriteProblem(w, r, errdefs.NewBadRequestError(errdefs.CodeInvalidRequest, err.Error()))
+		return
+	}
+
+	ctx := r.Context()
+	sub := h.service.Subscribe(ctx, filter)
+	if sub == nil {
+		errdefs.WriteProblem(w, r, errdefs.New(http.StatusNotImplemented, errdefs.CodeFeatureDisabled, "streaming is disabled"))
+		return
+	}
+	defer sub.Close()
+
+	rc := http.NewResponseController(w)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		logger.Log.Info("streaming is not supported by the response writer", zap.Error(err))
+		return
+	}
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	var last time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sub.Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-sub.Ready():
+			if wait := coalesce - time.Since(last); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				case <-sub.Done():
+					timer.Stop()
+					return
+				case <-timer.C:
+				}
+			}
+			last = time.Now()
+
+			if err := writeEvents(w, sub.Drain()); err != nil {
+				return
+			}
+		}
+
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeEvents(w http.ResponseWriter, events []models.MetricsDTO) error {
+	for _, e := range events {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: metric\ndata: %s\n\n", data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseStreamQuery(r *http.Request) (pubsub.Filter, time.Duration, error) {
+	q := r.URL.Query()
+	filter := pubsub.Filter{
+		Names: splitQuery(q["name"]),
+		Types: splitQuery(q["type"]),
+	}
+
+	for t := range filter.Types {
+		if t != string(models.Gauge) && t != string(models.Counter) {
+			return pubsub.Filter{}, 0, fmt.Errorf("invalid metric type %q", t)
+		}
+	}
+
+	coalesce := defaultStreamCoalesce
+	if v := q.Get("coalesce"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 || d > maxStreamCoalesce {
+			return pubsub.Filter{}, 0, fmt.Errorf("invalid coalesce %q", v)
+		}
+		coalesce = d
+	}
+
+	return filter, coalesce, nil
+}
+
+// splitQuery turns repeated and comma-separated query values into a set.
+func splitQuery(values []string) map[string]struct{} {
+	set := make(map[string]struct{})
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				set[part] = struct{}{}
+			}
+		}
+	}
+	return set
+}
@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zubans/metrics/internal/models"
+	"github.com/zubans/metrics/internal/pubsub"
+	"github.com/zubans/metrics/internal/services"
+	"github.com/zubans/metrics/internal/storage"
+)
+
+func TestHandler_StreamMetrics(t *testing.T) {
+	hub := pubsub.NewHub()
+	h := NewHandler(services.NewMetricService(storage.NewMemStorage(), services.WithHub(hub)))
+
+	r := chi.NewRouter()
+	r.Post("/update/{type}/{name}/{value}", h.UpdateMetric)
+	r.Get("/stream", h.StreamMetrics)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/stream?type=counter&coalesce=0s", nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	for _, path := range []string{"/update/gauge/Alloc/1", "/update/counter/PollCount/2", "/update/counter/PollCount/3"} {
+		res, err := http.Post(srv.URL+path, "text/plain", nil)
+		require.NoError(t, err)
+		_ = res.Body.Close()
+	}
+
+	var got []models.MetricsDTO
+	sc := bufio.NewScanner(resp.Body)
+	for len(got) == 0 || *got[len(got)-1].Delta != 5 {
+		require.True(t, sc.Scan(), "stream ended early: %v", sc.Err())
+		line := sc.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var m models.MetricsDTO
+		require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &m))
+		got = append(got, m)
+	}
+
+	for _, m := range got {
+		assert.Equal(t, "counter", m.MType, "gauge events must be filtered out")
+		assert.Equal(t, "PollCount", m.ID)
+	}
+
+	hub.Close()
+	_, err = io.Copy(io.Discard, resp.Body)
+	assert.NoError(t, err, "closing the hub must end the stream")
+}
+
+func TestHandler_StreamMetrics_CloseWhileCoalescing(t *testing.T) {
+	hub := pubsub.NewHub()
+	h := NewHandler(services.NewMetricService(storage.NewMemStorage(), services.WithHub(hub)))
+	ctx := context.Background()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.StreamMetrics(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/stream?coalesce=1m", nil))
+	}()
+
+	// The first update is written right away, the second waits for the
+	// coalesce delay.
+	for i, v := range []string{"1", "2"} {
+		require.Eventually(t, hub.HasSubscribers, time.Second, time.Millisecond)
+		_, err := h.service.UpdateMetric(ctx, &services.MetricData{Type: "gauge", Name: "Alloc", Value: &v})
+		require.NoError(t, err, i)
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	hub.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("closing the hub must end a stream waiting to coalesce")
+	}
+}
+
+func TestHandler_StreamMetrics_BadRequest(t *testing.T) {
+	h := NewHandler(services.NewMetricService(storage.NewMemStorage(), services.WithHub(pubsub.NewHub())))
+
+	for _, query := range []string{"type=histogram", "coalesce=abc", "coalesce=2h"} {
+		rr := httptest.NewRecorder()
+		h.StreamMetrics(rr, httptest.NewRequest(http.MethodGet, "/stream?"+query, nil))
+		assert.Equal(t, http.StatusBadRequest, rr.Code, query)
+	}
+
+	disabled := NewHandler(services.NewMetricService(storage.NewMemStorage()))
+	rr := httptest.NewRecorder()
+	disabled.StreamMetrics(rr, httptest.NewRequest(http.MethodGet, "/stream", nil))
+	assert.Equal(t, http.StatusNotImplemented, rr.Code)
+}
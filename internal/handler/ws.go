@@ -0,0 +1,229 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/zubans/metrics/internal/errdefs"
+	"github.com/zubans/metrics/internal/logger"
+	"github.com/zubans/metrics/internal/models"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// wsQueueSize is the number of updates buffered per connection; when a
+	// client falls behind the oldest updates are dropped.
+	wsQueueSize = 256
+	// wsRate and wsBurst cap the updates sent per connection per second.
+	wsRate  = 100
+	wsBurst = 100
+
+	wsMaxPatterns = 100
+	wsReadLimit   = 4096
+	wsWriteWait   = 10 * time.Second
+	wsPongWait    = 60 * time.Second
+	wsPingPeriod  = wsPongWait * 9 / 10
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// wsRequest is a client message: {"action":"subscribe","patterns":["Heap*"]}.
+// Patterns use path.Match syntax and are matched against metric names.
+type wsRequest struct {
+	Action   string   `json:"action"`
+	Patterns []string `json:"patterns"`
+}
+
+// wsMessage is a server message. Type is "metric" for updates, "ack" after a
+// subscription change, "dropped" when updates were discarded because the
+// client fell behind, and "error" for rejected requests.
+type wsMessage struct {
+	Type     string             `json:"type"`
+	Metric   *models.MetricsDTO `json:"metric,omitempty"`
+	Patterns []string           `json:"patterns,omitempty"`
+	Dropped  uint64             `json:"dropped,omitempty"`
+	Error    string             `json:"error,omitempty"`
+}
+
+type wsPatterns struct {
+	mu  sync.RWMutex
+	set map[string]struct{}
+}
+
+func (p *wsPatterns) match(m models.MetricsDTO) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for pattern := range p.set {
+		if ok, _ := path.Match(pattern, m.ID); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *wsPatterns) apply(req wsRequest) ([]string, error) {
+	if req.Action != "subscribe" && req.Action != "unsubscribe" {
+		return nil, fmt.Errorf("unknown action %q", req.Action)
+	}
+	if len(req.Patterns) == 0 {
+		return nil, errors.New("patterns are required")
+	}
+	for _, pattern := range req.Patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q", pattern)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if req.Action == "subscribe" {
+		if len(p.set)+len(req.Patterns) > wsMaxPatterns {
+			return nil, fmt.Errorf("at most %d patterns per connection", wsMaxPatterns)
+		}
+		for _, pattern := range req.Patterns {
+			p.set[pattern] = struct{}{}
+		}
+	} else {
+		for _, pattern := range req.Patterns {
+			delete(p.set, pattern)
+		}
+	}
+
+	current := make([]string, 0, len(p.set))
+	for pattern := range p.set {
+		current = append(current, pattern)
+	}
+	sort.Strings(current)
+
+	return current, nil
+}
+
+// SubscribeWS serves GET /ws. Clients send subscribe/unsubscribe requests
+// with metric name patterns and receive matching updates as they are
+// stored.
+func (h *Handler) SubscribeWS(w http.ResponseWriter, r *http.Request) {
+	patterns := &wsPatterns{set: make(map[string]struct{})}
+	queue := h.service.SubscribeQueue(r.Context(), wsQueueSize, patterns.match)
+	if queue == nil {
+		errdefs.WriteProblem(w, r, errdefs.New(http.StatusNotImplemented, errdefs.CodeFeatureDisabled, "streaming is disabled"))
+		return
+	}
+	defer queue.Close()
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Log.Info("websocket upgrade failed", zap.Error(err))
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	replies := make(chan wsMessage, 8)
+	go func() {
+		defer cancel()
+		readWS(ctx, conn, patterns, replies)
+	}()
+
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+
+	limiter := rate.NewLimiter(wsRate, wsBurst)
+	var reportedDrops uint64
+
+	write := func(msg wsMessage) error {
+		_ = conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+		return conn.WriteJSON(msg)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-queue.Done():
+			_ = conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutdown"),
+				time.Now().Add(wsWriteWait))
+			return
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				return
+			}
+		case msg := <-replies:
+			if err := write(msg); err != nil {
+				return
+			}
+		case <-queue.Ready():
+			if err := limiter.Wait(ctx); err != nil {
+				return
+			}
+			if dropped := queue.Dropped(); dropped != reportedDrops {
+				if err := write(wsMessage{Type: "dropped", Dropped: dropped - reportedDrops}); err != nil {
+					return
+				}
+				reportedDrops = dropped
+			}
+			for _, e := range queue.Drain(1) {
+				if err := write(wsMessage{Type: "metric", Metric: &e}); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// readWS handles client requests until the connection fails or ctx ends.
+// Replies are handed to the writer through replies, since a websocket
+// connection supports only one concurrent writer.
+func readWS(ctx context.Context, conn *websocket.Conn, patterns *wsPatterns, replies chan<- wsMessage) {
+	conn.SetReadLimit(wsReadLimit)
+	_ = conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var reply wsMessage
+		var req wsRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			reply = wsMessage{Type: "error", Error: "invalid request"}
+		} else if current, err := patterns.apply(req); err != nil {
+			reply = wsMessage{Type: "error", Error: err.Error()}
+		} else {
+			reply = wsMessage{Type: "ack", Patterns: current}
+		}
+
+		if !sendReply(ctx, replies, reply) {
+			return
+		}
+	}
+}
+
+func sendReply(ctx context.Context, replies chan<- wsMessage, msg wsMessage) bool {
+	select {
+	case replies <- msg:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
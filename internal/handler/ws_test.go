@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zubans/metrics/internal/middlewares"
+	"github.com/zubans/metrics/internal/pubsub"
+	"github.com/zubans/metrics/internal/services"
+	"github.com/zubans/metrics/internal/storage"
+)
+
+func TestHandler_SubscribeWS(t *testing.T) {
+	h := NewHandler(services.NewMetricService(storage.NewMemStorage(), services.WithHub(pubsub.NewHub())))
+	r := chi.NewRouter()
+	r.Use(middleware.Compress(5, "text/html", "application/json"))
+	r.Post("/update/{type}/{name}/{value}", h.UpdateMetric)
+	r.Get("/ws", h.SubscribeWS)
+	// RequestLogger wraps the writer the same way the server does.
+	srv := httptest.NewServer(middlewares.RequestLogger(r))
+	defer srv.Close()
+
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	defer conn.Close()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	read := func() wsMessage {
+		t.Helper()
+		var msg wsMessage
+		require.NoError(t, conn.ReadJSON(&msg))
+		return msg
+	}
+
+	require.NoError(t, conn.WriteJSON(wsRequest{Action: "subscribe", Patterns: []string{"Poll*", "Alloc"}}))
+	assert.Equal(t, wsMessage{Type: "ack", Patterns: []string{"Alloc", "Poll*"}}, read())
+
+	for _, path := range []string{"/update/gauge/HeapAlloc/1", "/update/counter/PollCount/2"} {
+		res, err := http.Post(srv.URL+path, "text/plain", nil)
+		require.NoError(t, err)
+		_ = res.Body.Close()
+	}
+
+	msg := read()
+	require.Equal(t, "metric", msg.Type)
+	assert.Equal(t, "PollCount", msg.Metric.ID)
+	assert.Equal(t, int64(2), *msg.Metric.Delta)
+
+	require.NoError(t, conn.WriteJSON(wsRequest{Action: "unsubscribe", Patterns: []string{"Poll*"}}))
+	assert.Equal(t, wsMessage{Type: "ack", Patterns: []string{"Alloc"}}, read())
+
+	require.NoError(t, conn.WriteJSON(wsRequest{Action: "subscribe", Patterns: []string{"["}}))
+	assert.Equal(t, "error", read().Type)
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("not json")))
+	assert.Equal(t, wsMessage{Type: "error", Error: "invalid request"}, read())
+}
+
+func TestWSPatterns_Apply(t *testing.T) {
+	p := &wsPatterns{set: make(map[string]struct{})}
+
+	_, err := p.apply(wsRequest{Action: "watch", Patterns: []string{"a"}})
+	assert.Error(t, err)
+	_, err = p.apply(wsRequest{Action: "subscribe"})
+	assert.Error(t, err)
+
+	many := make([]string, wsMaxPatterns+1)
+	for i := range many {
+		many[i] = strings.Repeat("a", i+1)
+	}
+	_, err = p.apply(wsRequest{Action: "subscribe", Patterns: many})
+	assert.Error(t, err, "pattern limit must be enforced")
+}
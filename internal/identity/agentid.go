@@ -0,0 +1,59 @@
+package identity
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// LoadOrCreateAgentID returns "<hostname>-<uuid>" where the UUID is read from
+// path, or generated and stored there on first start so the ID survives
+// restarts.
+func LoadOrCreateAgentID(path string) (string, error) {
+	id, err := loadOrCreateUUID(path)
+	if err != nil {
+		return "", err
+	}
+
+	return NewAgentID(id), nil
+}
+
+// NewAgentID builds an agent ID from the host name and the given UUID.
+func NewAgentID(id uuid.UUID) string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "unknown"
+	}
+
+	return host + "-" + id.String()
+}
+
+func loadOrCreateUUID(path string) (uuid.UUID, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		id, err := uuid.Parse(strings.TrimSpace(string(data)))
+		if err != nil {
+			return uuid.Nil, fmt.Errorf("invalid agent id in %s: %w", path, err)
+		}
+		return id, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return uuid.Nil, err
+	}
+
+	id := uuid.New()
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return uuid.Nil, err
+		}
+	}
+	if err := os.WriteFile(path, []byte(id.String()+"\n"), 0o644); err != nil {
+		return uuid.Nil, err
+	}
+
+	return id, nil
+}
@@ -0,0 +1,34 @@
+package identity
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadOrCreateAgentID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "agent_id")
+
+	first, err := LoadOrCreateAgentID(path)
+	require.NoError(t, err)
+
+	host, err := os.Hostname()
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(first, host+"-"), "agent id %q must start with the host name", first)
+
+	second, err := LoadOrCreateAgentID(path)
+	require.NoError(t, err)
+	assert.Equal(t, first, second, "agent id must be stable across restarts")
+}
+
+func TestLoadOrCreateAgentID_InvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent_id")
+	require.NoError(t, os.WriteFile(path, []byte("not-a-uuid"), 0o600))
+
+	_, err := LoadOrCreateAgentID(path)
+	assert.Error(t, err)
+}
@@ -0,0 +1,54 @@
+// Package identity carries the identity of the agent that sent a request
+// through the request context.
+//
+// The agent ID is whatever the client claims and only labels its metrics.
+// Limits are enforced per client key instead, which the client can't pick
+// freely: the authenticated token or the remote address.
+package identity
+
+import "context"
+
+// Request headers agents use to identify themselves.
+const (
+	AgentIDHeader      = "X-Agent-ID"
+	AgentVersionHeader = "X-Agent-Version"
+)
+
+type (
+	agentIDKey      struct{}
+	agentVersionKey struct{}
+	clientKey       struct{}
+)
+
+// WithAgentID returns a copy of ctx carrying the agent ID.
+func WithAgentID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, agentIDKey{}, id)
+}
+
+// AgentID returns the agent ID stored in ctx, or "" for anonymous requests.
+func AgentID(ctx context.Context) string {
+	id, _ := ctx.Value(agentIDKey{}).(string)
+	return id
+}
+
+// WithAgentVersion returns a copy of ctx carrying the agent build version.
+func WithAgentVersion(ctx context.Context, version string) context.Context {
+	return context.WithValue(ctx, agentVersionKey{}, version)
+}
+
+// AgentVersion returns the agent build version stored in ctx, if any.
+func AgentVersion(ctx context.Context) string {
+	v, _ := ctx.Value(agentVersionKey{}).(string)
+	return v
+}
+
+// WithClient returns a copy of ctx carrying the client key.
+func WithClient(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, clientKey{}, key)
+}
+
+// Client returns the client key stored in ctx, or "" if none was set.
+func Client(ctx context.Context) string {
+	key, _ := ctx.Value(clientKey{}).(string)
+	return key
+}
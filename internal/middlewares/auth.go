@@ -0,0 +1,73 @@
+package middlewares
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/zubans/metrics/internal/auth"
+	"github.com/zubans/metrics/internal/errdefs"
+)
+
+// Authenticate stores the token of requests carrying a known
+// "Authorization: Bearer" token in the request context. Other requests pass
+// unauthenticated; RequireRole turns them away where a role is needed. Nil
+// tokens disable authentication.
+func Authenticate(tokens *auth.Tokens) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tokens == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if secret, ok := bearerToken(r); ok {
+				if tok, ok := tokens.Lookup(secret); ok {
+					r = r.WithContext(auth.NewContext(r.Context(), tok))
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireRole lets through requests authenticated with a token that grants
+// role, so Authenticate must run first. Requests without a known token get
+// 401, requests whose token lacks the role get 403. Nil tokens disable
+// authentication.
+func RequireRole(tokens *auth.Tokens, role auth.Role) func(http.Handler) http.Handler {
+	if tokens == nil {
+		return func(next http.Handler) http.Handler { return next }
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tok, ok := auth.FromContext(r.Context())
+			if !ok {
+				if _, sent := bearerToken(r); sent {
+					w.Header().Set("WWW-Authenticate", `Bearer realm="metrics", error="invalid_token"`)
+					errdefs.WriteProblem(w, r, errdefs.New(http.StatusUnauthorized, errdefs.CodeUnauthorized, "invalid bearer token"))
+					return
+				}
+				w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+				errdefs.WriteProblem(w, r, errdefs.New(http.StatusUnauthorized, errdefs.CodeUnauthorized, "bearer token required"))
+				return
+			}
+
+			if !tok.Has(role) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="metrics", error="insufficient_scope"`)
+				errdefs.WriteProblem(w, r, errdefs.New(http.StatusForbidden, errdefs.CodeForbidden,
+					"token "+tok.Name+" lacks the "+string(role)+" role"))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
@@ -3,10 +3,12 @@ package middlewares
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 
 	"github.com/zubans/metrics/internal/cryptoutil"
+	"github.com/zubans/metrics/internal/errdefs"
 )
 
 func DecryptRequestMiddleware(decrypt func(*cryptoutil.Envelope) ([]byte, error)) func(http.Handler) http.Handler {
@@ -19,12 +21,17 @@ func DecryptRequestMiddleware(decrypt func(*cryptoutil.Envelope) ([]byte, error)
 
 			var env cryptoutil.Envelope
 			if err := json.NewDecoder(r.Body).Decode(&env); err != nil {
-				http.Error(w, "invalid encrypted payload", http.StatusBadRequest)
+				var tooLarge *http.MaxBytesError
+				if errors.As(err, &tooLarge) {
+					errdefs.WriteProblem(w, r, errdefs.TooLarge(tooLarge))
+					return
+				}
+				errdefs.WriteProblem(w, r, errdefs.NewBadRequestError(errdefs.CodeInvalidRequest, "invalid encrypted payload"))
 				return
 			}
 			plaintext, err := decrypt(&env)
 			if err != nil {
-				http.Error(w, "decryption failed", http.StatusBadRequest)
+				errdefs.WriteProblem(w, r, errdefs.NewBadRequestError(errdefs.CodeInvalidRequest, "decryption failed"))
 				return
 			}
 			r.Body = io.NopCloser(bytes.NewReader(plaintext))
@@ -0,0 +1,22 @@
+package middlewares
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Deprecated marks responses of a legacy endpoint as deprecated since the
+// given time (RFC 9745) and links the endpoint replacing it.
+func Deprecated(since time.Time, successor string) func(http.Handler) http.Handler {
+	deprecation := fmt.Sprintf("@%d", since.Unix())
+	link := fmt.Sprintf("<%s>; rel=\"successor-version\"", successor)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Deprecation", deprecation)
+			w.Header().Add("Link", link)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -2,8 +2,14 @@ package middlewares
 
 import (
 	"compress/gzip"
+	"errors"
+	"io"
 	"net/http"
 	"strings"
+
+	"github.com/zubans/metrics/internal/errdefs"
+	"github.com/zubans/metrics/internal/logger"
+	"go.uber.org/zap"
 )
 
 type gzipResponseWriter struct {
@@ -15,33 +21,46 @@ func (w gzipResponseWriter) Write(b []byte) (int, error) {
 	return w.Writer.Write(b)
 }
 
+// GzipMiddleware decompresses gzip request bodies without a size limit and
+// compresses responses for clients accepting gzip.
 func GzipMiddleware(next http.Handler) http.Handler {
+	return NewGzipMiddleware(0)(next)
+}
+
+// NewGzipMiddleware is like GzipMiddleware but fails reads of decompressed
+// bodies past maxDecompressed bytes with an *http.MaxBytesError, so a small
+// gzip bomb can't inflate into memory. A non-positive limit disables it.
+func NewGzipMiddleware(maxDecompressed int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return gunzip(next, maxDecompressed)
+	}
+}
+
+func gunzip(next http.Handler, maxDecompressed int64) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if strings.Contains(r.Header.Get("Content-Encoding"), "gzip") {
 			gzReader, err := gzip.NewReader(r.Body)
 			if err != nil {
-				http.Error(w, "Invalid gzip body", http.StatusBadRequest)
+				var tooLarge *http.MaxBytesError
+				if errors.As(err, &tooLarge) {
+					errdefs.WriteProblem(w, r, errdefs.TooLarge(tooLarge))
+					return
+				}
+				errdefs.WriteProblem(w, r, errdefs.NewBadRequestError(errdefs.CodeInvalidRequest, "invalid gzip body"))
 				return
 			}
 
-			defer func(gzReader *gzip.Reader) {
-				err := gzReader.Close()
-				if err != nil {
-					http.Error(w, "Error close gzReader", http.StatusBadRequest)
-				}
-			}(gzReader)
+			defer closeGzip(gzReader, "reader")
 			r.Body = gzReader
+			if maxDecompressed > 0 {
+				r.Body = http.MaxBytesReader(w, gzReader, maxDecompressed)
+			}
 
 			if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
 				w.Header().Set("Content-Encoding", "gzip")
 
 				gw := gzip.NewWriter(w)
-				defer func(gw *gzip.Writer) {
-					err := gw.Close()
-					if err != nil {
-						http.Error(w, "Error close gzWriter", http.StatusBadRequest)
-					}
-				}(gw)
+				defer closeGzip(gw, "writer")
 
 				gzipWriter := gzipResponseWriter{Writer: gw, ResponseWriter: w}
 				next.ServeHTTP(gzipWriter, r)
@@ -53,12 +72,7 @@ func GzipMiddleware(next http.Handler) http.Handler {
 			w.Header().Set("Content-Encoding", "gzip")
 			w.Header().Set("Content-Type", "text/html")
 			gw := gzip.NewWriter(w)
-			defer func(gw *gzip.Writer) {
-				err := gw.Close()
-				if err != nil {
-					http.Error(w, "Error close gzWriter", http.StatusBadRequest)
-				}
-			}(gw)
+			defer closeGzip(gw, "writer")
 
 			gzipWriter := gzipResponseWriter{Writer: gw, ResponseWriter: w}
 			next.ServeHTTP(gzipWriter, r)
@@ -68,3 +82,11 @@ func GzipMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// closeGzip only logs close errors: the handler has already sent the
+// response, so its status can't change any more.
+func closeGzip(c io.Closer, what string) {
+	if err := c.Close(); err != nil {
+		logger.Log.Info("failed to close gzip "+what, zap.Error(err))
+	}
+}
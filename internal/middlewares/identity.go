@@ -0,0 +1,65 @@
+package middlewares
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/zubans/metrics/internal/auth"
+	"github.com/zubans/metrics/internal/errdefs"
+	"github.com/zubans/metrics/internal/identity"
+)
+
+// maxAgentIDLength bounds the agent ID taken from the request header.
+const maxAgentIDLength = 128
+
+// AgentIdentity stores the agent ID and version from the X-Agent-ID and
+// X-Agent-Version headers in the request context. Requests without an ID
+// stay anonymous.
+func AgentIdentity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimSpace(r.Header.Get(identity.AgentIDHeader))
+		if id == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		version := strings.TrimSpace(r.Header.Get(identity.AgentVersionHeader))
+		if len(id) > maxAgentIDLength || len(version) > maxAgentIDLength {
+			errdefs.WriteProblem(w, r, errdefs.NewBadRequestError(errdefs.CodeInvalidRequest, "agent identity is too long"))
+			return
+		}
+
+		ctx := identity.WithAgentID(r.Context(), id)
+		if version != "" {
+			ctx = identity.WithAgentVersion(ctx, version)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// ClientIdentity stores the client key of the request in the context, see
+// package identity. Authenticated requests are keyed by token, others by
+// remote address, so Authenticate must run first.
+func ClientIdentity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(identity.WithClient(r.Context(), clientKey(r))))
+	})
+}
+
+// clientKey is "token:<name>" for authenticated requests and "ip:<address>"
+// for others. IPv6 clients are grouped by /64, the block a single host
+// usually gets.
+func clientKey(r *http.Request) string {
+	if tok, ok := auth.FromContext(r.Context()); ok {
+		return "token:" + tok.Name
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		host = ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+	}
+	return "ip:" + host
+}
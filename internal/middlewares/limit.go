@@ -0,0 +1,27 @@
+package middlewares
+
+import (
+	"net/http"
+
+	"github.com/zubans/metrics/internal/errdefs"
+)
+
+// LimitBody rejects request bodies over max bytes with 413. Bodies with a
+// known length are rejected before they are read; others fail with an
+// *http.MaxBytesError once the limit is crossed. A non-positive max disables
+// the limit.
+func LimitBody(max int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if max <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > max {
+				errdefs.WriteProblem(w, r, errdefs.TooLarge(&http.MaxBytesError{Limit: max}))
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, max)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -1,10 +1,13 @@
 package middlewares
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
 	"github.com/zubans/metrics/internal/logger"
 	"go.uber.org/zap"
 	"io"
+	"net"
 	"net/http"
 	"time"
 )
@@ -48,19 +51,56 @@ func (r *loggingResponseWriter) WriteHeader(status int) {
 	r.responseData.status = status
 }
 
+// Flush passes flushes of streaming responses through to the client.
+func (r *loggingResponseWriter) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets websocket upgrades take over the connection.
+func (r *loggingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	r.responseData.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// maxLoggedBody is how much of a request body is logged.
+const maxLoggedBody = 1024
+
+// bodyPrefix passes a request body through to the handler and keeps the
+// first maxLoggedBody bytes it reads for the log.
+type bodyPrefix struct {
+	io.ReadCloser
+	prefix bytes.Buffer
+}
+
+func (b *bodyPrefix) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if room := maxLoggedBody - b.prefix.Len(); room > 0 {
+		b.prefix.Write(p[:min(n, room)])
+	}
+	return n, err
+}
+
+// RequestLogger logs every request with the start of its body as far as
+// the handler read it. Bodies are streamed, not buffered.
 func RequestLogger(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 
-		var bodyString string
+		var body *bodyPrefix
 		if r.Method == http.MethodPost || r.Method == http.MethodPut {
-			bodyBytes, err := io.ReadAll(r.Body)
-			if err != nil {
-				logger.Log.Info("failed to read request body", zap.Error(err))
-			} else {
-				bodyString = string(bodyBytes)
-				r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
-			}
+			body = &bodyPrefix{ReadCloser: r.Body}
+			r.Body = body
 		}
 
 		responseData := &responseData{
@@ -74,6 +114,11 @@ func RequestLogger(h http.Handler) http.Handler {
 		}
 		h.ServeHTTP(lw, r)
 
+		var bodyString string
+		if body != nil {
+			bodyString = body.prefix.String()
+		}
+
 		duration := time.Since(start)
 		logger.Log.Info("got incoming HTTP request",
 			zap.Any("request", RequestInfo{
@@ -0,0 +1,123 @@
+package middlewares
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zubans/metrics/internal/errdefs"
+	"github.com/zubans/metrics/internal/identity"
+	"golang.org/x/time/rate"
+)
+
+// rateLimitIdle bounds how long an idle client keeps its bucket. Buckets are
+// dropped earlier once they would have refilled, see RateLimiter.prune.
+const rateLimitIdle = 10 * time.Minute
+
+// RateLimiter gives every client a token bucket of burst requests refilled
+// at rps per second. Clients are told apart by the key ClientIdentity
+// stores, the token or the remote address; the agent ID header is ignored,
+// as any client could rotate it for fresh buckets.
+type RateLimiter struct {
+	limit rate.Limit
+	burst int
+	now   func() time.Time
+
+	mu        sync.Mutex
+	clients   map[string]*rateClient
+	lastPrune time.Time
+}
+
+type rateClient struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// NewRateLimiter allows rps requests per second with bursts of burst
+// requests per client. A non-positive burst defaults to rps rounded up.
+func NewRateLimiter(rps float64, burst int) *RateLimiter {
+	if burst <= 0 {
+		burst = int(math.Max(1, math.Ceil(rps)))
+	}
+	return &RateLimiter{
+		limit:   rate.Limit(rps),
+		burst:   burst,
+		now:     time.Now,
+		clients: make(map[string]*rateClient),
+	}
+}
+
+// RateLimit limits requests per client, see RateLimiter. A non-positive rps
+// disables the limit.
+func RateLimit(rps float64, burst int) func(http.Handler) http.Handler {
+	if rps <= 0 {
+		return func(next http.Handler) http.Handler { return next }
+	}
+	return NewRateLimiter(rps, burst).Middleware
+}
+
+// Middleware answers requests over the limit with 429 and a Retry-After
+// header telling when the next request is allowed.
+func (l *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := identity.Client(r.Context())
+		if key == "" {
+			key = clientKey(r)
+		}
+		if wait := l.reserve(key); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			errdefs.WriteProblem(w, r, errdefs.New(http.StatusTooManyRequests, errdefs.CodeRateLimited, "rate limit exceeded"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// reserve takes a token for key and returns zero, or how long the client
+// has to wait for one when the bucket is empty.
+func (l *RateLimiter) reserve(key string) time.Duration {
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.prune(now)
+
+	c, ok := l.clients[key]
+	if !ok {
+		c = &rateClient{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[key] = c
+	}
+	c.lastSeen = now
+
+	res := c.limiter.ReserveN(now, 1)
+	if !res.OK() {
+		return time.Second
+	}
+	if wait := res.DelayFrom(now); wait > 0 {
+		res.CancelAt(now)
+		return wait
+	}
+	return 0
+}
+
+// prune drops, at most once a minute, clients idle long enough for their
+// bucket to be full again, so rotating keys can't grow the map forever.
+func (l *RateLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+
+	idle := rateLimitIdle
+	if refill := time.Duration(float64(l.burst) / float64(l.limit) * float64(time.Second)); refill < idle {
+		idle = refill
+	}
+	for k, c := range l.clients {
+		if now.Sub(c.lastSeen) >= idle {
+			delete(l.clients, k)
+		}
+	}
+}
@@ -50,3 +50,10 @@ func ConvertMetricsListToDTO(metrics []Metric) []MetricsDTO {
 	}
 	return result
 }
+
+// Snapshot is a point-in-time copy of all stored metrics. The maps are owned
+// by the caller and are never touched by the storage after being returned.
+type Snapshot struct {
+	Gauges   map[string]float64 `json:"gauges"`
+	Counters map[string]int64   `json:"counters"`
+}
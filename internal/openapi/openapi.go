@@ -0,0 +1,257 @@
+// Package openapi embeds the OpenAPI 3 specification of the server API,
+// serves it and validates requests against it.
+package openapi
+
+import (
+	"bytes"
+	"compress/gzip"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/legacy"
+	"github.com/zubans/metrics/internal/errdefs"
+)
+
+//go:embed openapi.yaml
+var specYAML []byte
+
+// Spec is the parsed specification.
+type Spec struct {
+	Doc *openapi3.T
+	// MaxDecompressed limits gzip bodies inflated for validation, in bytes.
+	// Zero means no limit.
+	MaxDecompressed int64
+
+	router routers.Router
+	json   []byte
+}
+
+// Load parses and checks the embedded specification.
+func Load() (*Spec, error) {
+	loader := openapi3.NewLoader()
+	doc, err := loader.LoadFromData(specYAML)
+	if err != nil {
+		return nil, err
+	}
+	if err = doc.Validate(loader.Context); err != nil {
+		return nil, err
+	}
+
+	router, err := legacy.NewRouter(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Spec{Doc: doc, router: router, json: raw}, nil
+}
+
+// MustLoad is like Load but panics on error. The specification is embedded,
+// so an error is a bug caught by the tests.
+func MustLoad() *Spec {
+	s, err := Load()
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// ServeHTTP serves the specification as JSON.
+func (s *Spec) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(s.json)
+}
+
+// Validate rejects requests that do not match the parameters and request
+// body of their operation with a 400 problem. Requests for paths or
+// methods missing from the specification are passed on unchecked, so the
+// router reports them.
+//
+// The body is read for validation and restored afterwards; gzip-encoded
+// bodies are validated decompressed and passed on as sent. Operations
+// marked x-streamed-body, the batch updates, are checked without their
+// body: their handlers decode it as a stream and stop at the batch limit,
+// which buffering the whole body here would defeat.
+func (s *Spec) Validate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, pathParams, err := s.router.FindRoute(r)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		streamed, _ := route.Operation.Extensions["x-streamed-body"].(bool)
+		req := r.Clone(r.Context())
+		if route.Operation.RequestBody != nil && !streamed {
+			raw, err := io.ReadAll(r.Body)
+			if err != nil {
+				errdefs.WriteProblem(w, r, bodyError(err, "can't read request body"))
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(raw))
+
+			body, err := decode(r.Header, raw, s.MaxDecompressed)
+			if err != nil {
+				errdefs.WriteProblem(w, r, bodyError(err, "invalid gzip body"))
+				return
+			}
+			req.Body = io.NopCloser(bytes.NewReader(body))
+			// Handlers decode JSON whatever the client declares, so the
+			// body is checked as JSON too.
+			req.Header.Del("Content-Encoding")
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		err = openapi3filter.ValidateRequest(r.Context(), &openapi3filter.RequestValidationInput{
+			Request:    req,
+			PathParams: pathParams,
+			Route:      route,
+			Options: &openapi3filter.Options{
+				MultiError:          true,
+				SkipSettingDefaults: true,
+				ExcludeRequestBody:  streamed,
+				AuthenticationFunc:  openapi3filter.NoopAuthenticationFunc,
+			},
+		})
+		if err != nil {
+			errdefs.WriteProblem(w, r, problem(err))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func decode(h http.Header, raw []byte, max int64) ([]byte, error) {
+	if !strings.Contains(h.Get("Content-Encoding"), "gzip") {
+		return raw, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	if max <= 0 {
+		return io.ReadAll(zr)
+	}
+	body, err := io.ReadAll(io.LimitReader(zr, max+1))
+	if err == nil && int64(len(body)) > max {
+		err = &http.MaxBytesError{Limit: max}
+	}
+	return body, err
+}
+
+// bodyError reports a body over a size limit as 413 and other read errors
+// as invalid requests.
+func bodyError(err error, message string) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return errdefs.TooLarge(tooLarge)
+	}
+	return errdefs.NewBadRequestError(errdefs.CodeInvalidRequest, message)
+}
+
+// problem turns validation errors into a validation problem listing the
+// invalid fields. Bodies that can't be decoded are reported as invalid
+// requests.
+func problem(err error) error {
+	var (
+		fields  []errdefs.FieldError
+		invalid *openapi3filter.RequestError
+	)
+	for _, e := range flatten(err) {
+		reqErr, ok := e.(*openapi3filter.RequestError)
+		if !ok {
+			fields = append(fields, errdefs.FieldError{Message: e.Error()})
+			continue
+		}
+
+		field := ""
+		if reqErr.Parameter != nil {
+			field = reqErr.Parameter.Name
+		}
+
+		schemaErrs := schemaErrors(reqErr.Err)
+		if len(schemaErrs) == 0 {
+			if reqErr.Parameter == nil {
+				invalid = reqErr
+				continue
+			}
+			msg := reqErr.Reason
+			if msg == "" && reqErr.Err != nil {
+				msg = reqErr.Err.Error()
+			}
+			fields = append(fields, errdefs.FieldError{Field: field, Message: msg})
+			continue
+		}
+		for _, se := range schemaErrs {
+			if reqErr.Parameter == nil {
+				field = fieldPath(se.JSONPointer())
+			}
+			fields = append(fields, errdefs.FieldError{Field: field, Message: se.Reason})
+		}
+	}
+
+	if len(fields) == 0 && invalid != nil {
+		msg := "invalid JSON body"
+		if invalid.Err != nil {
+			msg += ": " + invalid.Err.Error()
+		}
+		return errdefs.NewBadRequestError(errdefs.CodeInvalidRequest, msg)
+	}
+	return errdefs.NewValidationError("request does not match the API specification", fields...)
+}
+
+// flatten unpacks nested multi-errors without looking into wrapped errors.
+func flatten(err error) []error {
+	me, ok := err.(openapi3.MultiError)
+	if !ok {
+		return []error{err}
+	}
+	var res []error
+	for _, e := range me {
+		res = append(res, flatten(e)...)
+	}
+	return res
+}
+
+func schemaErrors(err error) []*openapi3.SchemaError {
+	var res []*openapi3.SchemaError
+	for _, e := range flatten(err) {
+		var se *openapi3.SchemaError
+		if errors.As(e, &se) {
+			res = append(res, se)
+		}
+	}
+	return res
+}
+
+// fieldPath formats a JSON pointer the way errdefs.FieldError expects,
+// e.g. "[2].value".
+func fieldPath(pointer []string) string {
+	var sb strings.Builder
+	for _, p := range pointer {
+		if p != "" && strings.Trim(p, "0123456789") == "" {
+			sb.WriteString("[" + p + "]")
+			continue
+		}
+		if sb.Len() > 0 {
+			sb.WriteByte('.')
+		}
+		sb.WriteString(p)
+	}
+	return sb.String()
+}
@@ -0,0 +1,151 @@
+package openapi
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zubans/metrics/internal/errdefs"
+)
+
+func TestSpec_ServeHTTP(t *testing.T) {
+	spec, err := Load()
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	spec.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var doc map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &doc))
+	assert.Contains(t, doc, "paths")
+}
+
+func TestSpec_Validate(t *testing.T) {
+	spec := MustLoad()
+
+	gzipped := func(s string) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, _ = zw.Write([]byte(s))
+		_ = zw.Close()
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		body     []byte
+		encoding string
+		status   int
+		code     errdefs.Code
+		fields   []string
+	}{
+		{
+			name:   "valid gauge",
+			method: http.MethodPost,
+			target: "/update/",
+			body:   []byte(`{"id":"Alloc","type":"gauge","value":1.5}`),
+			status: http.StatusOK,
+		},
+		{
+			name:   "invalid dto",
+			method: http.MethodPost,
+			target: "/update/",
+			body:   []byte(`{"id":"","type":"foo","value":"x"}`),
+			status: http.StatusBadRequest,
+			code:   errdefs.CodeValidationFailed,
+			fields: []string{"id", "type", "value"},
+		},
+		{
+			name:   "batch body is left to the handler",
+			method: http.MethodPost,
+			target: "/updates/",
+			body:   []byte(`[{"id":"a","type":"gauge","value":1},{"id":"b","type":"counter","delta":1.5}]`),
+			status: http.StatusOK,
+		},
+		{
+			name:   "not json",
+			method: http.MethodPost,
+			target: "/update/",
+			body:   []byte(`{bad`),
+			status: http.StatusBadRequest,
+			code:   errdefs.CodeInvalidRequest,
+		},
+		{
+			name:     "gzip body",
+			method:   http.MethodPost,
+			target:   "/update/",
+			body:     gzipped(`{"id":"PollCount","type":"counter","delta":1}`),
+			encoding: "gzip",
+			status:   http.StatusOK,
+		},
+		{
+			name:     "broken gzip body",
+			method:   http.MethodPost,
+			target:   "/update/",
+			body:     []byte("not gzip"),
+			encoding: "gzip",
+			status:   http.StatusBadRequest,
+			code:     errdefs.CodeInvalidRequest,
+		},
+		{
+			name:   "missing query parameter",
+			method: http.MethodGet,
+			target: "/query",
+			status: http.StatusBadRequest,
+			code:   errdefs.CodeValidationFailed,
+			fields: []string{"expr"},
+		},
+		{
+			name:   "unknown path",
+			method: http.MethodGet,
+			target: "/nowhere",
+			status: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []byte
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got, _ = io.ReadAll(r.Body)
+				w.WriteHeader(http.StatusOK)
+			})
+
+			r := httptest.NewRequest(tt.method, tt.target, bytes.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/json")
+			if tt.encoding != "" {
+				r.Header.Set("Content-Encoding", tt.encoding)
+			}
+			w := httptest.NewRecorder()
+			spec.Validate(next).ServeHTTP(w, r)
+
+			require.Equal(t, tt.status, w.Code, w.Body.String())
+			if tt.status == http.StatusOK {
+				assert.Equal(t, string(tt.body), string(got), "body must reach the handler as sent")
+				return
+			}
+
+			assert.Equal(t, errdefs.ProblemContentType, w.Header().Get("Content-Type"))
+			var p errdefs.Problem
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &p))
+			assert.Equal(t, tt.code, p.Code)
+
+			var fields []string
+			for _, f := range p.Errors {
+				fields = append(fields, f.Field)
+			}
+			assert.ElementsMatch(t, tt.fields, fields)
+		})
+	}
+}
@@ -0,0 +1,324 @@
+// Package pubsub fans metric updates out to streaming subscribers.
+//
+// Publishers never block. A Subscription keeps only the latest pending event
+// per metric, so a slow subscriber sees fewer, coalesced updates. A Queue
+// keeps every event in order up to a fixed size and drops the oldest ones
+// when the subscriber falls behind.
+package pubsub
+
+import (
+	"sync"
+
+	"github.com/zubans/metrics/internal/models"
+)
+
+// Filter selects the events a subscription receives. Empty sets match
+// everything.
+type Filter struct {
+	Names map[string]struct{}
+	Types map[string]struct{}
+}
+
+// Match reports whether m passes the filter.
+func (f Filter) Match(m models.MetricsDTO) bool {
+	if len(f.Names) > 0 {
+		if _, ok := f.Names[m.ID]; !ok {
+			return false
+		}
+	}
+	if len(f.Types) > 0 {
+		if _, ok := f.Types[m.MType]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+type subscriber interface {
+	push(events []models.MetricsDTO)
+	close()
+}
+
+// Hub delivers published events to all matching subscriptions.
+type Hub struct {
+	mu     sync.RWMutex
+	subs   map[subscriber]struct{}
+	closed bool
+}
+
+// NewHub creates an empty Hub.
+func NewHub() *Hub {
+	return &Hub{subs: make(map[subscriber]struct{})}
+}
+
+// Subscribe registers a new coalescing subscription. Subscriptions of a
+// closed hub are closed right away.
+func (h *Hub) Subscribe(f Filter) *Subscription {
+	s := &Subscription{
+		hub:     h,
+		filter:  f,
+		pending: make(map[key]models.MetricsDTO),
+		ready:   make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	h.add(s)
+
+	return s
+}
+
+// SubscribeQueue registers a queue holding up to size events accepted by
+// match. match is called on every published event and must be safe for
+// concurrent use.
+func (h *Hub) SubscribeQueue(size int, match func(models.MetricsDTO) bool) *Queue {
+	if size < 1 {
+		size = 1
+	}
+	q := &Queue{
+		hub:   h,
+		match: match,
+		buf:   make([]models.MetricsDTO, size),
+		ready: make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+	h.add(q)
+
+	return q
+}
+
+func (h *Hub) add(s subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		s.close()
+		return
+	}
+	h.subs[s] = struct{}{}
+}
+
+// HasSubscribers reports whether anyone is listening, so publishers can skip
+// building events nobody reads.
+func (h *Hub) HasSubscribers() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.subs) > 0
+}
+
+// Publish queues events for every matching subscription.
+func (h *Hub) Publish(events ...models.MetricsDTO) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for s := range h.subs {
+		s.push(events)
+	}
+}
+
+// Close ends all subscriptions. Later subscriptions are closed immediately.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return
+	}
+	h.closed = true
+	for s := range h.subs {
+		s.close()
+		delete(h.subs, s)
+	}
+}
+
+func (h *Hub) remove(s subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs, s)
+}
+
+type key struct {
+	mType string
+	name  string
+}
+
+// Subscription receives coalesced events from a Hub.
+type Subscription struct {
+	hub    *Hub
+	filter Filter
+
+	mu      sync.Mutex
+	pending map[key]models.MetricsDTO
+	order   []key
+
+	ready     chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Ready is signalled when events are pending.
+func (s *Subscription) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Done is closed when the subscription or its hub is closed.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Drain returns the pending events in the order their metrics first changed
+// and clears the queue. Each metric appears at most once with its latest
+// value.
+func (s *Subscription) Drain() []models.MetricsDTO {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.order) == 0 {
+		return nil
+	}
+
+	events := make([]models.MetricsDTO, 0, len(s.order))
+	for _, k := range s.order {
+		events = append(events, s.pending[k])
+		delete(s.pending, k)
+	}
+	s.order = s.order[:0]
+
+	return events
+}
+
+// Close unsubscribes from the hub.
+func (s *Subscription) Close() {
+	s.hub.remove(s)
+	s.close()
+}
+
+func (s *Subscription) close() {
+	s.closeOnce.Do(func() { close(s.done) })
+}
+
+func (s *Subscription) push(events []models.MetricsDTO) {
+	s.mu.Lock()
+	added := false
+	for _, e := range events {
+		if !s.filter.Match(e) {
+			continue
+		}
+		k := key{mType: e.MType, name: e.ID}
+		if _, ok := s.pending[k]; !ok {
+			s.order = append(s.order, k)
+		}
+		s.pending[k] = e
+		added = true
+	}
+	s.mu.Unlock()
+
+	if !added {
+		return
+	}
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Queue receives every matching event in order. When it is full the oldest
+// event is dropped to make room.
+type Queue struct {
+	hub   *Hub
+	match func(models.MetricsDTO) bool
+
+	mu      sync.Mutex
+	buf     []models.MetricsDTO
+	head    int
+	n       int
+	dropped uint64
+
+	ready     chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Ready is signalled when events are pending.
+func (q *Queue) Ready() <-chan struct{} {
+	return q.ready
+}
+
+// Done is closed when the queue or its hub is closed.
+func (q *Queue) Done() <-chan struct{} {
+	return q.done
+}
+
+// Drain returns up to limit pending events, oldest first. A limit of zero or
+// less returns all of them. Ready is signalled again if events remain.
+func (q *Queue) Drain(limit int) []models.MetricsDTO {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	count := q.n
+	if limit > 0 && limit < count {
+		count = limit
+	}
+	if count == 0 {
+		return nil
+	}
+
+	events := make([]models.MetricsDTO, count)
+	for i := range events {
+		events[i] = q.buf[(q.head+i)%len(q.buf)]
+		q.buf[(q.head+i)%len(q.buf)] = models.MetricsDTO{}
+	}
+	q.head = (q.head + count) % len(q.buf)
+	q.n -= count
+
+	if q.n > 0 {
+		q.signal()
+	}
+
+	return events
+}
+
+// Dropped returns how many events were discarded because the queue was full.
+func (q *Queue) Dropped() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.dropped
+}
+
+// Close unsubscribes from the hub.
+func (q *Queue) Close() {
+	q.hub.remove(q)
+	q.close()
+}
+
+func (q *Queue) close() {
+	q.closeOnce.Do(func() { close(q.done) })
+}
+
+func (q *Queue) push(events []models.MetricsDTO) {
+	q.mu.Lock()
+	added := false
+	for _, e := range events {
+		if !q.match(e) {
+			continue
+		}
+		if q.n == len(q.buf) {
+			q.head = (q.head + 1) % len(q.buf)
+			q.n--
+			q.dropped++
+		}
+		q.buf[(q.head+q.n)%len(q.buf)] = e
+		q.n++
+		added = true
+	}
+	q.mu.Unlock()
+
+	if added {
+		q.signal()
+	}
+}
+
+func (q *Queue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,116 @@
+package pubsub
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zubans/metrics/internal/models"
+)
+
+func gauge(name string, v float64) models.MetricsDTO {
+	return models.MetricsDTO{ID: name, MType: string(models.Gauge), Value: &v}
+}
+
+func counter(name string, d int64) models.MetricsDTO {
+	return models.MetricsDTO{ID: name, MType: string(models.Counter), Delta: &d}
+}
+
+func TestHub_CoalescesPendingEvents(t *testing.T) {
+	h := NewHub()
+	s := h.Subscribe(Filter{})
+	defer s.Close()
+
+	h.Publish(gauge("Alloc", 1), counter("PollCount", 1))
+	h.Publish(gauge("Alloc", 2))
+	h.Publish(counter("PollCount", 3))
+
+	select {
+	case <-s.Ready():
+	default:
+		t.Fatal("subscription must be ready after publish")
+	}
+
+	events := s.Drain()
+	require.Len(t, events, 2)
+	assert.Equal(t, "Alloc", events[0].ID)
+	assert.Equal(t, 2.0, *events[0].Value)
+	assert.Equal(t, "PollCount", events[1].ID)
+	assert.Equal(t, int64(3), *events[1].Delta)
+
+	assert.Nil(t, s.Drain(), "drain must clear the queue")
+}
+
+func TestHub_Filter(t *testing.T) {
+	h := NewHub()
+	byName := h.Subscribe(Filter{Names: map[string]struct{}{"Alloc": {}}})
+	byType := h.Subscribe(Filter{Types: map[string]struct{}{string(models.Counter): {}}})
+
+	h.Publish(gauge("Alloc", 1), gauge("HeapAlloc", 2), counter("PollCount", 1))
+
+	events := byName.Drain()
+	require.Len(t, events, 1)
+	assert.Equal(t, "Alloc", events[0].ID)
+
+	<-byType.Ready()
+	events = byType.Drain()
+	require.Len(t, events, 1)
+	assert.Equal(t, "PollCount", events[0].ID)
+
+	byName.Close()
+	h.Publish(gauge("HeapAlloc", 3))
+	select {
+	case <-byType.Ready():
+		t.Fatal("filtered out events must not signal readiness")
+	default:
+	}
+}
+
+func TestHub_Close(t *testing.T) {
+	h := NewHub()
+	s := h.Subscribe(Filter{})
+	assert.True(t, h.HasSubscribers())
+
+	s.Close()
+	s.Close()
+	assert.False(t, h.HasSubscribers())
+
+	s = h.Subscribe(Filter{})
+	h.Close()
+	<-s.Done()
+
+	late := h.Subscribe(Filter{})
+	<-late.Done()
+	assert.False(t, h.HasSubscribers())
+}
+
+func TestQueue_DropsOldest(t *testing.T) {
+	h := NewHub()
+	q := h.SubscribeQueue(3, func(m models.MetricsDTO) bool { return m.MType == string(models.Counter) })
+	defer q.Close()
+
+	for i := int64(1); i <= 5; i++ {
+		h.Publish(counter("PollCount", i), gauge("Alloc", float64(i)))
+	}
+
+	assert.Equal(t, uint64(2), q.Dropped())
+
+	<-q.Ready()
+	events := q.Drain(2)
+	require.Len(t, events, 2)
+	assert.Equal(t, int64(3), *events[0].Delta)
+	assert.Equal(t, int64(4), *events[1].Delta)
+
+	select {
+	case <-q.Ready():
+	default:
+		t.Fatal("queue must stay ready while events remain")
+	}
+	events = q.Drain(0)
+	require.Len(t, events, 1)
+	assert.Equal(t, int64(5), *events[0].Delta)
+	assert.Nil(t, q.Drain(0))
+
+	h.Close()
+	<-q.Done()
+}
@@ -0,0 +1,474 @@
+// Package query implements a small expression language over stored metrics.
+//
+// A query combines selectors, numbers, arithmetic and functions:
+//
+//	HeapInuse / HeapSys
+//	Heap*{type="gauge"}
+//	{name=~"Gc.*", type!="counter"} * 2
+//	rate(PollCount[5m])
+//	sum(Heap*)
+//
+// Selectors return a vector of the matching metrics; arithmetic between a
+// vector and a number applies to every element, between two vectors it
+// pairs elements by name (or the single elements of two one-element
+// vectors). Range functions need a History.
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/zubans/metrics/internal/models"
+)
+
+// Labels every metric carries.
+const (
+	labelName = "name"
+	labelType = "type"
+)
+
+// ErrNoHistory is returned for range queries when no History is configured.
+var ErrNoHistory = errors.New("range queries need metric history, which is disabled")
+
+// Source is any metrics storage.
+type Source interface {
+	Snapshot(ctx context.Context) (models.Snapshot, error)
+}
+
+// Series is an element of a vector result.
+type Series struct {
+	Name  string  `json:"name"`
+	Type  string  `json:"type,omitempty"`
+	Value float64 `json:"value"`
+}
+
+// Result type names.
+const (
+	ScalarResult = "scalar"
+	VectorResult = "vector"
+)
+
+// Result is the value of a query: a scalar or a vector.
+type Result struct {
+	Type   string   `json:"type"`
+	Scalar *float64 `json:"value,omitempty"`
+	Vector []Series `json:"result,omitempty"`
+}
+
+// MarshalJSON always writes the result list of a vector, even when empty.
+func (r Result) MarshalJSON() ([]byte, error) {
+	if r.Type != VectorResult {
+		type plain Result
+		return json.Marshal(plain(r))
+	}
+
+	vector := r.Vector
+	if vector == nil {
+		vector = []Series{}
+	}
+	return json.Marshal(struct {
+		Type   string   `json:"type"`
+		Vector []Series `json:"result"`
+	}{Type: r.Type, Vector: vector})
+}
+
+// EvalError is a query that parsed but cannot be evaluated, e.g. a call of
+// an unknown function.
+type EvalError struct {
+	Msg string
+}
+
+func (e *EvalError) Error() string {
+	return e.Msg
+}
+
+func evalErrorf(format string, args ...any) error {
+	return &EvalError{Msg: fmt.Sprintf(format, args...)}
+}
+
+// Evaluator runs queries against a Source and an optional History.
+type Evaluator struct {
+	source  Source
+	history *History
+	now     func() time.Time
+}
+
+// NewEvaluator creates an Evaluator. history may be nil, which disables
+// range functions.
+func NewEvaluator(source Source, history *History) *Evaluator {
+	return &Evaluator{source: source, history: history, now: time.Now}
+}
+
+// Query parses and evaluates input.
+func (e *Evaluator) Query(ctx context.Context, input string) (*Result, error) {
+	expr, err := Parse(input)
+	if err != nil {
+		return nil, err
+	}
+	return e.Eval(ctx, expr)
+}
+
+// Eval evaluates a parsed expression. The storage is read once, so all
+// selectors see the same snapshot.
+func (e *Evaluator) Eval(ctx context.Context, expr Expr) (*Result, error) {
+	snap, err := e.source.Snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	st := &evalState{snap: snap, history: e.history, now: e.now()}
+	v, err := st.eval(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	if v.vector == nil {
+		s := v.scalar
+		if math.IsNaN(s) || math.IsInf(s, 0) {
+			return nil, evalErrorf("result is not a finite number")
+		}
+		return &Result{Type: ScalarResult, Scalar: &s}, nil
+	}
+
+	sort.Slice(v.vector, func(i, j int) bool {
+		if v.vector[i].Name != v.vector[j].Name {
+			return v.vector[i].Name < v.vector[j].Name
+		}
+		return v.vector[i].Type < v.vector[j].Type
+	})
+	return &Result{Type: VectorResult, Vector: v.vector}, nil
+}
+
+// value is a scalar when vector is nil.
+type value struct {
+	scalar float64
+	vector []Series
+}
+
+type evalState struct {
+	snap    models.Snapshot
+	history *History
+	now     time.Time
+}
+
+func (st *evalState) eval(expr Expr) (value, error) {
+	switch n := expr.(type) {
+	case *NumberLiteral:
+		return value{scalar: n.Value}, nil
+	case *ParenExpr:
+		return st.eval(n.Expr)
+	case *UnaryExpr:
+		v, err := st.eval(n.Expr)
+		if err != nil {
+			return value{}, err
+		}
+		return apply(v, func(x float64) float64 { return -x }), nil
+	case *BinaryExpr:
+		return st.evalBinary(n)
+	case *Selector:
+		if n.Range > 0 {
+			return value{}, evalErrorf("range selector %s must be passed to a range function such as rate()", n)
+		}
+		return value{vector: st.selectCurrent(n)}, nil
+	case *Call:
+		return st.evalCall(n)
+	default:
+		return value{}, evalErrorf("unsupported expression %s", expr)
+	}
+}
+
+func apply(v value, fn func(float64) float64) value {
+	if v.vector == nil {
+		return value{scalar: fn(v.scalar)}
+	}
+	out := make([]Series, 0, len(v.vector))
+	for _, s := range v.vector {
+		s.Value = fn(s.Value)
+		if finite(s.Value) {
+			out = append(out, s)
+		}
+	}
+	return value{vector: out}
+}
+
+func finite(f float64) bool {
+	return !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+func arith(op string, a, b float64) float64 {
+	switch op {
+	case "+":
+		return a + b
+	case "-":
+		return a - b
+	case "*":
+		return a * b
+	default:
+		return a / b
+	}
+}
+
+func (st *evalState) evalBinary(n *BinaryExpr) (value, error) {
+	left, err := st.eval(n.Left)
+	if err != nil {
+		return value{}, err
+	}
+	right, err := st.eval(n.Right)
+	if err != nil {
+		return value{}, err
+	}
+
+	switch {
+	case left.vector == nil && right.vector == nil:
+		if n.Op == "/" && right.scalar == 0 {
+			return value{}, evalErrorf("division by zero")
+		}
+		return value{scalar: arith(n.Op, left.scalar, right.scalar)}, nil
+	case right.vector == nil:
+		return apply(left, func(x float64) float64 { return arith(n.Op, x, right.scalar) }), nil
+	case left.vector == nil:
+		return apply(right, func(x float64) float64 { return arith(n.Op, left.scalar, x) }), nil
+	}
+
+	// Two single metrics, e.g. HeapInuse / HeapSys.
+	if len(left.vector) == 1 && len(right.vector) == 1 {
+		l, r := left.vector[0], right.vector[0]
+		out := Series{Value: arith(n.Op, l.Value, r.Value)}
+		if l.Name == r.Name {
+			out.Name = l.Name
+		}
+		if l.Type == r.Type {
+			out.Type = l.Type
+		}
+		if !finite(out.Value) {
+			return value{vector: []Series{}}, nil
+		}
+		return value{vector: []Series{out}}, nil
+	}
+
+	byName := make(map[string]Series, len(right.vector))
+	for _, s := range right.vector {
+		byName[s.Name] = s
+	}
+	out := make([]Series, 0, len(left.vector))
+	for _, l := range left.vector {
+		r, ok := byName[l.Name]
+		if !ok {
+			continue
+		}
+		l.Value = arith(n.Op, l.Value, r.Value)
+		if l.Type != r.Type {
+			l.Type = ""
+		}
+		if finite(l.Value) {
+			out = append(out, l)
+		}
+	}
+	return value{vector: out}, nil
+}
+
+func (sel *Selector) matches(name, mType string) bool {
+	if sel.Name != "" {
+		if ok, _ := path.Match(sel.Name, name); !ok {
+			return false
+		}
+	}
+	for _, m := range sel.Matchers {
+		v := name
+		if m.Label == labelType {
+			v = mType
+		}
+
+		var ok bool
+		switch m.Op {
+		case MatchEqual:
+			ok = v == m.Value
+		case MatchNotEqual:
+			ok = v != m.Value
+		case MatchRegexp:
+			ok = m.re.MatchString(v)
+		case MatchNotRegexp:
+			ok = !m.re.MatchString(v)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (st *evalState) selectCurrent(sel *Selector) []Series {
+	out := []Series{}
+	for name, v := range st.snap.Gauges {
+		if sel.matches(name, string(models.Gauge)) {
+			out = append(out, Series{Name: name, Type: string(models.Gauge), Value: v})
+		}
+	}
+	for name, v := range st.snap.Counters {
+		if sel.matches(name, string(models.Counter)) {
+			out = append(out, Series{Name: name, Type: string(models.Counter), Value: float64(v)})
+		}
+	}
+	return out
+}
+
+type rangeFunc func(mType string, samples []Sample) (float64, bool)
+
+var rangeFuncs = map[string]rangeFunc{
+	"rate": func(mType string, samples []Sample) (float64, bool) {
+		inc, ok := increase(mType, samples)
+		if !ok {
+			return 0, false
+		}
+		return inc / samples[len(samples)-1].Time.Sub(samples[0].Time).Seconds(), true
+	},
+	"increase": increase,
+	"avg_over_time": func(_ string, samples []Sample) (float64, bool) {
+		sum := 0.0
+		for _, s := range samples {
+			sum += s.Value
+		}
+		return sum / float64(len(samples)), true
+	},
+	"min_over_time": func(_ string, samples []Sample) (float64, bool) {
+		m := samples[0].Value
+		for _, s := range samples[1:] {
+			m = math.Min(m, s.Value)
+		}
+		return m, true
+	},
+	"max_over_time": func(_ string, samples []Sample) (float64, bool) {
+		m := samples[0].Value
+		for _, s := range samples[1:] {
+			m = math.Max(m, s.Value)
+		}
+		return m, true
+	},
+}
+
+// increase is the growth over the samples. Counters that went down were
+// reset, so the value after the reset counts as growth.
+func increase(mType string, samples []Sample) (float64, bool) {
+	if len(samples) < 2 || !samples[len(samples)-1].Time.After(samples[0].Time) {
+		return 0, false
+	}
+	if mType != string(models.Counter) {
+		return samples[len(samples)-1].Value - samples[0].Value, true
+	}
+
+	inc := 0.0
+	for i := 1; i < len(samples); i++ {
+		if d := samples[i].Value - samples[i-1].Value; d >= 0 {
+			inc += d
+		} else {
+			inc += samples[i].Value
+		}
+	}
+	return inc, true
+}
+
+type aggregateFunc func(values []float64) float64
+
+var aggregateFuncs = map[string]aggregateFunc{
+	"sum": func(values []float64) float64 {
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+		}
+		return sum
+	},
+	"avg": func(values []float64) float64 {
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+		}
+		return sum / float64(len(values))
+	},
+	"min": func(values []float64) float64 {
+		m := values[0]
+		for _, v := range values[1:] {
+			m = math.Min(m, v)
+		}
+		return m
+	},
+	"max": func(values []float64) float64 {
+		m := values[0]
+		for _, v := range values[1:] {
+			m = math.Max(m, v)
+		}
+		return m
+	},
+	"count": func(values []float64) float64 {
+		return float64(len(values))
+	},
+}
+
+func (st *evalState) evalCall(c *Call) (value, error) {
+	if fn, ok := rangeFuncs[c.Func]; ok {
+		if len(c.Args) != 1 {
+			return value{}, evalErrorf("%s() takes exactly one argument", c.Func)
+		}
+		sel, ok := c.Args[0].(*Selector)
+		if !ok || sel.Range == 0 {
+			return value{}, evalErrorf("%s() expects a range selector such as %s(PollCount[5m])", c.Func, c.Func)
+		}
+		if st.history == nil {
+			return value{}, ErrNoHistory
+		}
+
+		out := []Series{}
+		st.history.Range(st.now.Add(-sel.Range), func(name, mType string, samples []Sample) {
+			if !sel.matches(name, mType) {
+				return
+			}
+			if v, ok := fn(mType, samples); ok && finite(v) {
+				out = append(out, Series{Name: name, Type: mType, Value: v})
+			}
+		})
+		return value{vector: out}, nil
+	}
+
+	if fn, ok := aggregateFuncs[c.Func]; ok {
+		if len(c.Args) != 1 {
+			return value{}, evalErrorf("%s() takes exactly one argument", c.Func)
+		}
+		v, err := st.eval(c.Args[0])
+		if err != nil {
+			return value{}, err
+		}
+		if v.vector == nil {
+			return value{}, evalErrorf("%s() expects a vector, got a number", c.Func)
+		}
+		if len(v.vector) == 0 {
+			if c.Func == "count" || c.Func == "sum" {
+				return value{vector: []Series{{Value: 0}}}, nil
+			}
+			return value{vector: []Series{}}, nil
+		}
+
+		values := make([]float64, len(v.vector))
+		for i, s := range v.vector {
+			values[i] = s.Value
+		}
+		return value{vector: []Series{{Value: fn(values)}}}, nil
+	}
+
+	if c.Func == "abs" {
+		if len(c.Args) != 1 {
+			return value{}, evalErrorf("abs() takes exactly one argument")
+		}
+		v, err := st.eval(c.Args[0])
+		if err != nil {
+			return value{}, err
+		}
+		return apply(v, math.Abs), nil
+	}
+
+	return value{}, evalErrorf("unknown function %q", c.Func)
+}
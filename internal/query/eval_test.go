@@ -0,0 +1,216 @@
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zubans/metrics/internal/models"
+)
+
+type snapshotSource models.Snapshot
+
+func (s snapshotSource) Snapshot(context.Context) (models.Snapshot, error) {
+	return models.Snapshot(s), nil
+}
+
+type failingSource struct{}
+
+func (failingSource) Snapshot(context.Context) (models.Snapshot, error) {
+	return models.Snapshot{}, errors.New("storage is down")
+}
+
+var testSnapshot = snapshotSource{
+	Gauges: map[string]float64{
+		"HeapInuse": 30,
+		"HeapSys":   120,
+		"HeapIdle":  90,
+		"Alloc":     -5,
+		"GCSys":     10,
+	},
+	Counters: map[string]int64{
+		"PollCount": 7,
+		"HeapCalls": 3,
+	},
+}
+
+func scalar(v float64) *Result {
+	return &Result{Type: ScalarResult, Scalar: &v}
+}
+
+func vector(series ...Series) *Result {
+	if series == nil {
+		series = []Series{}
+	}
+	return &Result{Type: VectorResult, Vector: series}
+}
+
+func TestEvaluator_Query(t *testing.T) {
+	tests := []struct {
+		input string
+		want  *Result
+	}{
+		{input: "1 + 2 * 3", want: scalar(7)},
+		{input: "(1 + 2) * 3", want: scalar(9)},
+		{input: "-2 - -3", want: scalar(1)},
+		{input: "HeapInuse", want: vector(Series{Name: "HeapInuse", Type: "gauge", Value: 30})},
+		{input: "Missing", want: vector()},
+		{input: "HeapInuse / HeapSys", want: vector(Series{Type: "gauge", Value: 0.25})},
+		{input: "HeapInuse * 2", want: vector(Series{Name: "HeapInuse", Type: "gauge", Value: 60})},
+		{input: "100 - HeapInuse", want: vector(Series{Name: "HeapInuse", Type: "gauge", Value: 70})},
+		{input: "PollCount + HeapInuse", want: vector(Series{Value: 37})},
+		{input: "Heap*", want: vector(
+			Series{Name: "HeapCalls", Type: "counter", Value: 3},
+			Series{Name: "HeapIdle", Type: "gauge", Value: 90},
+			Series{Name: "HeapInuse", Type: "gauge", Value: 30},
+			Series{Name: "HeapSys", Type: "gauge", Value: 120},
+		)},
+		{input: `Heap*{type="counter"}`, want: vector(Series{Name: "HeapCalls", Type: "counter", Value: 3})},
+		{input: `{name=~"GC.*|Alloc"}`, want: vector(
+			Series{Name: "Alloc", Type: "gauge", Value: -5},
+			Series{Name: "GCSys", Type: "gauge", Value: 10},
+		)},
+		{input: `Heap*{type!="counter", name!~"HeapI.*"}`, want: vector(Series{Name: "HeapSys", Type: "gauge", Value: 120})},
+		{input: "Heap* / Heap*", want: vector(
+			Series{Name: "HeapCalls", Type: "counter", Value: 1},
+			Series{Name: "HeapIdle", Type: "gauge", Value: 1},
+			Series{Name: "HeapInuse", Type: "gauge", Value: 1},
+			Series{Name: "HeapSys", Type: "gauge", Value: 1},
+		)},
+		{input: "HeapInuse / 0", want: vector()},
+		{input: `sum({type="gauge"})`, want: vector(Series{Value: 245})},
+		{input: `avg(HeapIdle + HeapInuse) / HeapSys`, want: vector(Series{Value: 1})},
+		{input: `min(Heap*)`, want: vector(Series{Value: 3})},
+		{input: `max(Heap*)`, want: vector(Series{Value: 120})},
+		{input: `count(Heap*)`, want: vector(Series{Value: 4})},
+		{input: `count(Missing)`, want: vector(Series{Value: 0})},
+		{input: `max(Missing)`, want: vector()},
+		{input: `abs(Alloc)`, want: vector(Series{Name: "Alloc", Type: "gauge", Value: 5})},
+		{input: `abs(-3)`, want: scalar(3)},
+	}
+
+	e := NewEvaluator(testSnapshot, nil)
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := e.Query(context.Background(), tt.input)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestEvaluator_Errors(t *testing.T) {
+	tests := []string{
+		"1 / 0",
+		"PollCount[5m]",
+		"unknown(Alloc)",
+		"rate(PollCount)",
+		"rate(PollCount[5m], Alloc)",
+		"sum(1)",
+		"sum(a, b)",
+	}
+
+	e := NewEvaluator(testSnapshot, NewHistory(time.Hour, 100))
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			_, err := e.Query(context.Background(), input)
+			var evalErr *EvalError
+			assert.True(t, errors.As(err, &evalErr), "want *EvalError, got %v", err)
+		})
+	}
+
+	_, err := NewEvaluator(testSnapshot, nil).Query(context.Background(), "rate(PollCount[5m])")
+	assert.ErrorIs(t, err, ErrNoHistory)
+
+	_, err = NewEvaluator(failingSource{}, nil).Query(context.Background(), "Alloc")
+	assert.EqualError(t, err, "storage is down")
+}
+
+func TestEvaluator_RangeFunctions(t *testing.T) {
+	clock := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	h := NewHistory(time.Hour, 1000)
+	h.now = func() time.Time { return clock }
+
+	record := func(poll, alloc float64) {
+		h.Record("PollCount", "counter", poll)
+		h.Record("Alloc", "gauge", alloc)
+		clock = clock.Add(10 * time.Second)
+	}
+	// PollCount restarts after 40s: 0 10 20 30 | 5 15
+	for i, poll := range []float64{0, 10, 20, 30, 5, 15} {
+		record(poll, float64(100+i*10))
+	}
+
+	e := NewEvaluator(testSnapshot, h)
+	e.now = func() time.Time { return clock }
+
+	tests := []struct {
+		input string
+		want  *Result
+	}{
+		{input: "increase(PollCount[1m])", want: vector(Series{Name: "PollCount", Type: "counter", Value: 45})},
+		{input: "rate(PollCount[1m])", want: vector(Series{Name: "PollCount", Type: "counter", Value: 0.9})},
+		{input: "rate(PollCount[25s])", want: vector(Series{Name: "PollCount", Type: "counter", Value: 1})},
+		{input: "rate(PollCount[5s])", want: vector()},
+		{input: "increase(Alloc[1m])", want: vector(Series{Name: "Alloc", Type: "gauge", Value: 50})},
+		{input: "avg_over_time(Alloc[1m])", want: vector(Series{Name: "Alloc", Type: "gauge", Value: 125})},
+		{input: "min_over_time(Alloc[30s])", want: vector(Series{Name: "Alloc", Type: "gauge", Value: 130})},
+		{input: "max_over_time(Alloc[1m])", want: vector(Series{Name: "Alloc", Type: "gauge", Value: 150})},
+		{input: `rate({type="counter"}[1m]) * 60`, want: vector(Series{Name: "PollCount", Type: "counter", Value: 54})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := e.Query(context.Background(), tt.input)
+			require.NoError(t, err)
+			require.Equal(t, tt.want.Type, got.Type)
+			require.Len(t, got.Vector, len(tt.want.Vector))
+			for i := range got.Vector {
+				assert.Equal(t, tt.want.Vector[i].Name, got.Vector[i].Name)
+				assert.InDelta(t, tt.want.Vector[i].Value, got.Vector[i].Value, 1e-9)
+			}
+		})
+	}
+}
+
+func TestHistory_Retention(t *testing.T) {
+	clock := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	h := NewHistory(time.Minute, 3)
+	h.now = func() time.Time { return clock }
+
+	for i := 0; i < 5; i++ {
+		h.Record("Alloc", "gauge", float64(i))
+		clock = clock.Add(time.Second)
+	}
+
+	var got []float64
+	h.Range(time.Time{}, func(_, _ string, samples []Sample) {
+		for _, s := range samples {
+			got = append(got, s.Value)
+		}
+	})
+	assert.Equal(t, []float64{2, 3, 4}, got, "at most maxSamples are kept")
+
+	clock = clock.Add(time.Hour)
+	h.Record("Alloc", "gauge", 9)
+	got = nil
+	h.Range(time.Time{}, func(_, _ string, samples []Sample) {
+		for _, s := range samples {
+			got = append(got, s.Value)
+		}
+	})
+	assert.Equal(t, []float64{9}, got, "samples older than the retention are pruned")
+}
+
+func TestResult_MarshalJSON(t *testing.T) {
+	b, err := json.Marshal(vector())
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"type":"vector","result":[]}`, string(b))
+
+	b, err = json.Marshal(scalar(0))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"type":"scalar","value":0}`, string(b))
+}
@@ -0,0 +1,88 @@
+package query
+
+import (
+	"sync"
+	"time"
+)
+
+// Sample is a metric value at a point in time.
+type Sample struct {
+	Time  time.Time
+	Value float64
+}
+
+type seriesKey struct {
+	name  string
+	mType string
+}
+
+// History keeps recent values of every metric for range functions such as
+// rate(). Samples older than the retention are pruned on write.
+type History struct {
+	retention  time.Duration
+	maxSamples int
+	now        func() time.Time
+
+	mu     sync.RWMutex
+	series map[seriesKey][]Sample
+}
+
+// NewHistory keeps samples for retention, at most maxSamples per metric.
+func NewHistory(retention time.Duration, maxSamples int) *History {
+	if maxSamples < 2 {
+		maxSamples = 2
+	}
+	return &History{
+		retention:  retention,
+		maxSamples: maxSamples,
+		now:        time.Now,
+		series:     make(map[seriesKey][]Sample),
+	}
+}
+
+// Record stores the current value of a metric.
+func (h *History) Record(name, mType string, value float64) {
+	now := h.now()
+	k := seriesKey{name: name, mType: mType}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	samples := append(h.series[k], Sample{Time: now, Value: value})
+
+	start := 0
+	if over := len(samples) - h.maxSamples; over > 0 {
+		start = over
+	}
+	cutoff := now.Add(-h.retention)
+	for start < len(samples)-1 && samples[start].Time.Before(cutoff) {
+		start++
+	}
+
+	h.series[k] = samples[start:]
+}
+
+// Forget drops the samples of a metric.
+func (h *History) Forget(name, mType string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.series, seriesKey{name: name, mType: mType})
+}
+
+// Range calls fn for every metric with samples not older than from. fn runs
+// under the history lock and must not keep samples.
+func (h *History) Range(from time.Time, fn func(name, mType string, samples []Sample)) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for k, samples := range h.series {
+		i := 0
+		for i < len(samples) && samples[i].Time.Before(from) {
+			i++
+		}
+		if i < len(samples) {
+			fn(k.name, k.mType, samples[i:])
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNumber
+	tokIdent
+	tokString
+	tokDuration
+	tokLParen
+	tokRParen
+	tokLBrace
+	tokRBrace
+	tokComma
+	tokPlus
+	tokMinus
+	tokStar
+	tokSlash
+	tokEq
+	tokNeq
+	tokMatch
+	tokNotMatch
+)
+
+var tokenNames = map[tokenKind]string{
+	tokEOF:      "end of input",
+	tokNumber:   "number",
+	tokIdent:    "identifier",
+	tokString:   "string",
+	tokDuration: "duration",
+	tokLParen:   `"("`,
+	tokRParen:   `")"`,
+	tokLBrace:   `"{"`,
+	tokRBrace:   `"}"`,
+	tokComma:    `","`,
+	tokPlus:     `"+"`,
+	tokMinus:    `"-"`,
+	tokStar:     `"*"`,
+	tokSlash:    `"/"`,
+	tokEq:       `"="`,
+	tokNeq:      `"!="`,
+	tokMatch:    `"=~"`,
+	tokNotMatch: `"!~"`,
+}
+
+func (k tokenKind) String() string {
+	return tokenNames[k]
+}
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// Error is a syntax error at byte offset Pos of the expression.
+type Error struct {
+	Pos int
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("parse error at position %d: %s", e.Pos, e.Msg)
+}
+
+func isIdentStart(r byte) bool {
+	return r == '_' || r == '*' || r == '?' || unicode.IsLetter(rune(r))
+}
+
+func isIdentChar(r byte) bool {
+	return isIdentStart(r) || unicode.IsDigit(rune(r))
+}
+
+func isDigit(r byte) bool {
+	return r >= '0' && r <= '9'
+}
+
+// lex splits input into tokens. Names may contain the glob characters "*"
+// and "?", so a multiplication directly following a name must be separated
+// by a space: "Heap*" is a glob, "HeapInuse * 2" a product.
+func lex(input string) ([]token, error) {
+	var tokens []token
+	i := 0
+
+	for i < len(input) {
+		c := input[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case c == '[':
+			end := strings.IndexByte(input[i:], ']')
+			if end < 0 {
+				return nil, &Error{Pos: i, Msg: `unclosed "["`}
+			}
+			tokens = append(tokens, token{kind: tokDuration, text: strings.TrimSpace(input[i+1 : i+end]), pos: i})
+			i += end + 1
+
+		case c == '"':
+			j := i + 1
+			for j < len(input) && input[j] != '"' {
+				if input[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(input) {
+				return nil, &Error{Pos: i, Msg: "unterminated string"}
+			}
+			tokens = append(tokens, token{kind: tokString, text: input[i : j+1], pos: i})
+			i = j + 1
+
+		case isDigit(c) || (c == '.' && i+1 < len(input) && isDigit(input[i+1])):
+			j := i
+			for j < len(input) && (isDigit(input[j]) || input[j] == '.') {
+				j++
+			}
+			if j < len(input) && (input[j] == 'e' || input[j] == 'E') {
+				k := j + 1
+				if k < len(input) && (input[k] == '+' || input[k] == '-') {
+					k++
+				}
+				if k < len(input) && isDigit(input[k]) {
+					for k < len(input) && isDigit(input[k]) {
+						k++
+					}
+					j = k
+				}
+			}
+			tokens = append(tokens, token{kind: tokNumber, text: input[i:j], pos: i})
+			i = j
+
+		case c == '*' && !globStar(tokens):
+			tokens = append(tokens, token{kind: tokStar, text: "*", pos: i})
+			i++
+
+		case isIdentStart(c):
+			j := i
+			for j < len(input) && isIdentChar(input[j]) {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: input[i:j], pos: i})
+			i = j
+
+		default:
+			kind, width := operator(input[i:])
+			if width == 0 {
+				return nil, &Error{Pos: i, Msg: fmt.Sprintf("unexpected character %q", c)}
+			}
+			tokens = append(tokens, token{kind: kind, text: input[i : i+width], pos: i})
+			i += width
+		}
+	}
+
+	return append(tokens, token{kind: tokEOF, pos: len(input)}), nil
+}
+
+// globStar reports whether a "*" starts a name glob rather
+// than being a multiplication: it does when no operand precedes it.
+func globStar(prev []token) bool {
+	if len(prev) == 0 {
+		return true
+	}
+	switch prev[len(prev)-1].kind {
+	case tokNumber, tokIdent, tokString, tokDuration, tokRParen, tokRBrace:
+		return false
+	}
+	return true
+}
+
+func operator(s string) (tokenKind, int) {
+	if len(s) >= 2 {
+		switch s[:2] {
+		case "!=":
+			return tokNeq, 2
+		case "=~":
+			return tokMatch, 2
+		case "!~":
+			return tokNotMatch, 2
+		}
+	}
+	switch s[0] {
+	case '(':
+		return tokLParen, 1
+	case ')':
+		return tokRParen, 1
+	case '{':
+		return tokLBrace, 1
+	case '}':
+		return tokRBrace, 1
+	case ',':
+		return tokComma, 1
+	case '+':
+		return tokPlus, 1
+	case '-':
+		return tokMinus, 1
+	case '*':
+		return tokStar, 1
+	case '/':
+		return tokSlash, 1
+	case '=':
+		return tokEq, 1
+	}
+	return tokEOF, 0
+}
@@ -0,0 +1,384 @@
+package query
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Expr is a parsed query expression.
+type Expr interface {
+	String() string
+}
+
+// NumberLiteral is a constant such as 2 or 1.5e3.
+type NumberLiteral struct {
+	Value float64
+}
+
+// MatchOp compares a label with a value.
+type MatchOp string
+
+const (
+	MatchEqual     MatchOp = "="
+	MatchNotEqual  MatchOp = "!="
+	MatchRegexp    MatchOp = "=~"
+	MatchNotRegexp MatchOp = "!~"
+)
+
+// Matcher is a label selector such as type="gauge". The labels of a metric
+// are "name" and "type".
+type Matcher struct {
+	Label string
+	Op    MatchOp
+	Value string
+	re    *regexp.Regexp
+}
+
+// Selector selects stored metrics by a name glob and label matchers. With a
+// Range it selects the history of the last Range instead of current values.
+type Selector struct {
+	Name     string
+	Matchers []Matcher
+	Range    time.Duration
+}
+
+// Call is a function call such as rate(PollCount[5m]).
+type Call struct {
+	Func string
+	Args []Expr
+}
+
+// BinaryExpr is an arithmetic operation.
+type BinaryExpr struct {
+	Op    string
+	Left  Expr
+	Right Expr
+}
+
+// UnaryExpr is a negation.
+type UnaryExpr struct {
+	Expr Expr
+}
+
+// ParenExpr is an expression in parentheses.
+type ParenExpr struct {
+	Expr Expr
+}
+
+func (n *NumberLiteral) String() string {
+	return strconv.FormatFloat(n.Value, 'f', -1, 64)
+}
+
+func (m Matcher) String() string {
+	return m.Label + string(m.Op) + strconv.Quote(m.Value)
+}
+
+func (s *Selector) String() string {
+	var b strings.Builder
+	b.WriteString(s.Name)
+	if len(s.Matchers) > 0 {
+		parts := make([]string, len(s.Matchers))
+		for i, m := range s.Matchers {
+			parts[i] = m.String()
+		}
+		b.WriteString("{" + strings.Join(parts, ",") + "}")
+	}
+	if s.Range > 0 {
+		b.WriteString("[" + s.Range.String() + "]")
+	}
+	return b.String()
+}
+
+func (c *Call) String() string {
+	args := make([]string, len(c.Args))
+	for i, a := range c.Args {
+		args[i] = a.String()
+	}
+	return c.Func + "(" + strings.Join(args, ", ") + ")"
+}
+
+func (b *BinaryExpr) String() string {
+	return b.Left.String() + " " + b.Op + " " + b.Right.String()
+}
+
+func (u *UnaryExpr) String() string {
+	return "-" + u.Expr.String()
+}
+
+func (p *ParenExpr) String() string {
+	return "(" + p.Expr.String() + ")"
+}
+
+// Parse parses a query expression:
+//
+//	expr     = term { ("+" | "-") term }
+//	term     = unary { ("*" | "/") unary }
+//	unary    = "-" unary | primary
+//	primary  = number | "(" expr ")" | call | selector
+//	call     = ident "(" [ expr { "," expr } ] ")"
+//	selector = [ glob ] [ "{" matcher { "," matcher } "}" ] [ "[" duration "]" ]
+//	matcher  = ident ( "=" | "!=" | "=~" | "!~" ) string
+func Parse(input string) (Expr, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	expr, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.unexpected(t)
+	}
+
+	return expr, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) expect(kind tokenKind) (token, error) {
+	t := p.next()
+	if t.kind != kind {
+		return t, &Error{Pos: t.pos, Msg: fmt.Sprintf("expected %s, found %s", kind, describe(t))}
+	}
+	return t, nil
+}
+
+func (p *parser) unexpected(t token) error {
+	return &Error{Pos: t.pos, Msg: "unexpected " + describe(t)}
+}
+
+func describe(t token) string {
+	if t.kind == tokEOF {
+		return t.kind.String()
+	}
+	return fmt.Sprintf("%s %q", t.kind, t.text)
+}
+
+func (p *parser) parseExpr() (Expr, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t := p.peek()
+		if t.kind != tokPlus && t.kind != tokMinus {
+			return left, nil
+		}
+		p.next()
+
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryExpr{Op: t.text, Left: left, Right: right}
+	}
+}
+
+func (p *parser) parseTerm() (Expr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t := p.peek()
+		if t.kind != tokStar && t.kind != tokSlash {
+			return left, nil
+		}
+		p.next()
+
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryExpr{Op: t.text, Left: left, Right: right}
+	}
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+	if p.peek().kind == tokMinus {
+		p.next()
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &UnaryExpr{Expr: expr}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (Expr, error) {
+	t := p.peek()
+
+	switch t.kind {
+	case tokNumber:
+		p.next()
+		v, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, &Error{Pos: t.pos, Msg: fmt.Sprintf("invalid number %q", t.text)}
+		}
+		return &NumberLiteral{Value: v}, nil
+
+	case tokLParen:
+		p.next()
+		expr, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokRParen); err != nil {
+			return nil, err
+		}
+		return &ParenExpr{Expr: expr}, nil
+
+	case tokIdent:
+		if p.tokens[p.pos+1].kind == tokLParen {
+			return p.parseCall()
+		}
+		return p.parseSelector()
+
+	case tokLBrace:
+		return p.parseSelector()
+
+	default:
+		return nil, p.unexpected(t)
+	}
+}
+
+func (p *parser) parseCall() (Expr, error) {
+	name := p.next()
+	if strings.ContainsAny(name.text, "*?") {
+		return nil, &Error{Pos: name.pos, Msg: fmt.Sprintf("invalid function name %q", name.text)}
+	}
+	p.next() // "("
+
+	call := &Call{Func: name.text}
+	if p.peek().kind == tokRParen {
+		p.next()
+		return call, nil
+	}
+
+	for {
+		arg, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		call.Args = append(call.Args, arg)
+
+		t := p.next()
+		switch t.kind {
+		case tokComma:
+		case tokRParen:
+			return call, nil
+		default:
+			return nil, &Error{Pos: t.pos, Msg: fmt.Sprintf(`expected "," or ")", found %s`, describe(t))}
+		}
+	}
+}
+
+func (p *parser) parseSelector() (Expr, error) {
+	sel := &Selector{}
+	start := p.peek()
+
+	if start.kind == tokIdent {
+		sel.Name = p.next().text
+	}
+
+	if p.peek().kind == tokLBrace {
+		p.next()
+		for p.peek().kind != tokRBrace {
+			m, err := p.parseMatcher()
+			if err != nil {
+				return nil, err
+			}
+			sel.Matchers = append(sel.Matchers, m)
+
+			if p.peek().kind != tokComma {
+				break
+			}
+			p.next()
+		}
+		if _, err := p.expect(tokRBrace); err != nil {
+			return nil, err
+		}
+	}
+
+	if sel.Name == "" && len(sel.Matchers) == 0 {
+		return nil, &Error{Pos: start.pos, Msg: "selector needs a name or at least one matcher"}
+	}
+
+	if t := p.peek(); t.kind == tokDuration {
+		p.next()
+		d, err := time.ParseDuration(t.text)
+		if err != nil || d <= 0 {
+			return nil, &Error{Pos: t.pos, Msg: fmt.Sprintf("invalid range %q", t.text)}
+		}
+		sel.Range = d
+	}
+
+	return sel, nil
+}
+
+func (p *parser) parseMatcher() (Matcher, error) {
+	label, err := p.expect(tokIdent)
+	if err != nil {
+		return Matcher{}, err
+	}
+	if label.text != labelName && label.text != labelType {
+		return Matcher{}, &Error{Pos: label.pos, Msg: fmt.Sprintf("unknown label %q, expected %q or %q", label.text, labelName, labelType)}
+	}
+
+	op := p.next()
+	m := Matcher{Label: label.text}
+	switch op.kind {
+	case tokEq:
+		m.Op = MatchEqual
+	case tokNeq:
+		m.Op = MatchNotEqual
+	case tokMatch:
+		m.Op = MatchRegexp
+	case tokNotMatch:
+		m.Op = MatchNotRegexp
+	default:
+		return Matcher{}, &Error{Pos: op.pos, Msg: "expected match operator, found " + describe(op)}
+	}
+
+	value, err := p.expect(tokString)
+	if err != nil {
+		return Matcher{}, err
+	}
+	m.Value, err = strconv.Unquote(value.text)
+	if err != nil {
+		return Matcher{}, &Error{Pos: value.pos, Msg: fmt.Sprintf("invalid string %s", value.text)}
+	}
+
+	if m.Op == MatchRegexp || m.Op == MatchNotRegexp {
+		m.re, err = regexp.Compile("^(?:" + m.Value + ")$")
+		if err != nil {
+			return Matcher{}, &Error{Pos: value.pos, Msg: fmt.Sprintf("invalid regexp %q", m.Value)}
+		}
+	}
+
+	return m, nil
+}
@@ -0,0 +1,126 @@
+package query
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse_Valid(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "42", want: "42"},
+		{input: "1.5e3", want: "1500"},
+		{input: ".5", want: "0.5"},
+		{input: "Alloc", want: "Alloc"},
+		{input: "Heap*", want: "Heap*"},
+		{input: "*", want: "*"},
+		{input: "Gc?", want: "Gc?"},
+		{input: "HeapInuse / HeapSys", want: "HeapInuse / HeapSys"},
+		{input: "HeapInuse/HeapSys", want: "HeapInuse / HeapSys"},
+		{input: "a + b * c", want: "a + b * c"},
+		{input: "(a + b) * c", want: "(a + b) * c"},
+		{input: "2 * Heap*", want: "2 * Heap*"},
+		{input: "Heap* * 2", want: "Heap* * 2"},
+		{input: "-Alloc", want: "-Alloc"},
+		{input: "--1", want: "--1"},
+		{input: "a - -b", want: "a - -b"},
+		{input: `{type="gauge"}`, want: `{type="gauge"}`},
+		{input: `Heap*{type!="counter"}`, want: `Heap*{type!="counter"}`},
+		{input: `{name=~"Gc.*", type="gauge",}`, want: `{name=~"Gc.*",type="gauge"}`},
+		{input: `{name!~"Heap.*"}`, want: `{name!~"Heap.*"}`},
+		{input: `{name="a\"b"}`, want: `{name="a\"b"}`},
+		{input: "rate(PollCount[5m])", want: "rate(PollCount[5m0s])"},
+		{input: "rate( PollCount [ 30s ] )", want: "rate(PollCount[30s])"},
+		{input: `increase({type="counter"}[1h])`, want: `increase({type="counter"}[1h0m0s])`},
+		{input: "sum(Heap*) / count(Heap*)", want: "sum(Heap*) / count(Heap*)"},
+		{input: "abs(-1)", want: "abs(-1)"},
+		{input: "f()", want: "f()"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			expr, err := Parse(tt.input)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, expr.String())
+		})
+	}
+}
+
+func TestParse_Precedence(t *testing.T) {
+	expr, err := Parse("a - b - c * d / e")
+	require.NoError(t, err)
+
+	// ((a - b) - ((c * d) / e))
+	top, ok := expr.(*BinaryExpr)
+	require.True(t, ok)
+	assert.Equal(t, "-", top.Op)
+
+	left, ok := top.Left.(*BinaryExpr)
+	require.True(t, ok)
+	assert.Equal(t, "a - b", left.String())
+
+	right, ok := top.Right.(*BinaryExpr)
+	require.True(t, ok)
+	assert.Equal(t, "/", right.Op)
+	assert.Equal(t, "c * d", right.Left.String())
+}
+
+func TestParse_Selector(t *testing.T) {
+	expr, err := Parse(`Heap*{type="gauge", name!~"HeapSys"}[90s]`)
+	require.NoError(t, err)
+
+	sel, ok := expr.(*Selector)
+	require.True(t, ok)
+	assert.Equal(t, "Heap*", sel.Name)
+	assert.Equal(t, 90*time.Second, sel.Range)
+	require.Len(t, sel.Matchers, 2)
+	assert.Equal(t, Matcher{Label: "type", Op: MatchEqual, Value: "gauge"}, sel.Matchers[0])
+	assert.Equal(t, MatchNotRegexp, sel.Matchers[1].Op)
+	assert.NotNil(t, sel.Matchers[1].re)
+}
+
+func TestParse_Errors(t *testing.T) {
+	tests := []struct {
+		input string
+		pos   int
+	}{
+		{input: "", pos: 0},
+		{input: "a +", pos: 3},
+		{input: "(a", pos: 2},
+		{input: "a)", pos: 1},
+		{input: "a b", pos: 2},
+		{input: "1 2", pos: 2},
+		{input: "{}", pos: 0},
+		{input: `{label="x"}`, pos: 1},
+		{input: `{name "x"}`, pos: 6},
+		{input: `{name=x}`, pos: 6},
+		{input: `{name="x"`, pos: 9},
+		{input: `{name=~"("}`, pos: 7},
+		{input: `{name="x`, pos: 6},
+		{input: "rate(a[5m]", pos: 10},
+		{input: "rate(a[5m)", pos: 6},
+		{input: "a[soon]", pos: 1},
+		{input: "a[-5m]", pos: 1},
+		{input: "f(a b)", pos: 4},
+		{input: "Heap*(a)", pos: 0},
+		{input: "a % b", pos: 2},
+		{input: "a = b", pos: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			_, err := Parse(tt.input)
+			require.Error(t, err)
+
+			var perr *Error
+			require.True(t, errors.As(err, &perr), "want *Error, got %T", err)
+			assert.Equal(t, tt.pos, perr.Pos, perr.Msg)
+		})
+	}
+}
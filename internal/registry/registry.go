@@ -0,0 +1,160 @@
+// Package registry tracks the agents that report metrics to the server.
+//
+// Agent IDs are not authenticated, so the registry is bounded: agents idle
+// for longer than the TTL are forgotten, and both the number of agents and
+// the metrics counted per agent are capped.
+package registry
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Agent describes a known agent.
+type Agent struct {
+	ID          string    `json:"id"`
+	Version     string    `json:"version,omitempty"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+	MetricCount int       `json:"metric_count"`
+}
+
+// Defaults for the registry limits.
+const (
+	DefaultTTL        = 24 * time.Hour
+	DefaultMaxAgents  = 10000
+	DefaultMaxMetrics = 10000
+)
+
+type entry struct {
+	agent   Agent
+	metrics map[string]struct{}
+}
+
+// Registry keeps the agents seen within the TTL.
+type Registry struct {
+	now        func() time.Time
+	ttl        time.Duration
+	maxAgents  int
+	maxMetrics int
+
+	mu        sync.RWMutex
+	agents    map[string]*entry
+	lastPrune time.Time
+}
+
+// Option configures a Registry.
+type Option func(*Registry)
+
+// WithTTL sets how long an agent is kept after its last report.
+func WithTTL(ttl time.Duration) Option {
+	return func(r *Registry) {
+		r.ttl = ttl
+	}
+}
+
+// WithMaxAgents caps the number of agents kept. Agents beyond the cap are
+// not recorded until others expire.
+func WithMaxAgents(n int) Option {
+	return func(r *Registry) {
+		r.maxAgents = n
+	}
+}
+
+// WithMaxMetrics caps the distinct metrics counted per agent, so
+// MetricCount stops growing at n.
+func WithMaxMetrics(n int) Option {
+	return func(r *Registry) {
+		r.maxMetrics = n
+	}
+}
+
+// New creates an empty Registry with the default limits.
+func New(opts ...Option) *Registry {
+	r := &Registry{
+		now:        time.Now,
+		ttl:        DefaultTTL,
+		maxAgents:  DefaultMaxAgents,
+		maxMetrics: DefaultMaxMetrics,
+		agents:     make(map[string]*entry),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Observe records that agent id running version reported the given metrics.
+// MetricCount is the number of distinct metric keys the agent has reported.
+func (r *Registry) Observe(id, version string, metrics []string) {
+	now := r.now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.prune(now)
+
+	e, ok := r.agents[id]
+	if ok && r.expired(e, now) {
+		delete(r.agents, id)
+		ok = false
+	}
+	if !ok {
+		if len(r.agents) >= r.maxAgents {
+			return
+		}
+		e = &entry{
+			agent:   Agent{ID: id, FirstSeen: now},
+			metrics: make(map[string]struct{}),
+		}
+		r.agents[id] = e
+	}
+
+	e.agent.LastSeen = now
+	if version != "" {
+		e.agent.Version = version
+	}
+	for _, m := range metrics {
+		if len(e.metrics) >= r.maxMetrics {
+			break
+		}
+		e.metrics[m] = struct{}{}
+	}
+	e.agent.MetricCount = len(e.metrics)
+}
+
+// Agents returns all known agents sorted by ID.
+func (r *Registry) Agents() []Agent {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	now := r.now()
+	agents := make([]Agent, 0, len(r.agents))
+	for _, e := range r.agents {
+		if !r.expired(e, now) {
+			agents = append(agents, e.agent)
+		}
+	}
+	sort.Slice(agents, func(i, j int) bool { return agents[i].ID < agents[j].ID })
+
+	return agents
+}
+
+func (r *Registry) expired(e *entry, now time.Time) bool {
+	return now.Sub(e.agent.LastSeen) >= r.ttl
+}
+
+// prune drops, at most once a minute, agents idle for longer than the TTL.
+func (r *Registry) prune(now time.Time) {
+	if now.Sub(r.lastPrune) < time.Minute {
+		return
+	}
+	r.lastPrune = now
+
+	for id, e := range r.agents {
+		if r.expired(e, now) {
+			delete(r.agents, id)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package registry
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry_Observe(t *testing.T) {
+	r := New()
+	clock := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	r.now = func() time.Time { return clock }
+
+	r.Observe("b", "v1.0.0", []string{"gauge/Alloc", "counter/PollCount"})
+	r.Observe("a", "", []string{"gauge/Alloc"})
+
+	clock = clock.Add(time.Minute)
+	r.Observe("b", "v1.1.0", []string{"gauge/Alloc", "gauge/HeapAlloc"})
+
+	agents := r.Agents()
+	require.Len(t, agents, 2)
+
+	assert.Equal(t, "a", agents[0].ID, "agents must be sorted by ID")
+	assert.Equal(t, 1, agents[0].MetricCount)
+	assert.Empty(t, agents[0].Version)
+
+	b := agents[1]
+	assert.Equal(t, "v1.1.0", b.Version)
+	assert.Equal(t, 3, b.MetricCount, "metric count must count distinct metrics")
+	assert.Equal(t, clock.Add(-time.Minute), b.FirstSeen)
+	assert.Equal(t, clock, b.LastSeen)
+}
+
+func TestRegistry_Limits(t *testing.T) {
+	r := New(WithTTL(time.Hour), WithMaxAgents(2), WithMaxMetrics(2))
+	clock := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	r.now = func() time.Time { return clock }
+
+	r.Observe("a", "", []string{"gauge/Alloc", "gauge/HeapAlloc", "gauge/HeapSys"})
+	r.Observe("b", "", nil)
+	r.Observe("c", "", nil)
+
+	agents := r.Agents()
+	require.Len(t, agents, 2, "agents beyond the cap are not recorded")
+	assert.Equal(t, "a", agents[0].ID)
+	assert.Equal(t, 2, agents[0].MetricCount, "metric count stops at the cap")
+	assert.Equal(t, "b", agents[1].ID)
+
+	clock = clock.Add(30 * time.Minute)
+	r.Observe("a", "", nil)
+
+	clock = clock.Add(45 * time.Minute)
+	agents = r.Agents()
+	require.Len(t, agents, 1, "idle agents expire")
+	assert.Equal(t, "a", agents[0].ID)
+
+	r.Observe("c", "", nil)
+	agents = r.Agents()
+	require.Len(t, agents, 2, "expired agents free their slot")
+	assert.Equal(t, "c", agents[1].ID)
+}
@@ -3,27 +3,139 @@ package router
 import (
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/zubans/metrics/internal/auth"
+	"github.com/zubans/metrics/internal/errdefs"
 	"github.com/zubans/metrics/internal/handler"
 	"github.com/zubans/metrics/internal/middlewares"
+	"github.com/zubans/metrics/internal/openapi"
 	"net/http"
+	"time"
 )
 
-func GetRouter(h *handler.Handler) http.Handler {
+// legacyDeprecated is when the legacy metric routes were deprecated in
+// favour of /api/v1/metrics.
+var legacyDeprecated = time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+
+// Option configures optional limits of the router.
+type Option func(*options)
+
+type options struct {
+	maxDecompressed int64
+	ingestRate      float64
+	ingestBurst     int
+	readRate        float64
+	readBurst       int
+	tokens          *auth.Tokens
+	anonymousRead   bool
+}
+
+// WithMaxDecompressedSize rejects gzip request bodies inflating to more than
+// n bytes with 413. Zero means no limit.
+func WithMaxDecompressedSize(n int64) Option {
+	return func(o *options) {
+		o.maxDecompressed = n
+	}
+}
+
+// WithIngestRateLimit limits metric updates to rps requests per second per
+// client with bursts of burst requests. Zero rps means no limit.
+func WithIngestRateLimit(rps float64, burst int) Option {
+	return func(o *options) {
+		o.ingestRate, o.ingestBurst = rps, burst
+	}
+}
+
+// WithReadRateLimit limits metric reads, queries and streams like
+// WithIngestRateLimit limits updates.
+func WithReadRateLimit(rps float64, burst int) Option {
+	return func(o *options) {
+		o.readRate, o.readBurst = rps, burst
+	}
+}
+
+// WithAuth requires bearer tokens from tokens: the ingest role for
+// updates, the read role for reads and the admin role for deleting metrics
+// and listing agents and self-metrics. With anonymousRead, reads other than
+// those admin ones need no token. Nil tokens disable authentication.
+func WithAuth(tokens *auth.Tokens, anonymousRead bool) Option {
+	return func(o *options) {
+		o.tokens, o.anonymousRead = tokens, anonymousRead
+	}
+}
+
+func GetRouter(h *handler.Handler, opts ...Option) http.Handler {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	spec := openapi.MustLoad()
+	spec.MaxDecompressed = o.maxDecompressed
+	gzipMiddleware := middlewares.NewGzipMiddleware(o.maxDecompressed)
+
+	deprecated := middlewares.Deprecated(legacyDeprecated, "/api/v1/metrics")
+
+	readTokens := o.tokens
+	if o.anonymousRead {
+		readTokens = nil
+	}
+	admin := middlewares.RequireRole(o.tokens, auth.Admin)
+
 	r := chi.NewRouter()
-	r.Use(middleware.Compress(5, "text/html", "application/json"))
-
-	r.With(middlewares.GzipMiddleware).Get("/", h.ShowMetrics)
-	r.Post("/update/{type}/{name}/{value}", h.UpdateMetric)
-	r.Route("/value/{type}", func(r chi.Router) {
-		r.Route("/{name}", func(r chi.Router) {
-			r.Post("/{value}", h.UpdateMetric)
-			r.Get("/", h.GetMetric)
-		})
+	r.Use(middleware.Compress(5, "text/html", "text/css", "application/json"))
+	r.Use(middlewares.AgentIdentity)
+	r.Use(middlewares.Authenticate(o.tokens))
+	r.Use(middlewares.ClientIdentity)
+
+	// Updates. Rate limits and authentication run before validation reads
+	// the body.
+	r.Group(func(r chi.Router) {
+		r.Use(middlewares.RateLimit(o.ingestRate, o.ingestBurst))
+		r.Use(middlewares.RequireRole(o.tokens, auth.Ingest))
+		r.Use(spec.Validate)
+
+		r.With(gzipMiddleware).Post("/api/v1/metrics", h.UpdateMetricsV1)
+		r.With(gzipMiddleware).Put("/api/v1/metrics/{type}/{name}", h.PutMetricV1)
+		r.With(admin).Delete("/api/v1/metrics/{type}/{name}", h.DeleteMetricV1)
+
+		// Legacy routes, superseded by /api/v1/metrics.
+		r.With(deprecated).Post("/update/{type}/{name}/{value}", h.UpdateMetric)
+		r.With(deprecated).Post("/value/{type}/{name}/{value}", h.UpdateMetric)
+		r.With(deprecated, gzipMiddleware).Post("/updates/", h.UpdateMetrics)
+		r.With(deprecated, gzipMiddleware).Post("/update/", h.UpdateMetricJSON)
 	})
-	r.With(middlewares.GzipMiddleware).Post("/updates/", h.UpdateMetrics)
-	r.With(middlewares.GzipMiddleware).Post("/update/", h.UpdateMetricJSON)
-	r.Post("/value/", h.GetMetricJSON)
+
+	// Reads.
+	r.Group(func(r chi.Router) {
+		r.Use(middlewares.RateLimit(o.readRate, o.readBurst))
+		r.Use(middlewares.RequireRole(readTokens, auth.Read))
+		r.Use(spec.Validate)
+
+		r.With(gzipMiddleware).Get("/", h.ShowMetrics)
+		r.Get("/api/v1/metrics", h.ListMetricsV1)
+		r.Get("/api/v1/metrics/{type}/{name}", h.GetMetricV1)
+		r.With(admin).Get("/api/v1/self/metrics", h.SelfMetricsV1)
+		r.With(admin).Get("/agents", h.ListAgents)
+		r.Get("/alerts", h.ListAlerts)
+		r.Get("/query", h.Query)
+		r.Get("/stream", h.StreamMetrics)
+		r.Get("/ws", h.SubscribeWS)
+
+		// Legacy routes, superseded by /api/v1/metrics.
+		r.With(deprecated).Get("/value/{type}/{name}", h.GetMetric)
+		r.With(deprecated).Post("/value/", h.GetMetricJSON)
+	})
+
+	r.Get("/static/*", h.StaticAssets)
 	r.Get("/ping", h.PingServer)
+	r.Get("/openapi.json", spec.ServeHTTP)
+
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		errdefs.WriteProblem(w, r, errdefs.NewNotFoundError(errdefs.CodeNotFound, "no such endpoint"))
+	})
+	r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		errdefs.WriteProblem(w, r, errdefs.New(http.StatusMethodNotAllowed, errdefs.CodeMethodNotAllowed, "method not allowed"))
+	})
 
 	return r
 }
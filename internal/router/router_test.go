@@ -0,0 +1,249 @@
+package router
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zubans/metrics/internal/auth"
+	"github.com/zubans/metrics/internal/handler"
+	"github.com/zubans/metrics/internal/middlewares"
+	"github.com/zubans/metrics/internal/openapi"
+	"github.com/zubans/metrics/internal/services"
+	"github.com/zubans/metrics/internal/storage"
+)
+
+var trailingParamSlash = regexp.MustCompile(`(\{[^}]+\})/$`)
+
+// TestGetRouter_MatchesSpec fails when a route is added without documenting
+// it in the OpenAPI specification, or the other way round.
+func TestGetRouter_MatchesSpec(t *testing.T) {
+	h := handler.NewHandler(services.NewMetricService(storage.NewMemStorage()))
+	r, ok := GetRouter(h).(chi.Routes)
+	require.True(t, ok)
+
+	var routes []string
+	err := chi.Walk(r, func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		// chi spells a catch-all as "/*" and keeps the slash closing a
+		// subrouter; the spec names the wildcard and drops the slash.
+		route = strings.Replace(route, "/*", "/{asset}", 1)
+		route = trailingParamSlash.ReplaceAllString(route, "$1")
+		routes = append(routes, method+" "+route)
+		return nil
+	})
+	require.NoError(t, err)
+
+	var documented []string
+	for path, item := range openapi.MustLoad().Doc.Paths.Map() {
+		for method := range item.Operations() {
+			documented = append(documented, method+" "+path)
+		}
+	}
+
+	assert.ElementsMatch(t, documented, routes)
+}
+
+func TestGetRouter_DeprecatesLegacyRoutes(t *testing.T) {
+	h := handler.NewHandler(services.NewMetricService(storage.NewMemStorage()))
+	r := GetRouter(h)
+
+	tests := []struct {
+		method     string
+		target     string
+		deprecated bool
+	}{
+		{method: http.MethodPost, target: "/update/counter/PollCount/1", deprecated: true},
+		{method: http.MethodGet, target: "/value/counter/PollCount", deprecated: true},
+		{method: http.MethodGet, target: "/api/v1/metrics/counter/PollCount"},
+		{method: http.MethodGet, target: "/ping"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, httptest.NewRequest(tt.method, tt.target, nil))
+
+			require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+			if !tt.deprecated {
+				assert.Empty(t, rr.Header().Get("Deprecation"))
+				return
+			}
+			assert.Equal(t, "@1792368000", rr.Header().Get("Deprecation"))
+			assert.Equal(t, `</api/v1/metrics>; rel="successor-version"`, rr.Header().Get("Link"))
+		})
+	}
+}
+
+func TestGetRouter_BodyLimits(t *testing.T) {
+	h := handler.NewHandler(services.NewMetricService(storage.NewMemStorage()))
+	r := middlewares.LimitBody(1024)(GetRouter(h, WithMaxDecompressedSize(4096)))
+
+	gzipped := func(b []byte) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, _ = zw.Write(b)
+		_ = zw.Close()
+		return buf.Bytes()
+	}
+	metric := []byte(`[{"id":"Alloc","type":"gauge","value":1}]`)
+	padded := append(bytes.Repeat([]byte(" "), 8192), metric...)
+
+	tests := []struct {
+		name     string
+		body     []byte
+		encoding string
+		chunked  bool
+		code     int
+	}{
+		{name: "small body", body: metric, code: http.StatusOK},
+		{name: "large body", body: padded, code: http.StatusRequestEntityTooLarge},
+		{name: "large body without length", body: padded, chunked: true, code: http.StatusRequestEntityTooLarge},
+		{name: "small gzip body", body: gzipped(metric), encoding: "gzip", code: http.StatusOK},
+		{name: "gzip bomb", body: gzipped(padded), encoding: "gzip", code: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.encoding != "" {
+				req.Header.Set("Content-Encoding", tt.encoding)
+			}
+			if tt.chunked {
+				req.ContentLength = -1
+			}
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+
+			require.Equal(t, tt.code, rr.Code, rr.Body.String())
+			if tt.code == http.StatusRequestEntityTooLarge {
+				assert.Contains(t, rr.Body.String(), `"code":"body_too_large"`)
+			}
+		})
+	}
+}
+
+func TestGetRouter_RateLimits(t *testing.T) {
+	h := handler.NewHandler(services.NewMetricService(storage.NewMemStorage()))
+	r := GetRouter(h, WithIngestRateLimit(0.001, 2), WithReadRateLimit(0.001, 1))
+
+	send := func(r http.Handler, method, target, addr, agent, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.RemoteAddr = addr
+		if agent != "" {
+			req.Header.Set("X-Agent-ID", agent)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+	update := func(addr, agent string) int {
+		return send(r, http.MethodPost, "/update/gauge/Alloc/1", addr, agent, "").Code
+	}
+
+	for range 2 {
+		require.Equal(t, http.StatusOK, update("192.0.2.1:1000", "a"))
+	}
+	rr := send(r, http.MethodPost, "/update/gauge/Alloc/1", "192.0.2.1:1000", "a", "")
+	require.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.NotEmpty(t, rr.Header().Get("Retry-After"))
+	assert.Contains(t, rr.Body.String(), `"code":"rate_limited"`)
+
+	assert.Equal(t, http.StatusTooManyRequests, update("192.0.2.1:2000", "b"), "rotating agent IDs gets no fresh budget")
+	assert.Equal(t, http.StatusOK, update("192.0.2.2:1000", "a"), "other addresses keep their budget")
+
+	assert.Equal(t, http.StatusOK, update("[2001:db8::1]:1000", ""))
+	assert.Equal(t, http.StatusOK, update("[2001:db8::2]:1000", ""))
+	assert.Equal(t, http.StatusTooManyRequests, update("[2001:db8::3]:1000", ""), "IPv6 addresses share the budget of their /64")
+	assert.Equal(t, http.StatusOK, update("[2001:db8:0:1::1]:1000", ""))
+
+	assert.Equal(t, http.StatusOK, send(r, http.MethodGet, "/value/gauge/Alloc", "192.0.2.1:1000", "", "").Code, "reads have a separate budget")
+	assert.Equal(t, http.StatusTooManyRequests, send(r, http.MethodGet, "/value/gauge/Alloc", "192.0.2.1:1000", "", "").Code)
+	assert.Equal(t, http.StatusOK, send(r, http.MethodGet, "/ping", "192.0.2.1:1000", "", "").Code, "health checks are not limited")
+
+	tokens, err := auth.New(
+		auth.Token{Name: "agent-1", Token: "secret-token-agent-1", Roles: []auth.Role{auth.Ingest}},
+		auth.Token{Name: "agent-2", Token: "secret-token-agent-2", Roles: []auth.Role{auth.Ingest}},
+	)
+	require.NoError(t, err)
+	authed := GetRouter(h, WithIngestRateLimit(0.001, 1), WithAuth(tokens, false))
+
+	assert.Equal(t, http.StatusOK, send(authed, http.MethodPost, "/update/gauge/Alloc/1", "192.0.2.1:1000", "", "secret-token-agent-1").Code)
+	assert.Equal(t, http.StatusTooManyRequests, send(authed, http.MethodPost, "/update/gauge/Alloc/1", "192.0.2.3:1000", "", "secret-token-agent-1").Code,
+		"a token keeps its budget across addresses")
+	assert.Equal(t, http.StatusOK, send(authed, http.MethodPost, "/update/gauge/Alloc/1", "192.0.2.1:1000", "", "secret-token-agent-2").Code,
+		"tokens sharing an address have their own budgets")
+}
+
+// TestGetRouter_Auth checks every documented operation against the role
+// its x-role extension names.
+func TestGetRouter_Auth(t *testing.T) {
+	roles := []auth.Role{auth.Ingest, auth.Read, auth.Admin}
+	var tokens []auth.Token
+	for _, role := range roles {
+		tokens = append(tokens, auth.Token{Name: string(role), Token: "secret-token-for-" + string(role), Roles: []auth.Role{role}})
+	}
+	tt, err := auth.New(tokens...)
+	require.NoError(t, err)
+
+	h := handler.NewHandler(services.NewMetricService(storage.NewMemStorage()))
+	r := GetRouter(h, WithAuth(tt, false))
+	anonRead := GetRouter(h, WithAuth(tt, true))
+
+	params := strings.NewReplacer("{type}", "gauge", "{name}", "Alloc", "{value}", "1", "{asset}", "app.js")
+	// Streams end at once with a cancelled context.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	send := func(r http.Handler, method, target, token string) int {
+		req := httptest.NewRequest(method, target, nil).WithContext(ctx)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	denied := func(code int) bool {
+		return code == http.StatusUnauthorized || code == http.StatusForbidden
+	}
+
+	for path, item := range openapi.MustLoad().Doc.Paths.Map() {
+		for method, op := range item.Operations() {
+			target := params.Replace(path)
+			name := method + " " + path
+			need, _ := op.Extensions["x-role"].(string)
+
+			if need == "" {
+				require.NotNil(t, op.Security, "%s: documented without a role but not public", name)
+				assert.False(t, denied(send(r, method, target, "")), "%s: public", name)
+				continue
+			}
+
+			assert.Equal(t, http.StatusUnauthorized, send(r, method, target, ""), "%s: no token", name)
+			assert.Equal(t, http.StatusUnauthorized, send(r, method, target, "secret-token-for-nobody"), "%s: unknown token", name)
+			for _, role := range roles {
+				code := send(r, method, target, "secret-token-for-"+string(role))
+				if string(role) == need || role == auth.Admin {
+					assert.False(t, denied(code), "%s: %s token got %d", name, role, code)
+				} else {
+					assert.Equal(t, http.StatusForbidden, code, "%s: %s token", name, role)
+				}
+			}
+
+			code := send(anonRead, method, target, "")
+			assert.Equal(t, need == string(auth.Read), !denied(code), "%s: anonymous read got %d", name, code)
+		}
+	}
+}
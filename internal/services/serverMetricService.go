@@ -3,30 +3,137 @@ package services
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/go-playground/validator/v10"
+	"github.com/zubans/metrics/internal/aggregate"
+	"github.com/zubans/metrics/internal/alerts"
 	"github.com/zubans/metrics/internal/errdefs"
+	"github.com/zubans/metrics/internal/guard"
+	"github.com/zubans/metrics/internal/identity"
 	"github.com/zubans/metrics/internal/models"
-	"github.com/zubans/metrics/internal/storage"
+	"github.com/zubans/metrics/internal/pubsub"
+	"github.com/zubans/metrics/internal/query"
+	"github.com/zubans/metrics/internal/registry"
+	"github.com/zubans/metrics/internal/webhook"
+	"math"
+	"net/http"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
 )
 
+// MetricStorage is implemented by every metrics backend. All of them must
+// follow the same update semantics:
+//   - a gauge update replaces the stored value; within one UpdateMetrics
+//     batch the last value for a name wins;
+//   - a counter update adds the delta to the stored value; deltas for one
+//     name within a batch are summed and then added;
+//   - entries with a missing value (gauge) or delta (counter) are ignored.
+//
+// UpdateGauge and UpdateCounter return the value stored after the update.
+// UpdateMetrics returns the values stored after the batch, once for every
+// metric it wrote in order of first appearance: the gauge value and the
+// counter total.
+// DeleteMetric reports whether a metric of that type and name was stored;
+// a later update starts from scratch.
+// Snapshot returns a consistent point-in-time copy the caller may keep and
+// modify; a concurrent UpdateMetrics batch is either fully visible in it or
+// not at all.
 type MetricStorage interface {
 	UpdateGauge(ctx context.Context, name string, value float64) float64
 	UpdateCounter(ctx context.Context, name string, value int64) int64
 	GetGauge(ctx context.Context, name string) (float64, bool)
 	GetCounter(ctx context.Context, name string) (int64, bool)
-	ShowMetrics(ctx context.Context) (map[string]float64, map[string]int64, error)
-	UpdateMetrics(ctx context.Context, m []models.MetricsDTO) error
+	Snapshot(ctx context.Context) (models.Snapshot, error)
+	UpdateMetrics(ctx context.Context, m []models.MetricsDTO) ([]models.MetricsDTO, error)
+	DeleteMetric(ctx context.Context, mType, name string) (bool, error)
+	Ping(ctx context.Context) error
 }
 
 type Storage struct {
-	storage MetricStorage
+	storage    MetricStorage
+	aggregator *aggregate.Aggregator
+	registry   *registry.Registry
+	hub        *pubsub.Hub
+	webhooks   *webhook.Dispatcher
+	alerts     *alerts.Engine
+	history    *query.History
+	guard      *guard.Guard
+	changes    *changeSet
+	writes     *writeLocks
 }
 
-func NewMetricService(storage MetricStorage) *Storage {
-	return &Storage{storage: storage}
+// Option configures optional features of the metric service.
+type Option func(*Storage)
+
+// WithAggregator enables cross-agent aggregates of gauges. Gauge updates from
+// identified agents are recorded and exposed as virtual metrics such as
+// "Alloc:avg".
+func WithAggregator(a *aggregate.Aggregator) Option {
+	return func(s *Storage) {
+		s.aggregator = a
+	}
+}
+
+// WithRegistry enables tracking of identified agents in r.
+func WithRegistry(r *registry.Registry) Option {
+	return func(s *Storage) {
+		s.registry = r
+	}
+}
+
+// WithHub publishes every metric change to h for streaming clients. Writes
+// that leave a value as it was are not published.
+func WithHub(h *pubsub.Hub) Option {
+	return func(s *Storage) {
+		s.hub = h
+	}
+}
+
+// WithWebhooks sends every metric change to the webhook dispatcher d. Writes
+// that leave a value as it was are not sent.
+func WithWebhooks(d *webhook.Dispatcher) Option {
+	return func(s *Storage) {
+		s.webhooks = d
+	}
+}
+
+// WithAlerts exposes the alerts of engine e.
+func WithAlerts(e *alerts.Engine) Option {
+	return func(s *Storage) {
+		s.alerts = e
+	}
+}
+
+// WithHistory records every metric change in h for range queries.
+func WithHistory(h *query.History) Option {
+	return func(s *Storage) {
+		s.history = h
+	}
+}
+
+// WithGuard rejects writes that break the name and cardinality policy of g
+// and exposes its counters as self-metrics.
+func WithGuard(g *guard.Guard) Option {
+	return func(s *Storage) {
+		s.guard = g
+	}
+}
+
+func NewMetricService(storage MetricStorage, opts ...Option) *Storage {
+	s := &Storage{storage: storage}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.hub != nil || s.webhooks != nil {
+		s.changes = &changeSet{last: make(map[string]uint64)}
+	}
+	if s.changes != nil || s.history != nil {
+		s.writes = &writeLocks{}
+	}
+	return s
 }
 
 var validate = validator.New()
@@ -48,12 +155,59 @@ func NewMetricData(t, n string, v ...string) (*MetricData, error) {
 	}
 
 	if err := validate.Struct(m); err != nil {
-		return nil, err
+		var verrs validator.ValidationErrors
+		if !errors.As(err, &verrs) {
+			return nil, errdefs.NewValidationError("invalid metric")
+		}
+
+		fields := make([]errdefs.FieldError, 0, len(verrs))
+		for _, fe := range verrs {
+			msg := "is required"
+			if fe.Tag() == "oneof" {
+				msg = "must be one of: " + fe.Param()
+			}
+			fields = append(fields, errdefs.FieldError{Field: strings.ToLower(fe.Field()), Message: msg})
+		}
+		return nil, errdefs.NewValidationError("invalid metric", fields...)
 	}
 
 	return m, nil
 }
 
+// ValidateMetric checks that m has a name, a known type and exactly the
+// value field its type needs. path prefixes the reported field names.
+func ValidateMetric(m models.MetricsDTO, path string) []errdefs.FieldError {
+	var fields []errdefs.FieldError
+	add := func(field, msg string) {
+		fields = append(fields, errdefs.FieldError{Field: path + field, Message: msg})
+	}
+
+	if m.ID == "" {
+		add("id", "is required")
+	}
+
+	switch m.MType {
+	case string(models.Gauge):
+		if m.Value == nil {
+			add("value", "is required for gauge")
+		}
+		if m.Delta != nil {
+			add("delta", "is not allowed for gauge")
+		}
+	case string(models.Counter):
+		if m.Delta == nil {
+			add("delta", "is required for counter")
+		}
+		if m.Value != nil {
+			add("value", "is not allowed for counter")
+		}
+	default:
+		add("type", "must be one of: counter gauge")
+	}
+
+	return fields
+}
+
 func ParseMetricValue(mData *MetricData) (float64, error) {
 	if mData.Value == nil {
 		return 0, fmt.Errorf("value is nil for metric %s", mData.Name)
@@ -67,145 +221,498 @@ func ParseMetricValue(mData *MetricData) (float64, error) {
 	return value, nil
 }
 
-func (s Storage) ShowMetrics(ctx context.Context) (string, error) {
-	gauges, counters, err := s.storage.ShowMetrics(ctx)
+// ListMetrics returns all stored metrics sorted by name and type.
+func (s Storage) ListMetrics(ctx context.Context) ([]models.MetricsDTO, error) {
+	snap, err := s.storage.Snapshot(ctx)
+	if err != nil {
+		return nil, errdefs.NewInternalError(errdefs.CodeStorageFailure, "can't read metrics", err)
+	}
 
+	metrics := make([]models.MetricsDTO, 0, len(snap.Gauges)+len(snap.Counters))
+	for name, value := range snap.Gauges {
+		metrics = append(metrics, models.MetricsDTO{ID: name, MType: string(models.Gauge), Value: &value})
+	}
+	for name, delta := range snap.Counters {
+		metrics = append(metrics, models.MetricsDTO{ID: name, MType: string(models.Counter), Delta: &delta})
+	}
+
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].ID != metrics[j].ID {
+			return metrics[i].ID < metrics[j].ID
+		}
+		return metrics[i].MType < metrics[j].MType
+	})
+
+	return metrics, nil
+}
+
+// Metric returns the stored metric described by mData, including virtual
+// aggregate gauges.
+func (s Storage) Metric(ctx context.Context, mData *MetricData) (*models.MetricsDTO, error) {
+	switch mData.Type {
+	case string(models.Counter):
+		if value, found := s.storage.GetCounter(ctx, mData.Name); found {
+			return &models.MetricsDTO{ID: mData.Name, MType: mData.Type, Delta: &value}, nil
+		}
+	case string(models.Gauge):
+		if value, found := s.getGauge(ctx, mData.Name); found {
+			return &models.MetricsDTO{ID: mData.Name, MType: mData.Type, Value: &value}, nil
+		}
+	default:
+		return nil, errdefs.NewValidationError("invalid metric type",
+			errdefs.FieldError{Field: "type", Message: "must be one of: counter gauge"})
+	}
+	return nil, errdefs.NewNotFoundError(errdefs.CodeMetricNotFound, "metric not found")
+}
+
+func (s Storage) GetMetric(ctx context.Context, mData *MetricData) (string, error) {
+	m, err := s.Metric(ctx, mData)
 	if err != nil {
 		return "", err
 	}
-	var keys []string
-	for k := range gauges {
-		keys = append(keys, k)
+	if m.Delta != nil {
+		return strconv.FormatInt(*m.Delta, 10), nil
 	}
+	return strconv.FormatFloat(*m.Value, 'f', -1, 64), nil
+}
 
-	sort.Strings(keys)
+func (s Storage) GetJSONMetric(ctx context.Context, jsonData *models.MetricsDTO) ([]byte, error) {
+	m, err := s.Metric(ctx, &MetricData{Type: jsonData.MType, Name: jsonData.ID})
+	if err != nil {
+		return nil, err
+	}
 
-	result := "<html><span style='float:left; margin-right:20px;'><strong>Guages</strong><table border=1 style='border-collapse: collapse;'><tr>"
+	res, err := json.Marshal(m)
+	if err != nil {
+		return nil, errdefs.NewInternalError(errdefs.CodeInternal, "can't marshal json data", err)
+	}
+	return res, nil
+}
 
-	for _, k := range keys {
-		v := gauges[k]
-		result += "<tr><td>" + k + "</td><td>" + strconv.FormatFloat(v, 'f', -1, 64) + "</td></tr>"
+func (s Storage) UpdateMetrics(ctx context.Context, m []models.MetricsDTO) error {
+	if m == nil {
+		return errdefs.NewValidationError("metrics are required")
 	}
 
-	result += "</table> </span>"
-	result += "<span style='float:left;'><strong>Counters</strong><table border=1 style='border-collapse: collapse;'><tr>"
+	var fields []errdefs.FieldError
+	for i, v := range m {
+		fields = append(fields, ValidateMetric(v, fmt.Sprintf("[%d].", i))...)
+	}
+	if len(fields) > 0 {
+		return errdefs.NewValidationError("invalid metrics", fields...)
+	}
 
-	for k, w := range counters {
-		result += "<td>" + k + "</td>" + "<td>" + strconv.FormatInt(w, 10) + "</td></tr>"
+	series := make([]guard.Series, len(m))
+	for i, v := range m {
+		series[i] = guard.Series{Type: v.MType, Name: v.ID}
+	}
+	if err := s.admit(ctx, "[%d].", series...); err != nil {
+		return err
 	}
-	result += "</table></span></html>"
 
-	return result, nil
-}
+	names := make([]string, len(m))
+	for i, v := range m {
+		names[i] = v.ID
+	}
+	defer s.lockWrites(names...)()
 
-func (s Storage) GetMetric(ctx context.Context, mData *MetricData) (string, *errdefs.CustomError) {
-	if mData.Type == "counter" {
-		value, found := s.storage.GetCounter(ctx, mData.Name)
-		if found {
-			return strconv.FormatInt(value, 10), nil
-		} else {
-			return "", errdefs.NewNotFoundError("metric name required")
-		}
-	} else if mData.Type == "gauge" {
-		value, found := s.storage.GetGauge(ctx, mData.Name)
-		if found {
-			return strconv.FormatFloat(value, 'f', -1, 64), nil
-		} else {
-			return "", errdefs.NewNotFoundError("metric name required")
-		}
-	} else {
-		return "", errdefs.NewBadRequestError("Invalid metric type")
+	stored, err := s.storage.UpdateMetrics(ctx, m)
+	if err != nil {
+		return errdefs.NewInternalError(errdefs.CodeStorageFailure, "can't update metrics", err)
 	}
-}
 
-func (s Storage) GetJSONMetric(ctx context.Context, jsonData *models.MetricsDTO) ([]byte, *errdefs.CustomError) {
-	if jsonData.MType == string(models.Counter) {
-		value, found := s.storage.GetCounter(ctx, jsonData.ID)
-		if found {
-			jsonData.Delta = &value
-			res, err := json.Marshal(jsonData)
-			if err != nil {
-				return nil, errdefs.NewBadRequestError("can't marshal json data")
-			}
-			return res, nil
-		} else {
-			return nil, errdefs.NewNotFoundError("metric name required")
-		}
-	} else if jsonData.MType == string(models.Gauge) {
-		value, found := s.storage.GetGauge(ctx, jsonData.ID)
-		if found {
-			jsonData.Value = &value
-			res, err := json.Marshal(jsonData)
-			if err != nil {
-				return nil, errdefs.NewBadRequestError("can't marshal json data")
-			}
-			return res, nil
-		} else {
-			return nil, errdefs.NewNotFoundError("metric name required")
+	keys := make([]string, 0, len(m))
+	for _, v := range m {
+		if v.MType == string(models.Gauge) && v.Value != nil {
+			s.observe(ctx, v.ID, *v.Value)
 		}
-	} else {
-		return nil, errdefs.NewBadRequestError("Invalid metric type")
+		keys = append(keys, metricKey(v.MType, v.ID))
 	}
+	s.register(ctx, keys...)
+	s.publish(stored...)
+
+	return nil
 }
 
-func (s Storage) UpdateMetrics(ctx context.Context, m []models.MetricsDTO) (bool, *errdefs.CustomError, error) {
-	if m == nil {
-		return false, errdefs.NewNotFoundError("metric name required"), fmt.Errorf("metric name required")
+// DeleteMetric removes the stored metric described by mData and its query
+// history.
+func (s Storage) DeleteMetric(ctx context.Context, mData *MetricData) error {
+	if mData.Type != string(models.Gauge) && mData.Type != string(models.Counter) {
+		return errdefs.NewValidationError("invalid metric type",
+			errdefs.FieldError{Field: "type", Message: "must be one of: counter gauge"})
 	}
 
-	err := s.storage.UpdateMetrics(ctx, m)
+	defer s.lockWrites(mData.Name)()
+
+	deleted, err := s.storage.DeleteMetric(ctx, mData.Type, mData.Name)
 	if err != nil {
-		return false, nil, errdefs.NewBadRequestError("can't update metrics")
+		return errdefs.NewInternalError(errdefs.CodeStorageFailure, "can't delete metric", err)
+	}
+	if !deleted {
+		return errdefs.NewNotFoundError(errdefs.CodeMetricNotFound, "metric not found")
 	}
-	return true, nil, nil
 
+	if s.history != nil {
+		s.history.Forget(mData.Name, mData.Type)
+	}
+	if s.changes != nil {
+		s.changes.forget(metricKey(mData.Type, mData.Name))
+	}
+	if s.guard != nil {
+		s.guard.Forget(guard.Series{Type: mData.Type, Name: mData.Name})
+	}
+
+	return nil
 }
 
-func (s Storage) UpdateMetric(ctx context.Context, mData *MetricData) (*models.MetricsDTO, *errdefs.CustomError, error) {
+func (s Storage) UpdateMetric(ctx context.Context, mData *MetricData) (*models.MetricsDTO, error) {
 	if mData.Name == "" {
-		return nil, errdefs.NewNotFoundError("metric name required"), fmt.Errorf("metric name required")
+		return nil, errdefs.NewNotFoundError(errdefs.CodeMetricNameRequired, "metric name required")
 	}
 
 	switch mData.Type {
 	case "gauge":
 		if mData.Value == nil {
-			return nil, errdefs.NewBadRequestError("missing gauge value"), fmt.Errorf("missing gauge value")
+			return nil, errdefs.NewValidationError("missing gauge value",
+				errdefs.FieldError{Field: "value", Message: "is required"})
 		}
 
 		value, err := ParseMetricValue(mData)
 		if err != nil {
-			return nil, errdefs.NewBadRequestError("invalid gauge value"), fmt.Errorf("invalid gauge value")
+			return nil, errdefs.NewValidationError("invalid gauge value",
+				errdefs.FieldError{Field: "value", Message: "must be a number"})
+		}
+		if err := s.admit(ctx, "", guard.Series{Type: mData.Type, Name: mData.Name}); err != nil {
+			return nil, err
 		}
 
+		defer s.lockWrites(mData.Name)()
+
 		res := s.storage.UpdateGauge(ctx, mData.Name, value)
+		s.observe(ctx, mData.Name, value)
+		s.register(ctx, metricKey(mData.Type, mData.Name))
 
-		return &models.MetricsDTO{
+		dto := &models.MetricsDTO{
 			ID:    mData.Name,
 			MType: "gauge",
 			Value: &res,
-		}, nil, nil
+		}
+		s.publish(*dto)
+
+		return dto, nil
 	case "counter":
 		if mData.Value == nil {
-			return nil, errdefs.NewBadRequestError("missing counter delta"), fmt.Errorf("missing counter delta")
+			return nil, errdefs.NewValidationError("missing counter delta",
+				errdefs.FieldError{Field: "value", Message: "is required"})
 		}
 
 		value, err := ParseMetricValue(mData)
 		if err != nil {
-			return nil, errdefs.NewBadRequestError("invalid counter metric value"), fmt.Errorf("invalid counter metric value")
+			return nil, errdefs.NewValidationError("invalid counter metric value",
+				errdefs.FieldError{Field: "value", Message: "must be a number"})
+		}
+		if err := s.admit(ctx, "", guard.Series{Type: mData.Type, Name: mData.Name}); err != nil {
+			return nil, err
 		}
 
+		defer s.lockWrites(mData.Name)()
+
 		res := s.storage.UpdateCounter(ctx, mData.Name, int64(value))
+		s.register(ctx, metricKey(mData.Type, mData.Name))
 
-		return &models.MetricsDTO{
+		dto := &models.MetricsDTO{
 			ID:    mData.Name,
 			MType: "counter",
 			Delta: &res,
-		}, nil, nil
+		}
+		s.publish(*dto)
+
+		return dto, nil
+	default:
+		return nil, errdefs.NewValidationError("invalid metric type",
+			errdefs.FieldError{Field: "type", Message: "must be one of: counter gauge"})
+	}
+}
+
+// admit passes a write to the guard and reports a rejection with the
+// offending entries as "id" fields. A non-empty format prefixes each field
+// with the entry index, as in "[%d].".
+func (s Storage) admit(ctx context.Context, format string, series ...guard.Series) error {
+	if s.guard == nil {
+		return nil
+	}
+
+	err := s.guard.Admit(identity.Client(ctx), series)
+	var rej *guard.Rejection
+	if !errors.As(err, &rej) {
+		return err
+	}
+
+	fields := make([]errdefs.FieldError, len(rej.Violations))
+	for i, v := range rej.Violations {
+		field := "id"
+		if format != "" {
+			field = fmt.Sprintf(format, v.Index) + field
+		}
+		fields[i] = errdefs.FieldError{Field: field, Message: v.Message}
+	}
+
+	var e *errdefs.Error
+	switch rej.Reason {
+	case guard.SeriesLimit:
+		e = errdefs.New(http.StatusUnprocessableEntity, errdefs.CodeSeriesLimit, rej.Message)
+	case guard.SeriesRate:
+		e = errdefs.New(http.StatusTooManyRequests, errdefs.CodeSeriesRateLimited, rej.Message)
 	default:
-		return nil, errdefs.NewBadRequestError("invalid counter metric type"), fmt.Errorf("invalid counter metric type")
+		e = errdefs.NewValidationError(rej.Message)
+	}
+	e.Fields = fields
+	return e
+}
+
+// SelfMetrics returns metrics about the server itself: the number of known
+// series and the metric updates rejected by the guard, in total and by
+// reason. It is empty without a guard.
+func (s Storage) SelfMetrics(_ context.Context) []models.MetricsDTO {
+	if s.guard == nil {
+		return []models.MetricsDTO{}
+	}
+
+	stats := s.guard.Stats()
+	series := float64(stats.Series)
+	metrics := []models.MetricsDTO{{ID: "server_series", MType: string(models.Gauge), Value: &series}}
+
+	var total int64
+	for _, r := range guard.Reasons {
+		total += stats.Rejected[r]
+	}
+	metrics = append(metrics, models.MetricsDTO{ID: "server_rejected_writes_total", MType: string(models.Counter), Delta: &total})
+	for _, r := range guard.Reasons {
+		n := stats.Rejected[r]
+		metrics = append(metrics, models.MetricsDTO{
+			ID:    "server_rejected_writes_" + string(r) + "_total",
+			MType: string(models.Counter),
+			Delta: &n,
+		})
+	}
+
+	return metrics
+}
+
+// getGauge reads a stored gauge and falls back to virtual aggregate metrics
+// like "Alloc:avg" when no gauge with that name is stored.
+func (s Storage) getGauge(ctx context.Context, name string) (float64, bool) {
+	if value, found := s.storage.GetGauge(ctx, name); found {
+		return value, true
+	}
+
+	if s.aggregator == nil {
+		return 0, false
+	}
+
+	base, fn, ok := aggregate.ParseVirtual(name)
+	if !ok {
+		return 0, false
+	}
+	return s.aggregator.Aggregate(base, fn)
+}
+
+// observe feeds a gauge update of an identified agent to the aggregator.
+// Agents are qualified by client key, so a client claiming another
+// client's agent ID can't overwrite its samples.
+func (s Storage) observe(ctx context.Context, name string, value float64) {
+	if s.aggregator == nil {
+		return
+	}
+
+	if agentID := identity.AgentID(ctx); agentID != "" {
+		s.aggregator.Observe(identity.Client(ctx)+"/"+agentID, name, value)
+	}
+}
+
+// register records the reporting agent, if identified, in the registry.
+func (s Storage) register(ctx context.Context, keys ...string) {
+	if s.registry == nil {
+		return
+	}
+
+	if agentID := identity.AgentID(ctx); agentID != "" {
+		s.registry.Observe(agentID, identity.AgentVersion(ctx), keys)
+	}
+}
+
+func metricKey(mType, name string) string {
+	return mType + "/" + name
+}
+
+// writeShards is the number of partitions of writeLocks. It must be a power
+// of two not greater than 64, so shard sets fit in a uint64 mask.
+const writeShards = 64
+
+// writeLocks serializes the writes of each metric with their publishing, so
+// the history, subscribers and webhooks see stored values in the order the
+// storage wrote them.
+type writeLocks struct {
+	shards [writeShards]sync.Mutex
+}
+
+// lock locks the partitions of names in index order, so concurrent batches
+// can't deadlock, and returns a function unlocking them.
+func (w *writeLocks) lock(names ...string) func() {
+	var mask uint64
+	for _, name := range names {
+		h := uint32(2166136261)
+		for i := 0; i < len(name); i++ {
+			h ^= uint32(name[i])
+			h *= 16777619
+		}
+		mask |= 1 << (h & (writeShards - 1))
+	}
+
+	for i := range w.shards {
+		if mask&(1<<i) != 0 {
+			w.shards[i].Lock()
+		}
+	}
+	return func() {
+		for i := range w.shards {
+			if mask&(1<<i) != 0 {
+				w.shards[i].Unlock()
+			}
+		}
+	}
+}
+
+// lockWrites holds off other writes of names until the returned function is
+// called. Without anything to publish to, writes are not serialized.
+func (s Storage) lockWrites(names ...string) func() {
+	if s.writes == nil {
+		return func() {}
+	}
+	return s.writes.lock(names...)
+}
+
+// publish records stored values in the history and notifies subscribers
+// and webhooks of those that changed. Callers hold the write locks of the
+// values, see lockWrites.
+func (s Storage) publish(events ...models.MetricsDTO) {
+	if s.history != nil {
+		for _, e := range events {
+			switch {
+			case e.Value != nil:
+				s.history.Record(e.ID, e.MType, *e.Value)
+			case e.Delta != nil:
+				s.history.Record(e.ID, e.MType, float64(*e.Delta))
+			}
+		}
+	}
+
+	if s.changes == nil {
+		return
+	}
+	events = s.changes.filter(events)
+	if len(events) == 0 {
+		return
+	}
+	if s.hub != nil {
+		s.hub.Publish(events...)
+	}
+	if s.webhooks != nil {
+		s.webhooks.Enqueue(events...)
+	}
+}
+
+// changeSet remembers the last value notified for every metric, so writes
+// repeating a gauge value or adding a zero delta notify nobody.
+type changeSet struct {
+	mu   sync.Mutex
+	last map[string]uint64 // metric key -> gauge bits or counter total
+}
+
+// filter returns the events whose value differs from the last one notified.
+func (c *changeSet) filter(events []models.MetricsDTO) []models.MetricsDTO {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	changed := events[:0:0]
+	for _, e := range events {
+		var value uint64
+		switch {
+		case e.Value != nil:
+			value = math.Float64bits(*e.Value)
+		case e.Delta != nil:
+			value = uint64(*e.Delta)
+		default:
+			continue
+		}
+
+		key := metricKey(e.MType, e.ID)
+		if last, ok := c.last[key]; ok && last == value {
+			continue
+		}
+		c.last[key] = value
+		changed = append(changed, e)
+	}
+	return changed
+}
+
+func (c *changeSet) forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.last, key)
+}
+
+// Subscribe starts streaming metric changes matching f. It returns nil when
+// streaming is disabled.
+func (s Storage) Subscribe(_ context.Context, f pubsub.Filter) *pubsub.Subscription {
+	if s.hub == nil {
+		return nil
+	}
+	return s.hub.Subscribe(f)
+}
+
+// SubscribeQueue starts streaming metric changes accepted by match into a
+// bounded queue. It returns nil when streaming is disabled.
+func (s Storage) SubscribeQueue(_ context.Context, size int, match func(models.MetricsDTO) bool) *pubsub.Queue {
+	if s.hub == nil {
+		return nil
+	}
+	return s.hub.SubscribeQueue(size, match)
+}
+
+// Query evaluates a query expression over the stored metrics. Invalid
+// queries are reported as bad requests.
+func (s Storage) Query(ctx context.Context, expr string) (*query.Result, error) {
+	res, err := query.NewEvaluator(s.storage, s.history).Query(ctx, expr)
+	if err != nil {
+		var qErr *query.Error
+		var evalErr *query.EvalError
+		if errors.As(err, &qErr) || errors.As(err, &evalErr) || errors.Is(err, query.ErrNoHistory) {
+			return nil, errdefs.NewBadRequestError(errdefs.CodeInvalidQuery, err.Error())
+		}
+		return nil, errdefs.NewInternalError(errdefs.CodeStorageFailure, "can't read metrics", err)
+	}
+	return res, nil
+}
+
+// Agents lists the agents known to the server. It is empty when agent
+// tracking is disabled.
+func (s Storage) Agents(_ context.Context) []registry.Agent {
+	if s.registry == nil {
+		return []registry.Agent{}
+	}
+	return s.registry.Agents()
+}
+
+// Alerts lists the current alerts. It is empty when alerting is disabled.
+func (s Storage) Alerts(_ context.Context) []alerts.Alert {
+	if s.alerts == nil {
+		return []alerts.Alert{}
 	}
+	return s.alerts.Alerts()
 }
 
 func (s Storage) Ping(ctx context.Context) error {
-	return storage.PingDB(ctx)
+	return s.storage.Ping(ctx)
 }
@@ -2,8 +2,27 @@ package services
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"github.com/zubans/metrics/internal/aggregate"
+	"github.com/zubans/metrics/internal/config"
+	"github.com/zubans/metrics/internal/errdefs"
+	"github.com/zubans/metrics/internal/guard"
+	"github.com/zubans/metrics/internal/identity"
 	"github.com/zubans/metrics/internal/models"
+	"github.com/zubans/metrics/internal/pubsub"
+	"github.com/zubans/metrics/internal/query"
+	"github.com/zubans/metrics/internal/storage"
+	"github.com/zubans/metrics/internal/webhook"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 )
 
 type MockMetricStorage struct {
@@ -42,23 +61,67 @@ func (m *MockMetricStorage) GetCounter(_ context.Context, name string) (int64, b
 	return value, exists
 }
 
-func (m *MockMetricStorage) ShowMetrics(_ context.Context) (map[string]float64, map[string]int64, error) {
-	return m.gauges, m.counters, nil
+func (m *MockMetricStorage) Snapshot(_ context.Context) (models.Snapshot, error) {
+	snap := models.Snapshot{
+		Gauges:   make(map[string]float64, len(m.gauges)),
+		Counters: make(map[string]int64, len(m.counters)),
+	}
+	for k, v := range m.gauges {
+		snap.Gauges[k] = v
+	}
+	for k, v := range m.counters {
+		snap.Counters[k] = v
+	}
+	return snap, nil
 }
 
-func (m *MockMetricStorage) UpdateMetrics(ctx context.Context, metrics []models.MetricsDTO) error {
+func (m *MockMetricStorage) UpdateMetrics(ctx context.Context, metrics []models.MetricsDTO) ([]models.MetricsDTO, error) {
+	var stored []models.MetricsDTO
+	seen := make(map[string]int)
+	add := func(v models.MetricsDTO) {
+		key := v.MType + "/" + v.ID
+		if i, ok := seen[key]; ok {
+			stored[i] = v
+			return
+		}
+		seen[key] = len(stored)
+		stored = append(stored, v)
+	}
+
 	for _, metric := range metrics {
 		switch metric.MType {
 		case "gauge":
 			if metric.Value != nil {
 				m.gauges[metric.ID] = *metric.Value
+				add(metric)
 			}
 		case "counter":
 			if metric.Delta != nil {
-				m.UpdateCounter(ctx, metric.ID, *metric.Delta)
+				total := m.UpdateCounter(ctx, metric.ID, *metric.Delta)
+				add(models.MetricsDTO{ID: metric.ID, MType: metric.MType, Delta: &total})
 			}
 		}
 	}
+	return stored, nil
+}
+
+func (m *MockMetricStorage) DeleteMetric(_ context.Context, mType, name string) (bool, error) {
+	switch mType {
+	case "gauge":
+		if _, exists := m.gauges[name]; exists {
+			delete(m.gauges, name)
+			return true, nil
+		}
+	case "counter":
+		if _, exists := m.counters[name]; exists {
+			delete(m.counters, name)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *MockMetricStorage) Ping(_ context.Context) error {
 	return nil
 }
 
@@ -240,33 +303,28 @@ func TestParseMetricValue_NilValue(t *testing.T) {
 	}
 }
 
-func TestStorage_ShowMetrics(t *testing.T) {
+func TestStorage_ListMetrics(t *testing.T) {
 	mockStorage := NewMockMetricStorage()
 	service := NewMetricService(mockStorage)
 
 	mockStorage.UpdateGauge(context.Background(), "test_gauge", 123.45)
 	mockStorage.UpdateCounter(context.Background(), "test_counter", 100)
+	mockStorage.UpdateCounter(context.Background(), "a_counter", 1)
+	mockStorage.UpdateGauge(context.Background(), "test_counter", 2.5)
 
-	result, err := service.ShowMetrics(context.Background())
-
+	result, err := service.ListMetrics(context.Background())
 	if err != nil {
-		t.Errorf("Unexpected error: %v", err)
+		t.Fatalf("Unexpected error: %v", err)
 	}
 
-	if result == "" {
-		t.Error("Expected non-empty result")
+	want := []models.MetricsDTO{
+		{ID: "a_counter", MType: "counter", Delta: int64Ptr(1)},
+		{ID: "test_counter", MType: "counter", Delta: int64Ptr(100)},
+		{ID: "test_counter", MType: "gauge", Value: float64Ptr(2.5)},
+		{ID: "test_gauge", MType: "gauge", Value: float64Ptr(123.45)},
 	}
-
-	if !contains(result, "<html>") {
-		t.Error("Expected HTML in result")
-	}
-
-	if !contains(result, "Guages") {
-		t.Error("Expected 'Guages' section in result")
-	}
-
-	if !contains(result, "Counters") {
-		t.Error("Expected 'Counters' section in result")
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("expected metrics sorted by name and type, got %+v", result)
 	}
 }
 
@@ -321,17 +379,17 @@ func TestStorage_GetMetric(t *testing.T) {
 				Name: tt.metricName,
 			}
 
-			result, customErr := service.GetMetric(context.Background(), metricData)
+			result, err := service.GetMetric(context.Background(), metricData)
 
 			if tt.expectError {
-				if customErr == nil {
+				if err == nil {
 					t.Error("Expected error but got none")
 				}
 				return
 			}
 
-			if customErr != nil {
-				t.Errorf("Unexpected error: %v", customErr)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
 				return
 			}
 
@@ -382,17 +440,17 @@ func TestStorage_GetJSONMetric(t *testing.T) {
 				MType: tt.metricType,
 			}
 
-			result, customErr := service.GetJSONMetric(context.Background(), jsonData)
+			result, err := service.GetJSONMetric(context.Background(), jsonData)
 
 			if tt.expectError {
-				if customErr == nil {
+				if err == nil {
 					t.Error("Expected error but got none")
 				}
 				return
 			}
 
-			if customErr != nil {
-				t.Errorf("Unexpected error: %v", customErr)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
 				return
 			}
 
@@ -473,20 +531,15 @@ func TestStorage_UpdateMetric(t *testing.T) {
 				metricData.Value = &tt.value
 			}
 
-			result, customErr, err := service.UpdateMetric(context.Background(), metricData)
+			result, err := service.UpdateMetric(context.Background(), metricData)
 
 			if tt.expectError {
-				if customErr == nil && err == nil {
+				if err == nil {
 					t.Error("Expected error but got none")
 				}
 				return
 			}
 
-			if customErr != nil {
-				t.Errorf("Unexpected custom error: %v", customErr)
-				return
-			}
-
 			if err != nil {
 				t.Errorf("Unexpected error: %v", err)
 				return
@@ -539,27 +592,17 @@ func TestStorage_UpdateMetrics(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			success, customErr, err := service.UpdateMetrics(context.Background(), tt.metrics)
+			err := service.UpdateMetrics(context.Background(), tt.metrics)
 
 			if tt.expectError {
-				if customErr == nil && err == nil {
+				if err == nil {
 					t.Error("Expected error but got none")
 				}
 				return
 			}
 
-			if customErr != nil {
-				t.Errorf("Unexpected custom error: %v", customErr)
-				return
-			}
-
 			if err != nil {
 				t.Errorf("Unexpected error: %v", err)
-				return
-			}
-
-			if !success {
-				t.Error("Expected success but got false")
 			}
 		})
 	}
@@ -575,12 +618,12 @@ func TestStorage_InterfaceCompliance(t *testing.T) {
 
 	ctx := context.Background()
 
-	result, err := service.ShowMetrics(ctx)
+	result, err := service.ListMetrics(ctx)
 	if err != nil {
-		t.Errorf("ShowMetrics failed: %v", err)
+		t.Errorf("ListMetrics failed: %v", err)
 	}
-	if result == "" {
-		t.Error("ShowMetrics should return non-empty result")
+	if result == nil {
+		t.Error("ListMetrics should return non-nil result")
 	}
 
 	metricData := &MetricData{
@@ -589,22 +632,15 @@ func TestStorage_InterfaceCompliance(t *testing.T) {
 		Value: stringPtr("123.45"),
 	}
 
-	resultDTO, customErr, err := service.UpdateMetric(ctx, metricData)
+	resultDTO, err := service.UpdateMetric(ctx, metricData)
 	if err != nil {
 		t.Errorf("UpdateMetric failed: %v", err)
 	}
-	if customErr != nil {
-		t.Errorf("UpdateMetric custom error: %v", customErr)
-	}
 	if resultDTO == nil {
 		t.Error("UpdateMetric should return result")
 	}
 }
 
-func contains(s, substr string) bool {
-	return len(s) >= len(substr) && (s == substr || len(s) > len(substr) && (s[:len(substr)] == substr || s[len(s)-len(substr):] == substr || contains(s[1:], substr)))
-}
-
 func float64Ptr(v float64) *float64 {
 	return &v
 }
@@ -616,3 +652,501 @@ func int64Ptr(v int64) *int64 {
 func stringPtr(v string) *string {
 	return &v
 }
+
+func TestStorage_AggregatesAcrossAgents(t *testing.T) {
+	mockStorage := NewMockMetricStorage()
+	service := NewMetricService(mockStorage, WithAggregator(aggregate.New(time.Minute)))
+
+	for agent, value := range map[string]string{"agent-1": "10", "agent-2": "30"} {
+		ctx := identity.WithAgentID(context.Background(), agent)
+		if _, err := service.UpdateMetric(ctx, &MetricData{Type: "gauge", Name: "Alloc", Value: stringPtr(value)}); err != nil {
+			t.Fatalf("UpdateMetric failed: %v", err)
+		}
+	}
+
+	ctx := identity.WithAgentID(context.Background(), "agent-3")
+	if err := service.UpdateMetrics(ctx, []models.MetricsDTO{
+		{ID: "Alloc", MType: "gauge", Value: float64Ptr(20)},
+	}); err != nil {
+		t.Fatalf("UpdateMetrics failed: %v", err)
+	}
+
+	// Anonymous updates are stored but not aggregated.
+	if _, err := service.UpdateMetric(context.Background(), &MetricData{Type: "gauge", Name: "Alloc", Value: stringPtr("1000")}); err != nil {
+		t.Fatalf("UpdateMetric failed: %v", err)
+	}
+
+	tests := map[string]string{
+		"Alloc":       "1000",
+		"Alloc:avg":   "20",
+		"Alloc:min":   "10",
+		"Alloc:max":   "30",
+		"Alloc:sum":   "60",
+		"Alloc:count": "3",
+	}
+	for name, want := range tests {
+		got, err := service.GetMetric(context.Background(), &MetricData{Type: "gauge", Name: name})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: expected %s, got %s", name, want, got)
+		}
+	}
+
+	res, err := service.GetJSONMetric(context.Background(), &models.MetricsDTO{ID: "Alloc:avg", MType: "gauge"})
+	if err != nil {
+		t.Fatalf("GetJSONMetric failed: %v", err)
+	}
+	if string(res) != `{"id":"Alloc:avg","type":"gauge","value":20}` {
+		t.Errorf("unexpected JSON: %s", res)
+	}
+
+	if _, err := service.GetMetric(context.Background(), &MetricData{Type: "gauge", Name: "Unknown:avg"}); err == nil {
+		t.Error("expected not found for aggregate of unknown gauge")
+	}
+}
+
+func TestStorage_PublishesUpdates(t *testing.T) {
+	hub := pubsub.NewHub()
+	service := NewMetricService(NewMockMetricStorage(), WithHub(hub))
+	sub := service.Subscribe(context.Background(), pubsub.Filter{})
+	defer sub.Close()
+
+	if _, err := service.UpdateMetric(context.Background(), &MetricData{Type: "counter", Name: "PollCount", Value: stringPtr("2")}); err != nil {
+		t.Fatalf("UpdateMetric failed: %v", err)
+	}
+	if err := service.UpdateMetrics(context.Background(), []models.MetricsDTO{
+		{ID: "PollCount", MType: "counter", Delta: int64Ptr(3)},
+		{ID: "PollCount", MType: "counter", Delta: int64Ptr(4)},
+		{ID: "Alloc", MType: "gauge", Value: float64Ptr(1.5)},
+	}); err != nil {
+		t.Fatalf("UpdateMetrics failed: %v", err)
+	}
+
+	events := sub.Drain()
+	if len(events) != 2 {
+		t.Fatalf("expected 2 coalesced events, got %d", len(events))
+	}
+	if events[0].ID != "PollCount" || *events[0].Delta != 9 {
+		t.Errorf("expected PollCount total 9, got %+v", events[0])
+	}
+	if events[1].ID != "Alloc" || *events[1].Value != 1.5 {
+		t.Errorf("expected Alloc 1.5, got %+v", events[1])
+	}
+}
+
+func TestStorage_PublishesChangesOnly(t *testing.T) {
+	hub := pubsub.NewHub()
+	service := NewMetricService(NewMockMetricStorage(), WithHub(hub))
+	sub := service.Subscribe(context.Background(), pubsub.Filter{})
+	defer sub.Close()
+	ctx := context.Background()
+
+	update := func(mType, name, value string) {
+		t.Helper()
+		if _, err := service.UpdateMetric(ctx, &MetricData{Type: mType, Name: name, Value: stringPtr(value)}); err != nil {
+			t.Fatalf("UpdateMetric failed: %v", err)
+		}
+	}
+
+	update("gauge", "Alloc", "1.5")
+	update("counter", "PollCount", "2")
+	if events := sub.Drain(); len(events) != 2 {
+		t.Fatalf("expected 2 events for new metrics, got %+v", events)
+	}
+
+	update("gauge", "Alloc", "1.5")
+	update("counter", "PollCount", "0")
+	if err := service.UpdateMetrics(ctx, []models.MetricsDTO{
+		{ID: "Alloc", MType: "gauge", Value: float64Ptr(1.5)},
+		{ID: "PollCount", MType: "counter", Delta: int64Ptr(1)},
+		{ID: "PollCount", MType: "counter", Delta: int64Ptr(-1)},
+	}); err != nil {
+		t.Fatalf("UpdateMetrics failed: %v", err)
+	}
+	if events := sub.Drain(); len(events) != 0 {
+		t.Errorf("expected no events for unchanged values, got %+v", events)
+	}
+
+	update("gauge", "Alloc", "2")
+	if events := sub.Drain(); len(events) != 1 || *events[0].Value != 2 {
+		t.Errorf("expected the changed gauge, got %+v", events)
+	}
+
+	if err := service.DeleteMetric(ctx, &MetricData{Type: "gauge", Name: "Alloc"}); err != nil {
+		t.Fatalf("DeleteMetric failed: %v", err)
+	}
+	update("gauge", "Alloc", "2")
+	if events := sub.Drain(); len(events) != 1 {
+		t.Errorf("expected a recreated metric to be published, got %+v", events)
+	}
+}
+
+// yieldingStorage lets other goroutines run after every write, so writers
+// racing to publish are likely to interleave.
+type yieldingStorage struct {
+	MetricStorage
+}
+
+func (y yieldingStorage) UpdateGauge(ctx context.Context, name string, value float64) float64 {
+	defer runtime.Gosched()
+	return y.MetricStorage.UpdateGauge(ctx, name, value)
+}
+
+func (y yieldingStorage) UpdateMetrics(ctx context.Context, m []models.MetricsDTO) ([]models.MetricsDTO, error) {
+	defer runtime.Gosched()
+	return y.MetricStorage.UpdateMetrics(ctx, m)
+}
+
+func TestStorage_PublishesInWriteOrder(t *testing.T) {
+	hub := pubsub.NewHub()
+	history := query.NewHistory(time.Hour, 10000)
+	service := NewMetricService(yieldingStorage{storage.NewMemStorage()}, WithHub(hub), WithHistory(history))
+	sub := service.Subscribe(context.Background(), pubsub.Filter{})
+	defer sub.Close()
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				value := strconv.Itoa(i*1000 + j)
+				if _, err := service.UpdateMetric(ctx, &MetricData{Type: "gauge", Name: "Alloc", Value: &value}); err != nil {
+					t.Errorf("UpdateMetric failed: %v", err)
+				}
+				if err := service.UpdateMetrics(ctx, []models.MetricsDTO{
+					{ID: "PollCount", MType: "counter", Delta: int64Ptr(1)},
+				}); err != nil {
+					t.Errorf("UpdateMetrics failed: %v", err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	last := make(map[string]models.MetricsDTO)
+	for _, e := range sub.Drain() {
+		last[e.ID] = e
+	}
+	gauge, err := service.Metric(ctx, &MetricData{Type: "gauge", Name: "Alloc"})
+	if err != nil {
+		t.Fatalf("Metric failed: %v", err)
+	}
+	if e, ok := last["Alloc"]; !ok || *e.Value != *gauge.Value {
+		t.Errorf("expected the stored gauge %v to be published last, got %+v", *gauge.Value, e)
+	}
+	if e, ok := last["PollCount"]; !ok || *e.Delta != 1600 {
+		t.Errorf("expected the counter total 1600 to be published last, got %+v", e)
+	}
+
+	history.Range(time.Time{}, func(name, _ string, samples []query.Sample) {
+		if name != "PollCount" {
+			return
+		}
+		for i := 1; i < len(samples); i++ {
+			if samples[i].Value < samples[i-1].Value {
+				t.Errorf("counter history goes back at %d: %v after %v", i, samples[i].Value, samples[i-1].Value)
+				return
+			}
+		}
+	})
+}
+
+func TestStorage_SendsWebhooks(t *testing.T) {
+	received := make(chan webhook.Payload, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p webhook.Payload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Errorf("decode payload: %v", err)
+		}
+		received <- p
+	}))
+	defer srv.Close()
+
+	hooks, err := webhook.New([]config.WebhookConfig{{URL: srv.URL, Pattern: "Poll*"}}, webhook.WithBatch(0, 100))
+	if err != nil {
+		t.Fatalf("webhook.New failed: %v", err)
+	}
+	service := NewMetricService(NewMockMetricStorage(), WithWebhooks(hooks))
+
+	if err := service.UpdateMetrics(context.Background(), []models.MetricsDTO{
+		{ID: "PollCount", MType: "counter", Delta: int64Ptr(2)},
+		{ID: "Alloc", MType: "gauge", Value: float64Ptr(1)},
+	}); err != nil {
+		t.Fatalf("UpdateMetrics failed: %v", err)
+	}
+
+	select {
+	case p := <-received:
+		if len(p.Events) != 1 || p.Events[0].ID != "PollCount" || *p.Events[0].Delta != 2 {
+			t.Errorf("unexpected webhook events: %+v", p.Events)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := hooks.Close(ctx); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+}
+
+func TestStorage_Query(t *testing.T) {
+	service := NewMetricService(NewMockMetricStorage(), WithHistory(query.NewHistory(time.Hour, 100)))
+
+	if _, err := service.UpdateMetric(context.Background(), &MetricData{Type: "counter", Name: "PollCount", Value: stringPtr("2")}); err != nil {
+		t.Fatalf("UpdateMetric failed: %v", err)
+	}
+	if err := service.UpdateMetrics(context.Background(), []models.MetricsDTO{
+		{ID: "PollCount", MType: "counter", Delta: int64Ptr(3)},
+	}); err != nil {
+		t.Fatalf("UpdateMetrics failed: %v", err)
+	}
+
+	res, err := service.Query(context.Background(), "increase(PollCount[1h])")
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if len(res.Vector) != 1 || res.Vector[0].Value != 3 {
+		t.Errorf("expected increase of 3 from recorded history, got %+v", res.Vector)
+	}
+
+	if _, err := service.Query(context.Background(), "PollCount +"); err == nil || errdefs.As(err).Code != errdefs.CodeInvalidQuery {
+		t.Errorf("expected bad request for invalid query, got %v", err)
+	}
+}
+
+func TestStorage_DeleteMetric(t *testing.T) {
+	ctx := context.Background()
+	service := NewMetricService(NewMockMetricStorage(), WithHistory(query.NewHistory(time.Hour, 100)))
+
+	if _, err := service.UpdateMetric(ctx, &MetricData{Type: "counter", Name: "PollCount", Value: stringPtr("2")}); err != nil {
+		t.Fatalf("UpdateMetric failed: %v", err)
+	}
+
+	if err := service.DeleteMetric(ctx, &MetricData{Type: "counter", Name: "PollCount"}); err != nil {
+		t.Fatalf("DeleteMetric failed: %v", err)
+	}
+
+	if _, err := service.Metric(ctx, &MetricData{Type: "counter", Name: "PollCount"}); errdefs.As(err) == nil || errdefs.As(err).Code != errdefs.CodeMetricNotFound {
+		t.Errorf("expected deleted metric to be not found, got %v", err)
+	}
+	if res, err := service.Query(ctx, "increase(PollCount[1h])"); err != nil || len(res.Vector) != 0 {
+		t.Errorf("expected history of deleted metric to be dropped, got %+v (%v)", res, err)
+	}
+
+	err := service.DeleteMetric(ctx, &MetricData{Type: "counter", Name: "PollCount"})
+	if e := errdefs.As(err); e == nil || e.Code != errdefs.CodeMetricNotFound {
+		t.Errorf("expected not found for missing metric, got %v", err)
+	}
+
+	err = service.DeleteMetric(ctx, &MetricData{Type: "histogram", Name: "PollCount"})
+	if e := errdefs.As(err); e == nil || e.Code != errdefs.CodeValidationFailed {
+		t.Errorf("expected validation error for unknown type, got %v", err)
+	}
+}
+
+func TestStorage_Guard(t *testing.T) {
+	g := guard.New(guard.Policy{NamePattern: regexp.MustCompile(`^[A-Za-z]+$`), MaxSeries: 2, MaxNewSeriesPerMinute: 3})
+	service := NewMetricService(NewMockMetricStorage(), WithGuard(g))
+	ctx := identity.WithClient(identity.WithAgentID(context.Background(), "agent-1"), "ip:192.0.2.1")
+
+	check := func(name string, err error, status int, code errdefs.Code, fields []errdefs.FieldError) {
+		t.Helper()
+		e := errdefs.As(err)
+		if err == nil || e.Status != status || e.Code != code {
+			t.Errorf("%s: expected %d %s, got %v", name, status, code, err)
+			return
+		}
+		if !reflect.DeepEqual(e.Fields, fields) {
+			t.Errorf("%s: expected fields %+v, got %+v", name, fields, e.Fields)
+		}
+	}
+
+	err := service.UpdateMetrics(ctx, []models.MetricsDTO{
+		{ID: "Alloc", MType: "gauge", Value: float64Ptr(1)},
+		{ID: "bad_name", MType: "gauge", Value: float64Ptr(1)},
+	})
+	check("invalid name", err, http.StatusBadRequest, errdefs.CodeValidationFailed,
+		[]errdefs.FieldError{{Field: "[1].id", Message: "must match ^[A-Za-z]+$"}})
+
+	if _, err := service.UpdateMetric(ctx, &MetricData{Type: "gauge", Name: "Alloc", Value: stringPtr("1")}); err != nil {
+		t.Fatalf("UpdateMetric failed: %v", err)
+	}
+	if _, err := service.UpdateMetric(ctx, &MetricData{Type: "counter", Name: "PollCount", Value: stringPtr("1")}); err != nil {
+		t.Fatalf("UpdateMetric failed: %v", err)
+	}
+
+	_, err = service.UpdateMetric(ctx, &MetricData{Type: "gauge", Name: "HeapSys", Value: stringPtr("1")})
+	check("series limit", err, http.StatusUnprocessableEntity, errdefs.CodeSeriesLimit,
+		[]errdefs.FieldError{{Field: "id", Message: "would create a new series"}})
+	if _, found := service.storage.GetGauge(ctx, "HeapSys"); found {
+		t.Errorf("rejected metric must not be stored")
+	}
+
+	if err := service.DeleteMetric(ctx, &MetricData{Type: "gauge", Name: "Alloc"}); err != nil {
+		t.Fatalf("DeleteMetric failed: %v", err)
+	}
+	if _, err := service.UpdateMetric(ctx, &MetricData{Type: "gauge", Name: "HeapSys", Value: stringPtr("1")}); err != nil {
+		t.Fatalf("expected a deleted metric to free its slot, got %v", err)
+	}
+	if err := service.DeleteMetric(ctx, &MetricData{Type: "gauge", Name: "HeapSys"}); err != nil {
+		t.Fatalf("DeleteMetric failed: %v", err)
+	}
+
+	_, err = service.UpdateMetric(ctx, &MetricData{Type: "gauge", Name: "HeapIdle", Value: stringPtr("1")})
+	check("series rate", err, http.StatusTooManyRequests, errdefs.CodeSeriesRateLimited,
+		[]errdefs.FieldError{{Field: "id", Message: "would create a new series"}})
+	_, err = service.UpdateMetric(identity.WithAgentID(ctx, "agent-2"), &MetricData{Type: "gauge", Name: "HeapIdle", Value: stringPtr("1")})
+	check("series rate with another agent ID", err, http.StatusTooManyRequests, errdefs.CodeSeriesRateLimited,
+		[]errdefs.FieldError{{Field: "id", Message: "would create a new series"}})
+
+	want := map[string]string{
+		"server_series":                             "1",
+		"server_rejected_writes_total":              "5",
+		"server_rejected_writes_invalid_name_total": "2",
+		"server_rejected_writes_series_limit_total": "1",
+		"server_rejected_writes_series_rate_total":  "2",
+	}
+	got := make(map[string]string)
+	for _, m := range service.SelfMetrics(ctx) {
+		if m.Delta != nil {
+			got[m.ID] = strconv.FormatInt(*m.Delta, 10)
+		} else {
+			got[m.ID] = strconv.FormatFloat(*m.Value, 'f', -1, 64)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected self-metrics %v, got %v", want, got)
+	}
+}
+
+type failingStorage struct {
+	*MockMetricStorage
+}
+
+var errStorageDown = errors.New("storage is down")
+
+func (failingStorage) UpdateMetrics(context.Context, []models.MetricsDTO) ([]models.MetricsDTO, error) {
+	return nil, errStorageDown
+}
+
+func (failingStorage) Snapshot(context.Context) (models.Snapshot, error) {
+	return models.Snapshot{}, errStorageDown
+}
+
+func TestStorage_TypedErrors(t *testing.T) {
+	service := NewMetricService(NewMockMetricStorage())
+	failing := NewMetricService(failingStorage{NewMockMetricStorage()})
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		call   func() error
+		status int
+		code   errdefs.Code
+		fields []errdefs.FieldError
+	}{
+		{
+			name: "missing name",
+			call: func() error {
+				_, err := service.UpdateMetric(ctx, &MetricData{Type: "gauge", Value: stringPtr("1")})
+				return err
+			},
+			status: http.StatusNotFound,
+			code:   errdefs.CodeMetricNameRequired,
+		},
+		{
+			name: "invalid gauge value",
+			call: func() error {
+				_, err := service.UpdateMetric(ctx, &MetricData{Type: "gauge", Name: "Alloc", Value: stringPtr("abc")})
+				return err
+			},
+			status: http.StatusBadRequest,
+			code:   errdefs.CodeValidationFailed,
+			fields: []errdefs.FieldError{{Field: "value", Message: "must be a number"}},
+		},
+		{
+			name: "invalid type in metric data",
+			call: func() error {
+				_, err := NewMetricData("histogram", "")
+				return err
+			},
+			status: http.StatusBadRequest,
+			code:   errdefs.CodeValidationFailed,
+			fields: []errdefs.FieldError{
+				{Field: "type", Message: "must be one of: counter gauge"},
+				{Field: "name", Message: "is required"},
+			},
+		},
+		{
+			name: "unknown metric",
+			call: func() error {
+				_, err := service.Metric(ctx, &MetricData{Type: "counter", Name: "Missing"})
+				return err
+			},
+			status: http.StatusNotFound,
+			code:   errdefs.CodeMetricNotFound,
+		},
+		{
+			name: "invalid batch entries",
+			call: func() error {
+				return service.UpdateMetrics(ctx, []models.MetricsDTO{
+					{ID: "Alloc", MType: "gauge", Value: float64Ptr(1)},
+					{ID: "PollCount", MType: "counter", Value: float64Ptr(1)},
+					{MType: "summary"},
+				})
+			},
+			status: http.StatusBadRequest,
+			code:   errdefs.CodeValidationFailed,
+			fields: []errdefs.FieldError{
+				{Field: "[1].delta", Message: "is required for counter"},
+				{Field: "[1].value", Message: "is not allowed for counter"},
+				{Field: "[2].id", Message: "is required"},
+				{Field: "[2].type", Message: "must be one of: counter gauge"},
+			},
+		},
+		{
+			name: "storage failure on update",
+			call: func() error {
+				return failing.UpdateMetrics(ctx, []models.MetricsDTO{{ID: "Alloc", MType: "gauge", Value: float64Ptr(1)}})
+			},
+			status: http.StatusInternalServerError,
+			code:   errdefs.CodeStorageFailure,
+		},
+		{
+			name: "storage failure on list",
+			call: func() error {
+				_, err := failing.ListMetrics(ctx)
+				return err
+			},
+			status: http.StatusInternalServerError,
+			code:   errdefs.CodeStorageFailure,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.call()
+			var e *errdefs.Error
+			if !errors.As(err, &e) {
+				t.Fatalf("expected *errdefs.Error, got %v", err)
+			}
+			if e.Status != tt.status || e.Code != tt.code {
+				t.Errorf("expected %d %s, got %d %s", tt.status, tt.code, e.Status, e.Code)
+			}
+			if !reflect.DeepEqual(e.Fields, tt.fields) {
+				t.Errorf("expected fields %+v, got %+v", tt.fields, e.Fields)
+			}
+		})
+	}
+
+	if _, err := failing.ListMetrics(ctx); !errors.Is(err, errStorageDown) {
+		t.Errorf("expected the storage error to be wrapped, got %v", err)
+	}
+}
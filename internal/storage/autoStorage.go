@@ -2,7 +2,6 @@ package storage
 
 import (
 	"context"
-	"fmt"
 	"github.com/zubans/metrics/internal/models"
 	"log"
 )
@@ -42,16 +41,36 @@ func (s *AutoStorage) GetGauge(ctx context.Context, name string) (float64, bool)
 func (s *AutoStorage) GetCounter(ctx context.Context, name string) (int64, bool) {
 	return s.storage.GetCounter(ctx, name)
 }
-func (s *AutoStorage) GetGauges(ctx context.Context) map[string]float64 {
-	return s.dump.storage.GetGauges(ctx)
+func (s *AutoStorage) Snapshot(ctx context.Context) (models.Snapshot, error) {
+	return s.storage.Snapshot(ctx)
 }
-func (s *AutoStorage) GetCounters(ctx context.Context) map[string]int64 {
-	return s.dump.storage.GetCounters(ctx)
+
+func (s *AutoStorage) UpdateMetrics(ctx context.Context, m []models.MetricsDTO) ([]models.MetricsDTO, error) {
+	res, err := s.storage.UpdateMetrics(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.dump.SaveMetricToFile(ctx); err != nil {
+		log.Println("error save metrics to file")
+	}
+
+	return res, nil
 }
-func (s *AutoStorage) ShowMetrics(ctx context.Context) (map[string]float64, map[string]int64, error) {
-	return s.storage.ShowMetrics(ctx)
+
+func (s *AutoStorage) DeleteMetric(ctx context.Context, mType, name string) (bool, error) {
+	deleted, err := s.storage.DeleteMetric(ctx, mType, name)
+	if err != nil || !deleted {
+		return deleted, err
+	}
+
+	if err := s.dump.SaveMetricToFile(ctx); err != nil {
+		log.Println("error save metrics to file")
+	}
+
+	return true, nil
 }
 
-func (s *AutoStorage) UpdateMetrics(ctx context.Context, m []models.MetricsDTO) error {
-	return fmt.Errorf("forbidden")
+func (s *AutoStorage) Ping(ctx context.Context) error {
+	return s.storage.Ping(ctx)
 }
@@ -0,0 +1,45 @@
+package storage
+
+import "github.com/zubans/metrics/internal/models"
+
+// written collects the values a batch leaves in a storage, as returned by
+// UpdateMetrics: one entry per metric the batch writes, in order of first
+// appearance, with the gauge value or the counter total.
+type written struct {
+	metrics []models.MetricsDTO
+	index   map[string]int
+}
+
+func newWritten(m []models.MetricsDTO) *written {
+	w := &written{
+		metrics: make([]models.MetricsDTO, 0, len(m)),
+		index:   make(map[string]int, len(m)),
+	}
+	for _, v := range m {
+		switch {
+		case v.MType == string(models.Counter) && v.Delta != nil:
+		case v.MType == string(models.Gauge) && v.Value != nil:
+		default:
+			continue
+		}
+
+		key := v.MType + "/" + v.ID
+		if _, ok := w.index[key]; !ok {
+			w.index[key] = len(w.metrics)
+			w.metrics = append(w.metrics, models.MetricsDTO{ID: v.ID, MType: v.MType})
+		}
+	}
+	return w
+}
+
+func (w *written) gauge(name string, value float64) {
+	if i, ok := w.index[string(models.Gauge)+"/"+name]; ok {
+		w.metrics[i].Value = &value
+	}
+}
+
+func (w *written) counter(name string, total int64) {
+	if i, ok := w.index[string(models.Counter)+"/"+name]; ok {
+		w.metrics[i].Delta = &total
+	}
+}
@@ -0,0 +1,318 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/zubans/metrics/internal/logger"
+	"github.com/zubans/metrics/internal/models"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+// CacheBackend is the part of a metrics storage CachedStorage needs from the
+// store it wraps. UpdateMetrics must apply a batch as a whole or return a
+// *BatchError naming the entries it did not apply, so a retried flush never
+// adds a counter delta twice.
+type CacheBackend interface {
+	UpdateMetrics(ctx context.Context, m []models.MetricsDTO) ([]models.MetricsDTO, error)
+	DeleteMetric(ctx context.Context, mType, name string) (bool, error)
+	Snapshot(ctx context.Context) (models.Snapshot, error)
+	Ping(ctx context.Context) error
+}
+
+// BatchError is returned by a backend that applied only part of a batch.
+type BatchError struct {
+	// NotApplied lists the entries that were not stored.
+	NotApplied []models.MetricsDTO
+	Err        error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%d of the batch entries not applied: %v", len(e.NotApplied), e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// CachedStorage keeps every metric in memory in front of a slower backend.
+// Reads are served from memory only. Writes update memory immediately and
+// are queued for the backend, which receives them as one batch per flush
+// interval. With a non-positive interval every write is forwarded at once.
+//
+// Queued writes are split into the shards of the in-memory store, so only
+// writes to metrics of the same shard wait for each other.
+type CachedStorage struct {
+	cache    *MemStorage
+	backend  CacheBackend
+	interval time.Duration
+
+	// flushMu serializes flushes so batches reach the backend in order.
+	flushMu sync.Mutex
+
+	pending [shardCount]pendingShard
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// pendingShard queues the writes to the metrics of one shard. Its lock is
+// held while the write is applied to memory too, so the queue always ends
+// with the value memory holds.
+type pendingShard struct {
+	mu       sync.Mutex
+	gauges   map[string]float64
+	counters map[string]int64
+}
+
+// NewCachedStorage loads the current backend state into memory and starts
+// the background flush loop. Close must be called to flush queued writes.
+func NewCachedStorage(ctx context.Context, backend CacheBackend, interval time.Duration) (*CachedStorage, error) {
+	snap, err := backend.Snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &CachedStorage{
+		cache:    NewMemStorage(),
+		backend:  backend,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	for i := range c.pending {
+		c.pending[i].gauges = make(map[string]float64)
+		c.pending[i].counters = make(map[string]int64)
+	}
+	c.cache.RestoreMetrics(ctx, snap.Gauges, snap.Counters)
+
+	if interval > 0 {
+		go c.flushLoop()
+	} else {
+		close(c.done)
+	}
+
+	return c, nil
+}
+
+func (c *CachedStorage) UpdateGauge(ctx context.Context, name string, value float64) float64 {
+	p := &c.pending[shardIndex(name)]
+	p.mu.Lock()
+	res := c.cache.UpdateGauge(ctx, name, value)
+	p.gauges[name] = value
+	p.mu.Unlock()
+
+	c.flushIfUnbuffered(ctx)
+
+	return res
+}
+
+func (c *CachedStorage) UpdateCounter(ctx context.Context, name string, value int64) int64 {
+	p := &c.pending[shardIndex(name)]
+	p.mu.Lock()
+	res := c.cache.UpdateCounter(ctx, name, value)
+	p.counters[name] += value
+	p.mu.Unlock()
+
+	c.flushIfUnbuffered(ctx)
+
+	return res
+}
+
+func (c *CachedStorage) UpdateMetrics(ctx context.Context, m []models.MetricsDTO) ([]models.MetricsDTO, error) {
+	var touched uint64
+	for _, v := range m {
+		touched |= 1 << shardIndex(v.ID)
+	}
+
+	c.lockPending(touched, true)
+	res, err := c.cache.UpdateMetrics(ctx, m)
+	if err != nil {
+		c.lockPending(touched, false)
+		return nil, err
+	}
+	c.queue(m)
+	c.lockPending(touched, false)
+
+	if c.interval <= 0 {
+		if err := c.Flush(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func (c *CachedStorage) GetGauge(ctx context.Context, name string) (float64, bool) {
+	return c.cache.GetGauge(ctx, name)
+}
+
+func (c *CachedStorage) GetCounter(ctx context.Context, name string) (int64, bool) {
+	return c.cache.GetCounter(ctx, name)
+}
+
+func (c *CachedStorage) Snapshot(ctx context.Context) (models.Snapshot, error) {
+	return c.cache.Snapshot(ctx)
+}
+
+// DeleteMetric removes the metric from memory and the backend right away,
+// dropping queued writes for it. It waits for a running flush, so a flush
+// can't store the metric again afterwards.
+func (c *CachedStorage) DeleteMetric(ctx context.Context, mType, name string) (bool, error) {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	p := &c.pending[shardIndex(name)]
+	p.mu.Lock()
+	cached, _ := c.cache.DeleteMetric(ctx, mType, name)
+	switch mType {
+	case string(models.Gauge):
+		delete(p.gauges, name)
+	case string(models.Counter):
+		delete(p.counters, name)
+	}
+	p.mu.Unlock()
+
+	stored, err := c.backend.DeleteMetric(ctx, mType, name)
+	if err != nil {
+		return false, err
+	}
+	return cached || stored, nil
+}
+
+func (c *CachedStorage) Ping(ctx context.Context) error {
+	return c.backend.Ping(ctx)
+}
+
+// Flush sends all queued writes to the backend as a single batch. On failure
+// the writes the backend did not apply are queued again and retried by the
+// next flush.
+func (c *CachedStorage) Flush(ctx context.Context) error {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	// All shards are taken at once, so a concurrent UpdateMetrics batch is
+	// flushed whole rather than split across two flushes.
+	var batch []models.MetricsDTO
+	c.lockPending(allShards, true)
+	for i := range c.pending {
+		p := &c.pending[i]
+		for k, v := range p.gauges {
+			batch = append(batch, models.MetricsDTO{ID: k, MType: string(models.Gauge), Value: &v})
+		}
+		for k, v := range p.counters {
+			batch = append(batch, models.MetricsDTO{ID: k, MType: string(models.Counter), Delta: &v})
+		}
+		if len(p.gauges) > 0 || len(p.counters) > 0 {
+			p.gauges = make(map[string]float64)
+			p.counters = make(map[string]int64)
+		}
+	}
+	c.lockPending(allShards, false)
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	if _, err := c.backend.UpdateMetrics(ctx, batch); err != nil {
+		var partial *BatchError
+		if errors.As(err, &partial) {
+			batch = partial.NotApplied
+		}
+		c.requeue(batch)
+		return err
+	}
+
+	return nil
+}
+
+// Close stops the flush loop and flushes the remaining writes.
+func (c *CachedStorage) Close(ctx context.Context) error {
+	c.closeOnce.Do(func() {
+		if c.interval > 0 {
+			close(c.stop)
+		}
+	})
+	<-c.done
+
+	return c.Flush(ctx)
+}
+
+// queue adds a batch already applied to memory to the pending writes. The
+// caller must hold the locks of the shards the batch touches.
+func (c *CachedStorage) queue(m []models.MetricsDTO) {
+	for _, v := range m {
+		p := &c.pending[shardIndex(v.ID)]
+		switch {
+		case v.MType == string(models.Counter) && v.Delta != nil:
+			p.counters[v.ID] += *v.Delta
+		case v.MType == string(models.Gauge) && v.Value != nil:
+			p.gauges[v.ID] = *v.Value
+		}
+	}
+}
+
+// requeue puts back writes of a failed flush. Gauges written since then are
+// newer and win; counter deltas are added.
+func (c *CachedStorage) requeue(batch []models.MetricsDTO) {
+	c.lockPending(allShards, true)
+	defer c.lockPending(allShards, false)
+
+	for _, v := range batch {
+		p := &c.pending[shardIndex(v.ID)]
+		switch {
+		case v.MType == string(models.Counter) && v.Delta != nil:
+			p.counters[v.ID] += *v.Delta
+		case v.MType == string(models.Gauge) && v.Value != nil:
+			if _, exists := p.gauges[v.ID]; !exists {
+				p.gauges[v.ID] = *v.Value
+			}
+		}
+	}
+}
+
+// allShards selects every shard in lockPending.
+const allShards = ^uint64(0)
+
+// lockPending locks (or unlocks) the pending shards in mask in index order.
+func (c *CachedStorage) lockPending(mask uint64, lock bool) {
+	for i := range c.pending {
+		if mask&(1<<i) == 0 {
+			continue
+		}
+		if lock {
+			c.pending[i].mu.Lock()
+		} else {
+			c.pending[i].mu.Unlock()
+		}
+	}
+}
+
+func (c *CachedStorage) flushIfUnbuffered(ctx context.Context) {
+	if c.interval > 0 {
+		return
+	}
+	if err := c.Flush(ctx); err != nil {
+		logger.Log.Info("error flush metrics to backend", zap.Error(err))
+	}
+}
+
+func (c *CachedStorage) flushLoop() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			if err := c.Flush(context.Background()); err != nil {
+				logger.Log.Info("error flush metrics to backend", zap.Error(err))
+			}
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zubans/metrics/internal/models"
+)
+
+// countingBackend wraps MemStorage and records calls reaching the backend.
+type countingBackend struct {
+	*MemStorage
+
+	mu      sync.Mutex
+	batches [][]models.MetricsDTO
+	fail    bool
+	// reject names a metric the backend does not apply, reporting the
+	// rest of the batch as applied.
+	reject string
+}
+
+func (b *countingBackend) UpdateMetrics(ctx context.Context, m []models.MetricsDTO) ([]models.MetricsDTO, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.fail {
+		return nil, errors.New("backend unavailable")
+	}
+	b.batches = append(b.batches, m)
+
+	if b.reject == "" {
+		return b.MemStorage.UpdateMetrics(ctx, m)
+	}
+	var applied, rejected []models.MetricsDTO
+	for _, v := range m {
+		if v.ID == b.reject {
+			rejected = append(rejected, v)
+		} else {
+			applied = append(applied, v)
+		}
+	}
+	if _, err := b.MemStorage.UpdateMetrics(ctx, applied); err != nil {
+		return nil, err
+	}
+	return nil, &BatchError{NotApplied: rejected, Err: errors.New("value rejected")}
+}
+
+func (b *countingBackend) batchCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.batches)
+}
+
+func (b *countingBackend) setFail(fail bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fail = fail
+}
+
+func TestCachedStorage_LoadsBackendState(t *testing.T) {
+	ctx := context.Background()
+	backend := &countingBackend{MemStorage: NewMemStorage()}
+	backend.MemStorage.UpdateGauge(ctx, "g", 1.5)
+	backend.MemStorage.UpdateCounter(ctx, "c", 3)
+
+	c, err := NewCachedStorage(ctx, backend, time.Hour)
+	require.NoError(t, err)
+	defer func() { _ = c.Close(ctx) }()
+
+	g, ok := c.GetGauge(ctx, "g")
+	require.True(t, ok)
+	assert.InDelta(t, 1.5, g, 0)
+	assert.Equal(t, int64(5), c.UpdateCounter(ctx, "c", 2))
+}
+
+func TestCachedStorage_BatchesWritesUntilFlush(t *testing.T) {
+	ctx := context.Background()
+	backend := &countingBackend{MemStorage: NewMemStorage()}
+
+	c, err := NewCachedStorage(ctx, backend, time.Hour)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		c.UpdateCounter(ctx, "c", 1)
+		c.UpdateGauge(ctx, "g", float64(i))
+	}
+	_, err = c.UpdateMetrics(ctx, []models.MetricsDTO{
+		{ID: "c", MType: string(models.Counter), Delta: int64Ptr(5)},
+	})
+	require.NoError(t, err)
+
+	v, ok := c.GetCounter(ctx, "c")
+	require.True(t, ok)
+	assert.Equal(t, int64(15), v, "reads must see writes before they are flushed")
+	assert.Equal(t, 0, backend.batchCount(), "writes must be queued until the flush interval")
+
+	require.NoError(t, c.Close(ctx))
+
+	require.Equal(t, 1, backend.batchCount(), "queued writes must be sent as one batch")
+	stored, ok := backend.MemStorage.GetCounter(ctx, "c")
+	require.True(t, ok)
+	assert.Equal(t, int64(15), stored)
+	g, ok := backend.MemStorage.GetGauge(ctx, "g")
+	require.True(t, ok)
+	assert.InDelta(t, 9, g, 0)
+}
+
+func TestCachedStorage_FlushesOnInterval(t *testing.T) {
+	ctx := context.Background()
+	backend := &countingBackend{MemStorage: NewMemStorage()}
+
+	c, err := NewCachedStorage(ctx, backend, 10*time.Millisecond)
+	require.NoError(t, err)
+	defer func() { _ = c.Close(ctx) }()
+
+	c.UpdateGauge(ctx, "g", 2)
+
+	assert.Eventually(t, func() bool {
+		_, ok := backend.MemStorage.GetGauge(ctx, "g")
+		return ok
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestCachedStorage_RetriesFailedFlush(t *testing.T) {
+	ctx := context.Background()
+	backend := &countingBackend{MemStorage: NewMemStorage()}
+
+	c, err := NewCachedStorage(ctx, backend, time.Hour)
+	require.NoError(t, err)
+
+	backend.setFail(true)
+	c.UpdateCounter(ctx, "c", 2)
+	c.UpdateGauge(ctx, "g", 1)
+	require.Error(t, c.Flush(ctx))
+
+	c.UpdateCounter(ctx, "c", 3)
+	c.UpdateGauge(ctx, "g", 2)
+
+	backend.setFail(false)
+	require.NoError(t, c.Close(ctx))
+
+	stored, ok := backend.MemStorage.GetCounter(ctx, "c")
+	require.True(t, ok)
+	assert.Equal(t, int64(5), stored, "deltas of a failed flush must not be lost")
+	g, ok := backend.MemStorage.GetGauge(ctx, "g")
+	require.True(t, ok)
+	assert.InDelta(t, 2, g, 0, "a newer gauge must win over a requeued one")
+}
+
+func TestCachedStorage_RetriesPartialFlush(t *testing.T) {
+	ctx := context.Background()
+	backend := &countingBackend{MemStorage: NewMemStorage(), reject: "bad"}
+
+	c, err := NewCachedStorage(ctx, backend, time.Hour)
+	require.NoError(t, err)
+
+	c.UpdateCounter(ctx, "c", 2)
+	c.UpdateCounter(ctx, "bad", 1)
+	require.Error(t, c.Flush(ctx))
+
+	backend.mu.Lock()
+	backend.reject = ""
+	backend.mu.Unlock()
+	require.NoError(t, c.Close(ctx))
+
+	stored, ok := backend.MemStorage.GetCounter(ctx, "c")
+	require.True(t, ok)
+	assert.Equal(t, int64(2), stored, "applied deltas must not be sent again")
+	stored, ok = backend.MemStorage.GetCounter(ctx, "bad")
+	require.True(t, ok)
+	assert.Equal(t, int64(1), stored, "deltas the backend did not apply must be retried")
+}
+
+func TestCachedStorage_Unbuffered(t *testing.T) {
+	ctx := context.Background()
+	backend := &countingBackend{MemStorage: NewMemStorage()}
+
+	c, err := NewCachedStorage(ctx, backend, 0)
+	require.NoError(t, err)
+
+	c.UpdateCounter(ctx, "c", 1)
+	_, err = c.UpdateMetrics(ctx, []models.MetricsDTO{
+		{ID: "c", MType: string(models.Counter), Delta: int64Ptr(1)},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, backend.batchCount())
+	require.NoError(t, c.Close(ctx))
+}
+
+func int64Ptr(v int64) *int64 {
+	return &v
+}
+
+func TestCachedStorage_DeleteDropsQueuedWrites(t *testing.T) {
+	ctx := context.Background()
+	backend := &countingBackend{MemStorage: NewMemStorage()}
+	backend.MemStorage.UpdateCounter(ctx, "c", 3)
+
+	c, err := NewCachedStorage(ctx, backend, time.Hour)
+	require.NoError(t, err)
+	defer func() { _ = c.Close(ctx) }()
+
+	c.UpdateCounter(ctx, "c", 2)
+	c.UpdateGauge(ctx, "g", 1)
+
+	deleted, err := c.DeleteMetric(ctx, string(models.Counter), "c")
+	require.NoError(t, err)
+	assert.True(t, deleted)
+
+	_, ok := backend.MemStorage.GetCounter(ctx, "c")
+	assert.False(t, ok, "deletion must reach the backend immediately")
+
+	require.NoError(t, c.Flush(ctx))
+	_, ok = backend.MemStorage.GetCounter(ctx, "c")
+	assert.False(t, ok, "a flush must not bring the deleted counter back")
+	_, ok = backend.MemStorage.GetGauge(ctx, "g")
+	assert.True(t, ok, "writes of other metrics must still be flushed")
+}
@@ -0,0 +1,116 @@
+package storage_test
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/require"
+	"github.com/zubans/metrics/internal/config"
+	"github.com/zubans/metrics/internal/services"
+	"github.com/zubans/metrics/internal/storage"
+	"github.com/zubans/metrics/internal/storage/storagetest"
+)
+
+func TestConformance_MemStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) (services.MetricStorage, func() services.MetricStorage) {
+		return storage.NewMemStorage(), nil
+	})
+}
+
+func TestConformance_AutoStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) (services.MetricStorage, func() services.MetricStorage) {
+		cfg := config.Config{FileStoragePath: filepath.Join(t.TempDir(), "metrics.json")}
+		mem := storage.NewMemStorage()
+
+		reopen := func() services.MetricStorage {
+			restored := storage.NewMemStorage()
+			dump := storage.New(restored, cfg)
+			require.NoError(t, dump.LoadMetricsFromFile())
+			return storage.NewAutoDump(restored, dump)
+		}
+
+		return storage.NewAutoDump(mem, storage.New(mem, cfg)), reopen
+	})
+}
+
+func TestConformance_PostDB(t *testing.T) {
+	dsn := storagetest.DSN(t)
+
+	open := func(t *testing.T) *sql.DB {
+		db, err := storage.InitDB(dsn, "../../migrations")
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = db.Close() })
+		return db
+	}
+
+	storagetest.Run(t, func(t *testing.T) (services.MetricStorage, func() services.MetricStorage) {
+		db := open(t)
+		_, err := db.Exec("TRUNCATE metrics")
+		require.NoError(t, err)
+
+		return storage.NewDB(db), func() services.MetricStorage { return storage.NewDB(open(t)) }
+	})
+}
+
+func TestConformance_SQLite(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) (services.MetricStorage, func() services.MetricStorage) {
+		dsn := storage.SQLiteScheme + filepath.Join(t.TempDir(), "metrics.db")
+
+		open := func() services.MetricStorage {
+			db, err := storage.InitSQLite(dsn, "../../migrations/sqlite")
+			require.NoError(t, err)
+
+			s := storage.NewSQLite(db)
+			t.Cleanup(func() { _ = s.Close() })
+			return s
+		}
+
+		return open(), open
+	})
+}
+
+func TestConformance_CachedStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) (services.MetricStorage, func() services.MetricStorage) {
+		ctx := context.Background()
+		backend := storage.NewMemStorage()
+
+		open := func() *storage.CachedStorage {
+			c, err := storage.NewCachedStorage(ctx, backend, time.Hour)
+			require.NoError(t, err)
+			return c
+		}
+
+		s := open()
+		t.Cleanup(func() { _ = s.Close(ctx) })
+
+		reopen := func() services.MetricStorage {
+			require.NoError(t, s.Close(ctx))
+			restarted := open()
+			t.Cleanup(func() { _ = restarted.Close(ctx) })
+			return restarted
+		}
+
+		return s, reopen
+	})
+}
+
+func TestConformance_Redis(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) (services.MetricStorage, func() services.MetricStorage) {
+		srv := miniredis.RunT(t)
+
+		open := func() services.MetricStorage {
+			client, err := storage.InitRedis("redis://" + srv.Addr())
+			require.NoError(t, err)
+
+			s := storage.NewRedis(client)
+			t.Cleanup(func() { _ = s.Close() })
+			return s
+		}
+
+		return open(), open
+	})
+}
@@ -1,7 +1,6 @@
 package storage
 
 import (
-	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -13,19 +12,16 @@ import (
 	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/zubans/metrics/internal/logger"
 	"go.uber.org/zap"
-	"log"
 	"time"
 )
 
-var DB *sql.DB
-
-func InitDB(connStr string, migrationsPath string) error {
+// InitDB applies migrations and opens a connection pool to the database.
+// The returned handle is owned by the caller, usually passed to NewDB.
+func InitDB(connStr string, migrationsPath string) (*sql.DB, error) {
 	const maxRetries = 3
 	retryDelays := []time.Duration{1 * time.Second, 3 * time.Second, 5 * time.Second}
-	if err := logger.Initialize("info"); err != nil {
-		log.Printf("logger error: %v", err)
-	}
 
+	var lastErr error
 	for trying := 0; trying < maxRetries; trying++ {
 		m, err := migrate.New(
 			fmt.Sprintf("file://%s", migrationsPath),
@@ -33,6 +29,7 @@ func InitDB(connStr string, migrationsPath string) error {
 		)
 
 		if err != nil {
+			lastErr = err
 			logger.Log.Info("Connection attempt failed",
 				zap.Int("attempt", trying+1),
 				zap.Error(err),
@@ -42,6 +39,7 @@ func InitDB(connStr string, migrationsPath string) error {
 		}
 		if err := m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
 			if isConnectionError(err) {
+				lastErr = err
 				logger.Log.Info("Connection attempt failed",
 					zap.Int("attempt", trying+1),
 					zap.Error(err),
@@ -50,11 +48,12 @@ func InitDB(connStr string, migrationsPath string) error {
 				continue
 			}
 
-			return fmt.Errorf("migrate.Up: %w", err)
+			return nil, fmt.Errorf("migrate.Up: %w", err)
 		}
 
-		DB, err = sql.Open("pgx", connStr)
+		db, err := sql.Open("pgx", connStr)
 		if err != nil {
+			lastErr = err
 			logger.Log.Info("Open sql failed",
 				zap.Int("attempt", trying+1),
 				zap.Error(err),
@@ -63,9 +62,10 @@ func InitDB(connStr string, migrationsPath string) error {
 			continue
 		}
 
+		return db, nil
 	}
 
-	return nil
+	return nil, fmt.Errorf("init db: %w", lastErr)
 }
 
 func getDelay(try int, delays []time.Duration) time.Duration {
@@ -84,7 +84,3 @@ func isConnectionError(err error) bool {
 	}
 	return false
 }
-
-func PingDB(ctx context.Context) error {
-	return DB.Ping()
-}
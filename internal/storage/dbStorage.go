@@ -3,22 +3,70 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"github.com/zubans/metrics/internal/models"
 	"log"
+	"maps"
+	"slices"
+	"sync"
 	"time"
 )
 
+var ErrNoDB = errors.New("database is not initialized")
+
+// Batch upserts take whole arrays as parameters, so a single prepared
+// statement covers batches of any size.
+const (
+	upsertGaugesQuery = `INSERT INTO metrics (type, name, value, timestamp)
+SELECT 'gauge', u.name, u.value, $3::timestamp
+FROM unnest($1::text[], $2::double precision[]) AS u(name, value)
+ON CONFLICT (name, type) DO UPDATE SET value = EXCLUDED.value, timestamp = EXCLUDED.timestamp`
+
+	upsertCountersQuery = `INSERT INTO metrics (type, name, delta, timestamp)
+SELECT 'counter', u.name, u.delta, $3::timestamp
+FROM unnest($1::text[], $2::bigint[]) AS u(name, delta)
+ON CONFLICT (name, type) DO UPDATE SET delta = metrics.delta + EXCLUDED.delta, timestamp = EXCLUDED.timestamp
+RETURNING name, delta`
+)
+
 type PostDB struct {
-	db   *sql.DB
-	dump *Dump
+	db *sql.DB
+
+	mu             sync.Mutex
+	upsertGauges   *sql.Stmt
+	upsertCounters *sql.Stmt
 }
 
 func NewDB(db *sql.DB) *PostDB {
 	return &PostDB{db: db}
 }
 
+func (db *PostDB) Ping(ctx context.Context) error {
+	if db.db == nil {
+		return ErrNoDB
+	}
+	return db.db.PingContext(ctx)
+}
+
+func (db *PostDB) Close() error {
+	if db.db == nil {
+		return nil
+	}
+
+	db.mu.Lock()
+	for _, stmt := range []*sql.Stmt{db.upsertGauges, db.upsertCounters} {
+		if stmt != nil {
+			_ = stmt.Close()
+		}
+	}
+	db.upsertGauges, db.upsertCounters = nil, nil
+	db.mu.Unlock()
+
+	return db.db.Close()
+}
+
 func (db *PostDB) UpdateGauge(ctx context.Context, name string, value float64) float64 {
-	_, err := db.db.ExecContext(ctx, "INSERT INTO metrics (type, name, value, timestamp) VALUES ($1, $2, $3, $4) ON CONFLICT (name, type) DO UPDATE SET value = $3", models.Gauge, name, value, time.Now())
+	_, err := db.db.ExecContext(ctx, "INSERT INTO metrics (type, name, value, timestamp) VALUES ($1, $2, $3, $4) ON CONFLICT (name, type) DO UPDATE SET value = EXCLUDED.value, timestamp = EXCLUDED.timestamp", models.Gauge, name, value, time.Now())
 
 	if err != nil {
 		log.Println("error insert metric: ", err)
@@ -28,24 +76,29 @@ func (db *PostDB) UpdateGauge(ctx context.Context, name string, value float64) f
 }
 
 func (db *PostDB) UpdateCounter(ctx context.Context, name string, value int64) int64 {
-	_, err := db.db.ExecContext(ctx, "INSERT INTO metrics (type, name, delta, timestamp) VALUES ($1, $2, $3, $4) ON CONFLICT (name, type) DO UPDATE SET delta = metrics.delta + EXCLUDED.delta, timestamp = EXCLUDED.timestamp", models.Counter, name, value, time.Now())
+	var total int64
+	row := db.db.QueryRowContext(ctx, "INSERT INTO metrics (type, name, delta, timestamp) VALUES ($1, $2, $3, $4) ON CONFLICT (name, type) DO UPDATE SET delta = metrics.delta + EXCLUDED.delta, timestamp = EXCLUDED.timestamp RETURNING delta", models.Counter, name, value, time.Now())
 
-	if err != nil {
+	if err := row.Scan(&total); err != nil {
 		log.Println("error insert metric: ", err)
+		return value
 	}
 
-	return value
+	return total
 }
 
-func (db *PostDB) UpdateMetrics(ctx context.Context, m []models.MetricsDTO) error {
-	tx, err := db.db.Begin()
-	if err != nil {
-		log.Println("error create transaction:", err)
-		return err
+func (db *PostDB) UpdateMetrics(ctx context.Context, m []models.MetricsDTO) ([]models.MetricsDTO, error) {
+	if db.db == nil {
+		return nil, ErrNoDB
+	}
+
+	if err := db.prepare(ctx); err != nil {
+		log.Println("error prepare statements:", err)
+		return nil, err
 	}
 
 	counterMap := make(map[string]int64)
-	var gauges []models.MetricsDTO
+	gaugeMap := make(map[string]float64)
 
 	for _, v := range m {
 		switch v.MType {
@@ -54,40 +107,126 @@ func (db *PostDB) UpdateMetrics(ctx context.Context, m []models.MetricsDTO) erro
 				counterMap[v.ID] += *v.Delta
 			}
 		case string(models.Gauge):
-			gauges = append(gauges, v)
+			if v.Value != nil {
+				gaugeMap[v.ID] = *v.Value
+			}
 		}
 	}
 
-	for k, v := range counterMap {
-		_, err = tx.ExecContext(ctx, "INSERT INTO metrics (type, name, delta, timestamp) VALUES ($1, $2, $3, $4) ON CONFLICT (name, type) DO UPDATE SET delta = $3", string(models.Counter), k, v, time.Now())
-		if err != nil {
-			err := tx.Rollback()
-			if err != nil {
-				return err
-			}
-			return err
+	// Rows are upserted in name order, so concurrent batches sharing names
+	// lock them in the same order and can't deadlock.
+	counterNames := slices.Sorted(maps.Keys(counterMap))
+	counterDeltas := make([]int64, len(counterNames))
+	for i, k := range counterNames {
+		counterDeltas[i] = counterMap[k]
+	}
+
+	w := newWritten(m)
+	gaugeNames := slices.Sorted(maps.Keys(gaugeMap))
+	gaugeValues := make([]float64, len(gaugeNames))
+	for i, k := range gaugeNames {
+		gaugeValues[i] = gaugeMap[k]
+		w.gauge(k, gaugeMap[k])
+	}
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println("error create transaction:", err)
+		return nil, err
+	}
+
+	now := time.Now()
+
+	if len(counterNames) > 0 {
+		if err = upsertCounters(ctx, tx.StmtContext(ctx, db.upsertCounters), w, counterNames, counterDeltas, now); err != nil {
+			return nil, rollback(tx, err)
 		}
 	}
 
-	for _, v := range gauges {
-		_, err = tx.ExecContext(ctx, "INSERT INTO metrics (type, name, value, timestamp) VALUES ($1, $2, $3, $4) ON CONFLICT (name, type) DO UPDATE SET value = $3", string(models.Gauge), v.ID, v.Value, time.Now())
-		if err != nil {
-			err := tx.Rollback()
-			if err != nil {
-				return err
-			}
+	if len(gaugeNames) > 0 {
+		if _, err = tx.StmtContext(ctx, db.upsertGauges).ExecContext(ctx, gaugeNames, gaugeValues, now); err != nil {
+			return nil, rollback(tx, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return w.metrics, nil
+}
+
+// upsertCounters adds the deltas and records the totals the rows return.
+func upsertCounters(ctx context.Context, stmt *sql.Stmt, w *written, names []string, deltas []int64, now time.Time) error {
+	rows, err := stmt.QueryContext(ctx, names, deltas, now)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			name  string
+			total int64
+		)
+		if err := rows.Scan(&name, &total); err != nil {
 			return err
 		}
+		w.counter(name, total)
+	}
+	return rows.Err()
+}
+
+// prepare lazily prepares the batch upsert statements. They are kept for the
+// lifetime of PostDB and reused by every UpdateMetrics call.
+func (db *PostDB) prepare(ctx context.Context) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.upsertGauges != nil && db.upsertCounters != nil {
+		return nil
+	}
+
+	gauges, err := db.db.PrepareContext(ctx, upsertGaugesQuery)
+	if err != nil {
+		return err
 	}
 
-	err = tx.Commit()
+	counters, err := db.db.PrepareContext(ctx, upsertCountersQuery)
 	if err != nil {
+		_ = gauges.Close()
 		return err
 	}
 
+	db.upsertGauges = gauges
+	db.upsertCounters = counters
+
 	return nil
 }
 
+func rollback(tx *sql.Tx, err error) error {
+	if rbErr := tx.Rollback(); rbErr != nil {
+		return errors.Join(err, rbErr)
+	}
+	return err
+}
+
+func (db *PostDB) DeleteMetric(ctx context.Context, mType, name string) (bool, error) {
+	if db.db == nil {
+		return false, ErrNoDB
+	}
+
+	res, err := db.db.ExecContext(ctx, "delete from metrics where name = $1 and type = $2", name, mType)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
 func (db *PostDB) GetGauge(ctx context.Context, name string) (float64, bool) {
 	var m models.MetricsDTO
 
@@ -116,13 +255,18 @@ func (db *PostDB) GetCounter(ctx context.Context, name string) (int64, bool) {
 	return *m.Delta, true
 }
 
-func (db *PostDB) ShowMetrics(ctx context.Context) (map[string]float64, map[string]int64, error) {
-	gauges := make(map[string]float64)
-	counters := make(map[string]int64)
+// Snapshot reads all metrics with a single statement, so the result is
+// consistent as of the statement start.
+func (db *PostDB) Snapshot(ctx context.Context) (models.Snapshot, error) {
+	snap := models.Snapshot{
+		Gauges:   make(map[string]float64),
+		Counters: make(map[string]int64),
+	}
 
 	rows, err := db.db.QueryContext(ctx, "select name, type, value, delta from metrics")
 	if err != nil {
 		log.Println("Error querying metrics", err)
+		return models.Snapshot{}, err
 	}
 
 	defer func(rows *sql.Rows) {
@@ -140,22 +284,23 @@ func (db *PostDB) ShowMetrics(ctx context.Context) (map[string]float64, map[stri
 			delta       sql.NullInt64
 		)
 
-		err := rows.Scan(&name, &metricType, &metricValue, &delta)
-		if err != nil {
-			log.Printf("DATA LAYER: storage.postgres.GetAllMetrics: rows.Scan error: %v", err)
-			continue
+		if err := rows.Scan(&name, &metricType, &metricValue, &delta); err != nil {
+			log.Printf("DATA LAYER: storage.postgres.Snapshot: rows.Scan error: %v", err)
+			return models.Snapshot{}, err
 		}
 
 		switch metricType {
 		case string(models.Gauge):
-			gauges[name] = metricValue.Float64
+			snap.Gauges[name] = metricValue.Float64
 		case string(models.Counter):
-			counters[name] = delta.Int64
-		}
-		if err = rows.Err(); err != nil {
-			log.Println("Error after scanning rows", err)
+			snap.Counters[name] = delta.Int64
 		}
 	}
 
-	return gauges, counters, nil
+	if err = rows.Err(); err != nil {
+		log.Println("Error after scanning rows", err)
+		return models.Snapshot{}, err
+	}
+
+	return snap, nil
 }
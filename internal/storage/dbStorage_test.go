@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/zubans/metrics/internal/models"
+)
+
+// testDSNEnv names the environment variable with a Postgres DSN used by the
+// DB-backed tests and benchmarks. They are skipped when it is empty.
+const testDSNEnv = "TEST_DATABASE_DSN"
+
+func openTestDB(tb testing.TB) *sql.DB {
+	tb.Helper()
+
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		tb.Skipf("%s is not set", testDSNEnv)
+	}
+
+	db, err := InitDB(dsn, "../../migrations")
+	if err != nil {
+		tb.Fatalf("init db: %v", err)
+	}
+	tb.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	if _, err := db.Exec("TRUNCATE metrics"); err != nil {
+		tb.Fatalf("truncate metrics: %v", err)
+	}
+
+	return db
+}
+
+// updateMetricsPerRow is the former UpdateMetrics implementation issuing one
+// statement per metric. It is kept only as a benchmark baseline.
+func updateMetricsPerRow(ctx context.Context, db *sql.DB, m []models.MetricsDTO) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	counterMap := make(map[string]int64)
+	var gauges []models.MetricsDTO
+
+	for _, v := range m {
+		switch v.MType {
+		case string(models.Counter):
+			if v.Delta != nil {
+				counterMap[v.ID] += *v.Delta
+			}
+		case string(models.Gauge):
+			gauges = append(gauges, v)
+		}
+	}
+
+	for k, v := range counterMap {
+		_, err = tx.ExecContext(ctx, "INSERT INTO metrics (type, name, delta, timestamp) VALUES ($1, $2, $3, $4) ON CONFLICT (name, type) DO UPDATE SET delta = $3", string(models.Counter), k, v, time.Now())
+		if err != nil {
+			return rollback(tx, err)
+		}
+	}
+
+	for _, v := range gauges {
+		_, err = tx.ExecContext(ctx, "INSERT INTO metrics (type, name, value, timestamp) VALUES ($1, $2, $3, $4) ON CONFLICT (name, type) DO UPDATE SET value = $3", string(models.Gauge), v.ID, v.Value, time.Now())
+		if err != nil {
+			return rollback(tx, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func benchBatch(size int) []models.MetricsDTO {
+	batch := make([]models.MetricsDTO, 0, size)
+	for i := 0; i < size; i++ {
+		if i%2 == 0 {
+			v := float64(i)
+			batch = append(batch, models.MetricsDTO{ID: fmt.Sprintf("gauge_%d", i), MType: string(models.Gauge), Value: &v})
+		} else {
+			d := int64(i)
+			batch = append(batch, models.MetricsDTO{ID: fmt.Sprintf("counter_%d", i), MType: string(models.Counter), Delta: &d})
+		}
+	}
+	return batch
+}
+
+func BenchmarkPostDB_UpdateMetrics(b *testing.B) {
+	db := openTestDB(b)
+	ctx := context.Background()
+
+	for _, size := range []int{10, 1000, 5000} {
+		batch := benchBatch(size)
+
+		b.Run(fmt.Sprintf("per_row/%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := updateMetricsPerRow(ctx, db, batch); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(size*b.N)/b.Elapsed().Seconds(), "metrics/s")
+		})
+
+		b.Run(fmt.Sprintf("batched/%d", size), func(b *testing.B) {
+			store := NewDB(db)
+			for i := 0; i < b.N; i++ {
+				if _, err := store.UpdateMetrics(ctx, batch); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(size*b.N)/b.Elapsed().Seconds(), "metrics/s")
+		})
+	}
+}
+
+func TestPostDB_UpdateMetrics_Batch(t *testing.T) {
+	db := openTestDB(t)
+	store := NewDB(db)
+	ctx := context.Background()
+
+	batch := benchBatch(1000)
+	last := 42.5
+	batch = append(batch, models.MetricsDTO{ID: "gauge_0", MType: string(models.Gauge), Value: &last})
+
+	stored, err := store.UpdateMetrics(ctx, batch)
+	if err != nil {
+		t.Fatalf("UpdateMetrics: %v", err)
+	}
+	if len(stored) != 1000 {
+		t.Fatalf("expected 1000 stored values, got %d", len(stored))
+	}
+	for _, m := range stored {
+		if m.Value == nil && m.Delta == nil {
+			t.Errorf("expected a stored value for %s %s", m.MType, m.ID)
+		}
+	}
+
+	snap, err := store.Snapshot(ctx)
+	if err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	gauges, counters := snap.Gauges, snap.Counters
+	if len(gauges) != 500 || len(counters) != 500 {
+		t.Fatalf("expected 500 gauges and 500 counters, got %d and %d", len(gauges), len(counters))
+	}
+	if gauges["gauge_0"] != last {
+		t.Errorf("expected the last gauge value in a batch to win, got %v", gauges["gauge_0"])
+	}
+}
+
+func TestPostDB_UpdateMetrics_NoDB(t *testing.T) {
+	store := NewDB(nil)
+	if _, err := store.UpdateMetrics(context.Background(), benchBatch(2)); err != ErrNoDB {
+		t.Errorf("expected ErrNoDB, got %v", err)
+	}
+	if err := store.Ping(context.Background()); err != ErrNoDB {
+		t.Errorf("expected ErrNoDB from Ping, got %v", err)
+	}
+}
+
+func TestSQLiteSource(t *testing.T) {
+	tests := []struct {
+		dsn  string
+		want string
+	}{
+		{
+			dsn:  "sqlite:///var/lib/metrics.db",
+			want: "/var/lib/metrics.db?_pragma=busy_timeout%285000%29&_pragma=journal_mode%28WAL%29",
+		},
+		{
+			dsn:  "sqlite:///var/lib/metrics.db?_pragma=foreign_keys(1)&x-migrations-table=migrations",
+			want: "/var/lib/metrics.db?_pragma=foreign_keys%281%29&_pragma=busy_timeout%285000%29&_pragma=journal_mode%28WAL%29",
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := sqliteSource(tt.dsn)
+		if err != nil {
+			t.Fatalf("sqliteSource(%q): %v", tt.dsn, err)
+		}
+		if got != tt.want {
+			t.Errorf("sqliteSource(%q) = %q, want %q", tt.dsn, got, tt.want)
+		}
+	}
+
+	if _, err := sqliteSource("sqlite:///metrics.db?%zz"); err == nil {
+		t.Error("expected an error for a malformed query")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/zubans/metrics/internal/config"
+	"github.com/zubans/metrics/internal/models"
 	"log"
 	"os"
 	"strings"
@@ -28,28 +29,31 @@ type PersistentStorage interface {
 }
 
 type GetterMetrics interface {
-	GetGauges(ctx context.Context) map[string]float64
-	GetCounters(ctx context.Context) map[string]int64
+	Snapshot(ctx context.Context) (models.Snapshot, error)
 }
 
-type Dump struct {
-	storage GetterMetrics
-	cfg     *config.Config
+type RestorerMetrics interface {
+	RestoreMetrics(ctx context.Context, gauges map[string]float64, counters map[string]int64)
 }
 
-type MetricsDump struct {
-	Gauges   map[string]float64 `json:"gauges"`
-	Counters map[string]int64   `json:"counters"`
+type DumpStorage interface {
+	GetterMetrics
+	RestorerMetrics
 }
 
-func New(storage GetterMetrics, cfg config.Config) *Dump {
+type Dump struct {
+	storage DumpStorage
+	cfg     *config.Config
+}
+
+func New(storage DumpStorage, cfg config.Config) *Dump {
 	return &Dump{storage: storage, cfg: &cfg}
 }
 
 func (d *Dump) SaveMetricToFile(ctx context.Context) error {
-	dump := MetricsDump{
-		Gauges:   d.storage.GetGauges(ctx),
-		Counters: d.storage.GetCounters(ctx),
+	dump, err := d.storage.Snapshot(ctx)
+	if err != nil {
+		return err
 	}
 
 	data, err := json.Marshal(dump)
@@ -88,13 +92,17 @@ func (d *Dump) LoadMetricsFromFile() error {
 			log.Printf("error open file: %v", err)
 			return err
 		}
+		break
 	}
 
-	err = json.Unmarshal(res, d.storage)
+	var dump models.Snapshot
+	err = json.Unmarshal(res, &dump)
 	if err != nil {
 		return err
 	}
 
+	d.storage.RestoreMetrics(context.Background(), dump.Gauges, dump.Counters)
+
 	return nil
 }
 
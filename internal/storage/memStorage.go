@@ -3,94 +3,307 @@ package storage
 import (
 	"context"
 	"github.com/zubans/metrics/internal/models"
+	"math"
 	"sync"
+	"sync/atomic"
 )
 
+// shardCount is the number of hash partitions in MemStorage. It must be a
+// power of two not greater than 64, so shard sets fit in a uint64 mask.
+const shardCount = 64
+
+// memShard holds one partition of the metrics. Values are atomics, so writers
+// of existing keys only need the read lock and hot counters do not serialize.
+// The write lock is taken to add keys and to take snapshots.
+type memShard struct {
+	mu       sync.RWMutex
+	gauges   map[string]*atomic.Uint64
+	counters map[string]*atomic.Int64
+}
+
 type MemStorage struct {
-	Gauges   map[string]float64
-	Counters map[string]int64
-	mutex    sync.Mutex
+	shards [shardCount]memShard
 }
 
 func NewMemStorage() *MemStorage {
-	return &MemStorage{
-		Gauges:   make(map[string]float64),
-		Counters: make(map[string]int64),
+	m := &MemStorage{}
+	for i := range m.shards {
+		m.shards[i].gauges = make(map[string]*atomic.Uint64)
+		m.shards[i].counters = make(map[string]*atomic.Int64)
 	}
+	return m
+}
+
+// shardIndex picks the partition for name using FNV-1a.
+func shardIndex(name string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(name); i++ {
+		h ^= uint32(name[i])
+		h *= 16777619
+	}
+	return int(h & (shardCount - 1))
+}
+
+func (m *MemStorage) shard(name string) *memShard {
+	return &m.shards[shardIndex(name)]
 }
 
 func (m *MemStorage) UpdateGauge(ctx context.Context, name string, value float64) float64 {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-	m.Gauges[name] = value
+	bits := math.Float64bits(value)
+	sh := m.shard(name)
+
+	sh.mu.RLock()
+	if v, exists := sh.gauges[name]; exists {
+		v.Store(bits)
+		sh.mu.RUnlock()
+		return value
+	}
+	sh.mu.RUnlock()
 
-	return m.Gauges[name]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.gaugeCell(name).Store(bits)
+
+	return value
 }
 
 func (m *MemStorage) UpdateCounter(ctx context.Context, name string, value int64) int64 {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-	m.Counters[name] += value
+	sh := m.shard(name)
 
-	return m.Counters[name]
+	sh.mu.RLock()
+	if v, exists := sh.counters[name]; exists {
+		res := v.Add(value)
+		sh.mu.RUnlock()
+		return res
+	}
+	sh.mu.RUnlock()
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	return sh.counterCell(name).Add(value)
 }
 
 func (m *MemStorage) GetGauge(ctx context.Context, name string) (float64, bool) {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-	value, exists := m.Gauges[name]
-	return value, exists
+	sh := m.shard(name)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	v, exists := sh.gauges[name]
+	if !exists {
+		return 0, false
+	}
+	return math.Float64frombits(v.Load()), true
 }
 
 func (m *MemStorage) GetCounter(ctx context.Context, name string) (int64, bool) {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-	value, exists := m.Counters[name]
-	return value, exists
+	sh := m.shard(name)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	v, exists := sh.counters[name]
+	if !exists {
+		return 0, false
+	}
+	return v.Load(), true
+}
+
+// Snapshot write-locks every shard in order, so no update is in flight while
+// the values are copied and a batch is either fully visible or not at all.
+func (m *MemStorage) Snapshot(ctx context.Context) (models.Snapshot, error) {
+	for i := range m.shards {
+		m.shards[i].mu.Lock()
+	}
+	defer func() {
+		for i := range m.shards {
+			m.shards[i].mu.Unlock()
+		}
+	}()
+
+	snap := models.Snapshot{
+		Gauges:   make(map[string]float64),
+		Counters: make(map[string]int64),
+	}
+	for i := range m.shards {
+		sh := &m.shards[i]
+		for k, v := range sh.gauges {
+			snap.Gauges[k] = math.Float64frombits(v.Load())
+		}
+		for k, v := range sh.counters {
+			snap.Counters[k] = v.Load()
+		}
+	}
+
+	return snap, nil
+}
+
+// UpdateMetrics applies the batch atomically with respect to Snapshot: missing
+// keys are created first, then the batch is written holding the read locks of
+// all shards it touches. A key deleted between the two steps is created again.
+func (m *MemStorage) UpdateMetrics(ctx context.Context, mDTO []models.MetricsDTO) ([]models.MetricsDTO, error) {
+	var touched uint64
+	for {
+		touched = 0
+		for _, v := range mDTO {
+			switch {
+			case v.MType == string(models.Counter) && v.Delta != nil:
+				touched |= m.ensureCounter(v.ID)
+			case v.MType == string(models.Gauge) && v.Value != nil:
+				touched |= m.ensureGauge(v.ID)
+			}
+		}
+
+		m.lockShards(touched, true)
+		if m.hasCells(mDTO) {
+			break
+		}
+		m.lockShards(touched, false)
+	}
+	defer m.lockShards(touched, false)
+
+	w := newWritten(mDTO)
+	for _, v := range mDTO {
+		switch {
+		case v.MType == string(models.Counter) && v.Delta != nil:
+			w.counter(v.ID, m.shard(v.ID).counters[v.ID].Add(*v.Delta))
+		case v.MType == string(models.Gauge) && v.Value != nil:
+			m.shard(v.ID).gauges[v.ID].Store(math.Float64bits(*v.Value))
+			w.gauge(v.ID, *v.Value)
+		}
+	}
+	return w.metrics, nil
 }
 
-func (m *MemStorage) GetGauges(ctx context.Context) map[string]float64 {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-	result := make(map[string]float64)
-	for k, v := range m.Gauges {
-		result[k] = v
+// RestoreMetrics overwrites stored values with the given ones, used when
+// loading a dump.
+func (m *MemStorage) RestoreMetrics(ctx context.Context, gauges map[string]float64, counters map[string]int64) {
+	for k, v := range gauges {
+		sh := m.shard(k)
+		sh.mu.Lock()
+		sh.gaugeCell(k).Store(math.Float64bits(v))
+		sh.mu.Unlock()
+	}
+	for k, v := range counters {
+		sh := m.shard(k)
+		sh.mu.Lock()
+		sh.counterCell(k).Store(v)
+		sh.mu.Unlock()
 	}
-	return result
 }
 
-func (m *MemStorage) GetCounters(ctx context.Context) map[string]int64 {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-	result := make(map[string]int64)
-	for k, v := range m.Counters {
-		result[k] = v
+// DeleteMetric removes the metric and reports whether it was stored.
+func (m *MemStorage) DeleteMetric(ctx context.Context, mType, name string) (bool, error) {
+	sh := m.shard(name)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	switch mType {
+	case string(models.Gauge):
+		if _, exists := sh.gauges[name]; exists {
+			delete(sh.gauges, name)
+			return true, nil
+		}
+	case string(models.Counter):
+		if _, exists := sh.counters[name]; exists {
+			delete(sh.counters, name)
+			return true, nil
+		}
 	}
-	return result
+	return false, nil
 }
 
-func (m *MemStorage) ShowMetrics(ctx context.Context) (map[string]float64, map[string]int64, error) {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
+func (m *MemStorage) Ping(ctx context.Context) error {
+	return nil
+}
+
+// ensureGauge creates the gauge key if needed and returns the mask bit of
+// its shard.
+func (m *MemStorage) ensureGauge(name string) uint64 {
+	idx := shardIndex(name)
+	sh := &m.shards[idx]
+
+	sh.mu.RLock()
+	_, exists := sh.gauges[name]
+	sh.mu.RUnlock()
+
+	if !exists {
+		sh.mu.Lock()
+		sh.gaugeCell(name)
+		sh.mu.Unlock()
+	}
 
-	return m.Gauges, m.Counters, nil
+	return 1 << idx
 }
 
-func (m *MemStorage) UpdateMetrics(ctx context.Context, mDTO []models.MetricsDTO) error {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
+// ensureCounter creates the counter key if needed and returns the mask bit of
+// its shard.
+func (m *MemStorage) ensureCounter(name string) uint64 {
+	idx := shardIndex(name)
+	sh := &m.shards[idx]
 
+	sh.mu.RLock()
+	_, exists := sh.counters[name]
+	sh.mu.RUnlock()
+
+	if !exists {
+		sh.mu.Lock()
+		sh.counterCell(name)
+		sh.mu.Unlock()
+	}
+
+	return 1 << idx
+}
+
+// hasCells reports whether every metric of the batch has a cell. The caller
+// must hold the read locks of the shards involved.
+func (m *MemStorage) hasCells(mDTO []models.MetricsDTO) bool {
 	for _, v := range mDTO {
-		switch v.MType {
-		case string(models.Counter):
-			if v.Delta != nil {
-				m.Counters[v.ID] += *v.Delta
+		switch {
+		case v.MType == string(models.Counter) && v.Delta != nil:
+			if _, exists := m.shard(v.ID).counters[v.ID]; !exists {
+				return false
 			}
-		case string(models.Gauge):
-			if v.Value != nil {
-				m.Gauges[v.ID] += *v.Value
+		case v.MType == string(models.Gauge) && v.Value != nil:
+			if _, exists := m.shard(v.ID).gauges[v.ID]; !exists {
+				return false
 			}
 		}
 	}
-	return nil
+	return true
+}
+
+// lockShards read-locks (or unlocks) the shards in mask in index order.
+func (m *MemStorage) lockShards(mask uint64, lock bool) {
+	for i := range m.shards {
+		if mask&(1<<i) == 0 {
+			continue
+		}
+		if lock {
+			m.shards[i].mu.RLock()
+		} else {
+			m.shards[i].mu.RUnlock()
+		}
+	}
+}
+
+// gaugeCell returns the cell for name, creating it if needed. The caller must
+// hold the shard write lock.
+func (sh *memShard) gaugeCell(name string) *atomic.Uint64 {
+	v, exists := sh.gauges[name]
+	if !exists {
+		v = new(atomic.Uint64)
+		sh.gauges[name] = v
+	}
+	return v
+}
+
+// counterCell returns the cell for name, creating it if needed. The caller
+// must hold the shard write lock.
+func (sh *memShard) counterCell(name string) *atomic.Int64 {
+	v, exists := sh.counters[name]
+	if !exists {
+		v = new(atomic.Int64)
+		sh.counters[name] = v
+	}
+	return v
 }
@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"context"
+	"github.com/zubans/metrics/internal/models"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// mutexStorage mirrors the former single-mutex MemStorage and serves as the
+// baseline for the parallel benchmarks.
+type mutexStorage struct {
+	mu       sync.Mutex
+	gauges   map[string]float64
+	counters map[string]int64
+}
+
+func newMutexStorage() *mutexStorage {
+	return &mutexStorage{gauges: make(map[string]float64), counters: make(map[string]int64)}
+}
+
+func (m *mutexStorage) UpdateGauge(_ context.Context, name string, value float64) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gauges[name] = value
+	return value
+}
+
+func (m *mutexStorage) UpdateCounter(_ context.Context, name string, value int64) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[name] += value
+	return m.counters[name]
+}
+
+func (m *mutexStorage) GetGauge(_ context.Context, name string) (float64, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.gauges[name]
+	return v, ok
+}
+
+type benchStorage interface {
+	UpdateGauge(ctx context.Context, name string, value float64) float64
+	UpdateCounter(ctx context.Context, name string, value int64) int64
+	GetGauge(ctx context.Context, name string) (float64, bool)
+}
+
+var benchNames = func() []string {
+	names := make([]string, 1024)
+	for i := range names {
+		names[i] = "metric_" + strconv.Itoa(i)
+	}
+	return names
+}()
+
+// Run with -cpu=1,2,4,8 to see how each implementation scales.
+func BenchmarkMemStorage_Parallel(b *testing.B) {
+	impls := []struct {
+		name string
+		new  func() benchStorage
+	}{
+		{"mutex", func() benchStorage { return newMutexStorage() }},
+		{"sharded", func() benchStorage { return NewMemStorage() }},
+	}
+
+	for _, impl := range impls {
+		b.Run(impl.name+"/hot_counter", func(b *testing.B) {
+			s := impl.new()
+			ctx := context.Background()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					s.UpdateCounter(ctx, "PollCount", 1)
+				}
+			})
+		})
+
+		b.Run(impl.name+"/spread_gauges", func(b *testing.B) {
+			s := impl.new()
+			ctx := context.Background()
+			var seed atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(seed.Add(1)) * 97
+				for pb.Next() {
+					s.UpdateGauge(ctx, benchNames[i%len(benchNames)], float64(i))
+					i++
+				}
+			})
+		})
+
+		b.Run(impl.name+"/read_mostly", func(b *testing.B) {
+			s := impl.new()
+			ctx := context.Background()
+			for i, name := range benchNames {
+				s.UpdateGauge(ctx, name, float64(i))
+			}
+			var seed atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(seed.Add(1)) * 97
+				for pb.Next() {
+					name := benchNames[i%len(benchNames)]
+					if i%10 == 0 {
+						s.UpdateGauge(ctx, name, float64(i))
+					} else {
+						s.GetGauge(ctx, name)
+					}
+					i++
+				}
+			})
+		})
+	}
+}
+
+func TestMemStorage_RestoreMetrics(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemStorage()
+	m.UpdateCounter(ctx, "c", 100)
+
+	m.RestoreMetrics(ctx, map[string]float64{"g": 1.5}, map[string]int64{"c": 3})
+
+	if v, ok := m.GetGauge(ctx, "g"); !ok || v != 1.5 {
+		t.Errorf("expected restored gauge 1.5, got %v (found %v)", v, ok)
+	}
+	if v, ok := m.GetCounter(ctx, "c"); !ok || v != 3 {
+		t.Errorf("expected restored counter to be replaced with 3, got %v (found %v)", v, ok)
+	}
+}
+
+func TestMemStorage_UpdateMetricsDuringDelete(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemStorage()
+	delta := int64(1)
+	batch := []models.MetricsDTO{{ID: "c", MType: string(models.Counter), Delta: &delta}}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			if _, err := m.UpdateMetrics(ctx, batch); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			_, _ = m.DeleteMetric(ctx, string(models.Counter), "c")
+		}
+	}()
+	wg.Wait()
+
+	if v, ok := m.GetCounter(ctx, "c"); ok && (v < 1 || v > 1000) {
+		t.Errorf("unexpected counter value %d", v)
+	}
+}
@@ -0,0 +1,203 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"github.com/zubans/metrics/internal/models"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// RedisScheme is the DSN prefix selecting the Redis backend,
+// e.g. redis://localhost:6379/0. rediss:// enables TLS.
+const (
+	RedisScheme    = "redis://"
+	RedisTLSScheme = "rediss://"
+)
+
+// Hash keys holding gauges and counters, field name is the metric name.
+const (
+	redisGaugesKey   = "metrics:gauges"
+	redisCountersKey = "metrics:counters"
+)
+
+// IsRedisDSN reports whether dsn selects the Redis backend.
+func IsRedisDSN(dsn string) bool {
+	return strings.HasPrefix(dsn, RedisScheme) || strings.HasPrefix(dsn, RedisTLSScheme)
+}
+
+// InitRedis creates a client for dsn. The connection is established lazily,
+// so an unreachable server is reported by Ping rather than here.
+func InitRedis(dsn string) (*redis.Client, error) {
+	opts, err := redis.ParseURL(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("parse redis dsn: %w", err)
+	}
+	return redis.NewClient(opts), nil
+}
+
+// RedisStorage keeps metrics in two Redis hashes so that several server
+// replicas can share state. Batches and snapshots run in MULTI/EXEC
+// transactions.
+type RedisStorage struct {
+	client redis.UniversalClient
+}
+
+func NewRedis(client redis.UniversalClient) *RedisStorage {
+	return &RedisStorage{client: client}
+}
+
+func (s *RedisStorage) Ping(ctx context.Context) error {
+	if s.client == nil {
+		return ErrNoDB
+	}
+	return s.client.Ping(ctx).Err()
+}
+
+func (s *RedisStorage) Close() error {
+	if s.client == nil {
+		return nil
+	}
+	return s.client.Close()
+}
+
+func (s *RedisStorage) UpdateGauge(ctx context.Context, name string, value float64) float64 {
+	if err := s.client.HSet(ctx, redisGaugesKey, name, formatGauge(value)).Err(); err != nil {
+		log.Println("error set gauge: ", err)
+	}
+
+	return value
+}
+
+func (s *RedisStorage) UpdateCounter(ctx context.Context, name string, value int64) int64 {
+	total, err := s.client.HIncrBy(ctx, redisCountersKey, name, value).Result()
+	if err != nil {
+		log.Println("error increment counter: ", err)
+		return value
+	}
+
+	return total
+}
+
+// UpdateMetrics writes the batch in a MULTI/EXEC transaction. Redis does not
+// roll a transaction back when one of its commands fails, so such a failure
+// is reported as a *BatchError listing the entries whose command failed.
+func (s *RedisStorage) UpdateMetrics(ctx context.Context, m []models.MetricsDTO) ([]models.MetricsDTO, error) {
+	w := newWritten(m)
+	totals := make(map[string]*redis.IntCmd)
+	var (
+		entries []models.MetricsDTO
+		cmds    []redis.Cmder
+	)
+
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, v := range m {
+			switch {
+			case v.MType == string(models.Counter) && v.Delta != nil:
+				cmd := pipe.HIncrBy(ctx, redisCountersKey, v.ID, *v.Delta)
+				totals[v.ID] = cmd
+				entries, cmds = append(entries, v), append(cmds, cmd)
+			case v.MType == string(models.Gauge) && v.Value != nil:
+				cmd := pipe.HSet(ctx, redisGaugesKey, v.ID, formatGauge(*v.Value))
+				w.gauge(v.ID, *v.Value)
+				entries, cmds = append(entries, v), append(cmds, cmd)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		var failed []models.MetricsDTO
+		for i, cmd := range cmds {
+			if cmd.Err() != nil {
+				failed = append(failed, entries[i])
+			}
+		}
+		if len(failed) > 0 && len(failed) < len(entries) {
+			return nil, &BatchError{NotApplied: failed, Err: err}
+		}
+		return nil, err
+	}
+
+	for name, cmd := range totals {
+		w.counter(name, cmd.Val())
+	}
+	return w.metrics, nil
+}
+
+func (s *RedisStorage) DeleteMetric(ctx context.Context, mType, name string) (bool, error) {
+	key := redisCountersKey
+	if mType == string(models.Gauge) {
+		key = redisGaugesKey
+	}
+
+	n, err := s.client.HDel(ctx, key, name).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (s *RedisStorage) GetGauge(ctx context.Context, name string) (float64, bool) {
+	value, err := s.client.HGet(ctx, redisGaugesKey, name).Float64()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			log.Println("error get gauge metric: ", err)
+		}
+		return 0, false
+	}
+
+	return value, true
+}
+
+func (s *RedisStorage) GetCounter(ctx context.Context, name string) (int64, bool) {
+	value, err := s.client.HGet(ctx, redisCountersKey, name).Int64()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			log.Println("error get counter metric: ", err)
+		}
+		return 0, false
+	}
+
+	return value, true
+}
+
+func (s *RedisStorage) Snapshot(ctx context.Context) (models.Snapshot, error) {
+	var gaugesCmd, countersCmd *redis.MapStringStringCmd
+
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		gaugesCmd = pipe.HGetAll(ctx, redisGaugesKey)
+		countersCmd = pipe.HGetAll(ctx, redisCountersKey)
+		return nil
+	})
+	if err != nil {
+		return models.Snapshot{}, err
+	}
+
+	snap := models.Snapshot{
+		Gauges:   make(map[string]float64, len(gaugesCmd.Val())),
+		Counters: make(map[string]int64, len(countersCmd.Val())),
+	}
+	for k, v := range gaugesCmd.Val() {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return models.Snapshot{}, fmt.Errorf("gauge %q: %w", k, err)
+		}
+		snap.Gauges[k] = f
+	}
+	for k, v := range countersCmd.Val() {
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return models.Snapshot{}, fmt.Errorf("counter %q: %w", k, err)
+		}
+		snap.Counters[k] = i
+	}
+
+	return snap, nil
+}
+
+func formatGauge(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
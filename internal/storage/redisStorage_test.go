@@ -0,0 +1,41 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zubans/metrics/internal/models"
+)
+
+func TestRedisStorage_PartialBatch(t *testing.T) {
+	ctx := context.Background()
+	srv := miniredis.RunT(t)
+	srv.HSet(redisCountersKey, "broken", "not a number")
+
+	client, err := InitRedis("redis://" + srv.Addr())
+	require.NoError(t, err)
+	s := NewRedis(client)
+	defer func() { _ = s.Close() }()
+
+	_, err = s.UpdateMetrics(ctx, []models.MetricsDTO{
+		{ID: "c", MType: string(models.Counter), Delta: int64Ptr(2)},
+		{ID: "broken", MType: string(models.Counter), Delta: int64Ptr(1)},
+		{ID: "g", MType: string(models.Gauge), Value: float64Ptr(1.5)},
+	})
+
+	var partial *BatchError
+	require.ErrorAs(t, err, &partial)
+	require.Len(t, partial.NotApplied, 1)
+	assert.Equal(t, "broken", partial.NotApplied[0].ID)
+
+	c, ok := s.GetCounter(ctx, "c")
+	require.True(t, ok, "Redis keeps the commands of a transaction that succeeded")
+	assert.Equal(t, int64(2), c)
+}
+
+func float64Ptr(v float64) *float64 {
+	return &v
+}
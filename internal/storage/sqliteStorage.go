@@ -0,0 +1,322 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/golang-migrate/migrate/v4"
+	_ "github.com/golang-migrate/migrate/v4/database/sqlite"
+	"github.com/zubans/metrics/internal/models"
+	"log"
+	_ "modernc.org/sqlite"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SQLiteScheme is the DSN prefix selecting the SQLite backend,
+// e.g. sqlite:///var/lib/metrics.db.
+const SQLiteScheme = "sqlite://"
+
+const (
+	sqliteUpsertGaugeQuery = `INSERT INTO metrics (type, name, value, timestamp) VALUES ('gauge', ?, ?, ?)
+ON CONFLICT (name, type) DO UPDATE SET value = excluded.value, timestamp = excluded.timestamp`
+
+	sqliteUpsertCounterQuery = `INSERT INTO metrics (type, name, delta, timestamp) VALUES ('counter', ?, ?, ?)
+ON CONFLICT (name, type) DO UPDATE SET delta = metrics.delta + excluded.delta, timestamp = excluded.timestamp
+RETURNING delta`
+)
+
+// IsSQLiteDSN reports whether dsn selects the SQLite backend.
+func IsSQLiteDSN(dsn string) bool {
+	return strings.HasPrefix(dsn, SQLiteScheme)
+}
+
+// InitSQLite applies the SQLite migrations from migrationsPath and opens the
+// database file referenced by dsn.
+func InitSQLite(dsn string, migrationsPath string) (*sql.DB, error) {
+	if !IsSQLiteDSN(dsn) {
+		return nil, fmt.Errorf("not a sqlite dsn: %q", dsn)
+	}
+
+	m, err := migrate.New(fmt.Sprintf("file://%s", migrationsPath), dsn)
+	if err != nil {
+		return nil, fmt.Errorf("migrate.New: %w", err)
+	}
+	if err := m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return nil, fmt.Errorf("migrate.Up: %w", err)
+	}
+	if srcErr, dbErr := m.Close(); srcErr != nil || dbErr != nil {
+		return nil, fmt.Errorf("migrate.Close: %w", errors.Join(srcErr, dbErr))
+	}
+
+	source, err := sqliteSource(dsn)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite", source)
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite: %w", err)
+	}
+
+	// SQLite allows a single writer, so one connection avoids "database is
+	// locked" errors under concurrent updates.
+	db.SetMaxOpenConns(1)
+
+	return db, nil
+}
+
+// sqliteSource turns dsn into a data source for the sqlite driver. Query
+// parameters of dsn are kept, except the x- ones meant for migrate, and the
+// busy timeout and WAL pragmas are added.
+func sqliteSource(dsn string) (string, error) {
+	path, query, _ := strings.Cut(strings.TrimPrefix(dsn, SQLiteScheme), "?")
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return "", fmt.Errorf("parse sqlite dsn: %w", err)
+	}
+
+	for k := range params {
+		if strings.HasPrefix(k, "x-") {
+			params.Del(k)
+		}
+	}
+	params.Add("_pragma", "busy_timeout(5000)")
+	params.Add("_pragma", "journal_mode(WAL)")
+
+	return path + "?" + params.Encode(), nil
+}
+
+type SQLiteDB struct {
+	db *sql.DB
+
+	mu            sync.Mutex
+	upsertGauge   *sql.Stmt
+	upsertCounter *sql.Stmt
+}
+
+func NewSQLite(db *sql.DB) *SQLiteDB {
+	return &SQLiteDB{db: db}
+}
+
+func (s *SQLiteDB) Ping(ctx context.Context) error {
+	if s.db == nil {
+		return ErrNoDB
+	}
+	return s.db.PingContext(ctx)
+}
+
+func (s *SQLiteDB) Close() error {
+	if s.db == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	for _, stmt := range []*sql.Stmt{s.upsertGauge, s.upsertCounter} {
+		if stmt != nil {
+			_ = stmt.Close()
+		}
+	}
+	s.upsertGauge, s.upsertCounter = nil, nil
+	s.mu.Unlock()
+
+	return s.db.Close()
+}
+
+func (s *SQLiteDB) UpdateGauge(ctx context.Context, name string, value float64) float64 {
+	if err := s.prepare(ctx); err != nil {
+		log.Println("error prepare statements: ", err)
+		return value
+	}
+
+	if _, err := s.upsertGauge.ExecContext(ctx, name, value, time.Now()); err != nil {
+		log.Println("error insert metric: ", err)
+	}
+
+	return value
+}
+
+func (s *SQLiteDB) UpdateCounter(ctx context.Context, name string, value int64) int64 {
+	if err := s.prepare(ctx); err != nil {
+		log.Println("error prepare statements: ", err)
+		return value
+	}
+
+	var total int64
+	if err := s.upsertCounter.QueryRowContext(ctx, name, value, time.Now()).Scan(&total); err != nil {
+		log.Println("error insert metric: ", err)
+		return value
+	}
+
+	return total
+}
+
+func (s *SQLiteDB) UpdateMetrics(ctx context.Context, m []models.MetricsDTO) ([]models.MetricsDTO, error) {
+	if s.db == nil {
+		return nil, ErrNoDB
+	}
+
+	if err := s.prepare(ctx); err != nil {
+		log.Println("error prepare statements:", err)
+		return nil, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println("error create transaction:", err)
+		return nil, err
+	}
+
+	gauges := tx.StmtContext(ctx, s.upsertGauge)
+	counters := tx.StmtContext(ctx, s.upsertCounter)
+	now := time.Now()
+	w := newWritten(m)
+
+	for _, v := range m {
+		switch v.MType {
+		case string(models.Counter):
+			if v.Delta == nil {
+				continue
+			}
+			var total int64
+			if err := counters.QueryRowContext(ctx, v.ID, *v.Delta, now).Scan(&total); err != nil {
+				return nil, rollback(tx, err)
+			}
+			w.counter(v.ID, total)
+		case string(models.Gauge):
+			if v.Value == nil {
+				continue
+			}
+			if _, err := gauges.ExecContext(ctx, v.ID, *v.Value, now); err != nil {
+				return nil, rollback(tx, err)
+			}
+			w.gauge(v.ID, *v.Value)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return w.metrics, nil
+}
+
+func (s *SQLiteDB) DeleteMetric(ctx context.Context, mType, name string) (bool, error) {
+	if s.db == nil {
+		return false, ErrNoDB
+	}
+
+	res, err := s.db.ExecContext(ctx, "delete from metrics where name = ? and type = ?", name, mType)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (s *SQLiteDB) GetGauge(ctx context.Context, name string) (float64, bool) {
+	var value float64
+
+	row := s.db.QueryRowContext(ctx, "select value from metrics where name = ? and type = ? limit 1", name, models.Gauge)
+	if err := row.Scan(&value); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Println("error get gauge metric: ", err)
+		}
+		return 0, false
+	}
+
+	return value, true
+}
+
+func (s *SQLiteDB) GetCounter(ctx context.Context, name string) (int64, bool) {
+	var delta int64
+
+	row := s.db.QueryRowContext(ctx, "select delta from metrics where name = ? and type = ? limit 1", name, models.Counter)
+	if err := row.Scan(&delta); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Println("error get counter metric: ", err)
+		}
+		return 0, false
+	}
+
+	return delta, true
+}
+
+// Snapshot reads all metrics with a single statement, so the result is
+// consistent as of the statement start.
+func (s *SQLiteDB) Snapshot(ctx context.Context) (models.Snapshot, error) {
+	snap := models.Snapshot{
+		Gauges:   make(map[string]float64),
+		Counters: make(map[string]int64),
+	}
+
+	rows, err := s.db.QueryContext(ctx, "select name, type, value, delta from metrics")
+	if err != nil {
+		return models.Snapshot{}, err
+	}
+	defer func(rows *sql.Rows) {
+		if err := rows.Close(); err != nil {
+			log.Println("Error rows close:", err)
+		}
+	}(rows)
+
+	for rows.Next() {
+		var (
+			name        string
+			metricType  string
+			metricValue sql.NullFloat64
+			delta       sql.NullInt64
+		)
+
+		if err := rows.Scan(&name, &metricType, &metricValue, &delta); err != nil {
+			return models.Snapshot{}, err
+		}
+
+		switch metricType {
+		case string(models.Gauge):
+			snap.Gauges[name] = metricValue.Float64
+		case string(models.Counter):
+			snap.Counters[name] = delta.Int64
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return models.Snapshot{}, err
+	}
+
+	return snap, nil
+}
+
+func (s *SQLiteDB) prepare(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.upsertGauge != nil && s.upsertCounter != nil {
+		return nil
+	}
+
+	if s.db == nil {
+		return ErrNoDB
+	}
+
+	gauge, err := s.db.PrepareContext(ctx, sqliteUpsertGaugeQuery)
+	if err != nil {
+		return err
+	}
+
+	counter, err := s.db.PrepareContext(ctx, sqliteUpsertCounterQuery)
+	if err != nil {
+		_ = gauge.Close()
+		return err
+	}
+
+	s.upsertGauge = gauge
+	s.upsertCounter = counter
+
+	return nil
+}
@@ -0,0 +1,444 @@
+// Package storagetest provides a conformance suite shared by all
+// services.MetricStorage implementations.
+//
+// A backend plugs in by passing a Factory to Run from its own tests:
+//
+//	func TestConformance_MemStorage(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) (services.MetricStorage, func() services.MetricStorage) {
+//			return storage.NewMemStorage(), nil
+//		})
+//	}
+package storagetest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zubans/metrics/internal/models"
+	"github.com/zubans/metrics/internal/services"
+)
+
+// DSNEnv names the environment variable holding a Postgres DSN for DB-backed
+// conformance runs.
+const DSNEnv = "TEST_DATABASE_DSN"
+
+// Factory creates a fresh, empty storage for a single test. Durable backends
+// also return reopen, which opens a new storage over the same state as after
+// a server restart. For in-memory backends reopen is nil and persistence
+// checks are skipped.
+type Factory func(t *testing.T) (s services.MetricStorage, reopen func() services.MetricStorage)
+
+// DSN returns the configured test database DSN or skips the test.
+func DSN(t testing.TB) string {
+	t.Helper()
+
+	dsn := os.Getenv(DSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", DSNEnv)
+	}
+	return dsn
+}
+
+// Run executes the whole suite against storages produced by newStorage.
+func Run(t *testing.T, newStorage Factory) {
+	t.Run("Semantics", func(t *testing.T) { testSemantics(t, newStorage) })
+	t.Run("MissingMetrics", func(t *testing.T) { testMissingMetrics(t, newStorage) })
+	t.Run("Delete", func(t *testing.T) { testDelete(t, newStorage) })
+	t.Run("Concurrency", func(t *testing.T) { testConcurrency(t, newStorage) })
+	t.Run("Snapshot", func(t *testing.T) { testSnapshot(t, newStorage) })
+	t.Run("Persistence", func(t *testing.T) { testPersistence(t, newStorage) })
+	t.Run("LargeDataset", func(t *testing.T) { testLargeDataset(t, newStorage) })
+}
+
+func testSemantics(t *testing.T, newStorage Factory) {
+	ctx := context.Background()
+
+	t.Run("gauge update replaces value", func(t *testing.T) {
+		s, _ := newStorage(t)
+
+		assert.InDelta(t, 1.5, s.UpdateGauge(ctx, "g", 1.5), 0)
+		assert.InDelta(t, 0.25, s.UpdateGauge(ctx, "g", 0.25), 0)
+
+		v, ok := s.GetGauge(ctx, "g")
+		require.True(t, ok)
+		assert.InDelta(t, 0.25, v, 0)
+	})
+
+	t.Run("counter update adds delta", func(t *testing.T) {
+		s, _ := newStorage(t)
+
+		assert.Equal(t, int64(3), s.UpdateCounter(ctx, "c", 3))
+		assert.Equal(t, int64(7), s.UpdateCounter(ctx, "c", 4))
+
+		v, ok := s.GetCounter(ctx, "c")
+		require.True(t, ok)
+		assert.Equal(t, int64(7), v)
+	})
+
+	t.Run("batch gauge last value wins", func(t *testing.T) {
+		s, _ := newStorage(t)
+		s.UpdateGauge(ctx, "g", 100)
+
+		stored := update(t, s,
+			Gauge("g", 1),
+			Gauge("g", 2),
+		)
+		assert.Equal(t, []models.MetricsDTO{Gauge("g", 2)}, stored, "a batch must return each stored value once")
+
+		v, ok := s.GetGauge(ctx, "g")
+		require.True(t, ok)
+		assert.InDelta(t, 2, v, 0)
+	})
+
+	t.Run("batch counter deltas are added to stored value", func(t *testing.T) {
+		s, _ := newStorage(t)
+		s.UpdateCounter(ctx, "c", 10)
+
+		stored := update(t, s,
+			Counter("c", 1),
+			Gauge("g", 1),
+			Counter("c", 2),
+		)
+		assert.Equal(t, []models.MetricsDTO{Counter("c", 13), Gauge("g", 1)}, stored, "a batch must return counter totals")
+		update(t, s,
+			Counter("c", 5),
+		)
+
+		v, ok := s.GetCounter(ctx, "c")
+		require.True(t, ok)
+		assert.Equal(t, int64(18), v)
+	})
+
+	t.Run("batch ignores entries without value", func(t *testing.T) {
+		s, _ := newStorage(t)
+
+		stored := update(t, s,
+			models.MetricsDTO{ID: "g", MType: string(models.Gauge)},
+			models.MetricsDTO{ID: "c", MType: string(models.Counter)},
+		)
+		assert.Empty(t, stored)
+
+		_, ok := s.GetGauge(ctx, "g")
+		assert.False(t, ok)
+		_, ok = s.GetCounter(ctx, "c")
+		assert.False(t, ok)
+	})
+
+	t.Run("empty batch is a no-op", func(t *testing.T) {
+		s, _ := newStorage(t)
+
+		update(t, s)
+
+		snap, err := s.Snapshot(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, snap.Gauges)
+		assert.Empty(t, snap.Counters)
+	})
+
+	t.Run("snapshot reflects updates", func(t *testing.T) {
+		s, _ := newStorage(t)
+
+		update(t, s,
+			Gauge("g", 3.5),
+			Counter("c", 4),
+		)
+
+		snap, err := s.Snapshot(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]float64{"g": 3.5}, snap.Gauges)
+		assert.Equal(t, map[string]int64{"c": 4}, snap.Counters)
+	})
+}
+
+// update applies a batch, failing the test on error, and returns the stored
+// values.
+func update(t *testing.T, s services.MetricStorage, m ...models.MetricsDTO) []models.MetricsDTO {
+	t.Helper()
+
+	stored, err := s.UpdateMetrics(context.Background(), m)
+	require.NoError(t, err)
+	return stored
+}
+
+func testMissingMetrics(t *testing.T, newStorage Factory) {
+	ctx := context.Background()
+	s, _ := newStorage(t)
+
+	_, ok := s.GetGauge(ctx, "unknown")
+	assert.False(t, ok, "unknown gauge must not be found")
+	_, ok = s.GetCounter(ctx, "unknown")
+	assert.False(t, ok, "unknown counter must not be found")
+
+	s.UpdateGauge(ctx, "only_gauge", 1)
+	s.UpdateCounter(ctx, "only_counter", 1)
+
+	_, ok = s.GetCounter(ctx, "only_gauge")
+	assert.False(t, ok, "a gauge must not be visible as a counter")
+	_, ok = s.GetGauge(ctx, "only_counter")
+	assert.False(t, ok, "a counter must not be visible as a gauge")
+
+	s.UpdateGauge(ctx, "both", 1.5)
+	s.UpdateCounter(ctx, "both", 2)
+
+	g, ok := s.GetGauge(ctx, "both")
+	require.True(t, ok)
+	assert.InDelta(t, 1.5, g, 0)
+	c, ok := s.GetCounter(ctx, "both")
+	require.True(t, ok)
+	assert.Equal(t, int64(2), c)
+}
+
+func testDelete(t *testing.T, newStorage Factory) {
+	ctx := context.Background()
+	s, reopen := newStorage(t)
+
+	s.UpdateGauge(ctx, "both", 1.5)
+	s.UpdateCounter(ctx, "both", 2)
+
+	deleted, err := s.DeleteMetric(ctx, string(models.Gauge), "both")
+	require.NoError(t, err)
+	assert.True(t, deleted)
+
+	_, ok := s.GetGauge(ctx, "both")
+	assert.False(t, ok, "a deleted gauge must not be found")
+	c, ok := s.GetCounter(ctx, "both")
+	require.True(t, ok, "deleting a gauge must keep the counter with the same name")
+	assert.Equal(t, int64(2), c)
+
+	deleted, err = s.DeleteMetric(ctx, string(models.Gauge), "both")
+	require.NoError(t, err)
+	assert.False(t, deleted, "deleting a missing metric must report false")
+
+	deleted, err = s.DeleteMetric(ctx, string(models.Counter), "both")
+	require.NoError(t, err)
+	assert.True(t, deleted)
+	assert.Equal(t, int64(5), s.UpdateCounter(ctx, "both", 5), "a deleted counter must start from scratch")
+
+	update(t, s, Counter("both", 1))
+	c, ok = s.GetCounter(ctx, "both")
+	require.True(t, ok)
+	assert.Equal(t, int64(6), c)
+
+	snap, err := s.Snapshot(ctx)
+	require.NoError(t, err)
+	assert.NotContains(t, snap.Gauges, "both")
+
+	if reopen != nil {
+		_, ok = reopen().GetGauge(ctx, "both")
+		assert.False(t, ok, "a deletion must be durable")
+	}
+}
+
+func testConcurrency(t *testing.T, newStorage Factory) {
+	const (
+		workers    = 8
+		iterations = 50
+	)
+
+	ctx := context.Background()
+	s, _ := newStorage(t)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				s.UpdateCounter(ctx, "hits", 1)
+				s.UpdateGauge(ctx, fmt.Sprintf("worker_%d", w), float64(i))
+				if _, err := s.UpdateMetrics(ctx, []models.MetricsDTO{
+					Counter("batch_hits", 2),
+					Gauge("shared", float64(w)),
+				}); err != nil {
+					t.Errorf("UpdateMetrics: %v", err)
+					return
+				}
+				s.GetCounter(ctx, "hits")
+				s.GetGauge(ctx, "shared")
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	hits, ok := s.GetCounter(ctx, "hits")
+	require.True(t, ok)
+	assert.Equal(t, int64(workers*iterations), hits, "concurrent counter updates must not be lost")
+
+	batchHits, ok := s.GetCounter(ctx, "batch_hits")
+	require.True(t, ok)
+	assert.Equal(t, int64(2*workers*iterations), batchHits, "concurrent batch deltas must not be lost")
+
+	for w := 0; w < workers; w++ {
+		v, ok := s.GetGauge(ctx, fmt.Sprintf("worker_%d", w))
+		require.True(t, ok)
+		assert.InDelta(t, iterations-1, v, 0)
+	}
+
+	shared, ok := s.GetGauge(ctx, "shared")
+	require.True(t, ok)
+	assert.True(t, shared >= 0 && shared < workers, "shared gauge must hold one of the written values, got %v", shared)
+}
+
+func testSnapshot(t *testing.T, newStorage Factory) {
+	ctx := context.Background()
+
+	t.Run("snapshot is a copy", func(t *testing.T) {
+		s, _ := newStorage(t)
+		s.UpdateGauge(ctx, "g", 1)
+		s.UpdateCounter(ctx, "c", 1)
+
+		snap, err := s.Snapshot(ctx)
+		require.NoError(t, err)
+		snap.Gauges["g"] = 100
+		snap.Counters["c"] = 100
+		snap.Gauges["injected"] = 1
+
+		s.UpdateCounter(ctx, "c", 1)
+		assert.Equal(t, int64(100), snap.Counters["c"], "snapshot must not follow later updates")
+
+		fresh, err := s.Snapshot(ctx)
+		require.NoError(t, err)
+		assert.InDelta(t, 1, fresh.Gauges["g"], 0)
+		assert.Equal(t, int64(2), fresh.Counters["c"])
+		assert.NotContains(t, fresh.Gauges, "injected")
+	})
+
+	t.Run("snapshot is consistent under concurrent writes", func(t *testing.T) {
+		const (
+			writers = 4
+			readers = 2
+			rounds  = 100
+		)
+
+		s, _ := newStorage(t)
+
+		var wg sync.WaitGroup
+		for w := 0; w < writers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < rounds; i++ {
+					// Both counters move together in one batch, so every
+					// snapshot must show them equal.
+					if _, err := s.UpdateMetrics(ctx, []models.MetricsDTO{
+						Counter("pair_a", 1),
+						Gauge(fmt.Sprintf("writer_%d", w), float64(i)),
+						Counter("pair_b", 1),
+					}); err != nil {
+						t.Errorf("UpdateMetrics: %v", err)
+						return
+					}
+					s.UpdateGauge(ctx, "single", float64(i))
+				}
+			}(w)
+		}
+
+		for r := 0; r < readers; r++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < rounds; i++ {
+					snap, err := s.Snapshot(ctx)
+					if err != nil {
+						t.Errorf("Snapshot: %v", err)
+						return
+					}
+					if snap.Counters["pair_a"] != snap.Counters["pair_b"] {
+						t.Errorf("torn batch in snapshot: pair_a=%d pair_b=%d", snap.Counters["pair_a"], snap.Counters["pair_b"])
+						return
+					}
+					for k := range snap.Gauges {
+						snap.Gauges[k]++
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		snap, err := s.Snapshot(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, int64(writers*rounds), snap.Counters["pair_a"])
+		assert.Equal(t, int64(writers*rounds), snap.Counters["pair_b"])
+	})
+}
+
+func testPersistence(t *testing.T, newStorage Factory) {
+	ctx := context.Background()
+	s, reopen := newStorage(t)
+	if reopen == nil {
+		t.Skip("storage is not durable")
+	}
+
+	s.UpdateGauge(ctx, "g", 1.25)
+	s.UpdateCounter(ctx, "c", 3)
+	update(t, s,
+		Gauge("batch_gauge", 7),
+		Counter("c", 4),
+	)
+
+	restarted := reopen()
+
+	g, ok := restarted.GetGauge(ctx, "g")
+	require.True(t, ok)
+	assert.InDelta(t, 1.25, g, 0)
+
+	bg, ok := restarted.GetGauge(ctx, "batch_gauge")
+	require.True(t, ok)
+	assert.InDelta(t, 7, bg, 0)
+
+	c, ok := restarted.GetCounter(ctx, "c")
+	require.True(t, ok)
+	assert.Equal(t, int64(7), c)
+
+	assert.Equal(t, int64(8), restarted.UpdateCounter(ctx, "c", 1), "counters must keep accumulating after restart")
+}
+
+func testLargeDataset(t *testing.T, newStorage Factory) {
+	size := 10000
+	if testing.Short() {
+		size = 1000
+	}
+
+	ctx := context.Background()
+	s, _ := newStorage(t)
+
+	batch := make([]models.MetricsDTO, 0, size)
+	for i := 0; i < size; i++ {
+		if i%2 == 0 {
+			batch = append(batch, Gauge(fmt.Sprintf("gauge_%d", i), float64(i)))
+		} else {
+			batch = append(batch, Counter(fmt.Sprintf("counter_%d", i), int64(i)))
+		}
+	}
+
+	update(t, s, batch...)
+	update(t, s, batch...)
+
+	snap, err := s.Snapshot(ctx)
+	require.NoError(t, err)
+	assert.Len(t, snap.Gauges, size/2)
+	assert.Len(t, snap.Counters, size/2)
+
+	g, ok := s.GetGauge(ctx, "gauge_10")
+	require.True(t, ok)
+	assert.InDelta(t, 10, g, 0)
+
+	c, ok := s.GetCounter(ctx, "counter_11")
+	require.True(t, ok)
+	assert.Equal(t, int64(22), c)
+}
+
+// Gauge builds a gauge DTO.
+func Gauge(name string, v float64) models.MetricsDTO {
+	return models.MetricsDTO{ID: name, MType: string(models.Gauge), Value: &v}
+}
+
+// Counter builds a counter DTO.
+func Counter(name string, d int64) models.MetricsDTO {
+	return models.MetricsDTO{ID: name, MType: string(models.Counter), Delta: &d}
+}
@@ -18,3 +18,8 @@ func PrintBuildInfo() {
 	fmt.Printf("Build date: %s\n", buildDate)
 	fmt.Printf("Build commit: %s\n", buildCommit)
 }
+
+// Version returns the build version reported to the server.
+func Version() string {
+	return buildVersion
+}
@@ -0,0 +1,386 @@
+// Package webhook delivers metric change events to external HTTP endpoints.
+//
+// Each configured endpoint has its own queue and worker. Events are batched,
+// POSTed as JSON and, when a secret is set, signed with HMAC-SHA256 over the
+// request body. Failed deliveries are retried with exponential backoff; a
+// batch that cannot be delivered is written to the dead-letter log.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/zubans/metrics/internal/config"
+	"github.com/zubans/metrics/internal/models"
+)
+
+// Request headers set on every delivery.
+const (
+	SignatureHeader = "X-Webhook-Signature"
+	DeliveryHeader  = "X-Webhook-Delivery"
+)
+
+// Payload is the JSON body POSTed to an endpoint.
+type Payload struct {
+	Delivery string              `json:"delivery"`
+	SentAt   time.Time           `json:"sent_at"`
+	Events   []models.MetricsDTO `json:"events"`
+}
+
+// DeadLetter is a JSON line written to the dead-letter log for every batch
+// that could not be delivered.
+type DeadLetter struct {
+	Time     time.Time           `json:"time"`
+	URL      string              `json:"url"`
+	Attempts int                 `json:"attempts"`
+	Error    string              `json:"error"`
+	Events   []models.MetricsDTO `json:"events"`
+}
+
+// Sign returns the signature header value for body: "sha256=" followed by
+// the hex HMAC-SHA256 of body keyed with secret.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Dispatcher fans metric changes out to the configured endpoints.
+type Dispatcher struct {
+	client      *http.Client
+	attempts    int
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+	batchWait   time.Duration
+	batchSize   int
+	queueSize   int
+
+	dlMu       sync.Mutex
+	deadLetter io.Writer
+
+	targets []*target
+	stop    chan struct{}
+	wg      sync.WaitGroup
+	once    sync.Once
+
+	// ctx scopes every request; Close cancels it when its own context
+	// ends before the workers are done.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Option configures a Dispatcher.
+type Option func(*Dispatcher)
+
+// WithClient sets the HTTP client used for deliveries.
+func WithClient(c *http.Client) Option {
+	return func(d *Dispatcher) {
+		d.client = c
+	}
+}
+
+// WithRetry sets the number of delivery attempts per batch and the backoff
+// between them, which doubles after every failure up to maxBackoff.
+func WithRetry(attempts int, baseBackoff, maxBackoff time.Duration) Option {
+	return func(d *Dispatcher) {
+		d.attempts = attempts
+		d.baseBackoff = baseBackoff
+		d.maxBackoff = maxBackoff
+	}
+}
+
+// WithBatch sets how long a worker waits for more events before sending and
+// the maximum number of events per request.
+func WithBatch(wait time.Duration, size int) Option {
+	return func(d *Dispatcher) {
+		d.batchWait = wait
+		d.batchSize = size
+	}
+}
+
+// WithDeadLetter sets where undeliverable batches are logged.
+func WithDeadLetter(w io.Writer) Option {
+	return func(d *Dispatcher) {
+		d.deadLetter = w
+	}
+}
+
+// New validates the endpoints and starts one worker per endpoint.
+func New(endpoints []config.WebhookConfig, opts ...Option) (*Dispatcher, error) {
+	d := &Dispatcher{
+		client:      &http.Client{Timeout: 5 * time.Second},
+		attempts:    5,
+		baseBackoff: 500 * time.Millisecond,
+		maxBackoff:  30 * time.Second,
+		batchWait:   time.Second,
+		batchSize:   500,
+		queueSize:   10000,
+		deadLetter:  io.Discard,
+		stop:        make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	if d.attempts < 1 {
+		d.attempts = 1
+	}
+	if d.batchSize < 1 {
+		d.batchSize = 1
+	}
+
+	for _, ep := range endpoints {
+		u, err := url.Parse(ep.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("webhook: invalid url %q", ep.URL)
+		}
+		if ep.Pattern == "" {
+			ep.Pattern = "*"
+		}
+		if _, err := path.Match(ep.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("webhook: invalid pattern %q for %s", ep.Pattern, ep.URL)
+		}
+		d.targets = append(d.targets, &target{cfg: ep, notify: make(chan struct{}, 1)})
+	}
+
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	for _, t := range d.targets {
+		d.wg.Add(1)
+		go d.run(t)
+	}
+
+	return d, nil
+}
+
+// Enqueue queues events for every endpoint whose pattern matches. It never
+// blocks; when an endpoint's queue is full the oldest events are moved to the
+// dead-letter log.
+func (d *Dispatcher) Enqueue(events ...models.MetricsDTO) {
+	for _, t := range d.targets {
+		var overflow []models.MetricsDTO
+
+		t.mu.Lock()
+		added := false
+		for _, e := range events {
+			if ok, _ := path.Match(t.cfg.Pattern, e.ID); !ok {
+				continue
+			}
+			t.pending = append(t.pending, e)
+			added = true
+		}
+		if n := len(t.pending) - d.queueSize; n > 0 {
+			overflow = append(overflow, t.pending[:n]...)
+			t.pending = append(t.pending[:0:0], t.pending[n:]...)
+		}
+		t.mu.Unlock()
+
+		if len(overflow) > 0 {
+			d.dead(t, 0, errors.New("queue overflow"), overflow)
+		}
+		if added {
+			select {
+			case t.notify <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// Close stops the workers after they made one delivery attempt for every
+// queued event, or ctx ends. In that case requests in flight are cancelled
+// and the events still queued are dead-lettered before Close returns.
+func (d *Dispatcher) Close(ctx context.Context) error {
+	d.once.Do(func() { close(d.stop) })
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		d.cancel()
+		return nil
+	case <-ctx.Done():
+		d.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+type target struct {
+	cfg    config.WebhookConfig
+	notify chan struct{}
+
+	mu      sync.Mutex
+	pending []models.MetricsDTO
+}
+
+func (t *target) take(limit int) []models.MetricsDTO {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := len(t.pending)
+	if n > limit {
+		n = limit
+	}
+	batch := append([]models.MetricsDTO(nil), t.pending[:n]...)
+	t.pending = append(t.pending[:0:0], t.pending[n:]...)
+
+	return batch
+}
+
+func (d *Dispatcher) run(t *target) {
+	defer d.wg.Done()
+
+	for {
+		select {
+		case <-d.stop:
+			d.drain(t)
+			return
+		case <-t.notify:
+		}
+
+		if !d.sleep(d.batchWait) {
+			d.drain(t)
+			return
+		}
+
+		for {
+			batch := t.take(d.batchSize)
+			if len(batch) == 0 {
+				break
+			}
+			d.deliver(t, batch, true)
+		}
+	}
+}
+
+// drain sends what is left on shutdown, making a single attempt per batch.
+// Once Close gave up waiting, the rest is dead-lettered without sending.
+func (d *Dispatcher) drain(t *target) {
+	for {
+		batch := t.take(d.batchSize)
+		if len(batch) == 0 {
+			return
+		}
+		if err := d.ctx.Err(); err != nil {
+			d.dead(t, 0, err, batch)
+			continue
+		}
+		d.deliver(t, batch, false)
+	}
+}
+
+func (d *Dispatcher) deliver(t *target, batch []models.MetricsDTO, retry bool) {
+	delivery := uuid.NewString()
+	body, err := json.Marshal(Payload{
+		Delivery: delivery,
+		SentAt:   time.Now().UTC(),
+		Events:   batch,
+	})
+	if err != nil {
+		d.dead(t, 0, err, batch)
+		return
+	}
+
+	backoff := d.baseBackoff
+	attempts := 0
+	for {
+		attempts++
+		retryable, err := d.post(t, delivery, body)
+		if err == nil {
+			return
+		}
+
+		if !retry || !retryable || attempts >= d.attempts || !d.sleep(backoff) {
+			d.dead(t, attempts, err, batch)
+			return
+		}
+
+		backoff *= 2
+		if backoff > d.maxBackoff {
+			backoff = d.maxBackoff
+		}
+	}
+}
+
+// post sends one request. It reports whether a failure is worth retrying:
+// network errors, 429 and 5xx are; other statuses are not.
+func (d *Dispatcher) post(t *target, delivery string, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodPost, t.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(DeliveryHeader, delivery)
+	if t.cfg.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(t.cfg.Secret, body))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
+		return d.ctx.Err() == nil, err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	default:
+		return false, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+}
+
+// sleep waits for dur and reports false if the dispatcher is stopping.
+func (d *Dispatcher) sleep(dur time.Duration) bool {
+	if dur <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(dur)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-d.stop:
+		return false
+	}
+}
+
+func (d *Dispatcher) dead(t *target, attempts int, err error, batch []models.MetricsDTO) {
+	line, mErr := json.Marshal(DeadLetter{
+		Time:     time.Now().UTC(),
+		URL:      t.cfg.URL,
+		Attempts: attempts,
+		Error:    err.Error(),
+		Events:   batch,
+	})
+	if mErr != nil {
+		return
+	}
+
+	d.dlMu.Lock()
+	defer d.dlMu.Unlock()
+	_, _ = d.deadLetter.Write(append(line, '\n'))
+}
@@ -0,0 +1,210 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zubans/metrics/internal/config"
+	"github.com/zubans/metrics/internal/models"
+)
+
+type delivery struct {
+	header  http.Header
+	body    []byte
+	payload Payload
+}
+
+// receiver records deliveries and answers with the given statuses in order,
+// repeating the last one.
+type receiver struct {
+	mu         sync.Mutex
+	statuses   []int
+	deliveries []delivery
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	var p Payload
+	_ = json.Unmarshal(body, &p)
+
+	rc.mu.Lock()
+	status := http.StatusOK
+	if n := len(rc.deliveries); len(rc.statuses) > 0 {
+		status = rc.statuses[min(n, len(rc.statuses)-1)]
+	}
+	rc.deliveries = append(rc.deliveries, delivery{header: r.Header.Clone(), body: body, payload: p})
+	rc.mu.Unlock()
+
+	w.WriteHeader(status)
+}
+
+func (rc *receiver) received() []delivery {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return append([]delivery(nil), rc.deliveries...)
+}
+
+func gauge(name string, v float64) models.MetricsDTO {
+	return models.MetricsDTO{ID: name, MType: string(models.Gauge), Value: &v}
+}
+
+func closeDispatcher(t *testing.T, d *Dispatcher) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, d.Close(ctx))
+}
+
+func TestDispatcher_BatchesAndSigns(t *testing.T) {
+	rc := &receiver{}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	d, err := New([]config.WebhookConfig{{URL: srv.URL, Pattern: "Heap*", Secret: "s3cret"}},
+		WithBatch(20*time.Millisecond, 100))
+	require.NoError(t, err)
+
+	d.Enqueue(gauge("HeapAlloc", 1), gauge("Alloc", 2))
+	d.Enqueue(gauge("HeapInuse", 3))
+
+	require.Eventually(t, func() bool { return len(rc.received()) == 1 }, 2*time.Second, 5*time.Millisecond)
+	closeDispatcher(t, d)
+
+	got := rc.received()
+	require.Len(t, got, 1, "events enqueued within the batch window must be sent together")
+	assert.Equal(t, "application/json", got[0].header.Get("Content-Type"))
+	assert.Equal(t, Sign("s3cret", got[0].body), got[0].header.Get(SignatureHeader))
+	assert.Equal(t, got[0].payload.Delivery, got[0].header.Get(DeliveryHeader))
+
+	require.Len(t, got[0].payload.Events, 2)
+	assert.Equal(t, "HeapAlloc", got[0].payload.Events[0].ID)
+	assert.Equal(t, "HeapInuse", got[0].payload.Events[1].ID)
+}
+
+func TestDispatcher_RetriesWithBackoff(t *testing.T) {
+	rc := &receiver{statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK}}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	var dl bytes.Buffer
+	d, err := New([]config.WebhookConfig{{URL: srv.URL}},
+		WithBatch(0, 100), WithRetry(5, time.Millisecond, 4*time.Millisecond), WithDeadLetter(&dl))
+	require.NoError(t, err)
+
+	d.Enqueue(gauge("Alloc", 1))
+	require.Eventually(t, func() bool { return len(rc.received()) == 3 }, 2*time.Second, 5*time.Millisecond)
+	closeDispatcher(t, d)
+
+	got := rc.received()
+	require.Len(t, got, 3)
+	assert.Equal(t, got[0].payload.Delivery, got[2].payload.Delivery, "retries must reuse the delivery ID")
+	assert.Empty(t, dl.String())
+	assert.Nil(t, got[0].header.Values(SignatureHeader), "unsigned without a secret")
+}
+
+func TestDispatcher_DeadLetter(t *testing.T) {
+	failing := &receiver{statuses: []int{http.StatusInternalServerError}}
+	failingSrv := httptest.NewServer(failing)
+	defer failingSrv.Close()
+
+	rejecting := &receiver{statuses: []int{http.StatusBadRequest}}
+	rejectingSrv := httptest.NewServer(rejecting)
+	defer rejectingSrv.Close()
+
+	var dl bytes.Buffer
+	d, err := New([]config.WebhookConfig{{URL: failingSrv.URL}, {URL: rejectingSrv.URL}},
+		WithBatch(0, 100), WithRetry(3, time.Millisecond, time.Millisecond), WithDeadLetter(&dl))
+	require.NoError(t, err)
+
+	d.Enqueue(gauge("Alloc", 1))
+	require.Eventually(t, func() bool {
+		return len(failing.received()) == 3 && len(rejecting.received()) == 1
+	}, 2*time.Second, 5*time.Millisecond)
+	closeDispatcher(t, d)
+
+	assert.Len(t, rejecting.received(), 1, "client errors must not be retried")
+
+	attempts := map[string]int{}
+	for _, line := range strings.Split(strings.TrimSpace(dl.String()), "\n") {
+		var entry DeadLetter
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		require.Len(t, entry.Events, 1)
+		attempts[entry.URL] = entry.Attempts
+	}
+	assert.Equal(t, map[string]int{failingSrv.URL: 3, rejectingSrv.URL: 1}, attempts)
+}
+
+func TestDispatcher_CloseDeliversPending(t *testing.T) {
+	rc := &receiver{}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	d, err := New([]config.WebhookConfig{{URL: srv.URL}}, WithBatch(time.Hour, 100))
+	require.NoError(t, err)
+
+	d.Enqueue(gauge("Alloc", 1))
+	closeDispatcher(t, d)
+
+	got := rc.received()
+	require.Len(t, got, 1)
+	assert.Len(t, got[0].payload.Events, 1)
+}
+
+func TestDispatcher_CloseCancelsInFlight(t *testing.T) {
+	started := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	var dl bytes.Buffer
+	d, err := New([]config.WebhookConfig{{URL: srv.URL}},
+		WithBatch(0, 1), WithClient(&http.Client{}), WithDeadLetter(&dl))
+	require.NoError(t, err)
+
+	d.Enqueue(gauge("Alloc", 1), gauge("HeapSys", 2), gauge("HeapIdle", 3))
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	begin := time.Now()
+	require.ErrorIs(t, d.Close(ctx), context.DeadlineExceeded)
+	assert.Less(t, time.Since(begin), 2*time.Second, "Close must not wait for the endpoint")
+
+	var names []string
+	for _, line := range strings.Split(strings.TrimSpace(dl.String()), "\n") {
+		var entry DeadLetter
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		for _, e := range entry.Events {
+			names = append(names, e.ID)
+		}
+	}
+	assert.ElementsMatch(t, []string{"Alloc", "HeapSys", "HeapIdle"}, names,
+		"the cancelled and the queued events must be dead-lettered")
+}
+
+func TestNew_InvalidEndpoint(t *testing.T) {
+	for _, ep := range []config.WebhookConfig{
+		{URL: "ftp://hooks.local"},
+		{URL: "not a url"},
+		{URL: "http://hooks.local", Pattern: "["},
+	} {
+		_, err := New([]config.WebhookConfig{ep})
+		assert.Error(t, err, "%+v", ep)
+	}
+}
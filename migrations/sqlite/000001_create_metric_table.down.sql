@@ -0,0 +1 @@
+DROP TABLE IF EXISTS metrics;
\ No newline at end of file
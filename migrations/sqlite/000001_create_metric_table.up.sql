@@ -0,0 +1,10 @@
+CREATE TABLE metrics
+(
+    id        INTEGER PRIMARY KEY AUTOINCREMENT,
+    name      TEXT     NOT NULL,
+    type      TEXT     NOT NULL CHECK (type IN ('gauge', 'counter')),
+    value     REAL,
+    delta     INTEGER,
+    timestamp DATETIME NOT NULL,
+    CONSTRAINT metrics_name_type_unique UNIQUE (name, type)
+);